@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// alarmActions maps the actions of POST /api/v1/alarms/{target} to the values of the
+// action field of the card's alarm form and to the event description.
+var alarmActions = map[string][2]string{
+	"mute":        {"muteAudibleAlarm", "Audible alarm mute"},
+	"acknowledge": {"acknowledgeAlarms", "Alarm acknowledgement"},
+}
+
+// alarmRequest is the body of POST /api/v1/alarms/{target}.
+type alarmRequest struct {
+	Action string `json:"action"`
+}
+
+func parseAlarmRequest(r *http.Request, rec *controlRecord) error {
+	var req alarmRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+	action, ok := alarmActions[req.Action]
+	if !ok {
+		return fmt.Errorf("action must be mute or acknowledge")
+	}
+	rec.Action, rec.description = "alarm_"+req.Action, action[1]
+	return nil
+}
+
+// controlAlarm submits the alarm form of the card, which silences the beeper of the UPS
+// or acknowledges the active alarms.
+func (ctl *controller) controlAlarm(c *upsCollector, rec *controlRecord) error {
+	action := alarmActions[strings.TrimPrefix(rec.Action, "alarm_")][0]
+	return ctl.submit(c, rec, ctl.cfg.AlarmPath, url.Values{"action": {action}})
+}
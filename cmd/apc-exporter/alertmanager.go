@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// AlertmanagerConfig holds the settings for pushing alerts straight to Alertmanager.
+type AlertmanagerConfig struct {
+	URLs                []string          `yaml:"urls"`
+	Interval            time.Duration     `yaml:"interval"`
+	Timeout             time.Duration     `yaml:"timeout"`
+	Username            string            `yaml:"username"`
+	Password            string            `yaml:"password"`
+	BearerToken         string            `yaml:"bearer_token"`
+	Labels              map[string]string `yaml:"labels"`
+	GeneratorURL        string            `yaml:"generator_url"`
+	LowRuntimeMinutes   float64           `yaml:"low_runtime_minutes"`
+	OnBatteryInputVolts float64           `yaml:"on_battery_input_voltage"`
+}
+
+// upsAlert is an alert the exporter raises on its own, evaluated against the state of
+// one target.
+type upsAlert struct {
+	name     string
+	severity string
+	summary  string
+	firing   func(cfg AlertmanagerConfig, state map[string]float64) bool
+}
+
+var upsAlerts = []upsAlert{
+	{"UPSOnBattery", "warning", "UPS is running on battery", func(cfg AlertmanagerConfig, state map[string]float64) bool {
+		if trap, ok := state["ups_on_battery"]; ok {
+			return trap == 1
+		}
+		volts, ok := state["ups_input_voltage_vac"]
+		return ok && volts < cfg.OnBatteryInputVolts
+	}},
+	{"UPSLowRuntime", "critical", "UPS battery runtime is low", func(cfg AlertmanagerConfig, state map[string]float64) bool {
+		runtime, ok := state["ups_runtime_remaining_minutes"]
+		return ok && runtime < cfg.LowRuntimeMinutes
+	}},
+	{"UPSReplaceBattery", "warning", "UPS battery needs replacing", func(cfg AlertmanagerConfig, state map[string]float64) bool {
+		return state["ups_battery_replacement_needed"] == 1
+	}},
+}
+
+// alertmanagerAlert is an alert in the Alertmanager v2 API.
+type alertmanagerAlert struct {
+	Labels       map[string]string `json:"labels"`
+	Annotations  map[string]string `json:"annotations"`
+	StartsAt     time.Time         `json:"startsAt"`
+	EndsAt       time.Time         `json:"endsAt"`
+	GeneratorURL string            `json:"generatorURL,omitempty"`
+}
+
+// runAlertmanager evaluates the alerts on every interval and pushes them to every
+// Alertmanager until the context is cancelled. It returns immediately if no URLs are
+// configured.
+//
+// Firing alerts are re-sent on every interval with an endsAt a few intervals ahead,
+// so Alertmanager resolves them on its own if the exporter goes away. Alerts that stop
+// firing are sent once more with endsAt set to now.
+func runAlertmanager(ctx context.Context, cfg AlertmanagerConfig, gatherer prometheus.Gatherer) {
+	if len(cfg.URLs) == 0 {
+		return
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = 30 * time.Second
+	}
+	gatherer = gatherWithin(gatherer, cfg.Interval)
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	if cfg.LowRuntimeMinutes <= 0 {
+		cfg.LowRuntimeMinutes = 10
+	}
+	if cfg.OnBatteryInputVolts <= 0 {
+		cfg.OnBatteryInputVolts = 1
+	}
+	client := &http.Client{Timeout: cfg.Timeout}
+	started := make(map[string]time.Time) // by target and alert name
+
+	slog.Info("Pushing alerts to Alertmanager", "urls", len(cfg.URLs), "interval", cfg.Interval)
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			samples, err := gatherSamples(gatherer, "ups_")
+			if err != nil {
+				slog.Error("Error gathering metrics for Alertmanager", "err", err)
+				continue
+			}
+			targets, states := samplesByTarget(samples)
+			alerts := evaluateAlerts(cfg, targets, states, started, now)
+			if len(alerts) == 0 {
+				continue
+			}
+			body, err := json.Marshal(alerts)
+			if err != nil {
+				continue
+			}
+			for _, u := range cfg.URLs {
+				if err := postAlerts(ctx, client, cfg, u, body); err != nil {
+					slog.Warn("Error pushing alerts to Alertmanager", "url", u, "err", err)
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// evaluateAlerts returns the firing alerts and those that just resolved, keeping the
+// start time of every firing alert in started.
+func evaluateAlerts(cfg AlertmanagerConfig, targets []string, states map[string]map[string]float64, started map[string]time.Time, now time.Time) []alertmanagerAlert {
+	var alerts []alertmanagerAlert
+	for _, target := range targets {
+		for _, a := range upsAlerts {
+			key := target + "\x00" + a.name
+			startsAt, wasFiring := started[key]
+			firing := a.firing(cfg, states[target])
+			if !firing && !wasFiring {
+				continue
+			}
+
+			endsAt := now.Add(3 * cfg.Interval)
+			if firing && !wasFiring {
+				startsAt = now
+				started[key] = now
+			} else if !firing {
+				endsAt = now
+				delete(started, key)
+			}
+
+			labels := map[string]string{"alertname": a.name, "severity": a.severity, "target": target}
+			for k, v := range cfg.Labels {
+				labels[k] = v
+			}
+			alerts = append(alerts, alertmanagerAlert{
+				Labels:       labels,
+				Annotations:  map[string]string{"summary": fmt.Sprintf("%s (%s)", a.summary, target)},
+				StartsAt:     startsAt.UTC(),
+				EndsAt:       endsAt.UTC(),
+				GeneratorURL: cfg.GeneratorURL,
+			})
+		}
+	}
+	return alerts
+}
+
+// postAlerts sends the alerts to one Alertmanager's v2 API.
+func postAlerts(ctx context.Context, client *http.Client, cfg AlertmanagerConfig, baseURL string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(baseURL, "/")+"/api/v2/alerts", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "apc-exporter")
+	if cfg.Username != "" {
+		req.SetBasicAuth(cfg.Username, cfg.Password)
+	} else if cfg.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg.BearerToken)
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("server returned HTTP status %d", res.StatusCode)
+	}
+	return nil
+}
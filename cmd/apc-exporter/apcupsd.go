@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ApcupsdConfig configures a target with backend apcupsd, read from the network
+// information server of apcupsd on the host the UPS is attached to.
+type ApcupsdConfig struct {
+	// Address is the host:port of the server, by default the host of ups_url, or
+	// localhost, on port 3551.
+	Address string        `yaml:"address"`
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// apcupsdMetrics map the fields of the apcupsd status onto the metrics of the web
+// scraper. The values start with a number, followed by a unit such as "Percent".
+var apcupsdMetrics = map[string]string{
+	"LOADPCT":  "ups_load_percent",
+	"TIMELEFT": "ups_runtime_remaining_minutes",
+	"BCHARGE":  "ups_battery_charge_percent",
+	"BATTV":    "ups_battery_voltage_vdc",
+	"LINEV":    "ups_input_voltage_vac",
+	"LINEFREQ": "ups_input_frequency_hz",
+	"OUTPUTV":  "ups_output_voltage_vac",
+	"OUTCURNT": "ups_load_current_amps",
+	"ITEMP":    "ups_internal_temperature_celsius",
+}
+
+// apcupsdAddress returns the address of the server of a target.
+func apcupsdAddress(cfg ApcupsdConfig, upsURL string) string {
+	if cfg.Address != "" {
+		if _, _, err := net.SplitHostPort(cfg.Address); err != nil {
+			return net.JoinHostPort(cfg.Address, "3551")
+		}
+		return cfg.Address
+	}
+	if u, err := url.Parse(upsURL); err == nil && u.Hostname() != "" {
+		return net.JoinHostPort(u.Hostname(), "3551")
+	}
+	return "localhost:3551"
+}
+
+// apcupsdBackend reads a target from apcupsd, as the collector's backend.
+type apcupsdBackend struct {
+	addr    string
+	timeout time.Duration
+}
+
+func newApcupsdBackend(target TargetConfig) *apcupsdBackend {
+	timeout := target.Apcupsd.Timeout
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	return &apcupsdBackend{addr: apcupsdAddress(target.Apcupsd, target.URL), timeout: timeout}
+}
+
+// Values reads the status apcupsd reports, as apcaccess does, under the metric names
+// of the web scraper. The device status is up while the UPS is on line and apcupsd
+// still talks to it, and the outlets are on while the UPS powers them, on line or on
+// battery.
+func (b *apcupsdBackend) Values(ctx context.Context) (map[string]float64, error) {
+	fields, err := apcupsdStatus(ctx, b.addr, b.timeout)
+	if err != nil {
+		return nil, err
+	}
+	status, ok := fields["STATUS"]
+	if !ok {
+		return nil, fmt.Errorf("apcupsd at %s sent no STATUS", b.addr)
+	}
+	flags := strings.Fields(status)
+	values := map[string]float64{"ups_device_status_up": 0, "ups_outlet_status": 0}
+	if !slices.Contains(flags, "COMMLOST") {
+		if slices.Contains(flags, "ONLINE") {
+			values["ups_device_status_up"] = 1
+		}
+		if slices.Contains(flags, "ONLINE") || slices.Contains(flags, "ONBATT") {
+			values["ups_outlet_status"] = 1
+		}
+	}
+	for field, metric := range apcupsdMetrics {
+		value, ok := fields[field]
+		if !ok {
+			continue
+		}
+		number, _, _ := strings.Cut(value, " ")
+		v, err := strconv.ParseFloat(number, 64)
+		if err != nil {
+			return nil, fmt.Errorf("apcupsd at %s sent %s %q, not a number", b.addr, field, value)
+		}
+		values[metric] = v
+	}
+	return values, nil
+}
+
+// Unsupported returns the metrics apcupsd has no field for, and the load current, which
+// only larger models report.
+func (b *apcupsdBackend) Unsupported() []string {
+	return []string{"ups_load_power_percent_va", "ups_load_current_amps", "ups_output_frequency_hz"}
+}
+
+// apcupsdStatus asks the network information server of apcupsd for the status and
+// returns its fields by name. Requests and the lines of the answer are sent as records
+// with a 16-bit length, and the answer ends with an empty record.
+func apcupsdStatus(ctx context.Context, addr string, timeout time.Duration) (map[string]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	req := binary.BigEndian.AppendUint16(nil, uint16(len("status")))
+	if _, err := conn.Write(append(req, "status"...)); err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	fields := make(map[string]string)
+	for {
+		var n uint16
+		if err := binary.Read(r, binary.BigEndian, &n); err != nil {
+			if errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, fmt.Errorf("reading the status from apcupsd at %s: %w", addr, err)
+		}
+		if n == 0 {
+			return fields, nil
+		}
+		line := make([]byte, n)
+		if _, err := io.ReadFull(r, line); err != nil {
+			return nil, fmt.Errorf("reading the status from apcupsd at %s: %w", addr, err)
+		}
+		// Lines are "NAME     : value".
+		if name, value, ok := strings.Cut(string(line), ":"); ok {
+			fields[strings.TrimSpace(name)] = strings.TrimSpace(value)
+		}
+	}
+}
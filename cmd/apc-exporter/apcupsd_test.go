@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"maps"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// apcupsdTestLines are the status lines of apcupsd for a Back-UPS, as apcaccess prints
+// them, but for STATUS.
+var apcupsdTestLines = []string{
+	"APC      : 001,036,0866",
+	"DATE     : 2024-05-01 12:00:00 +0000  ",
+	"UPSNAME  : rack-a",
+	"LINEV    : 230.0 Volts",
+	"LOADPCT  : 23.0 Percent",
+	"BCHARGE  : 100.0 Percent",
+	"TIMELEFT : 45.3 Minutes",
+	"BATTV    : 13.6 Volts",
+	"LINEFREQ : 50.0 Hz",
+	"ITEMP    : 29.2 C",
+	"END APC  : 2024-05-01 12:00:01 +0000  ",
+}
+
+// apcupsdTestServer starts a fake network information server that answers a status
+// request with the lines as length-prefixed records, followed by the bytes of end,
+// and returns its address.
+func apcupsdTestServer(t *testing.T, lines []string, end []byte) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		req := make([]byte, 8)
+		if _, err := io.ReadFull(conn, req); err != nil || binary.BigEndian.Uint16(req) != 6 || string(req[2:]) != "status" {
+			t.Errorf("request %q (%v), want a status record", req, err)
+			return
+		}
+		var res []byte
+		for _, line := range lines {
+			res = binary.BigEndian.AppendUint16(res, uint16(len(line)+1))
+			res = append(res, line+"\n"...)
+		}
+		conn.Write(append(res, end...))
+	}()
+	return ln.Addr().String()
+}
+
+// TestApcupsdValues checks the metrics read from the status of apcupsd, and how the
+// flags of STATUS map onto the device and outlet status.
+func TestApcupsdValues(t *testing.T) {
+	want := map[string]float64{
+		"ups_input_voltage_vac":            230,
+		"ups_load_percent":                 23,
+		"ups_battery_charge_percent":       100,
+		"ups_runtime_remaining_minutes":    45.3,
+		"ups_battery_voltage_vdc":          13.6,
+		"ups_input_frequency_hz":           50,
+		"ups_internal_temperature_celsius": 29.2,
+	}
+	for _, tc := range []struct {
+		status        string
+		up, outletsOn float64
+	}{
+		{"ONLINE", 1, 1},
+		{"ONLINE REPLACEBATT", 1, 1},
+		{"ONBATT", 0, 1},
+		{"ONBATT LOWBATT", 0, 1},
+		{"COMMLOST", 0, 0},
+		{"ONLINE COMMLOST", 0, 0},
+		{"ONBATT COMMLOST", 0, 0},
+		{"SHUTTING DOWN", 0, 0},
+	} {
+		t.Run(tc.status, func(t *testing.T) {
+			lines := append([]string{"STATUS   : " + tc.status + " "}, apcupsdTestLines...)
+			b := newApcupsdBackend(TargetConfig{Apcupsd: ApcupsdConfig{Address: apcupsdTestServer(t, lines, []byte{0, 0})}})
+			values, err := b.Values(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := maps.Clone(want)
+			expected["ups_device_status_up"], expected["ups_outlet_status"] = tc.up, tc.outletsOn
+			if !maps.Equal(values, expected) {
+				t.Errorf("values:\n%v\nwant:\n%v", values, expected)
+			}
+		})
+	}
+}
+
+// TestApcupsdStatusErrors checks that answers cut short or without the fields needed
+// fail the scrape.
+func TestApcupsdStatusErrors(t *testing.T) {
+	status := append([]string{"STATUS   : ONLINE "}, apcupsdTestLines...)
+	for _, tc := range []struct {
+		name  string
+		lines []string
+		end   []byte
+		err   error
+		msg   string
+	}{
+		{"no end record", status, nil, io.ErrUnexpectedEOF, ""},
+		{"truncated length", status, []byte{0}, io.ErrUnexpectedEOF, ""},
+		{"truncated record", status, []byte{0, 20, 'L', 'O', 'A', 'D'}, io.ErrUnexpectedEOF, ""},
+		{"no status", apcupsdTestLines, []byte{0, 0}, nil, "sent no STATUS"},
+		{"not a number", append(status, "BCHARGE  : N/A"), []byte{0, 0}, nil, `sent BCHARGE "N/A", not a number`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b := &apcupsdBackend{addr: apcupsdTestServer(t, tc.lines, tc.end), timeout: 5 * time.Second}
+			_, err := b.Values(context.Background())
+			switch {
+			case err == nil:
+				t.Fatal("no error")
+			case tc.err != nil && !errors.Is(err, tc.err):
+				t.Errorf("error %v, want %v", err, tc.err)
+			case tc.msg != "" && !strings.Contains(err.Error(), tc.msg):
+				t.Errorf("error %v, want one with %q", err, tc.msg)
+			}
+		})
+	}
+}
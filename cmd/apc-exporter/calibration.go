@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// calibrationActions maps the actions of POST /api/v1/calibration/{target} to the
+// values of the action field of the card's diagnostics form.
+var calibrationActions = map[string]string{
+	"start":  "startRuntimeCalibration",
+	"cancel": "cancelRuntimeCalibration",
+}
+
+// calibrationRequest is the body of POST /api/v1/calibration/{target}.
+type calibrationRequest struct {
+	Action string `json:"action"`
+}
+
+// parseCalibrationRequest accepts a calibration request only if allow_calibration is set,
+// since a calibration runs the battery down to about a quarter of its charge.
+func (ctl *controller) parseCalibrationRequest(r *http.Request, rec *controlRecord) error {
+	var req calibrationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+	if _, ok := calibrationActions[req.Action]; !ok {
+		return fmt.Errorf("action must be start or cancel")
+	}
+	rec.Action = "calibration_" + req.Action
+	rec.description = calibrationDescription(rec.Action)
+	if !ctl.cfg.AllowCalibration {
+		return errControlDisabled
+	}
+	return nil
+}
+
+func calibrationDescription(action string) string {
+	return "Runtime calibration " + strings.TrimPrefix(action, "calibration_")
+}
+
+// controlCalibration submits the runtime calibration form of the card's diagnostics page.
+func (ctl *controller) controlCalibration(c *upsCollector, rec *controlRecord) error {
+	action := calibrationActions[strings.TrimPrefix(rec.Action, "calibration_")]
+	return ctl.submit(c, rec, ctl.cfg.DiagnosticsPath, url.Values{"action": {action}})
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+)
+
+const cardRebootDescription = "Management card reboot"
+
+func parseCardRebootRequest(r *http.Request, rec *controlRecord) error {
+	rec.Action, rec.description = "card_reboot", cardRebootDescription
+	return nil
+}
+
+// rebootCard submits the reset form of the card, which restarts the network management
+// interface only and leaves the UPS output alone. The session does not survive the
+// restart, so the next request logs in again.
+func (ctl *controller) rebootCard(c *upsCollector, rec *controlRecord) error {
+	err := ctl.submit(c, rec, ctl.cfg.ResetPath, url.Values{"action": {"rebootManagementInterface"}})
+	if !rec.DryRun {
+		c.Client().Expire()
+	}
+	return err
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// defaultChatTemplate renders a one-line message for a transition.
+const defaultChatTemplate = `{{if .Active}}⚠️{{else}}✅{{end}} {{.Target}} {{.Condition}}: {{.From}} → {{.To}}` +
+	`{{with index .Metrics "ups_runtime_remaining_minutes"}} ({{.}} min runtime){{end}}`
+
+// ChatConfig holds the settings for one chat notifier. Each notifier can be limited
+// to a group of targets and to some conditions.
+type ChatConfig struct {
+	Type       string   `yaml:"type"`
+	WebhookURL string   `yaml:"webhook_url"`
+	BotToken   string   `yaml:"bot_token"`
+	ChatID     string   `yaml:"chat_id"`
+	APIURL     string   `yaml:"api_url"`
+	Targets    []string `yaml:"targets"`
+	Conditions []string `yaml:"conditions"`
+	Template   string   `yaml:"template"`
+}
+
+// newChatNotifier returns a notifier that posts a templated message to Slack,
+// Discord or Telegram.
+func newChatNotifier(cfg ChatConfig) (transitionNotifier, error) {
+	if cfg.Template == "" {
+		cfg.Template = defaultChatTemplate
+	}
+	tmpl, err := template.New(cfg.Type).Parse(cfg.Template)
+	if err != nil {
+		return nil, fmt.Errorf("template: %w", err)
+	}
+
+	// payload renders the request URL and body for a message.
+	var payload func(text string) (string, map[string]string)
+	switch cfg.Type {
+	case "slack", "discord":
+		if cfg.WebhookURL == "" {
+			return nil, fmt.Errorf("%s: webhook_url is required", cfg.Type)
+		}
+		key := "text"
+		if cfg.Type == "discord" {
+			key = "content"
+		}
+		payload = func(text string) (string, map[string]string) {
+			return cfg.WebhookURL, map[string]string{key: text}
+		}
+	case "telegram":
+		if cfg.BotToken == "" || cfg.ChatID == "" {
+			return nil, fmt.Errorf("telegram: bot_token and chat_id are required")
+		}
+		if cfg.APIURL == "" {
+			cfg.APIURL = "https://api.telegram.org"
+		}
+		endpoint := strings.TrimSuffix(cfg.APIURL, "/") + "/bot" + cfg.BotToken + "/sendMessage"
+		payload = func(text string) (string, map[string]string) {
+			return endpoint, map[string]string{"chat_id": cfg.ChatID, "text": text}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported type %q (use slack, discord or telegram)", cfg.Type)
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	return func(ctx context.Context, tr transition) error {
+		if len(cfg.Targets) > 0 && !slices.Contains(cfg.Targets, tr.Target) {
+			return nil
+		}
+		if len(cfg.Conditions) > 0 && !slices.Contains(cfg.Conditions, tr.Condition) {
+			return nil
+		}
+		var text bytes.Buffer
+		if err := tmpl.Execute(&text, tr); err != nil {
+			return fmt.Errorf("%s template: %w", cfg.Type, err)
+		}
+		url, fields := payload(text.String())
+		body, err := json.Marshal(fields)
+		if err != nil {
+			return err
+		}
+		if err := postChat(ctx, client, url, body); err != nil {
+			return fmt.Errorf("%s: %w", cfg.Type, err)
+		}
+		return nil
+	}, nil
+}
+
+func postChat(ctx context.Context, client *http.Client, url string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "apc-exporter")
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("server returned HTTP status %d", res.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// checkSeverity orders the plugin states from best to worst for the overall state.
+var checkSeverity = map[int]int{checkOK: 0, checkUnknown: 1, checkWarning: 2, checkCritical: 3}
+
+// runCheckCommand implements the check command, an active check for Nagios and
+// Icinga: it scrapes one target once, evaluates the same checks as the passive
+// checks, prints one status line with performance data and returns the plugin exit
+// code. The log is discarded unless -v is given, as the status line is the output.
+func runCheckCommand(cfg Config, args []string) int {
+	flags := flag.NewFlagSet("check", flag.ContinueOnError)
+	name := flags.String("target", "", "Name or URL of the target to check (default the only configured target)")
+	username := flags.String("username", "", "Username to log in with instead of the configured one")
+	password := flags.String("password", "", "Password to log in with instead of the configured one")
+	verbose := flags.Bool("v", false, "Log to stderr")
+	warnRuntime := flags.Float64("warn-runtime", 15, "Warn at or below this runtime in minutes")
+	critRuntime := flags.Float64("crit-runtime", 5, "Critical at or below this runtime in minutes")
+	warnCharge := flags.Float64("warn-charge", 50, "Warn at or below this battery charge in percent")
+	critCharge := flags.Float64("crit-charge", 25, "Critical at or below this battery charge in percent")
+	warnLoad := flags.Float64("warn-load", 80, "Warn at or above this load in percent")
+	critLoad := flags.Float64("crit-load", 90, "Critical at or above this load in percent")
+	if err := flags.Parse(args); err != nil {
+		fmt.Printf("UPS UNKNOWN - %v\n", err)
+		return checkUnknown
+	}
+	if !*verbose {
+		setLogOutput(io.Discard)
+	}
+
+	target, err := commandTarget(cfg, *name, *username, *password)
+	if err != nil {
+		fmt.Printf("UPS UNKNOWN - %v\n", err)
+		return checkUnknown
+	}
+	httpClient, err := newTargetHTTPClient(target)
+	if err != nil {
+		fmt.Printf("UPS UNKNOWN - %v\n", err)
+		return checkUnknown
+	}
+	collector, err := newUPSCollector(cfg, httpClient, target)
+	if err != nil {
+		fmt.Printf("UPS UNKNOWN - %v\n", err)
+		return checkUnknown
+	}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collector)
+	samples, err := gatherSamples(registry, "ups_")
+	if err != nil || !collector.Scraped() {
+		fmt.Printf("UPS UNKNOWN - %s could not be scraped, run with -v for details\n", target.Name)
+		return checkUnknown
+	}
+	_, states := samplesByTarget(samples)
+
+	state, outputs, perfData := checkOK, []string(nil), []string(nil)
+	checks := []CheckConfig{
+		defaultChecks[0],
+		{Metric: "ups_runtime_remaining_minutes", Warning: *warnRuntime, Critical: *critRuntime, Below: true},
+		{Metric: "ups_battery_charge_percent", Warning: *warnCharge, Critical: *critCharge, Below: true},
+		{Metric: "ups_load_percent", Warning: *warnLoad, Critical: *critLoad},
+	}
+	for _, c := range checks {
+		r := evaluateCheck(c, target.Name, states[target.Name])
+		if checkSeverity[r.State] > checkSeverity[state] {
+			state = r.State
+		}
+		// The output of a result reads "STATE - metric is value".
+		_, output, _ := strings.Cut(r.Output, " - ")
+		output = strings.TrimPrefix(output, "ups_")
+		if r.State != checkOK {
+			output += " (" + strings.ToLower(checkStateNames[r.State]) + ")"
+		}
+		outputs = append(outputs, output)
+		if r.PerfData != "" {
+			perfData = append(perfData, r.PerfData)
+		}
+	}
+	fmt.Printf("UPS %s - %s: %s | %s\n", checkStateNames[state], target.Name, strings.Join(outputs, ", "), strings.Join(perfData, " "))
+	return state
+}
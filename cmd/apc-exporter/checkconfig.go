@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"maps"
+	"net/url"
+	"os"
+	"path"
+	"reflect"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/veter2005/apc-exporter/pkg/collector"
+	"github.com/veter2005/apc-exporter/pkg/nmc"
+)
+
+// runCheckConfigCommand validates a config file without starting the exporter, so
+// deployments can check it first. Every problem found is printed; the command fails
+// if there is any.
+func runCheckConfigCommand(configPath string, args []string) error {
+	flags := flag.NewFlagSet("check-config", flag.ContinueOnError)
+	path := flags.String("config", configPath, "Path to the configuration file")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	errs := checkConfigFile(*path)
+	for _, err := range errs {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", *path, err)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%d problem(s) found", len(errs))
+	}
+	fmt.Printf("%s: OK\n", *path)
+	return nil
+}
+
+// checkConfigFile decodes the config strictly, rejecting unknown fields, and checks
+// everything the exporter would otherwise only report, or skip, at runtime.
+func checkConfigFile(path string) []error {
+	data, err := readConfigFile(path)
+	if err != nil {
+		return []error{err}
+	}
+	var cfg Config
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	var errs []error
+	if err := dec.Decode(&cfg); err != nil {
+		var typeErr *yaml.TypeError
+		if !errors.As(err, &typeErr) {
+			return []error{err}
+		}
+		// The rest of the document was decoded; check that as well.
+		for _, msg := range typeErr.Errors {
+			errs = append(errs, errors.New(msg))
+		}
+	}
+	if err := cfg.resolveModes(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := cfg.readPasswordFiles(); err != nil {
+		errs = append(errs, err)
+	}
+	return append(errs, checkConfig(cfg)...)
+}
+
+// checkStatusStrings checks a list of status strings.
+func checkStatusStrings(setting string, list []nmc.StatusString, add func(string, ...any)) {
+	for i, st := range list {
+		if st.Text == "" || st.State == "" {
+			add("%s[%d]: text and state are required", setting, i)
+		}
+	}
+}
+
+// checkTargetSettings checks the settings of a target, or of an auth module.
+func checkTargetSettings(setting string, t TargetConfig, add func(string, ...any)) {
+	switch t.Backend {
+	case "", "web":
+		if t.Username == "" || t.Password == "" {
+			add("%s: username and password are required", setting)
+		}
+	case "exec":
+		if t.Exec.Command == "" {
+			add("%s: exec.command is required with backend exec", setting)
+		}
+	case "snmp":
+		// The address is checked with the target, an auth module gets it from the probe.
+		if _, err := newSNMPClient(t.SNMP, "http://localhost"); err != nil {
+			add("%s: %v", setting, err)
+		}
+	case "modbus", "apcupsd":
+	default:
+		add("%s: unknown backend %q, must be web, snmp, modbus, apcupsd or exec", setting, t.Backend)
+	}
+	if t.Profile != "" && nmc.LookupProfile(t.Profile) == nil {
+		var known []string
+		for _, p := range nmc.Profiles() {
+			known = append(known, p.Name)
+		}
+		add("%s: unknown parser_profile %q, known are %s", setting, t.Profile, strings.Join(known, ", "))
+	}
+	if _, err := nmc.DecimalSeparator(t.Locale); err != nil {
+		add("%s: %v", setting, err)
+	}
+	if l := t.Language; l != "" && l != "auto" && l != "en" && nmc.LanguageStatusStrings[l] == nil {
+		add("%s: unknown language %q, known are auto, en, %s", setting, l, strings.Join(nmc.Languages(), ", "))
+	}
+	if t.Units != "" && !slices.Contains(collector.Units, t.Units) {
+		add("%s: unknown units %q, must be one of %s", setting, t.Units, strings.Join(collector.Units, ", "))
+	}
+	if t.InfoRefresh < 0 {
+		add("%s: info_refresh must not be negative", setting)
+	}
+	if t.ScrapeTimeout < 0 {
+		add("%s: scrape_timeout must not be negative", setting)
+	}
+	if t.PollInterval < 0 {
+		add("%s: poll_interval must not be negative", setting)
+	}
+	if _, err := t.tlsConfig(); err != nil {
+		add("%s: %v", setting, err)
+	}
+}
+
+// checkConfig checks a decoded config. Errors name the setting they are about.
+func checkConfig(cfg Config) []error {
+	var errs []error
+	add := func(format string, args ...any) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	checkStatusStrings("status_strings", cfg.StatusStrings, add)
+	targets := cfg.targetConfigs()
+	if len(targets) == 0 && len(cfg.AuthModules) == 0 {
+		add("no UPS configured: set ups_url, add entries under targets, or add auth_modules to probe cards")
+	}
+	for _, name := range slices.Sorted(maps.Keys(cfg.AuthModules)) {
+		m := cfg.AuthModules[name]
+		setting := "auth_modules." + name
+		checkTargetSettings(setting, m.TargetConfig, add)
+		checkStatusStrings(setting+": status_strings", m.StatusStrings, add)
+		if len(m.Hosts) == 0 {
+			add(`%s: hosts is required, list the hosts the credentials may be sent to, or "*" for any`, setting)
+		}
+		for _, pattern := range m.Hosts {
+			if _, err := path.Match(pattern, ""); err != nil {
+				add("%s: hosts: bad pattern %q", setting, pattern)
+			}
+		}
+	}
+	var names []string
+	for i, t := range targets {
+		setting := fmt.Sprintf("targets[%d]", i)
+		if i == len(cfg.Targets) {
+			setting = "ups_url"
+		}
+		if slices.Contains(names, t.Name) {
+			add("%s: duplicate target name %q", setting, t.Name)
+		}
+		names = append(names, t.Name)
+		if (t.Backend == "exec" || t.Backend == "apcupsd") && t.Name == "" {
+			add("%s: name is required with backend %s", setting, t.Backend)
+		}
+		if t.Backend == "snmp" && t.URL == "" {
+			switch {
+			case t.SNMP.Address == "":
+				add("%s: ups_url or snmp.address is required with backend snmp", setting)
+			case t.Name == "":
+				add("%s: name is required with backend snmp without ups_url", setting)
+			}
+		}
+		if t.Backend == "modbus" && t.URL == "" {
+			switch {
+			case t.Modbus.Address == "":
+				add("%s: ups_url or modbus.address is required with backend modbus", setting)
+			case t.Name == "":
+				add("%s: name is required with backend modbus without ups_url", setting)
+			}
+		}
+		checkTargetSettings(fmt.Sprintf("%s (%s)", setting, t.Name), t, add)
+		if i < len(cfg.Targets) {
+			checkStatusStrings(fmt.Sprintf("%s (%s): status_strings", setting, t.Name), cfg.Targets[i].StatusStrings, add)
+		}
+	}
+	knownTargets := func(setting string, list []string) {
+		for _, name := range list {
+			if !slices.Contains(names, name) {
+				add("%s: unknown target %q", setting, name)
+			}
+		}
+	}
+
+	errs = append(errs, checkURLs(reflect.ValueOf(cfg), "")...)
+
+	for i, m := range cfg.DerivedMetrics {
+		name := strings.TrimPrefix(m.Name, "ups_")
+		if !metricNameRE.MatchString("ups_" + name) {
+			add("derived_metrics[%d]: invalid name %q", i, m.Name)
+		}
+		if _, err := parseExpr(m.Expr); err != nil {
+			add("derived_metrics[%d] (%s): expr: %v", i, m.Name, err)
+		}
+		knownTargets(fmt.Sprintf("derived_metrics[%d].targets", i), m.Targets)
+	}
+	for i, r := range cfg.Transitions.Rules {
+		if _, err := compileRule(r); err != nil {
+			add("transitions.rules[%d] (%s): %v", i, r.Name, err)
+		}
+		knownTargets(fmt.Sprintf("transitions.rules[%d].targets", i), r.Targets)
+	}
+	for i, w := range cfg.Maintenance {
+		if _, err := compileMaintenanceWindow(w); err != nil {
+			add("maintenance[%d] (%s): %v", i, w.Name, err)
+		}
+		knownTargets(fmt.Sprintf("maintenance[%d].targets", i), w.Targets)
+	}
+
+	if err := cfg.MQTT.check(); err != nil {
+		add("mqtt: %v", err)
+	}
+	if _, err := newEmailNotifier(cfg.Email); err != nil {
+		add("email: %v", err)
+	}
+	for i, c := range cfg.Chat {
+		if _, err := newChatNotifier(c); err != nil {
+			add("chat[%d]: %v", i, err)
+		}
+		knownTargets(fmt.Sprintf("chat[%d].targets", i), c.Targets)
+	}
+	if _, err := newNtfyNotifier(cfg.Ntfy); err != nil {
+		add("ntfy: %v", err)
+	}
+	knownTargets("ntfy.targets", cfg.Ntfy.Targets)
+	knownTargets("pagerduty.targets", cfg.PagerDuty.Targets)
+
+	errs = append(errs, checkControlConfig(cfg.Control, targets)...)
+	for i, t := range cfg.Control.Tokens {
+		knownTargets(fmt.Sprintf("control.tokens[%d].targets", i), t.Targets)
+	}
+	for i, g := range cfg.Shutdown.Groups {
+		knownTargets(fmt.Sprintf("shutdown.groups[%d].targets", i), g.Targets)
+	}
+
+	switch cfg.HA.Lock {
+	case "", "kubernetes":
+	case "file":
+		if cfg.HA.Path == "" {
+			add("high_availability: path is required for the file lock")
+		}
+	default:
+		add("high_availability.lock: unknown lock %q, expected file or kubernetes", cfg.HA.Lock)
+	}
+
+	if cfg.Zabbix.KeyMapFile != "" {
+		if _, err := loadZabbixKeyMap(cfg.Zabbix.KeyMapFile); err != nil {
+			add("zabbix.key_map_file: %v", err)
+		}
+	}
+	return errs
+}
+
+// checkControlConfig checks the tokens and schedules of the control API the way
+// newController does, without opening the audit log.
+func checkControlConfig(cfg ControlConfig, targets []TargetConfig) []error {
+	var errs []error
+	tokens := cfg
+	tokens.Schedules, tokens.AuditLog = nil, ""
+	if _, err := newController(tokens, nil, nil); err != nil {
+		errs = append(errs, fmt.Errorf("control: %w", err))
+	}
+
+	ctl := &controller{cfg: cfg.withDefaults(), collectors: make(map[string]*upsCollector)}
+	for _, t := range targets {
+		// The schedules only need the target; its other settings are checked above.
+		c, err := newUPSCollector(Config{}, nil, TargetConfig{Target: t.Target})
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", t.Name, err))
+			continue
+		}
+		ctl.collectors[t.Name] = c
+	}
+	for i, s := range cfg.Schedules {
+		if _, err := ctl.compileSchedule(s); err != nil {
+			errs = append(errs, fmt.Errorf("control.schedules[%d] (%s): %w", i, s.Name, err))
+		}
+	}
+	return errs
+}
+
+// checkURLs walks the config and checks every setting named url, urls or *_url, which
+// must be absolute URLs with a host.
+func checkURLs(v reflect.Value, path string) []error {
+	var errs []error
+	switch v.Kind() {
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			name, opts, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+			if name == "" && opts == "inline" {
+				errs = append(errs, checkURLs(v.Field(i), path)...)
+				continue
+			}
+			if name == "" || name == "-" {
+				continue
+			}
+			setting := name
+			if path != "" {
+				setting = path + "." + name
+			}
+			if name == "url" || name == "urls" || strings.HasSuffix(name, "_url") {
+				errs = append(errs, checkURLValue(v.Field(i), setting)...)
+				continue
+			}
+			errs = append(errs, checkURLs(v.Field(i), setting)...)
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			errs = append(errs, checkURLs(v.Index(i), fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	}
+	return errs
+}
+
+func checkURLValue(v reflect.Value, setting string) []error {
+	switch v.Kind() {
+	case reflect.String:
+		if s := v.String(); s != "" {
+			if u, err := url.Parse(s); err != nil {
+				return []error{fmt.Errorf("%s: %v", setting, err)}
+			} else if u.Scheme == "" || u.Host == "" {
+				return []error{fmt.Errorf("%s: %q is not an absolute URL", setting, s)}
+			}
+		}
+	case reflect.Slice:
+		var errs []error
+		for i := 0; i < v.Len(); i++ {
+			errs = append(errs, checkURLValue(v.Index(i), fmt.Sprintf("%s[%d]", setting, i))...)
+		}
+		return errs
+	}
+	return nil
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+)
+
+// cliCommand is a command as offered by the shell completion.
+type cliCommand struct {
+	name  string
+	usage string
+	flags []string // taking a value, without the dash
+	bools []string // boolean flags
+	args  []string // fixed arguments
+}
+
+// cliCommands are the commands given after the global flags. Their flags are kept in
+// step with the flag sets of the commands by hand.
+var cliCommands = []cliCommand{
+	{name: "status", usage: "Print the status of the targets like apcaccess", flags: []string{"target", "username", "password"}},
+	{name: "watch", usage: "Show the status of a target live in the terminal", flags: []string{"target", "username", "password", "interval"}},
+	{name: "check", usage: "Check a target as a Nagios / Icinga plugin", flags: []string{"target", "username", "password", "warn-runtime", "crit-runtime", "warn-charge", "crit-charge", "warn-load", "crit-load"}, bools: []string{"v"}},
+	{name: "scrape", usage: "Scrape a target once and print its metrics", flags: []string{"target", "username", "password"}},
+	{name: "diff", usage: "Compare the values of a target read through two backends", flags: []string{"target", "username", "password", "backends", "community", "snmp-address", "timeout", "tolerance"}},
+	{name: "login-test", usage: "Log in to a target step by step", flags: []string{"target", "username", "password"}, bools: []string{"v"}},
+	{name: "dump-pages", usage: "Save the pages of a card for a bug report", flags: []string{"target", "username", "password", "o", "about-path", "paths"}},
+	{name: "selftest", usage: "Start a battery self-test on the targets", bools: []string{"dry-run"}},
+	{name: "discover", usage: "Scan networks for management cards", flags: []string{"cidr", "community", "timeout", "concurrency"}},
+	{name: "gen-rules", usage: "Print Prometheus alerting rules", flags: []string{"group", "job", "on-battery-for", "on-battery-input-voltage", "low-runtime", "low-runtime-for", "unreachable-for", "stale-after"}},
+	{name: "check-config", usage: "Validate the config file", flags: []string{"config"}},
+	{name: "healthcheck", usage: "Check a running exporter's health endpoint", flags: []string{"url", "timeout"}},
+	{name: "service", usage: "Install or uninstall the Windows service", args: []string{"install", "uninstall"}},
+	{name: "version", usage: "Print the version"},
+	{name: "completion", usage: "Print a shell completion script", args: []string{"bash", "zsh", "fish"}},
+}
+
+// runCompletionCommand implements the completion command: it prints the completion
+// script for a shell, covering the global flags, the commands and their flags.
+func runCompletionCommand(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: completion bash|zsh|fish")
+	}
+	var global, globalBools []string
+	usages := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+			globalBools = append(globalBools, f.Name)
+		} else {
+			global = append(global, f.Name)
+		}
+		usages[f.Name] = f.Usage
+	})
+	switch args[0] {
+	case "bash":
+		writeBashCompletion(os.Stdout, global, globalBools)
+	case "zsh":
+		writeZshCompletion(os.Stdout, global, globalBools)
+	case "fish":
+		writeFishCompletion(os.Stdout, global, globalBools, usages)
+	default:
+		return fmt.Errorf("unknown shell %q, want bash, zsh or fish", args[0])
+	}
+	return nil
+}
+
+// dashed returns the names as flags, separated by sep.
+func dashed(names []string, sep string) string {
+	flags := make([]string, len(names))
+	for i, n := range names {
+		flags[i] = "-" + n
+	}
+	return strings.Join(flags, sep)
+}
+
+// commandWords returns the words completed after a command.
+func commandWords(c cliCommand) string {
+	return strings.Join(slices.Concat(strings.Fields(dashed(slices.Concat(c.flags, c.bools), " ")), c.args), " ")
+}
+
+// boolFlags returns the global and command flags that take no value.
+func boolFlags(globalBools []string) []string {
+	bools := slices.Clone(globalBools)
+	for _, c := range cliCommands {
+		for _, b := range c.bools {
+			if !slices.Contains(bools, b) {
+				bools = append(bools, b)
+			}
+		}
+	}
+	return bools
+}
+
+// shellQuote quotes s in single quotes for bash, zsh and fish.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func commandNames() []string {
+	names := make([]string, len(cliCommands))
+	for i, c := range cliCommands {
+		names[i] = c.name
+	}
+	return names
+}
+
+func writeBashCompletion(w io.Writer, global, globalBools []string) {
+	fmt.Fprintf(w, `# bash completion for apc-exporter, from "apc-exporter completion bash"
+_apc_exporter() {
+    local cur="${COMP_WORDS[COMP_CWORD]}" prev="${COMP_WORDS[COMP_CWORD-1]}" cmd="" i word
+    # The command is the first word that is neither a flag nor a flag's value.
+    for ((i = 1; i < COMP_CWORD; i++)); do
+        word="${COMP_WORDS[i]}"
+        case "$word" in
+        -* | =) continue ;;
+        esac
+        case "${COMP_WORDS[i-1]}" in
+        = | %s) continue ;;
+        esac
+        cmd="$word"
+        break
+    done
+
+    # Values of flags fall back to file names.
+    case "$prev" in
+    =) return ;;
+    -*)
+        if [[ -z $cmd ]]; then
+            case "$prev" in %s) return ;; esac
+        elif [[ $prev != @(%s) ]]; then
+            return
+        fi
+        ;;
+    esac
+
+    local words
+    case "$cmd" in
+    "") words=%s ;;
+`, dashed(global, " | "), dashed(global, " | "), dashed(boolFlags(globalBools), "|"),
+		shellQuote(dashed(slices.Concat(global, globalBools), " ")+" "+strings.Join(commandNames(), " ")))
+	for _, c := range cliCommands {
+		fmt.Fprintf(w, "    %s) words=%s ;;\n", c.name, shellQuote(commandWords(c)))
+	}
+	fmt.Fprint(w, `    *) return ;;
+    esac
+    COMPREPLY=($(compgen -W "$words" -- "$cur"))
+}
+complete -o default -F _apc_exporter apc-exporter
+`)
+}
+
+func writeZshCompletion(w io.Writer, global, globalBools []string) {
+	fmt.Fprintf(w, `#compdef apc-exporter
+# zsh completion for apc-exporter, from "apc-exporter completion zsh"
+_apc_exporter() {
+    local cmd="" i
+    local -a commands
+    commands=(
+`)
+	for _, c := range cliCommands {
+		fmt.Fprintf(w, "        %s\n", shellQuote(c.name+":"+c.usage))
+	}
+	fmt.Fprintf(w, `    )
+    # The command is the first word that is neither a flag nor a flag's value.
+    for ((i = 2; i < CURRENT; i++)); do
+        [[ ${words[i]} == -* ]] && continue
+        [[ ${words[i-1]} == (%s) ]] && continue
+        cmd=${words[i]}
+        break
+    done
+
+    # Values of flags are file names.
+    if [[ $PREFIX == -*=* ]]; then
+        compset -P '*='
+        _files
+        return
+    fi
+    if [[ ${words[CURRENT-1]} == -* && ${words[CURRENT-1]} != (%s) ]]; then
+        _files
+        return
+    fi
+
+    case $cmd in
+    "")
+        if [[ $PREFIX == -* ]]; then
+            compadd -- %s
+        else
+            _describe command commands
+        fi
+        ;;
+`, dashed(global, "|"), dashed(boolFlags(globalBools), "|"), dashed(slices.Concat(global, globalBools), " "))
+	for _, c := range cliCommands {
+		words := commandWords(c)
+		if words == "" {
+			continue
+		}
+		fmt.Fprintf(w, "    %s) compadd -- %s ;;\n", c.name, words)
+	}
+	fmt.Fprint(w, `    esac
+}
+
+if [[ $funcstack[1] == _apc_exporter ]]; then
+    _apc_exporter "$@"
+else
+    compdef _apc_exporter apc-exporter
+fi
+`)
+}
+
+func writeFishCompletion(w io.Writer, global, globalBools []string, usage map[string]string) {
+	fmt.Fprint(w, "# fish completion for apc-exporter, from \"apc-exporter completion fish\"\ncomplete -c apc-exporter -f\n")
+	for _, f := range global {
+		fmt.Fprintf(w, "complete -c apc-exporter -n __fish_use_subcommand -o %s -r -F -d %s\n", f, shellQuote(usage[f]))
+	}
+	for _, f := range globalBools {
+		fmt.Fprintf(w, "complete -c apc-exporter -n __fish_use_subcommand -o %s -d %s\n", f, shellQuote(usage[f]))
+	}
+	for _, c := range cliCommands {
+		fmt.Fprintf(w, "complete -c apc-exporter -n __fish_use_subcommand -a %s -d %s\n", c.name, shellQuote(c.usage))
+		cond := shellQuote("__fish_seen_subcommand_from " + c.name)
+		for _, f := range c.flags {
+			fmt.Fprintf(w, "complete -c apc-exporter -n %s -o %s -r -F\n", cond, f)
+		}
+		for _, f := range c.bools {
+			fmt.Fprintf(w, "complete -c apc-exporter -n %s -o %s\n", cond, f)
+		}
+		if len(c.args) > 0 {
+			fmt.Fprintf(w, "complete -c apc-exporter -n %s -a %s\n", cond, shellQuote(strings.Join(c.args, " ")))
+		}
+	}
+}
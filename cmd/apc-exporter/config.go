@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// envReference matches the ${VAR} references to environment variables in the config file.
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv replaces the ${VAR} references in the config file by the values of the
+// environment variables. Other uses of $ are left alone, so passwords and hashes may
+// contain it. A reference to an unset variable is an error rather than an empty value.
+func expandEnv(data []byte) ([]byte, error) {
+	var unset []string
+	data = envReference.ReplaceAllFunc(data, func(ref []byte) []byte {
+		name := string(envReference.FindSubmatch(ref)[1])
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			if !slices.Contains(unset, name) {
+				unset = append(unset, name)
+			}
+			return ref
+		}
+		return []byte(value)
+	})
+	if len(unset) > 0 {
+		return nil, fmt.Errorf("environment variables not set: %s", strings.Join(unset, ", "))
+	}
+	return data, nil
+}
+
+// readConfigFile reads the config file with the environment variables expanded.
+func readConfigFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return expandEnv(data)
+}
+
+// loadConfig reads and decodes the config file as the exporter runs with it: unknown
+// fields are ignored, and the password files are read into the passwords.
+func loadConfig(path string) (Config, error) {
+	var cfg Config
+	data, err := readConfigFile(path)
+	if err != nil {
+		return cfg, err
+	}
+	if err := yaml.NewDecoder(bytes.NewReader(data)).Decode(&cfg); err != nil {
+		return cfg, fmt.Errorf("decoding %s: %w", path, err)
+	}
+	if err := cfg.resolveModes(); err != nil {
+		return cfg, err
+	}
+	if err := cfg.SNMPTraps.check(); err != nil {
+		return cfg, err
+	}
+	return cfg, cfg.readPasswordFiles()
+}
+
+// resolveModes takes the mode of the targets and auth modules as their backend, which
+// it is another name of.
+func (c *Config) resolveModes() error {
+	var errs []error
+	for i := range c.Targets {
+		if err := c.Targets[i].resolveMode(fmt.Sprintf("targets[%d]", i)); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(c.AuthModules)) {
+		m := c.AuthModules[name]
+		if err := m.resolveMode("auth_modules." + name); err != nil {
+			errs = append(errs, err)
+		}
+		c.AuthModules[name] = m
+	}
+	return errors.Join(errs...)
+}
+
+// resolveMode sets the backend to the mode, if only the mode is given.
+func (t *TargetConfig) resolveMode(setting string) error {
+	switch {
+	case t.Mode == "" || t.Mode == t.Backend:
+	case t.Backend == "":
+		t.Backend = t.Mode
+	default:
+		return fmt.Errorf("%s: mode %q and backend %q differ, mode is another name of backend", setting, t.Mode, t.Backend)
+	}
+	t.Mode = ""
+	return nil
+}
+
+// readPasswordFiles sets the passwords given as password_file, at the top level, of the
+// targets and of the auth modules, to the contents of their files.
+func (c *Config) readPasswordFiles() error {
+	if err := readPasswordFile("password_file", &c.PASSWORD, c.PasswordFile); err != nil {
+		return err
+	}
+	for i := range c.Targets {
+		t := &c.Targets[i]
+		if err := readPasswordFile(fmt.Sprintf("targets[%d].password_file", i), &t.Password, t.PasswordFile); err != nil {
+			return err
+		}
+	}
+	for name, m := range c.AuthModules {
+		if err := readPasswordFile(fmt.Sprintf("auth_modules.%s.password_file", name), &m.Password, m.PasswordFile); err != nil {
+			return err
+		}
+		c.AuthModules[name] = m
+	}
+	return nil
+}
+
+// readPasswordFile sets the password to the contents of the file, without the trailing
+// newline, if a file is given.
+func readPasswordFile(setting string, password *string, file string) error {
+	if file == "" {
+		return nil
+	}
+	if *password != "" {
+		return fmt.Errorf("%s: password and password_file cannot both be set", setting)
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return fmt.Errorf("%s: %w", setting, err)
+	}
+	*password = strings.TrimRight(string(data), "\r\n")
+	return nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// confirmationTTL is how long a destructive request waits for its confirmation.
+const confirmationTTL = 60 * time.Second
+
+// pendingAction is a destructive request waiting to be confirmed.
+type pendingAction struct {
+	rec     controlRecord
+	perform func(*upsCollector, *controlRecord) error
+}
+
+// requestConfirmation holds back a destructive request and answers 202 with the
+// confirmation that executes it.
+func (ctl *controller) requestConfirmation(w http.ResponseWriter, rec controlRecord, perform func(*upsCollector, *controlRecord) error) {
+	b := make([]byte, 16)
+	rand.Read(b)
+	expires := rec.Time.Add(confirmationTTL)
+	rec.Confirmation, rec.ConfirmBy, rec.Result = hex.EncodeToString(b), &expires, "pending"
+
+	ctl.mu.Lock()
+	for id, p := range ctl.pending {
+		if rec.Time.After(*p.rec.ConfirmBy) {
+			delete(ctl.pending, id)
+		}
+	}
+	ctl.pending[rec.Confirmation] = pendingAction{rec: rec, perform: perform}
+	ctl.mu.Unlock()
+	ctl.record(rec)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(rec)
+}
+
+// confirm serves POST /api/v1/confirm/{confirmation}, which executes a pending request.
+// A confirmation can be used once, and only with the token that made the request.
+func (ctl *controller) confirm() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		token := ctl.authorize(r)
+		if token == nil {
+			ctl.record(controlRecord{Time: now, Remote: r.RemoteAddr, Result: "unauthorized"})
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		id := r.PathValue("confirmation")
+		ctl.mu.Lock()
+		p, ok := ctl.pending[id]
+		ok = ok && p.rec.Token == token.Name && !now.After(*p.rec.ConfirmBy)
+		if ok {
+			delete(ctl.pending, id)
+		}
+		ctl.mu.Unlock()
+		if !ok {
+			ctl.record(controlRecord{Time: now, Token: token.Name, Remote: r.RemoteAddr, Result: "invalid", Error: "unknown or expired confirmation"})
+			http.Error(w, "unknown or expired confirmation", http.StatusNotFound)
+			return
+		}
+
+		rec := p.rec
+		rec.Time, rec.Remote, rec.ConfirmBy, rec.Result = now, r.RemoteAddr, nil, ""
+		if err := ctl.execute(ctl.collectors[rec.Target], &rec, p.perform); err != nil {
+			http.Error(w, "control request failed: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rec)
+	})
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ControlConfig holds the settings for the control API, which drives the control
+// pages of the cards. The API is disabled unless at least one token is configured;
+// scheduled actions run without one.
+type ControlConfig struct {
+	OutletPath       string         `yaml:"outlet_path"`
+	OutletConfigPath string         `yaml:"outlet_config_path"`
+	DiagnosticsPath  string         `yaml:"diagnostics_path"`
+	AlarmPath        string         `yaml:"alarm_path"`
+	ResetPath        string         `yaml:"reset_path"`
+	Tokens           []ControlToken `yaml:"tokens"`
+	AuditLog         string         `yaml:"audit_log"`
+
+	Schedules []ControlSchedule `yaml:"schedules"`
+
+	// AllowCalibration enables runtime calibrations, which deeply discharge the battery.
+	AllowCalibration bool `yaml:"allow_calibration"`
+}
+
+// ControlToken is a bearer token and what it may do. Empty lists allow all targets,
+// outlet groups or actions.
+type ControlToken struct {
+	Name    string   `yaml:"name"`
+	Token   string   `yaml:"token"`
+	Targets []string `yaml:"targets"`
+	Groups  []string `yaml:"groups"`
+	Actions []string `yaml:"actions"`
+}
+
+// controlActions are the actions tokens can be limited to.
+var controlActions = []string{"on", "off", "reboot", "self_test", "calibration_start", "calibration_cancel", "alarm_mute", "alarm_acknowledge", "card_reboot", "delays_read", "delays_write"}
+
+// errControlDisabled is returned by a request parser for actions not enabled in the config.
+var errControlDisabled = errors.New("disabled in the configuration")
+
+var controlRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "ups_control_requests_total",
+	Help: "Number of authenticated control requests, by action and result (ok, dry_run, pending, denied, unavailable or error).",
+}, []string{"target", "action", "result"})
+
+// controlRecord describes a control request for the audit log and the response.
+type controlRecord struct {
+	Time    time.Time `json:"timestamp"`
+	Token   string    `json:"token,omitempty"`
+	Remote  string    `json:"remote"`
+	Target  string    `json:"target"`
+	Group   string    `json:"group,omitempty"`
+	Action  string    `json:"action"`
+	Delayed bool      `json:"delayed,omitempty"`
+	DryRun  bool      `json:"dry_run,omitempty"`
+	Result  string    `json:"result"`
+	Error   string    `json:"error,omitempty"`
+
+	// Delays are the outlet group delays read or written.
+	Delays *outletDelays `json:"delays,omitempty"`
+	// Form is the form submitted to the card, or that would be in a dry run.
+	Form *controlForm `json:"form,omitempty"`
+	// Confirmation executes a pending destructive request until ConfirmBy.
+	Confirmation string     `json:"confirmation,omitempty"`
+	ConfirmBy    *time.Time `json:"confirm_by,omitempty"`
+
+	// description names the action in event messages, e.g. "Outlet group 2 reboot".
+	description string
+	// readOnly requests change nothing on the card and are not added as events.
+	readOnly bool
+	// destructive requests can drop load and must be confirmed.
+	destructive bool
+}
+
+// controller serves the control API. Every request is audited.
+type controller struct {
+	cfg        ControlConfig
+	collectors map[string]*upsCollector
+	store      *eventStore
+	audit      *rotatingFile
+	schedules  []*controlSchedule
+
+	mu      sync.Mutex
+	pending map[string]pendingAction // by confirmation
+}
+
+// newController returns nil without an error if no tokens or schedules are
+// configured. Invalid schedules are logged and skipped.
+func newController(cfg ControlConfig, collectors []*upsCollector, store *eventStore) (*controller, error) {
+	if len(cfg.Tokens) == 0 && len(cfg.Schedules) == 0 {
+		return nil, nil
+	}
+	cfg = cfg.withDefaults()
+	cfg.Tokens = slices.Clone(cfg.Tokens)
+	for i, t := range cfg.Tokens {
+		if t.Name == "" {
+			cfg.Tokens[i].Name = fmt.Sprintf("token%d", i+1)
+		}
+		if t.Token == "" {
+			return nil, fmt.Errorf("token %d (%s) is empty", i+1, t.Name)
+		}
+		for _, action := range t.Actions {
+			if !slices.Contains(controlActions, action) {
+				return nil, fmt.Errorf("token %d (%s): unknown action %q", i+1, t.Name, action)
+			}
+		}
+	}
+
+	ctl := &controller{cfg: cfg, collectors: make(map[string]*upsCollector), store: store, pending: make(map[string]pendingAction)}
+	// Targets read by a plugin have no card to control.
+	for _, c := range collectors {
+		if c.Backend == nil {
+			ctl.collectors[c.Target().Name] = c
+		}
+	}
+	if cfg.AuditLog != "" {
+		audit, err := openRotatingFile(cfg.AuditLog, 0, 0)
+		if err != nil {
+			return nil, fmt.Errorf("opening audit log: %w", err)
+		}
+		ctl.audit = audit
+	}
+	for i, sc := range cfg.Schedules {
+		if sc.Name == "" {
+			sc.Name = fmt.Sprintf("schedule%d", i+1)
+		}
+		s, err := ctl.compileSchedule(sc)
+		if err != nil {
+			slog.Warn("Scheduled action disabled", "index", i+1, "name", sc.Name, "err", err)
+			continue
+		}
+		ctl.schedules = append(ctl.schedules, s)
+	}
+	return ctl, nil
+}
+
+func (cfg ControlConfig) withDefaults() ControlConfig {
+	if cfg.OutletPath == "" {
+		cfg.OutletPath = "/outlctrl"
+	}
+	if cfg.OutletConfigPath == "" {
+		cfg.OutletConfigPath = "/outlcfg"
+	}
+	if cfg.DiagnosticsPath == "" {
+		cfg.DiagnosticsPath = "/diagnostics"
+	}
+	if cfg.AlarmPath == "" {
+		cfg.AlarmPath = "/alarms"
+	}
+	if cfg.ResetPath == "" {
+		cfg.ResetPath = "/reset"
+	}
+	return cfg
+}
+
+// register adds the control endpoints to the mux, unless no tokens are configured.
+func (ctl *controller) register(mux *http.ServeMux) {
+	if len(ctl.cfg.Tokens) == 0 {
+		return
+	}
+	mux.Handle("POST /api/v1/outlets/{target}/{group}", ctl.handle(parseOutletRequest, ctl.controlOutletGroup))
+	mux.Handle("GET /api/v1/outlets/{target}/{group}/delays", ctl.handle(parseDelaysReadRequest, ctl.readOutletDelays))
+	mux.Handle("PUT /api/v1/outlets/{target}/{group}/delays", ctl.handle(parseDelaysWriteRequest, ctl.writeOutletDelays))
+	mux.Handle("POST /api/v1/selftest/{target}", ctl.handle(parseSelfTestRequest, ctl.startSelfTest))
+	mux.Handle("POST /api/v1/calibration/{target}", ctl.handle(ctl.parseCalibrationRequest, ctl.controlCalibration))
+	mux.Handle("POST /api/v1/alarms/{target}", ctl.handle(parseAlarmRequest, ctl.controlAlarm))
+	mux.Handle("POST /api/v1/card/{target}/reboot", ctl.handle(parseCardRebootRequest, ctl.rebootCard))
+	mux.Handle("POST /api/v1/confirm/{confirmation}", ctl.confirm())
+}
+
+// Close closes the audit log.
+func (ctl *controller) Close() error {
+	if ctl.audit == nil {
+		return nil
+	}
+	return ctl.audit.Close()
+}
+
+// authorize returns the token presented in the Authorization header, or nil.
+func (ctl *controller) authorize(r *http.Request) *ControlToken {
+	presented, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return nil
+	}
+	for i := range ctl.cfg.Tokens {
+		if subtle.ConstantTimeCompare([]byte(presented), []byte(ctl.cfg.Tokens[i].Token)) == 1 {
+			return &ctl.cfg.Tokens[i]
+		}
+	}
+	return nil
+}
+
+// handle returns a handler for one kind of control request: parse fills in the action
+// from the request, and perform carries it out once the token is found to allow it.
+func (ctl *controller) handle(parse func(*http.Request, *controlRecord) error, perform func(*upsCollector, *controlRecord) error) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := controlRecord{Time: time.Now(), Remote: r.RemoteAddr, Target: r.PathValue("target"), Group: r.PathValue("group")}
+
+		token := ctl.authorize(r)
+		if token == nil {
+			rec.Result = "unauthorized"
+			ctl.record(rec)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		rec.Token = token.Name
+
+		if v := r.URL.Query().Get("dry_run"); v != "" {
+			dryRun, err := strconv.ParseBool(v)
+			if err != nil {
+				rec.Result, rec.Error = "invalid", "invalid dry_run parameter"
+				ctl.record(rec)
+				http.Error(w, "invalid dry_run parameter", http.StatusBadRequest)
+				return
+			}
+			rec.DryRun = dryRun
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, 1<<16)
+		if err := parse(r, &rec); errors.Is(err, errControlDisabled) {
+			rec.Result, rec.Error = "denied", err.Error()
+			ctl.record(rec)
+			http.Error(w, rec.Action+" is "+err.Error(), http.StatusForbidden)
+			return
+		} else if err != nil {
+			rec.Result, rec.Error = "invalid", err.Error()
+			ctl.record(rec)
+			http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		c, ok := ctl.collectors[rec.Target]
+		if !ok {
+			rec.Result = "invalid"
+			ctl.record(rec)
+			http.Error(w, "unknown target", http.StatusNotFound)
+			return
+		}
+		if !allowed(token.Targets, rec.Target) || (rec.Group != "" && !allowed(token.Groups, rec.Group)) || !allowed(token.Actions, rec.Action) {
+			rec.Result = "denied"
+			ctl.record(rec)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		if c.Following() {
+			rec.Result, rec.Error = "unavailable", "not the leader"
+			ctl.record(rec)
+			http.Error(w, "this replica is not the leader, send control requests to "+c.Leader.LeaderURL(), http.StatusServiceUnavailable)
+			return
+		}
+		if rec.destructive && !rec.DryRun {
+			ctl.requestConfirmation(w, rec, perform)
+			return
+		}
+
+		if err := ctl.execute(c, &rec, perform); err != nil {
+			http.Error(w, "control request failed: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rec)
+	})
+}
+
+// execute carries out an authorized request and records its outcome.
+func (ctl *controller) execute(c *upsCollector, rec *controlRecord, perform func(*upsCollector, *controlRecord) error) error {
+	err := perform(c, rec)
+	switch {
+	case err != nil:
+		rec.Result, rec.Error = "error", err.Error()
+	case rec.DryRun:
+		rec.Result = "dry_run"
+	default:
+		rec.Result = "ok"
+	}
+	ctl.record(*rec)
+	return err
+}
+
+func allowed(list []string, value string) bool {
+	return len(list) == 0 || slices.Contains(list, value)
+}
+
+// record writes the request to the log and the audit log. Authenticated requests for
+// known targets and actions are counted, and those that reached the card are added to
+// the event store.
+func (ctl *controller) record(rec controlRecord) {
+	level, attrs := slog.LevelInfo, []any{
+		"token", rec.Token, "remote", rec.Remote, "target", rec.Target, "group", rec.Group,
+		"action", rec.Action, "delayed", rec.Delayed, "dry_run", rec.DryRun, "result", rec.Result,
+	}
+	if rec.Error != "" {
+		level, attrs = slog.LevelError, append(attrs, "err", rec.Error)
+	}
+	slog.Log(context.Background(), level, "Control request", attrs...)
+	if ctl.audit != nil {
+		line, _ := json.Marshal(rec)
+		if _, err := ctl.audit.Write(append(line, '\n')); err != nil {
+			slog.Error("Error writing the control audit log", "err", err)
+		}
+	}
+	if !slices.Contains(controlActions, rec.Action) || rec.Token == "" || ctl.collectors[rec.Target] == nil {
+		return
+	}
+	controlRequests.WithLabelValues(rec.Target, rec.Action, rec.Result).Inc()
+	if (rec.Result != "ok" && rec.Result != "error") || rec.readOnly || rec.DryRun {
+		return
+	}
+
+	message := rec.description + " requested by " + rec.Token
+	if rec.Error != "" {
+		message += " failed: " + rec.Error
+	}
+	ctl.store.add(context.Background(), []event{{Time: rec.Time, Target: rec.Target, Source: "control", Severity: "warning", Category: classifyEvent(rec.description), Message: message}})
+}
+
+// controlForm is a form submitted to a control page of the card, without the session
+// and anti-CSRF fields.
+type controlForm struct {
+	Path   string     `json:"path"`
+	Fields url.Values `json:"fields"`
+}
+
+// submit submits a control form for the request, or in a dry run only loads the page.
+func (ctl *controller) submit(c *upsCollector, rec *controlRecord, path string, fields url.Values) error {
+	rec.Form = &controlForm{Path: path, Fields: fields}
+	return submitControlForm(c, path, fields, rec.DryRun)
+}
+
+// submitControlForm submits a control form of the card with the given fields. A dry
+// run logs in and loads the page, but stops short of submitting the form.
+func submitControlForm(c *upsCollector, path string, fields url.Values, dryRun bool) error {
+	return c.Client().WithPage(context.Background(), path, func(doc *goquery.Document) error {
+		if dryRun {
+			slog.Info("Dry run: control form not submitted", "target", c.Target().Name, "path", path, "fields", fields.Encode())
+			return nil
+		}
+
+		// The form carries the same anti-CSRF tokens as the login page.
+		formToken, _ := doc.Find("input[name=\"formtoken\"]").Attr("value")
+		formTokenID, _ := doc.Find("input[name=\"formtokenid\"]").Attr("value")
+
+		form := url.Values{
+			"formtoken":   {formToken},
+			"formtokenid": {formTokenID},
+			"submit":      {"Apply"},
+		}
+		for k, v := range fields {
+			form[k] = v
+		}
+		// The form is submitted once only, so an action is never carried out twice.
+		res, err := c.Client().PostForm(context.Background(), path, form)
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return fmt.Errorf("status code %d", res.StatusCode)
+		}
+		slog.Info("Control form submitted", "target", c.Target().Name, "path", path, "fields", fields.Encode())
+		return nil
+	})
+}
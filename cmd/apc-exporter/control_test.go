@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/veter2005/apc-exporter/pkg/nmc"
+	"github.com/veter2005/apc-exporter/pkg/nmcsim"
+)
+
+// controlTestForm is the control form of the simulated pages, with the anti-CSRF
+// fields the control API sends back.
+const controlTestForm = `<html><body><form method="post">
+<input type="hidden" name="formtoken" value="ft">
+<input type="hidden" name="formtokenid" value="fid">
+%s<input type="submit" name="submit" value="Apply">
+</form></body></html>`
+
+// controlTestCard is a simulated card that records the control forms posted to it,
+// leaving out the login.
+type controlTestCard struct {
+	sim *nmcsim.Server
+
+	mu     sync.Mutex
+	posts  []controlForm
+	status int // answered to the control forms instead of the page, if set
+}
+
+func (c *controlTestCard) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost && r.URL.Path != nmc.LoginPath {
+		r.ParseForm()
+		c.mu.Lock()
+		c.posts = append(c.posts, controlForm{Path: r.URL.RequestURI(), Fields: r.PostForm})
+		status := c.status
+		c.mu.Unlock()
+		if status != 0 {
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+	}
+	c.sim.ServeHTTP(w, r)
+}
+
+// takePosts returns the forms posted since the last call.
+func (c *controlTestCard) takePosts() []controlForm {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	posts := c.posts
+	c.posts = nil
+	return posts
+}
+
+// controlTest is the control API of two simulated cards, rack-a and rack-b.
+type controlTest struct {
+	ctl   *controller
+	api   *httptest.Server
+	cards map[string]*controlTestCard
+}
+
+// Tokens of the control tests: admin may do anything, outlets may switch outlet group 1
+// of rack-a on and off only, and selftest may start self-tests only.
+var controlTestTokens = []ControlToken{
+	{Name: "admin", Token: "admin-secret"},
+	{Name: "outlets", Token: "outlets-secret", Targets: []string{"rack-a"}, Groups: []string{"1"}, Actions: []string{"on", "off"}},
+	{Name: "selftest", Token: "selftest-secret", Actions: []string{"self_test"}},
+}
+
+func newControlTest(t *testing.T) *controlTest {
+	t.Helper()
+	ct := &controlTest{cards: make(map[string]*controlTestCard)}
+	var collectors []*upsCollector
+	for _, name := range []string{"rack-a", "rack-b"} {
+		sim, err := nmcsim.New(nmcsim.Options{Pages: map[string][]byte{
+			"/outlctrl":              []byte(strings.Replace(controlTestForm, "%s", `<select name="outletgroup"></select>`, 1)),
+			"/outlcfg?outletgroup=1": []byte(strings.Replace(controlTestForm, "%s", `<input name="poweronDelay" value="0"><input name="poweroffDelay" value="90">`, 1)),
+			"/diagnostics":           []byte(strings.Replace(controlTestForm, "%s", `<select name="action"></select>`, 1)),
+		}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		card := &controlTestCard{sim: sim}
+		srv := httptest.NewServer(card)
+		t.Cleanup(srv.Close)
+		ct.cards[name] = card
+
+		target := TargetConfig{Target: nmc.Target{Name: name, URL: srv.URL, Username: "apc", Password: "apc"}}
+		client, err := newTargetHTTPClient(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := newUPSCollector(Config{}, client, target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		collectors = append(collectors, c)
+	}
+
+	ctl, err := newController(ControlConfig{Tokens: controlTestTokens}, collectors, newEventStore(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ct.ctl = ctl
+	mux := http.NewServeMux()
+	ctl.register(mux)
+	ct.api = httptest.NewServer(mux)
+	t.Cleanup(ct.api.Close)
+	return ct
+}
+
+// do sends a control request with the token, if any, and returns the status code and
+// the decoded record, if the API answered with one.
+func (ct *controlTest) do(t *testing.T, token, method, path, body string) (int, controlRecord) {
+	t.Helper()
+	req, err := http.NewRequest(method, ct.api.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rec controlRecord
+	if res.Header.Get("Content-Type") == "application/json" {
+		if err := json.Unmarshal(data, &rec); err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+	}
+	return res.StatusCode, rec
+}
+
+// checkPosts checks that the card of target was posted the forms with the given action
+// fields, in order, and no card any other form.
+func (ct *controlTest) checkPosts(t *testing.T, target string, actions ...string) {
+	t.Helper()
+	for name, card := range ct.cards {
+		posts := card.takePosts()
+		want := []string(nil)
+		if name == target {
+			want = actions
+		}
+		var got []string
+		for _, p := range posts {
+			if p.Fields.Get("formtoken") != "ft" || p.Fields.Get("formtokenid") != "fid" {
+				t.Errorf("%s: form posted to %s without the form tokens of the page: %v", name, p.Path, p.Fields)
+			}
+			got = append(got, p.Fields.Get("action"))
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("%s was posted forms with actions %q, want %q", name, got, want)
+		}
+	}
+}
+
+// TestControlScoping checks that requests are carried out only with a token that allows
+// their target, outlet group and action, each with a single form posted to the card.
+func TestControlScoping(t *testing.T) {
+	ct := newControlTest(t)
+	for _, tc := range []struct {
+		name, token, method, path, body string
+		status                          int
+		target                          string   // whose card is posted to
+		posts                           []string // the action fields posted
+	}{
+		{"no token", "", "POST", "/api/v1/outlets/rack-a/1", `{"action":"on"}`, 401, "", nil},
+		{"unknown token", "guess", "POST", "/api/v1/outlets/rack-a/1", `{"action":"on"}`, 401, "", nil},
+		{"allowed", "outlets-secret", "POST", "/api/v1/outlets/rack-a/1", `{"action":"on"}`, 200, "rack-a", []string{"turnOnImmediate"}},
+		{"allowed delayed", "outlets-secret", "POST", "/api/v1/outlets/rack-a/1", `{"action":"on","delayed":true}`, 200, "rack-a", []string{"turnOnWithDelay"}},
+		{"other target", "outlets-secret", "POST", "/api/v1/outlets/rack-b/1", `{"action":"on"}`, 403, "", nil},
+		{"other group", "outlets-secret", "POST", "/api/v1/outlets/rack-a/2", `{"action":"on"}`, 403, "", nil},
+		{"other action", "outlets-secret", "POST", "/api/v1/outlets/rack-a/1", `{"action":"reboot"}`, 403, "", nil},
+		{"self-test not allowed", "outlets-secret", "POST", "/api/v1/selftest/rack-a", "", 403, "", nil},
+		{"outlets not allowed", "selftest-secret", "POST", "/api/v1/outlets/rack-b/1", `{"action":"on"}`, 403, "", nil},
+		{"self-test", "selftest-secret", "POST", "/api/v1/selftest/rack-b", "", 200, "rack-b", []string{"startSelfTest"}},
+		{"delays", "admin-secret", "PUT", "/api/v1/outlets/rack-a/1/delays", `{"power_on_delay_seconds":30}`, 200, "rack-a", []string{""}},
+		{"delays read", "admin-secret", "GET", "/api/v1/outlets/rack-b/1/delays", "", 200, "", nil},
+		{"unknown target", "admin-secret", "POST", "/api/v1/selftest/rack-c", "", 404, "", nil},
+		{"unknown action", "admin-secret", "POST", "/api/v1/outlets/rack-a/1", `{"action":"toggle"}`, 400, "", nil},
+		{"calibration disabled", "admin-secret", "POST", "/api/v1/calibration/rack-a", `{"action":"start"}`, 403, "", nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			status, rec := ct.do(t, tc.token, tc.method, tc.path, tc.body)
+			if status != tc.status {
+				t.Fatalf("status %d, want %d", status, tc.status)
+			}
+			if status == 200 && rec.Result != "ok" {
+				t.Errorf("result %q, want ok", rec.Result)
+			}
+			ct.checkPosts(t, tc.target, tc.posts...)
+		})
+	}
+
+	// The delays written keep the power off delay the page showed.
+	_, rec := ct.do(t, "admin-secret", "PUT", "/api/v1/outlets/rack-b/1/delays", `{"power_on_delay_seconds":30}`)
+	if rec.Form == nil || rec.Form.Fields.Get("poweronDelay") != "30" || rec.Form.Fields.Get("poweroffDelay") != "90" {
+		t.Errorf("delays form %+v, want a power on delay of 30 and power off delay of 90", rec.Form)
+	}
+	ct.checkPosts(t, "rack-b", "")
+}
+
+// TestControlDryRun checks that a dry run loads the control page but posts nothing,
+// and is not held back for a confirmation even if the action is destructive.
+func TestControlDryRun(t *testing.T) {
+	ct := newControlTest(t)
+	for _, body := range []string{`{"action":"on"}`, `{"action":"off"}`} {
+		status, rec := ct.do(t, "admin-secret", "POST", "/api/v1/outlets/rack-a/2?dry_run=true", body)
+		if status != 200 || rec.Result != "dry_run" || !rec.DryRun || rec.Confirmation != "" {
+			t.Errorf("%s: status %d and record %+v, want a dry run", body, status, rec)
+		}
+		if rec.Form == nil || rec.Form.Path != "/outlctrl" || rec.Form.Fields.Get("outletgroup") != "2" {
+			t.Errorf("%s: dry run form %+v, want outlet group 2 on /outlctrl", body, rec.Form)
+		}
+		ct.checkPosts(t, "")
+	}
+
+	if status, _ := ct.do(t, "admin-secret", "POST", "/api/v1/outlets/rack-a/2?dry_run=perhaps", `{"action":"on"}`); status != 400 {
+		t.Errorf("invalid dry_run: status %d, want 400", status)
+	}
+	// A dry run is still subject to the scope of the token.
+	if status, _ := ct.do(t, "outlets-secret", "POST", "/api/v1/outlets/rack-b/1?dry_run=true", `{"action":"on"}`); status != 403 {
+		t.Errorf("dry run on another target: status %d, want 403", status)
+	}
+	ct.checkPosts(t, "")
+}
+
+// TestControlConfirmation checks that a destructive request is carried out only once it
+// is confirmed, by the token that made it, once, and before the confirmation expires.
+func TestControlConfirmation(t *testing.T) {
+	ct := newControlTest(t)
+	request := func(token string) string {
+		t.Helper()
+		status, rec := ct.do(t, token, "POST", "/api/v1/outlets/rack-a/1", `{"action":"off"}`)
+		if status != 202 || rec.Result != "pending" || rec.Confirmation == "" || rec.ConfirmBy == nil {
+			t.Fatalf("status %d and record %+v, want a pending request", status, rec)
+		}
+		if d := time.Until(*rec.ConfirmBy); d <= 0 || d > confirmationTTL {
+			t.Errorf("confirm by %v, want within %v", rec.ConfirmBy, confirmationTTL)
+		}
+		ct.checkPosts(t, "")
+		return rec.Confirmation
+	}
+	confirm := func(token, confirmation string, want int) {
+		t.Helper()
+		if status, _ := ct.do(t, token, "POST", "/api/v1/confirm/"+confirmation, ""); status != want {
+			t.Errorf("confirmation with %s: status %d, want %d", token, status, want)
+		}
+	}
+
+	confirmation := request("outlets-secret")
+	confirm("", confirmation, 401)
+	confirm("admin-secret", confirmation, 404) // bound to the token that made the request
+	ct.checkPosts(t, "")
+	confirm("outlets-secret", confirmation, 200)
+	ct.checkPosts(t, "rack-a", "turnOffImmediate")
+	confirm("outlets-secret", confirmation, 404) // used up
+	ct.checkPosts(t, "")
+	confirm("outlets-secret", "0123456789abcdef0123456789abcdef", 404)
+
+	confirmation = request("outlets-secret")
+	ct.ctl.mu.Lock()
+	*ct.ctl.pending[confirmation].rec.ConfirmBy = time.Now().Add(-time.Second)
+	ct.ctl.mu.Unlock()
+	confirm("outlets-secret", confirmation, 404)
+	ct.checkPosts(t, "")
+
+	// A card refusing the form is not posted it again.
+	confirmation = request("admin-secret")
+	ct.cards["rack-a"].mu.Lock()
+	ct.cards["rack-a"].status = http.StatusInternalServerError
+	ct.cards["rack-a"].mu.Unlock()
+	confirm("admin-secret", confirmation, 502)
+	ct.checkPosts(t, "rack-a", "turnOffImmediate")
+	confirm("admin-secret", confirmation, 404)
+	ct.checkPosts(t, "")
+}
+
+// TestControlForm checks the form posted for an outlet group, including the fields
+// the API does not set itself.
+func TestControlForm(t *testing.T) {
+	ct := newControlTest(t)
+	if status, _ := ct.do(t, "admin-secret", "POST", "/api/v1/outlets/rack-b/3", `{"action":"on","delayed":true}`); status != 200 {
+		t.Fatalf("status %d, want 200", status)
+	}
+	posts := ct.cards["rack-b"].takePosts()
+	want := url.Values{"formtoken": {"ft"}, "formtokenid": {"fid"}, "submit": {"Apply"}, "outletgroup": {"3"}, "action": {"turnOnWithDelay"}}
+	if len(posts) != 1 || posts[0].Path != "/outlctrl" || posts[0].Fields.Encode() != want.Encode() {
+		t.Errorf("posted %+v, want one form to /outlctrl with %v", posts, want)
+	}
+}
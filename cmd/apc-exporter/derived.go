@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// DerivedMetricConfig defines a gauge computed from other metrics of the same target.
+type DerivedMetricConfig struct {
+	Name    string   `yaml:"name"`
+	Help    string   `yaml:"help"`
+	Expr    string   `yaml:"expr"`
+	Targets []string `yaml:"targets"`
+}
+
+var metricNameRE = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// derivedMetric is a compiled DerivedMetricConfig.
+type derivedMetric struct {
+	DerivedMetricConfig
+	expr      expr
+	collision sync.Once
+}
+
+// newDerivedGatherer wraps a gatherer so that every gather also returns the derived
+// metrics, computed from the values of that same gather. Derivations therefore
+// happen once per poll and never trigger extra scrapes of the cards. It returns the
+// gatherer itself if no derived metrics are configured.
+func newDerivedGatherer(g prometheus.Gatherer, configs []DerivedMetricConfig) prometheus.Gatherer {
+	var metrics []*derivedMetric
+	for i, cfg := range configs {
+		if !strings.HasPrefix(cfg.Name, "ups_") {
+			cfg.Name = "ups_" + cfg.Name
+		}
+		if !metricNameRE.MatchString(cfg.Name) {
+			slog.Warn("Derived metric disabled: invalid name", "index", i+1, "name", cfg.Name)
+			continue
+		}
+		if cfg.Help == "" {
+			cfg.Help = "Derived metric: " + cfg.Expr
+		}
+		e, err := parseExpr(cfg.Expr)
+		if err != nil {
+			slog.Warn("Derived metric disabled", "name", cfg.Name, "err", err)
+			continue
+		}
+		metrics = append(metrics, &derivedMetric{DerivedMetricConfig: cfg, expr: e})
+	}
+	if len(metrics) == 0 {
+		return g
+	}
+
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		mfs, err := g.Gather()
+		if len(mfs) == 0 {
+			return mfs, err
+		}
+		samples, _ := gatherSamples(prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) { return mfs, nil }), "ups_")
+		targets, states := samplesByTarget(samples)
+		collected := make(map[string]bool, len(mfs))
+		for _, mf := range mfs {
+			collected[mf.GetName()] = true
+		}
+		mfs = append(mfs, deriveMetrics(metrics, targets, states, collected)...)
+		sort.Slice(mfs, func(i, j int) bool { return mfs[i].GetName() < mfs[j].GetName() })
+		return mfs, err
+	})
+}
+
+// deriveMetrics evaluates the derived metrics in order for every target, so later
+// ones can build on earlier ones. Besides the target's own metrics, expressions can
+// use sum_, avg_, min_ and max_ of any metric across the targets the derived metric
+// applies to, for example "load_percent / avg_load_percent" to compare the load of
+// parallel units.
+func deriveMetrics(metrics []*derivedMetric, targets []string, states map[string]map[string]float64, collected map[string]bool) []*dto.MetricFamily {
+	var families []*dto.MetricFamily
+	for _, m := range metrics {
+		if collected[m.Name] {
+			m.collision.Do(func() { slog.Warn("Derived metric skipped: a collected metric has the same name", "name", m.Name) })
+			continue
+		}
+		group := targets
+		if len(m.Targets) > 0 {
+			group = slices.DeleteFunc(slices.Clone(targets), func(t string) bool { return !slices.Contains(m.Targets, t) })
+		}
+		aggregates := aggregateStates(group, states)
+
+		mf := &dto.MetricFamily{Name: proto.String(m.Name), Help: proto.String(m.Help), Type: dto.MetricType_GAUGE.Enum()}
+		for _, target := range group {
+			env := make(map[string]float64, len(states[target])+len(aggregates))
+			for k, v := range aggregates {
+				env[k] = v
+			}
+			for k, v := range states[target] {
+				env[k] = v
+			}
+			v, err := m.expr.eval(env)
+			if err != nil {
+				if !errors.Is(err, errUnknownMetric) {
+					slog.Warn("Error deriving a metric", "name", m.Name, "target", target, "err", err)
+				}
+				continue
+			}
+			states[target][m.Name] = v.num
+			mf.Metric = append(mf.Metric, &dto.Metric{
+				Label: []*dto.LabelPair{{Name: proto.String("target"), Value: proto.String(target)}},
+				Gauge: &dto.Gauge{Value: proto.Float64(v.num)},
+			})
+		}
+		if len(mf.Metric) > 0 {
+			families = append(families, mf)
+		}
+	}
+	return families
+}
+
+// aggregateStates computes sum_, avg_, min_ and max_ of every metric, keyed by the
+// metric name without the ups_ prefix, across the given targets.
+func aggregateStates(targets []string, states map[string]map[string]float64) map[string]float64 {
+	aggregates := make(map[string]float64)
+	counts := make(map[string]int)
+	for _, target := range targets {
+		for name, v := range states[target] {
+			name = strings.TrimPrefix(name, "ups_")
+			if counts[name] == 0 {
+				aggregates["min_"+name], aggregates["max_"+name] = v, v
+			}
+			counts[name]++
+			aggregates["sum_"+name] += v
+			aggregates["min_"+name] = min(aggregates["min_"+name], v)
+			aggregates["max_"+name] = max(aggregates["max_"+name], v)
+		}
+	}
+	for name, n := range counts {
+		aggregates["avg_"+name] = aggregates["sum_"+name] / float64(n)
+	}
+	return aggregates
+}
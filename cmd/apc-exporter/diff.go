@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// diffBackend reads the values of one target under the metric names of the web
+// scraper, with the resolution of every value where it is known.
+type diffBackend func(target TargetConfig) (state, resolution map[string]float64, err error)
+
+// runDiffCommand implements the diff command: it reads one target through two
+// backends and prints the values side by side, to check the SNMP OID mappings and
+// catch the web parser drifting after a firmware upgrade. It fails if any value that
+// both backends read differs by more than the tolerance.
+func runDiffCommand(cfg Config, args []string) error {
+	flags := flag.NewFlagSet("diff", flag.ContinueOnError)
+	name := flags.String("target", "", "Name or URL of the target to compare (default the only configured target)")
+	username := flags.String("username", "", "Username to log in with instead of the configured one")
+	password := flags.String("password", "", "Password to log in with instead of the configured one")
+	backendNames := flags.String("backends", "web,snmp", "The two backends to compare, comma-separated: web, snmp")
+	community := flags.String("community", "", "SNMP v2c community of the card (default the target's snmp settings, or public)")
+	snmpAddress := flags.String("snmp-address", "", "host:port of the card's SNMP agent (default the target's snmp settings, or the host of its URL on port 161)")
+	timeout := flags.Duration("timeout", 0, "Time to wait for the SNMP agent (default the target's snmp settings, or 5s)")
+	tolerance := flags.Float64("tolerance", 1, "Largest difference in percent that still matches, on top of the resolution of the values")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	target, err := cardTarget(cfg, *name, *username, *password)
+	if err != nil {
+		return err
+	}
+
+	backends := map[string]diffBackend{
+		"web": func(target TargetConfig) (map[string]float64, map[string]float64, error) {
+			return diffWebBackend(cfg, target)
+		},
+		"snmp": func(target TargetConfig) (map[string]float64, map[string]float64, error) {
+			// The flags given override the SNMP settings of the target.
+			cfg := target.SNMP
+			if *community != "" {
+				cfg.Version, cfg.Community = "2c", *community
+			}
+			if *snmpAddress != "" {
+				cfg.Address = *snmpAddress
+			}
+			if *timeout > 0 {
+				cfg.Timeout = *timeout
+			}
+			client, err := newSNMPClient(cfg, target.URL)
+			if err != nil {
+				return nil, nil, err
+			}
+			state, sources, err := readPowerNetState(client)
+			if err != nil {
+				return nil, nil, err
+			}
+			resolution := make(map[string]float64, len(sources))
+			for metric, obj := range sources {
+				resolution[metric] = obj.scale
+			}
+			return state, resolution, nil
+		},
+	}
+	names := strings.Split(strings.ReplaceAll(*backendNames, " ", ""), ",")
+	if len(names) != 2 || names[0] == names[1] {
+		return fmt.Errorf("-backends needs two different backends, got %q", *backendNames)
+	}
+	var states, resolutions [2]map[string]float64
+	for i, n := range names {
+		backend, ok := backends[n]
+		if !ok {
+			return fmt.Errorf("unknown backend %q, want web or snmp", n)
+		}
+		if states[i], resolutions[i], err = backend(target); err != nil {
+			return fmt.Errorf("%s: %w", n, err)
+		}
+	}
+
+	var metrics []string
+	for _, state := range states {
+		for m := range state {
+			if !slices.Contains(metrics, m) {
+				metrics = append(metrics, m)
+			}
+		}
+	}
+	slices.Sort(metrics)
+
+	fmt.Printf("Comparing %s at %s\n\n", target.Name, target.URL)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "METRIC\t%s\t%s\tDIFF\t\n", strings.ToUpper(names[0]), strings.ToUpper(names[1]))
+	differ := 0
+	for _, m := range metrics {
+		a, okA := states[0][m]
+		b, okB := states[1][m]
+		switch {
+		case !okA:
+			fmt.Fprintf(tw, "%s\t-\t%.6g\t\tonly in %s\n", m, b, names[1])
+		case !okB:
+			fmt.Fprintf(tw, "%s\t%.6g\t-\t\tonly in %s\n", m, a, names[0])
+		default:
+			// Values match within the coarser resolution of the two and the tolerance.
+			allowed := max(resolutions[0][m], resolutions[1][m]) + math.Max(math.Abs(a), math.Abs(b))**tolerance/100
+			verdict := "ok"
+			if math.Abs(a-b) > allowed+1e-9 {
+				verdict = "DIFFERS"
+				differ++
+			}
+			fmt.Fprintf(tw, "%s\t%.6g\t%.6g\t%+.3g\t%s\n", m, a, b, b-a, verdict)
+		}
+	}
+	tw.Flush()
+	if differ > 0 {
+		return fmt.Errorf("%d values differ between %s and %s", differ, names[0], names[1])
+	}
+	return nil
+}
+
+// diffWebBackend scrapes the target's web interface once. The resolution of its
+// values is not known.
+func diffWebBackend(cfg Config, target TargetConfig) (map[string]float64, map[string]float64, error) {
+	target.Backend = "web"
+	httpClient, err := newTargetHTTPClient(target)
+	if err != nil {
+		return nil, nil, err
+	}
+	collector, err := newUPSCollector(cfg, httpClient, target)
+	if err != nil {
+		return nil, nil, err
+	}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collector)
+	samples, err := gatherSamples(registry, "ups_")
+	if err != nil {
+		return nil, nil, err
+	}
+	if !collector.Scraped() {
+		return nil, nil, errors.New("the scrape failed, see the log")
+	}
+	_, states := samplesByTarget(samples)
+	return states[target.Name], nil, nil
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+var (
+	upsBasicIdentModel = mustParseOID("1.3.6.1.4.1.318.1.1.1.1.1.1.0")
+	upsBasicIdentName  = mustParseOID("1.3.6.1.4.1.318.1.1.1.1.1.2.0")
+
+	// cardModelRE finds the model of the card itself in the sysDescr of a card, e.g.
+	// "APC Web/SNMP Management Card (MB:v4.1.0 PF:v6.8.2 … MN:AP9631 HR:05 …)".
+	cardModelRE = regexp.MustCompile(`\bMN:\s*(\S+)`)
+)
+
+// maxDiscoverHosts bounds the size of the networks the discover command scans.
+const maxDiscoverHosts = 1 << 16
+
+// discoveredCard is a card found by the discover command.
+type discoveredCard struct {
+	addr     netip.Addr
+	url      string // the web interface, if found
+	hostname string // from reverse DNS or sysName
+	name     string // the UPS name configured on the card
+	model    string
+	snmp     bool
+}
+
+// runDiscoverCommand implements the discover command: it scans networks for the web
+// interfaces and SNMP agents of management cards and prints a targets section for the
+// config file with the cards found.
+func runDiscoverCommand(args []string) error {
+	flags := flag.NewFlagSet("discover", flag.ContinueOnError)
+	cidrs := flags.String("cidr", "", "Networks to scan, comma-separated, e.g. 10.20.0.0/24")
+	community := flags.String("community", "public", "SNMP community to query the cards with (empty disables SNMP)")
+	timeout := flags.Duration("timeout", 2*time.Second, "Time to wait for every host")
+	concurrency := flags.Int("concurrency", 64, "Number of hosts to probe at once")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *cidrs == "" {
+		return errors.New("-cidr is required")
+	}
+
+	var addrs []netip.Addr
+	for _, cidr := range strings.Split(*cidrs, ",") {
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(cidr))
+		if err != nil {
+			return err
+		}
+		hosts, err := prefixHosts(prefix.Masked())
+		if err != nil {
+			return err
+		}
+		addrs = append(addrs, hosts...)
+	}
+	fmt.Fprintf(os.Stderr, "Scanning %d addresses...\n", len(addrs))
+
+	client := &http.Client{
+		Timeout: *timeout,
+		// Cards come with self-signed certificates.
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+	}
+	var (
+		mu    sync.Mutex
+		cards []discoveredCard
+		wg    sync.WaitGroup
+		slots = make(chan struct{}, max(1, *concurrency))
+	)
+	for _, addr := range addrs {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			if card, ok := probeCard(client, addr, *community, *timeout); ok {
+				mu.Lock()
+				cards = append(cards, card)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	slices.SortFunc(cards, func(a, b discoveredCard) int { return a.addr.Compare(b.addr) })
+	fmt.Fprintf(os.Stderr, "Found %d card(s)\n", len(cards))
+	if len(cards) > 0 {
+		fmt.Print(discoveredTargetsYAML(cards))
+	}
+	return nil
+}
+
+// prefixHosts lists the host addresses of a network, leaving out the network and
+// broadcast addresses of IPv4 networks larger than /31.
+func prefixHosts(prefix netip.Prefix) ([]netip.Addr, error) {
+	bits := prefix.Addr().BitLen() - prefix.Bits()
+	if bits > 16 {
+		return nil, fmt.Errorf("%s has more than %d addresses", prefix, maxDiscoverHosts)
+	}
+	var hosts []netip.Addr
+	for addr := prefix.Addr(); prefix.Contains(addr); addr = addr.Next() {
+		hosts = append(hosts, addr)
+		if !addr.Next().IsValid() {
+			break
+		}
+	}
+	if prefix.Addr().Is4() && bits > 1 {
+		hosts = hosts[1 : len(hosts)-1]
+	}
+	return hosts, nil
+}
+
+// probeCard looks for the web interface and the SNMP agent of a card at addr.
+func probeCard(client *http.Client, addr netip.Addr, community string, timeout time.Duration) (discoveredCard, bool) {
+	card := discoveredCard{addr: addr}
+	host := strings.TrimSuffix(net.JoinHostPort(addr.String(), ""), ":") // brackets IPv6 addresses
+	for _, scheme := range []string{"https", "http"} {
+		if isLogonPage(client, scheme+"://"+host+LOGONPAGEURL) {
+			card.url = scheme + "://" + host
+			break
+		}
+	}
+	if community != "" {
+		card.snmp = probeCardSNMP(&card, community, timeout)
+	}
+	if card.url == "" && !card.snmp {
+		return card, false
+	}
+	if names, err := net.LookupAddr(addr.String()); err == nil && len(names) > 0 {
+		card.hostname = strings.TrimSuffix(names[0], ".")
+	}
+	return card, true
+}
+
+// isLogonPage reports whether url serves the logon form of a card.
+func isLogonPage(client *http.Client, url string) bool {
+	res, err := client.Get(url)
+	if err != nil {
+		return false
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return false
+	}
+	doc, err := goquery.NewDocumentFromReader(res.Body)
+	if err != nil {
+		return false
+	}
+	return doc.Find(`input[name="formtoken"], input[name="j_username"]`).Length() > 0
+}
+
+// probeCardSNMP asks the SNMP agent at the card's address for the system and UPS
+// identification, and reports whether it is an APC agent.
+func probeCardSNMP(card *discoveredCard, community string, timeout time.Duration) bool {
+	vbs, err := snmpGet(net.JoinHostPort(card.addr.String(), "161"), community, timeout,
+		sysDescrOID, sysObjectIDOID, sysNameOID, upsBasicIdentModel, upsBasicIdentName)
+	if err != nil || len(vbs) != 5 {
+		return false
+	}
+	descr := vbs[0].String()
+	objectID, _ := vbs[1].Value.(snmpOID)
+	if !objectID.HasPrefix(powerNetEnterprise) && !strings.Contains(descr, "APC") {
+		return false
+	}
+	if card.hostname == "" {
+		card.hostname = vbs[2].String()
+	}
+	card.model, card.name = vbs[3].String(), vbs[4].String()
+	if card.model == "" {
+		if m := cardModelRE.FindStringSubmatch(descr); m != nil {
+			card.model = m[1]
+		}
+	}
+	return true
+}
+
+// snmpGet sends an SNMPv2c get request for the OIDs and returns the var binds of the
+// response, in the order requested.
+func snmpGet(addr, community string, timeout time.Duration, oids ...snmpOID) ([]snmpVarBind, error) {
+	req := &snmpMessage{Version: snmpV2c, Community: community, PDU: snmpPDU{Type: snmpGetRequest, RequestID: rand.Int32()}}
+	for _, oid := range oids {
+		req.PDU.VarBinds = append(req.PDU.VarBinds, snmpVarBind{OID: oid, Type: snmpNull})
+	}
+	b, err := req.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write(b); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		res, err := unmarshalSNMPMessage(buf[:n])
+		if err != nil || res.PDU.RequestID != req.PDU.RequestID {
+			continue
+		}
+		if res.PDU.ErrorStatus != snmpNoError {
+			return nil, fmt.Errorf("SNMP error status %d", res.PDU.ErrorStatus)
+		}
+		return res.PDU.VarBinds, nil
+	}
+}
+
+// discoveredTargetsYAML renders the cards as the targets section of the config, with
+// placeholders for the credentials.
+func discoveredTargetsYAML(cards []discoveredCard) string {
+	var b strings.Builder
+	b.WriteString("targets:\n")
+	for _, c := range cards {
+		name := c.addr.String()
+		if c.hostname != "" {
+			name, _, _ = strings.Cut(c.hostname, ".")
+		}
+
+		var about []string
+		if c.model != "" {
+			about = append(about, c.model)
+		}
+		if c.name != "" {
+			about = append(about, fmt.Sprintf("%q", c.name))
+		}
+		if c.hostname != "" {
+			about = append(about, c.hostname)
+		}
+		about = append(about, c.addr.String())
+		if c.url == "" {
+			about = append(about, "SNMP only, no web interface found")
+		}
+
+		url := c.url
+		if url == "" {
+			url = "https://" + strings.TrimSuffix(net.JoinHostPort(c.addr.String(), ""), ":")
+		}
+		fmt.Fprintf(&b, "  # %s\n", strings.Join(about, ", "))
+		fmt.Fprintf(&b, "  - name: %q\n", name)
+		fmt.Fprintf(&b, "    ups_url: %q\n", url)
+		b.WriteString("    username: \"apc\"\n")
+		b.WriteString("    password: \"\"\n")
+	}
+	return b.String()
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/veter2005/apc-exporter/pkg/nmc"
+)
+
+// dumpPageLimit bounds the size of a saved page.
+const dumpPageLimit = 4 << 20
+
+var (
+	inputTagRE   = regexp.MustCompile(`(?is)<input\b[^>]*>`)
+	inputValueRE = regexp.MustCompile(`(?is)(\bvalue\s*=\s*)("[^"]*"|'[^']*'|[^\s>]+)`)
+	// secretInputRE matches the inputs whose values are redacted: form tokens,
+	// passwords and user names.
+	secretInputRE = regexp.MustCompile(`(?i)\b(name\s*=\s*["']?(formtoken\w*|j_username|j_password|\w*password\w*)|type\s*=\s*["']?password)\b`)
+)
+
+// runDumpPagesCommand implements the dump-pages command: it logs in to one target and
+// saves the pages the exporter reads, with form tokens and credentials redacted, into
+// a gzipped tarball for bug reports.
+func runDumpPagesCommand(cfg Config, args []string) error {
+	flags := flag.NewFlagSet("dump-pages", flag.ContinueOnError)
+	name := flags.String("target", "", "Name or URL of the target to dump (default the only configured target)")
+	username := flags.String("username", "", "Username to log in with instead of the configured one")
+	password := flags.String("password", "", "Password to log in with instead of the configured one")
+	output := flags.String("o", "", "File to write (default apc-pages-<target>.tar.gz)")
+	aboutPath := flags.String("about-path", nmc.AboutPath, "Path of the card's about page")
+	extra := flags.String("paths", "", "Further paths to save, comma-separated")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	target, err := cardTarget(cfg, *name, *username, *password)
+	if err != nil {
+		return err
+	}
+	if *output == "" {
+		*output = "apc-pages-" + target.Name + ".tar.gz"
+	}
+
+	eventLogPath := cfg.EventLog.Path
+	if eventLogPath == "" {
+		eventLogPath = "/eventlog"
+	}
+	paths := []string{STATUSURL, *aboutPath, nmc.BatteryPath, cfg.Control.withDefaults().DiagnosticsPath, eventLogPath}
+	if *extra != "" {
+		paths = append(paths, strings.Split(*extra, ",")...)
+	}
+
+	httpClient, err := newTargetHTTPClient(target)
+	if err != nil {
+		return err
+	}
+	useRecordings(httpClient, target)
+	client := nmc.NewClient(httpClient, target.Target)
+
+	var pages []dumpedPage
+	// The logon page is saved as served before the login.
+	pages = append(pages, dumpPage(client.HTTPClient(), target, target.URL, LOGONPAGEURL))
+	if err := client.Login(context.Background()); err != nil {
+		return fmt.Errorf("login: %w", err)
+	}
+	// The other pages are loaded in the session, below its path on cards that have one.
+	base := client.PageURL("")
+	for _, path := range paths {
+		pages = append(pages, dumpPage(client.HTTPClient(), target, base, strings.TrimSpace(path)))
+	}
+
+	f, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	if err := writeDumpArchive(f, target, pages); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	fmt.Printf("Saved %d pages of %s to %s; please check it for anything else you do not want to share before attaching it\n", len(pages), target.Name, *output)
+	return nil
+}
+
+// dumpedPage is a page saved by the dump-pages command.
+type dumpedPage struct {
+	path     string
+	finalURL string // after redirects, without the card's address
+	status   string
+	header   http.Header
+	body     []byte
+	err      error
+}
+
+func dumpPage(client *http.Client, target TargetConfig, base, path string) dumpedPage {
+	page := dumpedPage{path: path}
+	res, err := client.Get(base + path)
+	if err != nil {
+		page.err = err
+		return page
+	}
+	defer res.Body.Close()
+	page.status, page.header = res.Status, res.Header
+	page.finalURL = strings.TrimPrefix(res.Request.URL.String(), strings.TrimSuffix(target.URL, "/"))
+	body, err := io.ReadAll(io.LimitReader(res.Body, dumpPageLimit))
+	page.body, page.err = redactPage(body, target), err
+	return page
+}
+
+// redactPage blanks the values of form token, user name and password inputs, and
+// the target's password wherever else it appears.
+func redactPage(body []byte, target TargetConfig) []byte {
+	body = inputTagRE.ReplaceAllFunc(body, func(tag []byte) []byte {
+		if !secretInputRE.Match(tag) {
+			return tag
+		}
+		return inputValueRE.ReplaceAll(tag, []byte(`${1}"REDACTED"`))
+	})
+	if target.Password != "" {
+		body = bytes.ReplaceAll(body, []byte(target.Password), []byte("REDACTED"))
+	}
+	return body
+}
+
+// writeDumpArchive writes the pages and a manifest describing them as a gzipped tar.
+func writeDumpArchive(w io.Writer, target TargetConfig, pages []dumpedPage) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	now := time.Now()
+	add := func(name string, data []byte) error {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(data)), ModTime: now}); err != nil {
+			return err
+		}
+		_, err := tw.Write(data)
+		return err
+	}
+
+	var manifest strings.Builder
+	fmt.Fprintf(&manifest, "%s\nTarget: %s\nSaved: %s\n\n", versionString(), target.Name, now.UTC().Format(time.RFC3339))
+	for i, p := range pages {
+		file := fmt.Sprintf("%02d%s.html", i+1, strings.NewReplacer("/", "_", "?", "_", "&", "_").Replace(p.path))
+		fmt.Fprintf(&manifest, "%s: GET %s", file, p.path)
+		if p.status != "" {
+			fmt.Fprintf(&manifest, " -> %s at %s, %s, %d bytes", p.status, p.finalURL, p.header.Get("Content-Type"), len(p.body))
+		}
+		if p.err != nil {
+			fmt.Fprintf(&manifest, " (error: %v)", p.err)
+		}
+		manifest.WriteString("\n")
+		if p.body != nil {
+			if err := add(file, p.body); err != nil {
+				return err
+			}
+		}
+	}
+	if err := add("MANIFEST.txt", []byte(manifest.String())); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/smtp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EmailConfig holds the settings for sending transition notifications by email.
+type EmailConfig struct {
+	SMTPServer         string   `yaml:"smtp_server"`
+	TLS                string   `yaml:"tls"`
+	Username           string   `yaml:"username"`
+	Password           string   `yaml:"password"`
+	From               string   `yaml:"from"`
+	To                 []string `yaml:"to"`
+	Conditions         []string `yaml:"conditions"`
+	SubjectPrefix      string   `yaml:"subject_prefix"`
+	InsecureSkipVerify bool     `yaml:"insecure_skip_verify"`
+}
+
+// newEmailNotifier returns a notifier that mails the transitions of the configured
+// conditions (all of them if none are configured). It returns nil if no SMTP server
+// is configured.
+func newEmailNotifier(cfg EmailConfig) (transitionNotifier, error) {
+	if cfg.SMTPServer == "" {
+		return nil, nil
+	}
+	if len(cfg.To) == 0 || cfg.From == "" {
+		return nil, fmt.Errorf("from and to are required")
+	}
+	if _, _, err := net.SplitHostPort(cfg.SMTPServer); err != nil {
+		cfg.SMTPServer = net.JoinHostPort(cfg.SMTPServer, "25")
+	}
+	if cfg.TLS == "" {
+		cfg.TLS = "starttls"
+		if _, port, _ := net.SplitHostPort(cfg.SMTPServer); port == "465" {
+			cfg.TLS = "tls"
+		}
+	}
+	switch cfg.TLS {
+	case "starttls", "tls", "none":
+	default:
+		return nil, fmt.Errorf("unsupported tls mode %q (use starttls, tls or none)", cfg.TLS)
+	}
+	if cfg.SubjectPrefix == "" {
+		cfg.SubjectPrefix = "[UPS]"
+	}
+
+	return func(ctx context.Context, tr transition) error {
+		if len(cfg.Conditions) > 0 && !slices.Contains(cfg.Conditions, tr.Condition) {
+			return nil
+		}
+		return sendEmail(ctx, cfg, emailMessage(cfg, tr))
+	}, nil
+}
+
+// emailMessage renders a plain-text message describing the transition.
+func emailMessage(cfg EmailConfig, tr transition) []byte {
+	state := "cleared"
+	if tr.Active {
+		state = "set"
+	}
+	id := make([]byte, 12)
+	rand.Read(id)
+	host := cfg.From[strings.LastIndex(cfg.From, "@")+1:]
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", cfg.From)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(cfg.To, ", "))
+	fmt.Fprintf(&b, "Subject: %s %s: %s -> %s\r\n", cfg.SubjectPrefix, tr.Target, tr.From, tr.To)
+	fmt.Fprintf(&b, "Date: %s\r\n", tr.Time.Format(time.RFC1123Z))
+	fmt.Fprintf(&b, "Message-ID: <%s@%s>\r\n", hex.EncodeToString(id), host)
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	fmt.Fprintf(&b, "The %s condition of %s was %s at %s.\r\n", tr.Condition, tr.Target, state, tr.Time.Format(time.RFC3339))
+	fmt.Fprintf(&b, "State: %s -> %s\r\n\r\n", tr.From, tr.To)
+
+	names := make([]string, 0, len(tr.Metrics))
+	for name := range tr.Metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s: %s\r\n", name, strconv.FormatFloat(tr.Metrics[name], 'f', -1, 64))
+	}
+	return []byte(b.String())
+}
+
+// sendEmail delivers the message over SMTP. With "starttls" the connection is
+// upgraded if the server offers it; authentication is only attempted over TLS.
+func sendEmail(ctx context.Context, cfg EmailConfig, msg []byte) error {
+	host, _, _ := net.SplitHostPort(cfg.SMTPServer)
+	tlsConfig := &tls.Config{ServerName: host, InsecureSkipVerify: cfg.InsecureSkipVerify}
+
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	var conn net.Conn
+	var err error
+	if cfg.TLS == "tls" {
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: tlsConfig}).DialContext(ctx, "tcp", cfg.SMTPServer)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", cfg.SMTPServer)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if cfg.TLS == "starttls" {
+		if ok, _ := client.Extension("STARTTLS"); ok {
+			if err := client.StartTLS(tlsConfig); err != nil {
+				return err
+			}
+		}
+	}
+	if cfg.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", cfg.Username, cfg.Password, host)); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(cfg.From); err != nil {
+		return err
+	}
+	for _, to := range cfg.To {
+		if err := client.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// EnergyConfig holds the settings for deriving energy, cost and carbon counters from
+// the output energy the UPS counts or, where it counts none, the output power.
+type EnergyConfig struct {
+	Enabled           bool               `yaml:"enabled"`
+	Interval          time.Duration      `yaml:"interval"`
+	PricePerKWh       float64            `yaml:"price_per_kwh"`
+	CO2GramsPerKWh    float64            `yaml:"co2_grams_per_kwh"`
+	Schedule          []EnergyRate       `yaml:"schedule"`
+	RatedWatts        map[string]float64 `yaml:"rated_watts"`
+	DefaultRatedWatts float64            `yaml:"default_rated_watts"`
+}
+
+// EnergyRate overrides the static price and carbon intensity for the local hours
+// [From, To); a range may wrap around midnight. Unset values keep the static ones.
+type EnergyRate struct {
+	From           int      `yaml:"from"`
+	To             int      `yaml:"to"`
+	PricePerKWh    *float64 `yaml:"price_per_kwh"`
+	CO2GramsPerKWh *float64 `yaml:"co2_grams_per_kwh"`
+}
+
+// rates returns the price and carbon intensity in effect at t.
+func (c EnergyConfig) rates(t time.Time) (price, co2 float64) {
+	price, co2 = c.PricePerKWh, c.CO2GramsPerKWh
+	hour := t.Hour()
+	for _, r := range c.Schedule {
+		in := hour >= r.From && hour < r.To
+		if r.From > r.To {
+			in = hour >= r.From || hour < r.To
+		}
+		if !in {
+			continue
+		}
+		if r.PricePerKWh != nil {
+			price = *r.PricePerKWh
+		}
+		if r.CO2GramsPerKWh != nil {
+			co2 = *r.CO2GramsPerKWh
+		}
+		break
+	}
+	return price, co2
+}
+
+// energyMeter follows the output energy of each target, as counted by the UPS where it
+// exports ups_output_energy_kwh and else integrated from the output power over time,
+// and exposes the resulting energy, cost and carbon counters.
+type energyMeter struct {
+	cfg EnergyConfig
+
+	energyDesc *prometheus.Desc
+	costDesc   *prometheus.Desc
+	co2Desc    *prometheus.Desc
+
+	mu     sync.Mutex
+	last   map[string]energyReading
+	energy map[string]float64
+	cost   map[string]float64
+	co2    map[string]float64
+}
+
+type energyReading struct {
+	time    time.Time
+	watts   float64
+	kwh     float64 // of the UPS's energy counter, if metered
+	metered bool
+}
+
+// energyTotals are the counters of a target as kept in the state store, with the
+// reading of the UPS's energy counter they were last updated from, if any.
+type energyTotals struct {
+	WattHours float64  `json:"watt_hours"`
+	Cost      float64  `json:"cost"`
+	CO2Grams  float64  `json:"co2_grams"`
+	MeterKWh  *float64 `json:"meter_kwh,omitempty"`
+}
+
+// newEnergyMeter returns a meter for the config, or nil if it is not enabled.
+func newEnergyMeter(cfg EnergyConfig) *energyMeter {
+	if !cfg.Enabled {
+		return nil
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = 15 * time.Second
+	}
+	return &energyMeter{
+		cfg:        cfg,
+		energyDesc: prometheus.NewDesc("ups_energy_output_watt_hours_total", "Output energy delivered, as counted by the UPS or else integrated from the output power, in watt hours.", []string{"target"}, nil),
+		costDesc:   prometheus.NewDesc("ups_energy_cost_total", "Cost of the output energy at the configured electricity price.", []string{"target"}, nil),
+		co2Desc:    prometheus.NewDesc("ups_energy_co2_grams_total", "Carbon emissions of the output energy at the configured carbon intensity, in grams.", []string{"target"}, nil),
+		last:       make(map[string]energyReading),
+		energy:     make(map[string]float64),
+		cost:       make(map[string]float64),
+		co2:        make(map[string]float64),
+	}
+}
+
+// takeOver continues the counters of the targets kept by a reload from the meter it
+// replaces, so they do not reset.
+func (m *energyMeter) takeOver(old *energyMeter, targets []string) {
+	old.mu.Lock()
+	defer old.mu.Unlock()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, target := range targets {
+		if wh, ok := old.energy[target]; ok {
+			m.last[target] = old.last[target]
+			m.energy[target], m.cost[target], m.co2[target] = wh, old.cost[target], old.co2[target]
+		}
+	}
+}
+
+// Describe sends the descriptors of the counters to the provided channel.
+func (m *energyMeter) Describe(ch chan<- *prometheus.Desc) {
+	ch <- m.energyDesc
+	ch <- m.costDesc
+	ch <- m.co2Desc
+}
+
+// Collect sends the current counter values to the provided channel.
+func (m *energyMeter) Collect(ch chan<- prometheus.Metric) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for target, wh := range m.energy {
+		ch <- prometheus.MustNewConstMetric(m.energyDesc, prometheus.CounterValue, wh, target)
+		ch <- prometheus.MustNewConstMetric(m.costDesc, prometheus.CounterValue, m.cost[target], target)
+		ch <- prometheus.MustNewConstMetric(m.co2Desc, prometheus.CounterValue, m.co2[target], target)
+	}
+}
+
+// run samples the output energy or power on every interval until the context is
+// cancelled. With a state store, the counters are restored at startup and saved after
+// every sample, so they survive restarts.
+func (m *energyMeter) run(ctx context.Context, gatherer prometheus.Gatherer, state *stateStore) {
+	gatherer = gatherWithin(gatherer, m.cfg.Interval)
+	if state != nil {
+		var restored map[string]energyTotals
+		if _, err := state.load("energy", &restored); err != nil {
+			slog.Error("Error restoring the energy counters", "err", err)
+		}
+		m.restore(restored)
+	}
+	slog.Info("Metering output energy", "interval", m.cfg.Interval)
+	ticker := time.NewTicker(m.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			if err := m.sample(gatherer, now); err != nil {
+				slog.Error("Error gathering metrics for energy metering", "err", err)
+				continue
+			}
+			if state != nil {
+				if err := state.save("energy", m.totals()); err != nil {
+					slog.Error("Error saving the energy counters", "err", err)
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// sample reads the energy counter or the output power of every target and adds the
+// energy since the previous reading. The counter is taken as it is, and a lower reading
+// than the last, after a reset of the UPS's counter, adds nothing. The power is
+// integrated with the trapezoidal rule, and gaps longer than five intervals, e.g. while
+// the exporter was stalled, are not counted.
+func (m *energyMeter) sample(gatherer prometheus.Gatherer, now time.Time) error {
+	samples, err := gatherSamples(gatherer, "ups_")
+	if err != nil {
+		return err
+	}
+	targets, states := samplesByTarget(samples)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, target := range targets {
+		kwh, metered := states[target]["ups_output_energy_kwh"]
+		watts, ok := m.outputWatts(target, states[target])
+		if !metered && !ok {
+			continue
+		}
+		if _, seen := m.energy[target]; !seen {
+			m.energy[target], m.cost[target], m.co2[target] = 0, 0, 0
+		}
+
+		var wh float64
+		if last, ok := m.last[target]; ok {
+			switch elapsed := now.Sub(last.time); {
+			case metered && last.metered:
+				if kwh > last.kwh {
+					wh = (kwh - last.kwh) * 1000
+				}
+			case !metered && !last.metered && elapsed > 0 && elapsed <= 5*m.cfg.Interval:
+				wh = (last.watts + watts) / 2 * elapsed.Hours()
+			}
+		}
+		price, co2 := m.cfg.rates(now)
+		m.energy[target] += wh
+		m.cost[target] += wh / 1000 * price
+		m.co2[target] += wh / 1000 * co2
+		m.last[target] = energyReading{time: now, watts: watts, kwh: kwh, metered: metered}
+	}
+	return nil
+}
+
+// totals returns the counters of the targets to be saved.
+func (m *energyMeter) totals() map[string]energyTotals {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	totals := make(map[string]energyTotals, len(m.energy))
+	for target, wh := range m.energy {
+		t := energyTotals{WattHours: wh, Cost: m.cost[target], CO2Grams: m.co2[target]}
+		if last := m.last[target]; last.metered {
+			t.MeterKWh = &last.kwh
+		}
+		totals[target] = t
+	}
+	return totals
+}
+
+// restore continues the saved counters of the targets the meter has none of yet, such
+// as those not taken over from the meter replaced by a reload. The energy the UPS
+// counted while the exporter was down is added with the next sample.
+func (m *energyMeter) restore(totals map[string]energyTotals) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for target, t := range totals {
+		if _, ok := m.energy[target]; ok {
+			continue
+		}
+		m.energy[target], m.cost[target], m.co2[target] = t.WattHours, t.Cost, t.CO2Grams
+		if t.MeterKWh != nil {
+			m.last[target] = energyReading{kwh: *t.MeterKWh, metered: true}
+		}
+	}
+}
+
+// ratedWatts returns the real power rating of a target, or 0 if unknown.
+func (c EnergyConfig) ratedWatts(target string) float64 {
+	if rated := c.RatedWatts[target]; rated != 0 {
+		return rated
+	}
+	return c.DefaultRatedWatts
+}
+
+// outputWatts derives the output power from the load in percent of the rated real
+// power when the rating is known, and otherwise approximates it as output voltage
+// times load current (assuming a power factor of 1).
+func (m *energyMeter) outputWatts(target string, state map[string]float64) (float64, bool) {
+	rated := m.cfg.ratedWatts(target)
+	if load, ok := state["ups_load_percent"]; ok && rated > 0 {
+		return load / 100 * rated, true
+	}
+	volts, okV := state["ups_output_voltage_vac"]
+	amps, okA := state["ups_load_current_amps"]
+	if okV && okA {
+		return volts * amps, true
+	}
+	return 0, false
+}
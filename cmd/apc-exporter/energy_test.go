@@ -0,0 +1,70 @@
+package main
+
+import (
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// TestEnergyMeter checks that the energy is taken from the UPS's counter where it has
+// one and integrated from the output power otherwise, and that the counters continue
+// from the state store.
+func TestEnergyMeter(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	counted := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "ups_output_energy_kwh", Help: "Output energy the UPS counted in kilowatt hours."}, []string{"target"})
+	load := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "ups_load_percent", Help: "Output load in percent."}, []string{"target"})
+	reg.MustRegister(counted, load)
+	// rack-a counts its energy, rack-b has only a power rating.
+	load.WithLabelValues("rack-a").Set(50)
+	load.WithLabelValues("rack-b").Set(50)
+	cfg := EnergyConfig{Enabled: true, Interval: time.Minute, PricePerKWh: 0.5, RatedWatts: map[string]float64{"rack-a": 1200, "rack-b": 1200}}
+
+	m := newEnergyMeter(cfg)
+	now := historyTestTime
+	for _, kwh := range []float64{100, 100.2, 100.5, 3, 3.1} { // reset to 3 after 100.5
+		counted.WithLabelValues("rack-a").Set(kwh)
+		if err := m.sample(reg, now); err != nil {
+			t.Fatal(err)
+		}
+		now = now.Add(time.Minute)
+	}
+	// 200 + 300 + 100 Wh counted, 4 minutes at 600 W integrated.
+	want := map[string]float64{"rack-a": 600, "rack-b": 40}
+	for target, wh := range want {
+		if got := m.energy[target]; math.Abs(got-wh) > 1e-6 {
+			t.Errorf("%s: %g Wh, want %g", target, got, wh)
+		}
+	}
+	if got := m.cost["rack-a"]; math.Abs(got-0.3) > 1e-9 {
+		t.Errorf("rack-a cost %g, want 0.3", got)
+	}
+
+	state, err := openStateStore(StateConfig{Path: filepath.Join(t.TempDir(), "state.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.Close()
+	if err := state.save("energy", m.totals()); err != nil {
+		t.Fatal(err)
+	}
+	var saved map[string]energyTotals
+	if _, err := state.load("energy", &saved); err != nil {
+		t.Fatal(err)
+	}
+	restarted := newEnergyMeter(cfg)
+	restarted.restore(saved)
+	// rack-a counted 400 Wh while the exporter was down.
+	counted.WithLabelValues("rack-a").Set(3.5)
+	if err := restarted.sample(reg, now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	want = map[string]float64{"rack-a": 1000, "rack-b": 40}
+	for target, wh := range want {
+		if got := restarted.energy[target]; math.Abs(got-wh) > 1e-6 {
+			t.Errorf("%s after the restart: %g Wh, want %g", target, got, wh)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// EventLogConfig holds the settings for scraping the event log of every target.
+type EventLogConfig struct {
+	Enabled  bool          `yaml:"enabled"`
+	Path     string        `yaml:"path"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+var (
+	eventLogDate = regexp.MustCompile(`^\d{2}/\d{2}/\d{4}$`)
+	eventLogTime = regexp.MustCompile(`^\d{2}:\d{2}:\d{2}$`)
+)
+
+// eventLogSeverities maps the severity column values used by the cards to the
+// severity label values.
+var eventLogSeverities = map[string]string{
+	"informational": "info",
+	"information":   "info",
+	"info":          "info",
+	"warning":       "warning",
+	"severe":        "critical",
+	"critical":      "critical",
+}
+
+// runEventLog polls the event log of every collector's target on each interval
+// until the context is cancelled and adds the new entries to the event store. The
+// first poll of a target adds its whole log, less the entries restored from the state
+// store. It returns immediately if the event log is not enabled.
+func runEventLog(ctx context.Context, cfg EventLogConfig, collectors []*upsCollector, store *eventStore) {
+	if !cfg.Enabled {
+		return
+	}
+	if cfg.Path == "" {
+		cfg.Path = "/eventlog"
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = time.Minute
+	}
+
+	// newest remembers the time of the newest entry seen per target; the log has a
+	// one second resolution, so lines at exactly that time are remembered as well.
+	// Both start from the stored events, which survive restarts with a state store.
+	newest := make(map[string]time.Time)
+	seenAtNewest := make(map[string]map[string]bool)
+	for _, c := range collectors {
+		newest[c.Target().Name], seenAtNewest[c.Target().Name] = store.newest(c.Target().Name, "eventlog")
+	}
+
+	poll := func() {
+		for _, c := range collectors {
+			if c.Following() || c.Backend != nil {
+				continue
+			}
+			entries, err := fetchEventLog(ctx, c, cfg.Path)
+			if err != nil {
+				logStage(priorityErr, c.Target().Name, "eventlog", "Error scraping event log of %s: %v", c.Target().Name, err)
+				continue
+			}
+
+			var fresh []event
+			last, seen := newest[c.Target().Name], seenAtNewest[c.Target().Name]
+			for _, e := range entries {
+				if e.Time.Before(last) || (e.Time.Equal(last) && seen[e.Raw]) {
+					continue
+				}
+				fresh = append(fresh, e)
+			}
+			for _, e := range fresh {
+				if e.Time.After(newest[c.Target().Name]) {
+					newest[c.Target().Name] = e.Time
+					seenAtNewest[c.Target().Name] = make(map[string]bool)
+				}
+				if e.Time.Equal(newest[c.Target().Name]) {
+					seenAtNewest[c.Target().Name][e.Raw] = true
+				}
+			}
+			store.add(ctx, fresh)
+		}
+	}
+
+	slog.Info("Scraping the event log", "path", cfg.Path, "interval", cfg.Interval)
+	poll()
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			poll()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// fetchEventLog downloads and parses the target's event log page, logging in again
+// if the session has expired. Entries are returned oldest first.
+func fetchEventLog(ctx context.Context, c *upsCollector, path string) ([]event, error) {
+	var entries []event
+	err := c.Client().WithPage(ctx, path, func(doc *goquery.Document) error {
+		entries = parseEventLog(c.Target().Name, doc)
+		return nil
+	})
+	return entries, err
+}
+
+// parseEventLog extracts the rows of the event log table. Each row has a date
+// (MM/DD/YYYY) and a time cell followed by the event text, optionally with a
+// severity column; rows without a recognisable date are skipped.
+func parseEventLog(target string, doc *goquery.Document) []event {
+	var entries []event
+	doc.Find("tr").Each(func(_ int, row *goquery.Selection) {
+		var cells []string
+		row.Find("td").Each(func(_ int, cell *goquery.Selection) {
+			if text := strings.Join(strings.Fields(cell.Text()), " "); text != "" {
+				cells = append(cells, text)
+			}
+		})
+
+		entry := event{Target: target, Source: "eventlog", Severity: "info"}
+		var date, clock string
+		var message []string
+		for _, cell := range cells {
+			switch {
+			case date == "" && eventLogDate.MatchString(cell):
+				date = cell
+			case clock == "" && eventLogTime.MatchString(cell):
+				clock = cell
+			default:
+				if severity, ok := eventLogSeverities[strings.ToLower(cell)]; ok {
+					entry.Severity = severity
+				} else {
+					message = append(message, cell)
+				}
+			}
+		}
+		if date == "" || len(message) == 0 {
+			return
+		}
+		if clock == "" {
+			clock = "00:00:00"
+		}
+		t, err := time.ParseInLocation("01/02/2006 15:04:05", date+" "+clock, time.Local)
+		if err != nil {
+			return
+		}
+		entry.Time = t
+		entry.Message = strings.Join(message, " ")
+		entry.Category = classifyEvent(entry.Message)
+		entry.Raw = strings.Join(cells, " ")
+		entries = append(entries, entry)
+	})
+
+	// The cards list the newest entry first.
+	if len(entries) > 1 && entries[0].Time.After(entries[len(entries)-1].Time) {
+		for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+			entries[i], entries[j] = entries[j], entries[i]
+		}
+	}
+	return entries
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// maxStoredEvents is the number of most recent events kept per target for the API.
+const maxStoredEvents = 1000
+
+// event is a structured UPS event, whatever source it came from.
+type event struct {
+	Time     time.Time `json:"timestamp"`
+	Target   string    `json:"target"`
+	Source   string    `json:"source"`
+	Severity string    `json:"severity"`
+	Category string    `json:"category"`
+	Message  string    `json:"message"`
+
+	// Raw is the event as received, e.g. the full event log row.
+	Raw string `json:"-"`
+}
+
+// eventSink receives every batch of new events.
+type eventSink func(ctx context.Context, events []event) error
+
+// eventCategories classifies events by keywords in their message, checked in order.
+var eventCategories = []struct {
+	category string
+	keywords []string
+}{
+	{"security", []string{"logged in", "logged out", "login", "log on", "password", "authentication", "security", "unauthorized"}},
+	{"power", []string{"on battery power", "no longer on battery"}},
+	{"battery", []string{"battery", "self-test", "self test", "runtime calibration"}},
+	{"network", []string{"network", "ethernet", "dhcp", "ip address", "email", "smtp", "snmp", "ftp", "web server", "link"}},
+	{"power", []string{"power", "voltage", "frequency", "overload", "load", "input", "output", "utility", "bypass", "outlet"}},
+}
+
+// classifyEvent returns the category of an event message: security, power, battery,
+// network or, if nothing matches, system.
+func classifyEvent(message string) string {
+	lower := strings.ToLower(message)
+	for _, c := range eventCategories {
+		for _, keyword := range c.keywords {
+			if strings.Contains(lower, keyword) {
+				return c.category
+			}
+		}
+	}
+	return "system"
+}
+
+// eventQueueSize is the number of batches of events that may wait for the sinks.
+const eventQueueSize = 256
+
+// eventStore keeps the most recent events per target, counts them and forwards them
+// to the configured sinks.
+type eventStore struct {
+	sinks []eventSink
+	queue chan []event // batches waiting for the sinks, nil without sinks
+	state *stateStore  // optional persistence
+
+	mu     sync.RWMutex
+	events map[string][]event // per target, oldest first
+}
+
+func newEventStore(sinks []eventSink) *eventStore {
+	s := &eventStore{sinks: sinks, events: make(map[string][]event)}
+	if len(sinks) > 0 {
+		s.queue = make(chan []event, eventQueueSize)
+	}
+	return s
+}
+
+// eventLogEntries counts the entries read from the card event logs per category.
+var eventLogEntries = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "ups_event_log_entries_total",
+	Help: "Number of event log entries read from the card, by category.",
+}, []string{"target", "category"})
+
+// eventsTotal counts the events of all sources by category and severity.
+var eventsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "ups_events_total",
+	Help: "Number of events received from the card event logs, traps, syslog and transitions, by category and severity.",
+}, []string{"target", "category", "severity"})
+
+// eventsDropped counts the events not forwarded because the sinks fell behind.
+var eventsDropped = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "apc_exporter_events_dropped_total",
+	Help: "Number of events not forwarded to the event sinks because too many were waiting for them.",
+})
+
+// add stores the events and queues them for the sinks. If the queue is full, as while
+// a sink is unreachable, the events are not forwarded, so that the sources never wait
+// for the sinks.
+func (s *eventStore) add(_ context.Context, events []event) {
+	if len(events) == 0 {
+		return
+	}
+
+	s.mu.Lock()
+	for _, e := range events {
+		stored := append(s.events[e.Target], e)
+		if len(stored) > maxStoredEvents {
+			stored = append([]event(nil), stored[len(stored)-maxStoredEvents:]...)
+		}
+		s.events[e.Target] = stored
+		eventsTotal.WithLabelValues(e.Target, e.Category, e.Severity).Inc()
+		if e.Source == "eventlog" {
+			eventLogEntries.WithLabelValues(e.Target, e.Category).Inc()
+		}
+	}
+	s.mu.Unlock()
+
+	if s.state != nil {
+		if err := s.state.saveEvents(events); err != nil {
+			slog.Error("Error persisting events", "target", events[0].Target, "err", err)
+		}
+	}
+	if s.queue != nil {
+		select {
+		case s.queue <- events:
+		default:
+			eventsDropped.Add(float64(len(events)))
+			slog.Warn("Event sinks fell behind, dropping events", "target", events[0].Target, "count", len(events))
+		}
+	}
+}
+
+// forward hands the queued events to the sinks, one batch at a time, until the context
+// is cancelled.
+func (s *eventStore) forward(ctx context.Context) {
+	for {
+		select {
+		case events := <-s.queue:
+			for _, sink := range s.sinks {
+				if err := sink(ctx, events); err != nil {
+					slog.Warn("Error forwarding events", "target", events[0].Target, "err", err)
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// restore loads the events persisted in state and persists all new events there.
+// Restored events are neither counted nor forwarded to the sinks again.
+func (s *eventStore) restore(state *stateStore) error {
+	events, err := state.loadEvents()
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range events {
+		s.events[e.Target] = append(s.events[e.Target], e)
+	}
+	s.state = state
+	return nil
+}
+
+// takeOver keeps the events of the store a reload replaces, and persists new events
+// where it did. They are neither counted nor forwarded to the sinks again.
+func (s *eventStore) takeOver(old *eventStore) {
+	old.mu.RLock()
+	defer old.mu.RUnlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for target, events := range old.events {
+		s.events[target] = slices.Clone(events)
+	}
+	s.state = old.state
+}
+
+// all returns the stored events of all targets.
+func (s *eventStore) all() []event {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var events []event
+	for _, stored := range s.events {
+		events = append(events, stored...)
+	}
+	return events
+}
+
+// newest returns the time of the newest stored event of a target from a source and
+// the raw form of the events at exactly that time.
+func (s *eventStore) newest(target, source string) (time.Time, map[string]bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var newest time.Time
+	raw := make(map[string]bool)
+	for _, e := range s.events[target] {
+		if e.Source != source || e.Time.Before(newest) {
+			continue
+		}
+		if e.Time.After(newest) {
+			newest = e.Time
+			clear(raw)
+		}
+		raw[e.Raw] = true
+	}
+	return newest, raw
+}
+
+// ServeHTTP implements /api/v1/events?target=...&severity=...&category=...&source=...&since=...&limit=...,
+// returning the matching events newest first. limit defaults to 100.
+func (s *eventStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	since, err := parseHistoryTime(q.Get("since"), time.Time{})
+	if err != nil {
+		http.Error(w, "invalid since parameter: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit := 100
+	if v := q.Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 {
+			http.Error(w, "invalid limit parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	matches := func(param, value string) bool {
+		return q.Get(param) == "" || q.Get(param) == value
+	}
+
+	s.mu.RLock()
+	var result []event
+	for target, events := range s.events {
+		if !matches("target", target) {
+			continue
+		}
+		for _, e := range events {
+			if e.Time.Before(since) || !matches("severity", e.Severity) || !matches("category", e.Category) || !matches("source", e.Source) {
+				continue
+			}
+			result = append(result, e)
+		}
+	}
+	s.mu.RUnlock()
+
+	sortEventsNewestFirst(result)
+	if len(result) > limit {
+		result = result[:limit]
+	}
+	if result == nil {
+		result = []event{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"events": result})
+}
+
+func sortEventsNewestFirst(events []event) {
+	sort.SliceStable(events, func(i, j int) bool { return events[i].Time.After(events[j].Time) })
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// TestEventStoreSinks checks that adding events does not wait for a stuck sink, that
+// the events beyond the queue are dropped and counted, and that the queued ones reach
+// the sinks once the sink recovers.
+func TestEventStoreSinks(t *testing.T) {
+	release := make(chan struct{})
+	forwarded := make(chan int, eventQueueSize+2)
+	s := newEventStore([]eventSink{func(ctx context.Context, events []event) error {
+		<-release
+		forwarded <- len(events)
+		return nil
+	}})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.forward(ctx)
+
+	dropped := eventsDroppedValue()
+	e := event{Time: historyTestTime, Target: "rack-a", Source: "syslog", Severity: "info", Category: "system", Message: "Test"}
+	added := make(chan struct{})
+	go func() {
+		// One batch is taken by the stuck sink, the queue holds the next ones.
+		for range eventQueueSize + 3 {
+			s.add(ctx, []event{e})
+		}
+		close(added)
+	}()
+	select {
+	case <-added:
+	case <-time.After(5 * time.Second):
+		t.Fatal("adding events waits for the sink")
+	}
+	if n := len(s.all()); n != eventQueueSize+3 {
+		t.Errorf("%d events stored, want %d", n, eventQueueSize+3)
+	}
+	// Depending on whether the worker took the first batch before the queue filled up,
+	// two or three are dropped.
+	if n := eventsDroppedValue() - dropped; n != 2 && n != 3 {
+		t.Errorf("%g events dropped, want 2 or 3", n)
+	}
+
+	close(release)
+	for range eventQueueSize {
+		select {
+		case <-forwarded:
+		case <-time.After(5 * time.Second):
+			t.Fatal("queued events not forwarded")
+		}
+	}
+}
+
+// eventsDroppedValue returns the count of dropped events.
+func eventsDroppedValue() float64 {
+	var m dto.Metric
+	eventsDropped.Write(&m)
+	return m.GetCounter().GetValue()
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+)
+
+// execOutputLimit bounds the output read from a plugin.
+const execOutputLimit = 1 << 20
+
+// ExecConfig configures a target with backend exec, read by running an external
+// program on every scrape.
+type ExecConfig struct {
+	Command string        `yaml:"command"`
+	Args    []string      `yaml:"args"`
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// execOutput is what a plugin prints on stdout: the values by metric name, or an
+// error to report instead.
+type execOutput struct {
+	Metrics map[string]float64 `json:"metrics"`
+	Error   string             `json:"error"`
+}
+
+// source describes where the values of a target come from, for the status commands.
+func (t TargetConfig) source() string {
+	switch t.Backend {
+	case "exec":
+		return strings.TrimSpace("exec: " + t.Exec.Command + " " + strings.Join(t.Exec.Args, " "))
+	case "snmp":
+		if client, err := newSNMPClient(t.SNMP, t.URL); err == nil {
+			return "snmp: " + client.addr
+		}
+	case "modbus":
+		return "modbus: " + modbusAddress(t.Modbus, t.URL)
+	case "apcupsd":
+		return "apcupsd: " + apcupsdAddress(t.Apcupsd, t.URL)
+	}
+	return t.URL
+}
+
+// execBackend reads a target by running its plugin, as the collector's backend.
+type execBackend struct {
+	target TargetConfig
+	known  map[string]bool // names of the metrics a plugin may report
+}
+
+func newExecBackend(target TargetConfig, c *upsCollector) *execBackend {
+	known := make(map[string]bool)
+	for name := range c.Descs() {
+		known[name] = true
+	}
+	return &execBackend{target: target, known: known}
+}
+
+// Values runs the plugin with the target in its environment and reads its output. A
+// plugin fails by exiting with an error, or by printing an error in its output.
+func (b *execBackend) Values(ctx context.Context) (map[string]float64, error) {
+	timeout := b.target.Exec.Timeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, b.target.Exec.Command, b.target.Exec.Args...)
+	cmd.Env = append(os.Environ(),
+		"APC_EXPORTER_TARGET="+b.target.Name,
+		"APC_EXPORTER_URL="+b.target.URL,
+		"APC_EXPORTER_USERNAME="+b.target.Username,
+		"APC_EXPORTER_PASSWORD="+b.target.Password,
+	)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &limitedBuffer{buf: &stdout, limit: execOutputLimit}
+	cmd.Stderr = &limitedBuffer{buf: &stderr, limit: 4096}
+	// A plugin that leaves children behind holding its output does not block the scrape.
+	cmd.WaitDelay = time.Second
+
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("%s timed out after %s", b.target.Exec.Command, timeout)
+		}
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%s: %v: %s", b.target.Exec.Command, err, msg)
+		}
+		return nil, fmt.Errorf("%s: %v", b.target.Exec.Command, err)
+	}
+
+	var out execOutput
+	if err := json.Unmarshal(stdout.Bytes(), &out); err != nil {
+		return nil, fmt.Errorf("%s printed invalid JSON: %v", b.target.Exec.Command, err)
+	}
+	if out.Error != "" {
+		return nil, errors.New(out.Error)
+	}
+	if out.Metrics == nil {
+		return nil, fmt.Errorf("%s printed no metrics", b.target.Exec.Command)
+	}
+	var unknown []string
+	for name := range out.Metrics {
+		if !b.known[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("%s printed unknown metrics: %s", b.target.Exec.Command, strings.Join(unknown, ", "))
+	}
+	return out.Metrics, nil
+}
+
+// limitedBuffer keeps the first limit bytes written to it and discards the rest.
+type limitedBuffer struct {
+	buf   *bytes.Buffer
+	limit int
+}
+
+func (w *limitedBuffer) Write(p []byte) (int, error) {
+	if room := w.limit - w.buf.Len(); room > 0 {
+		w.buf.Write(p[:min(len(p), room)])
+	}
+	return len(p), nil
+}
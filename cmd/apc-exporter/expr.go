@@ -0,0 +1,231 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/common/ast"
+	"github.com/google/cel-go/common/operators"
+	"github.com/google/cel-go/common/types"
+	"github.com/google/cel-go/common/types/ref"
+)
+
+// Expressions are CEL (https://cel.dev), evaluated with cel-go over a flat set of
+// metric values. Identifiers name metrics with or without the ups_ prefix, so
+// runtime_remaining_minutes and ups_runtime_remaining_minutes are the same, and are
+// doubles. Integer literals are taken as doubles too, so "load_percent > 80" need not
+// be written "load_percent > 80.0". Besides the standard operators, % works on doubles,
+// and the functions min and max (of up to maxExprArgs numbers) and abs are available.
+// An expression must yield a number or a boolean.
+
+// maxExprArgs is how many numbers min and max take at most.
+const maxExprArgs = 8
+
+// errUnknownMetric is returned when an expression refers to a metric the target does
+// not have, for example because its card does not report it.
+var errUnknownMetric = errors.New("unknown metric")
+
+// exprIdent matches the identifiers that name metrics, leaving out the variables CEL
+// macros use internally, such as @it.
+var exprIdent = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// exprValue is the result of an expression: a number or, if isBool, a boolean.
+type exprValue struct {
+	num    float64
+	isBool bool
+}
+
+func (v exprValue) String() string {
+	if v.isBool {
+		return strconv.FormatBool(v.num != 0)
+	}
+	return strconv.FormatFloat(v.num, 'g', -1, 64)
+}
+
+func boolValue(b bool) exprValue {
+	if b {
+		return exprValue{num: 1, isBool: true}
+	}
+	return exprValue{isBool: true}
+}
+
+// expr is a parsed expression, evaluated against the metrics of one target.
+type expr interface {
+	eval(metrics map[string]float64) (exprValue, error)
+}
+
+// exprModulo is the function % is rewritten to, as CEL only has it for integers and
+// its own cannot be overloaded. Users cannot call it by name.
+const exprModulo = "@mod"
+
+// exprEnv is the CEL environment of all expressions, before their metrics are declared.
+var exprEnv = sync.OnceValues(func() (*cel.Env, error) {
+	opts := []cel.EnvOption{
+		cel.Function(exprModulo, cel.Overload("modulo_double_double",
+			[]*cel.Type{cel.DoubleType, cel.DoubleType}, cel.DoubleType,
+			cel.BinaryBinding(func(l, r ref.Val) ref.Val {
+				return types.Double(math.Mod(float64(l.(types.Double)), float64(r.(types.Double))))
+			}))),
+		cel.Function("abs", cel.Overload("abs_double",
+			[]*cel.Type{cel.DoubleType}, cel.DoubleType,
+			cel.UnaryBinding(func(v ref.Val) ref.Val {
+				return types.Double(math.Abs(float64(v.(types.Double))))
+			}))),
+	}
+	for _, name := range []string{"min", "max"} {
+		pick := math.Min
+		if name == "max" {
+			pick = math.Max
+		}
+		var overloads []cel.FunctionOpt
+		for n := 1; n <= maxExprArgs; n++ {
+			args := slices.Repeat([]*cel.Type{cel.DoubleType}, n)
+			overloads = append(overloads, cel.Overload(fmt.Sprintf("%s_double_%d", name, n), args, cel.DoubleType,
+				cel.FunctionBinding(func(values ...ref.Val) ref.Val {
+					result := float64(values[0].(types.Double))
+					for _, v := range values[1:] {
+						result = pick(result, float64(v.(types.Double)))
+					}
+					return types.Double(result)
+				})))
+		}
+		opts = append(opts, cel.Function(name, overloads...))
+	}
+	return cel.NewEnv(opts...)
+})
+
+// celExpr is a compiled CEL expression and the metrics it refers to.
+type celExpr struct {
+	program cel.Program
+	idents  []string
+	isBool  bool
+}
+
+// parseExpr compiles a CEL expression: it is parsed, its integer literals are made
+// doubles and % is rewritten to exprModulo, its identifiers are declared as double
+// metrics, and it is type-checked, so mistakes such as comparing a number with a
+// boolean are found before it runs.
+func parseExpr(src string) (expr, error) {
+	env, err := exprEnv()
+	if err != nil {
+		return nil, err
+	}
+	parsed, iss := env.Parse(src)
+	if iss.Err() != nil {
+		return nil, exprIssues(iss)
+	}
+
+	var idents, iterVars []string
+	ast.PostOrderVisit(parsed.NativeRep().Expr(), ast.NewExprVisitor(func(e ast.Expr) {
+		switch e.Kind() {
+		case ast.LiteralKind:
+			if v, ok := e.AsLiteral().(types.Int); ok {
+				e.SetKindCase(ast.NewExprFactory().NewLiteral(e.ID(), types.Double(v)))
+			}
+		case ast.CallKind:
+			if c := e.AsCall(); c.FunctionName() == operators.Modulo {
+				e.SetKindCase(ast.NewExprFactory().NewCall(e.ID(), exprModulo, c.Args()...))
+			}
+		case ast.IdentKind:
+			if name := e.AsIdent(); exprIdent.MatchString(name) && !slices.Contains(idents, name) {
+				idents = append(idents, name)
+			}
+		case ast.ComprehensionKind:
+			c := e.AsComprehension()
+			iterVars = append(iterVars, c.IterVar(), c.IterVar2())
+		}
+	}))
+	idents = slices.DeleteFunc(idents, func(name string) bool { return slices.Contains(iterVars, name) })
+
+	vars := make([]cel.EnvOption, 0, len(idents))
+	for _, name := range idents {
+		vars = append(vars, cel.Variable(name, cel.DoubleType))
+	}
+	env, err = env.Extend(vars...)
+	if err != nil {
+		return nil, err
+	}
+	checked, iss := env.Check(parsed)
+	if iss.Err() != nil {
+		return nil, exprIssues(iss)
+	}
+	if t := checked.OutputType(); t != cel.DoubleType && t != cel.BoolType {
+		return nil, fmt.Errorf("expression yields a %s, not a number or boolean", t)
+	}
+	program, err := env.Program(checked)
+	if err != nil {
+		return nil, err
+	}
+	return &celExpr{program: program, idents: idents, isBool: checked.OutputType() == cel.BoolType}, nil
+}
+
+// parseCondition compiles a CEL expression that must yield a boolean.
+func parseCondition(src string) (expr, error) {
+	e, err := parseExpr(src)
+	if err != nil {
+		return nil, err
+	}
+	if !e.(*celExpr).isBool {
+		return nil, errors.New("expression yields a number, not a boolean")
+	}
+	return e, nil
+}
+
+// exprIssues returns the issues of parsing or checking an expression as one line per
+// issue, without the source CEL repeats under every one.
+func exprIssues(iss *cel.Issues) error {
+	var msgs []string
+	for _, e := range iss.Errors() {
+		msgs = append(msgs, fmt.Sprintf("column %d: %s", max(e.Location.Column()+1, 1), e.Message))
+	}
+	return errors.New(strings.Join(msgs, "; "))
+}
+
+func (e *celExpr) eval(metrics map[string]float64) (exprValue, error) {
+	vars := make(map[string]any, len(e.idents))
+	var missing []string
+	for _, name := range e.idents {
+		if v, ok := metrics[name]; ok {
+			vars[name] = v
+		} else if v, ok := metrics["ups_"+name]; ok {
+			vars[name] = v
+		} else {
+			missing = append(missing, name)
+		}
+	}
+	out, _, err := e.program.Eval(vars)
+	if err != nil {
+		// && and || skip a side that fails, so a guard can protect against a
+		// missing metric; the error only stands if nothing made up for it.
+		if len(missing) > 0 {
+			return exprValue{}, fmt.Errorf("%w %s", errUnknownMetric, strings.Join(missing, ", "))
+		}
+		return exprValue{}, err
+	}
+	switch v := out.(type) {
+	case types.Bool:
+		return boolValue(bool(v)), nil
+	case types.Double:
+		return exprValue{num: float64(v)}, nil
+	}
+	return exprValue{}, fmt.Errorf("expression yields %v, not a number or boolean", out)
+}
+
+// evalBool evaluates an expression that must yield a boolean.
+func evalBool(e expr, metrics map[string]float64) (bool, error) {
+	v, err := e.eval(metrics)
+	if err != nil {
+		return false, err
+	}
+	if !v.isBool {
+		return false, fmt.Errorf("expression yields the number %s, not a boolean", v)
+	}
+	return v.num != 0, nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParseExprErrors(t *testing.T) {
+	for _, tt := range []struct {
+		src  string
+		want string
+	}{
+		{"", "column 1"},
+		{"load_percent >", "column 15"},
+		{"load_percent > 80 &&", "column"},
+		{"(load_percent", "column"},
+		{`load_percent == "high"`, "no matching overload"},
+		{"load_percent > true", "no matching overload"},
+		{"on_battery && load_percent > 80", "expected type 'bool' but found 'double'"},
+		{"average(load_percent)", "undeclared reference to 'average'"},
+		{"min()", "no matching overload for 'min'"},
+		{"min(1, 2, 3, 4, 5, 6, 7, 8, 9)", "no matching overload for 'min'"},
+		{"load_percent % true", "no matching overload"},
+		{`"text"`, "not a number or boolean"},
+		{"[load_percent]", "not a number or boolean"},
+	} {
+		_, err := parseExpr(tt.src)
+		if err == nil {
+			t.Errorf("parseExpr(%q) succeeded", tt.src)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("parseExpr(%q) = %v, want an error containing %q", tt.src, err, tt.want)
+		}
+	}
+}
+
+func TestExprEval(t *testing.T) {
+	metrics := map[string]float64{
+		"ups_load_percent":              42,
+		"ups_runtime_remaining_minutes": 8.5,
+		"ups_output_voltage_volts":      230,
+		"ups_output_current_amps":       2,
+		"on_battery":                    1,
+		"sum_load_percent":              126,
+	}
+	for _, tt := range []struct {
+		src  string
+		want exprValue
+	}{
+		// Integer literals are doubles, and metrics may be named without ups_.
+		{"load_percent", exprValue{num: 42}},
+		{"ups_load_percent", exprValue{num: 42}},
+		{"7 / 2", exprValue{num: 3.5}},
+		{"load_percent > 40", boolValue(true)},
+		{"runtime_remaining_minutes < 10", boolValue(true)},
+
+		// Precedence: * / % before + -, comparisons before && before ||.
+		{"2 + 3 * 4", exprValue{num: 14}},
+		{"(2 + 3) * 4", exprValue{num: 20}},
+		{"10 - 4 - 3", exprValue{num: 3}},
+		{"2 * 3 % 4", exprValue{num: 2}},
+		{"-load_percent + 50", exprValue{num: 8}},
+		{"1 + 1 == 2", boolValue(true)},
+		{"true || false && false", boolValue(true)},
+		{"(true || false) && false", boolValue(false)},
+		{"!(load_percent > 40) || on_battery == 1", boolValue(true)},
+		{"load_percent > 50 ? 1 : 0", exprValue{num: 0}},
+		{"on_battery == 1 ? runtime_remaining_minutes : 60", exprValue{num: 8.5}},
+
+		{"load_percent % 5", exprValue{num: 2}},
+		{"output_voltage_volts * output_current_amps", exprValue{num: 460}},
+		{"load_percent / sum_load_percent", exprValue{num: 42.0 / 126}},
+		{"min(load_percent, 50, runtime_remaining_minutes)", exprValue{num: 8.5}},
+		{"max(load_percent, 50)", exprValue{num: 50}},
+		{"max(load_percent)", exprValue{num: 42}},
+		{"abs(runtime_remaining_minutes - 10)", exprValue{num: 1.5}},
+
+		// A guard protects against a metric the target lacks.
+		{"on_battery == 0 && battery_temperature_celsius > 40", boolValue(false)},
+		{"load_percent > 40 || battery_temperature_celsius > 40", boolValue(true)},
+	} {
+		e, err := parseExpr(tt.src)
+		if err != nil {
+			t.Errorf("parseExpr(%q): %v", tt.src, err)
+			continue
+		}
+		got, err := e.eval(metrics)
+		if err != nil {
+			t.Errorf("%q: %v", tt.src, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%q = %v, want %v", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestExprEvalErrors(t *testing.T) {
+	metrics := map[string]float64{"ups_load_percent": 42, "on_battery": 0}
+
+	for _, src := range []string{
+		"battery_temperature_celsius > 40",
+		"on_battery == 1 || battery_temperature_celsius > 40",
+		"load_percent + battery_temperature_celsius",
+	} {
+		e, err := parseExpr(src)
+		if err != nil {
+			t.Fatalf("parseExpr(%q): %v", src, err)
+		}
+		_, err = e.eval(metrics)
+		if !errors.Is(err, errUnknownMetric) || !strings.Contains(err.Error(), "battery_temperature_celsius") {
+			t.Errorf("%q: got error %v, want unknown metric battery_temperature_celsius", src, err)
+		}
+	}
+
+	e, err := parseExpr("load_percent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := evalBool(e, metrics); err == nil || !strings.Contains(err.Error(), "not a boolean") {
+		t.Errorf("evalBool of a number: got error %v", err)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// FileOutputConfig holds the settings for appending every poll to a local file.
+type FileOutputConfig struct {
+	Path       string        `yaml:"path"`
+	Format     string        `yaml:"format"`
+	Interval   time.Duration `yaml:"interval"`
+	MaxSizeMB  int           `yaml:"max_size_mb"`
+	MaxBackups int           `yaml:"max_backups"`
+}
+
+// runFileOutput appends one timestamped JSON or CSV line per target to the configured
+// file on every interval until the context is cancelled. It returns immediately if no
+// path is configured.
+func runFileOutput(ctx context.Context, cfg FileOutputConfig, gatherer prometheus.Gatherer) {
+	if cfg.Path == "" {
+		return
+	}
+	if cfg.Format == "" {
+		cfg.Format = "json"
+	}
+	if cfg.Format != "json" && cfg.Format != "csv" {
+		slog.Warn("File output disabled: unsupported format", "format", cfg.Format)
+		return
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = time.Minute
+	}
+	gatherer = gatherWithin(gatherer, cfg.Interval)
+
+	file, err := openRotatingFile(cfg.Path, int64(cfg.MaxSizeMB)*1024*1024, cfg.MaxBackups)
+	if err != nil {
+		slog.Warn("File output disabled", "err", err)
+		return
+	}
+	defer file.Close()
+
+	w := &statusFileWriter{format: cfg.Format, file: file}
+
+	slog.Info("Writing status lines to a file", "format", cfg.Format, "path", cfg.Path, "interval", cfg.Interval)
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			if err := w.write(gatherer, now); err != nil {
+				slog.Error("Error writing the status file", "path", cfg.Path, "err", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// statusFileWriter renders polls into the rotating file. For CSV it remembers the
+// current columns so a changed metric set starts a fresh file instead of misaligning
+// columns, and has the file start every new one, rotated or not, with their header.
+type statusFileWriter struct {
+	format  string
+	file    *rotatingFile
+	columns []string
+}
+
+func (w *statusFileWriter) write(gatherer prometheus.Gatherer, now time.Time) error {
+	samples, err := gatherSamples(gatherer, "ups_")
+	if err != nil {
+		return err
+	}
+	targets, states := samplesByTarget(samples)
+	timestamp := now.UTC().Format(time.RFC3339)
+
+	var buf bytes.Buffer
+	switch w.format {
+	case "json":
+		enc := json.NewEncoder(&buf)
+		for _, target := range targets {
+			line := map[string]any{"timestamp": timestamp, "target": target}
+			for name, value := range states[target] {
+				line[name] = value
+			}
+			if err := enc.Encode(line); err != nil {
+				return err
+			}
+		}
+	case "csv":
+		columns := metricColumns(states)
+		if !slices.Equal(columns, w.columns) {
+			if w.columns != nil {
+				if err := w.file.Rotate(); err != nil {
+					return err
+				}
+			}
+			var header bytes.Buffer
+			hw := csv.NewWriter(&header)
+			hw.Write(append([]string{"timestamp", "target"}, columns...))
+			hw.Flush()
+			if err := hw.Error(); err != nil {
+				return err
+			}
+			w.file.SetHeader(header.Bytes())
+			w.columns = columns
+		}
+
+		cw := csv.NewWriter(&buf)
+		for _, target := range targets {
+			record := []string{timestamp, target}
+			for _, name := range columns {
+				if value, ok := states[target][name]; ok {
+					record = append(record, strconv.FormatFloat(value, 'f', -1, 64))
+				} else {
+					record = append(record, "")
+				}
+			}
+			cw.Write(record)
+		}
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupported format %q", w.format)
+	}
+
+	_, err = w.file.Write(buf.Bytes())
+	return err
+}
+
+// metricColumns returns the sorted union of metric names across all targets.
+func metricColumns(states map[string]map[string]float64) []string {
+	seen := make(map[string]bool)
+	var columns []string
+	for _, state := range states {
+		for name := range state {
+			if !seen[name] {
+				seen[name] = true
+				columns = append(columns, name)
+			}
+		}
+	}
+	sort.Strings(columns)
+	return columns
+}
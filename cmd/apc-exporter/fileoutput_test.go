@@ -0,0 +1,58 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// TestStatusFileCSVHeader checks that every CSV file starts with the header of its
+// columns: the first one, those rotated on max_size and the one a changed metric set
+// starts.
+func TestStatusFileCSVHeader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "status.csv")
+	// Room for the header and one line, so every poll but the first rotates.
+	file, err := openRotatingFile(path, 70, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	w := &statusFileWriter{format: "csv", file: file}
+
+	reg := prometheus.NewRegistry()
+	load := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "ups_load_percent", Help: "Output load in percent."}, []string{"target"})
+	capacity := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "ups_battery_capacity_percent", Help: "Battery capacity in percent."}, []string{"target"})
+	reg.MustRegister(load, capacity)
+	for i := range 3 {
+		load.WithLabelValues("rack-a").Set(float64(10 + i))
+		if err := w.write(reg, historyTestTime.Add(time.Duration(i)*time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	capacity.WithLabelValues("rack-a").Set(100)
+	if err := w.write(reg, historyTestTime.Add(3*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		file  string
+		lines []string
+	}{
+		{path + ".3", []string{"timestamp,target,ups_load_percent", "2024-05-01T12:00:00Z,rack-a,10"}},
+		{path + ".2", []string{"timestamp,target,ups_load_percent", "2024-05-01T12:01:00Z,rack-a,11"}},
+		{path + ".1", []string{"timestamp,target,ups_load_percent", "2024-05-01T12:02:00Z,rack-a,12"}},
+		{path, []string{"timestamp,target,ups_battery_capacity_percent,ups_load_percent", "2024-05-01T12:03:00Z,rack-a,100,12"}},
+	} {
+		data, err := os.ReadFile(tc.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := strings.Join(tc.lines, "\n") + "\n"; string(data) != want {
+			t.Errorf("%s:\n%s\nwant:\n%s", filepath.Base(tc.file), data, want)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v3"
+)
+
+// promRuleGroups is a Prometheus rules file.
+type promRuleGroups struct {
+	Groups []promRuleGroup `yaml:"groups"`
+}
+
+type promRuleGroup struct {
+	Name  string      `yaml:"name"`
+	Rules []promAlert `yaml:"rules"`
+}
+
+type promAlert struct {
+	Alert       string            `yaml:"alert"`
+	Expr        string            `yaml:"expr"`
+	For         string            `yaml:"for,omitempty"`
+	Labels      map[string]string `yaml:"labels"`
+	Annotations map[string]string `yaml:"annotations"`
+}
+
+// runGenRulesCommand implements the gen-rules command: it prints a Prometheus rules
+// file with alerts on the exporter's metrics, with the thresholds given by flags. The
+// alerts that overlap with the Alertmanager push carry the same names and severities.
+func runGenRulesCommand(args []string) error {
+	flags := flag.NewFlagSet("gen-rules", flag.ContinueOnError)
+	group := flags.String("group", "apc-ups", "Name of the rule group")
+	job := flags.String("job", "", "Only alert on series of this Prometheus job (default all)")
+	onBatteryFor := flags.Duration("on-battery-for", time.Minute, "Time on battery before UPSOnBattery fires")
+	onBatteryVolts := flags.Float64("on-battery-input-voltage", 1, "Input voltage below which the UPS is taken to be on battery without traps")
+	lowRuntime := flags.Float64("low-runtime", 10, "Runtime in minutes below which UPSLowRuntime fires")
+	lowRuntimeFor := flags.Duration("low-runtime-for", 0, "Time below -low-runtime before UPSLowRuntime fires")
+	unreachableFor := flags.Duration("unreachable-for", 5*time.Minute, "Time the exporter fails to scrape a card before UPSUnreachable fires")
+	staleAfter := flags.Duration("stale-after", 30*time.Minute, "Time without any change of the voltages before UPSStaleData fires")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *staleAfter <= 0 {
+		return fmt.Errorf("-stale-after must be positive, got %s", *staleAfter)
+	}
+
+	m := func(metric string) string {
+		if *job == "" {
+			return metric
+		}
+		return metric + "{job=" + strconv.Quote(*job) + "}"
+	}
+	forDuration := func(d time.Duration) string {
+		if d <= 0 {
+			return ""
+		}
+		return model.Duration(d).String()
+	}
+	alert := func(name, severity, expr string, d time.Duration, summary, description string) promAlert {
+		return promAlert{
+			Alert:  name,
+			Expr:   expr,
+			For:    forDuration(d),
+			Labels: map[string]string{"severity": severity},
+			Annotations: map[string]string{
+				"summary":     "{{ $labels.target }}: " + summary,
+				"description": description,
+			},
+		}
+	}
+	volts := strconv.FormatFloat(*onBatteryVolts, 'f', -1, 64)
+	minutes := strconv.FormatFloat(*lowRuntime, 'f', -1, 64)
+	stale := model.Duration(*staleAfter).String()
+
+	// Values a card does not show are 0, and a real battery always has a voltage, so
+	// the alerts on readings require one. Stale data also needs the series to be older
+	// than the window, or a new target fires.
+	rules := promRuleGroups{Groups: []promRuleGroup{{Name: *group, Rules: []promAlert{
+		alert("UPSOnBattery", "warning",
+			fmt.Sprintf("%s == 1 or (%s < %s and %s > 0 unless %s)", m("ups_on_battery"), m("ups_input_voltage_vac"), volts, m("ups_battery_voltage_vdc"), m("ups_on_battery")),
+			*onBatteryFor, "UPS is running on battery",
+			"The UPS reports running on battery, or without a device status its input voltage is below "+volts+" V."),
+		alert("UPSLowRuntime", "critical",
+			fmt.Sprintf("%s < %s and %s > 0", m("ups_runtime_remaining_minutes"), minutes, m("ups_battery_voltage_vdc")),
+			*lowRuntimeFor, "UPS battery runtime is low",
+			"The remaining runtime is {{ $value }} minutes, below "+minutes+"."),
+		alert("UPSReplaceBattery", "warning",
+			m("ups_battery_replacement_needed")+" == 1",
+			0, "UPS battery needs replacing",
+			"The UPS reported by SNMP trap that its battery needs replacing."),
+		alert("UPSUnreachable", "warning",
+			m("ups_up")+" == 0",
+			*unreachableFor, "The exporter cannot scrape the card",
+			"The exporter's scrapes of the card fail: the card is down, unreachable or refuses the login. ups_scrape_errors_total and the exporter's log tell which."),
+		alert("UPSStaleData", "warning",
+			fmt.Sprintf("changes(%s[%s]) == 0 and changes(%s[%s]) == 0 and %s offset %s > 0", m("ups_battery_voltage_vdc"), stale, m("ups_input_voltage_vac"), stale, m("ups_battery_voltage_vdc"), stale),
+			0, "The card's readings are stale",
+			"Neither the battery nor the input voltage changed in "+stale+": the card's web interface is probably serving frozen values and needs a restart."),
+	}}}}
+
+	fmt.Printf("# Generated by %s\n", versionString())
+	enc := yaml.NewEncoder(os.Stdout)
+	enc.SetIndent(2)
+	if err := enc.Encode(rules); err != nil {
+		return err
+	}
+	return enc.Close()
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/graphite"
+)
+
+// GraphiteConfig holds the settings for pushing metrics to a Graphite/carbon endpoint.
+type GraphiteConfig struct {
+	Address  string        `yaml:"address"`
+	Prefix   string        `yaml:"prefix"`
+	Interval time.Duration `yaml:"interval"`
+	UseTags  bool          `yaml:"use_tags"`
+}
+
+// runGraphite pushes the gathered metrics to Graphite until the context is cancelled.
+// It returns immediately if no Graphite address is configured.
+func runGraphite(ctx context.Context, cfg GraphiteConfig, gatherer prometheus.Gatherer) {
+	if cfg.Address == "" {
+		return
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = 15 * time.Second
+	}
+	gatherer = gatherWithin(gatherer, cfg.Interval)
+
+	bridge, err := graphite.NewBridge(&graphite.Config{
+		URL:           cfg.Address,
+		Prefix:        cfg.Prefix,
+		Interval:      cfg.Interval,
+		UseTags:       cfg.UseTags,
+		Gatherer:      gatherer,
+		Logger:        slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn),
+		ErrorHandling: graphite.ContinueOnError,
+	})
+	if err != nil {
+		slog.Warn("Graphite output disabled", "err", err)
+		return
+	}
+
+	slog.Info("Pushing metrics to Graphite", "address", cfg.Address, "interval", cfg.Interval)
+	bridge.Run(ctx)
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// HAConfig holds the settings for running several replicas of the exporter, of which
+// only the elected leader talks to the cards. Followers serve the leader's values, so
+// cards that allow a single session are not fought over.
+type HAConfig struct {
+	// Lock is "file" for a lock file on storage shared by the replicas, or
+	// "kubernetes" for a coordination.k8s.io Lease.
+	Lock          string        `yaml:"lock"`
+	Path          string        `yaml:"path"`
+	LeaseName     string        `yaml:"lease_name"`
+	Namespace     string        `yaml:"namespace"`
+	LeaseDuration time.Duration `yaml:"lease_duration"`
+	// AdvertiseURL is how the other replicas reach this one; it also identifies it.
+	AdvertiseURL string `yaml:"advertise_url"`
+}
+
+// leaderLock is a lock that one replica holds at a time.
+type leaderLock interface {
+	// acquire takes or renews the lock for the identity if it is free, and returns the
+	// identity of the holder.
+	acquire(ctx context.Context, identity string) (string, error)
+	// release gives up the lock, so that another replica takes over without waiting
+	// for it to expire.
+	release(ctx context.Context, identity string) error
+}
+
+var haLeader = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "ups_ha_leader",
+	Help: "Whether this replica is the leader that polls the cards (1) or a follower (0).",
+})
+
+// leaderElection keeps trying to become the leader, and tells the rest of the
+// exporter whether it is. A nil election is always the leader.
+type leaderElection struct {
+	cfg    HAConfig
+	lock   leaderLock
+	client *http.Client
+
+	mu     sync.Mutex
+	leader bool
+	holder string
+	cached map[string]cachedValues // by target
+}
+
+// cachedValues are the values of a target last fetched from the leader.
+type cachedValues struct {
+	values  map[string]float64
+	fetched time.Time
+}
+
+// newLeaderElection returns nil without an error if no lock is configured.
+func newLeaderElection(cfg HAConfig) (*leaderElection, error) {
+	if cfg.Lock == "" {
+		return nil, nil
+	}
+	if cfg.LeaseDuration <= 0 {
+		cfg.LeaseDuration = 15 * time.Second
+	}
+	if cfg.AdvertiseURL == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		cfg.AdvertiseURL = "http://" + host + listenPort()
+	}
+	cfg.AdvertiseURL = strings.TrimSuffix(cfg.AdvertiseURL, "/")
+
+	e := &leaderElection{cfg: cfg, client: &http.Client{Timeout: 10 * time.Second}, cached: make(map[string]cachedValues)}
+	var err error
+	switch cfg.Lock {
+	case "file":
+		if cfg.Path == "" {
+			return nil, errors.New("path is required for the file lock")
+		}
+		e.lock, err = newFileLock(cfg.Path)
+	case "kubernetes":
+		if cfg.LeaseName == "" {
+			cfg.LeaseName = "apc-exporter"
+		}
+		e.lock, err = newKubernetesLock(cfg.Namespace, cfg.LeaseName, cfg.LeaseDuration)
+	default:
+		err = fmt.Errorf("unknown lock %q, expected file or kubernetes", cfg.Lock)
+	}
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("Electing the leader", "lock", cfg.Lock, "url", cfg.AdvertiseURL)
+	return e, nil
+}
+
+// run keeps campaigning for the lock until the context is cancelled, then releases it.
+func (e *leaderElection) run(ctx context.Context) {
+	ticker := time.NewTicker(e.cfg.LeaseDuration / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			e.campaign(ctx)
+		case <-ctx.Done():
+			if e.isLeader() {
+				releaseCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				if err := e.lock.release(releaseCtx, e.cfg.AdvertiseURL); err != nil {
+					slog.Warn("Error releasing the leader lock", "err", err)
+				}
+				cancel()
+			}
+			return
+		}
+	}
+}
+
+// campaign takes or renews the lock. A replica that cannot reach the lock steps down,
+// as another one may have taken over.
+func (e *leaderElection) campaign(ctx context.Context) {
+	holder, err := e.lock.acquire(ctx, e.cfg.AdvertiseURL)
+	if err != nil {
+		slog.Error("Error acquiring the leader lock", "err", err)
+		holder = ""
+	}
+	leader := holder == e.cfg.AdvertiseURL
+
+	e.mu.Lock()
+	changed := leader != e.leader || holder != e.holder
+	e.leader, e.holder = leader, holder
+	e.mu.Unlock()
+
+	if leader {
+		haLeader.Set(1)
+	} else {
+		haLeader.Set(0)
+	}
+	switch {
+	case !changed:
+	case leader:
+		slog.Info("This replica is the leader now and polls the cards")
+	case holder != "":
+		slog.Info("Following the leader", "leader", holder)
+	default:
+		slog.Warn("No leader known, not polling the cards")
+	}
+}
+
+func (e *leaderElection) isLeader() bool {
+	if e == nil {
+		return true
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.leader
+}
+
+// Following reports whether another replica talks to the cards.
+func (e *leaderElection) Following() bool {
+	return !e.isLeader()
+}
+
+func (e *leaderElection) LeaderURL() string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.holder
+}
+
+// suppress wraps the notifiers so that only the leader sends notifications.
+func (e *leaderElection) suppress(notifiers []transitionNotifier) []transitionNotifier {
+	if e == nil || len(notifiers) == 0 {
+		return notifiers
+	}
+	return []transitionNotifier{func(ctx context.Context, tr transition) error {
+		if e.Following() {
+			notificationsSuppressed.WithLabelValues(tr.Target, "follower").Inc()
+			return nil
+		}
+		var errs []error
+		for _, notify := range notifiers {
+			errs = append(errs, notify(ctx, tr))
+		}
+		return errors.Join(errs...)
+	}}
+}
+
+// LeaderValues fetches the values of a target from the leader's /ha/ document. If the
+// leader cannot be reached, the values fetched last are returned.
+func (e *leaderElection) LeaderValues(target string) (map[string]float64, error) {
+	values, err := e.fetchLeaderValues(target)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err == nil {
+		e.cached[target] = cachedValues{values: values, fetched: time.Now()}
+		return values, nil
+	}
+	if cached, ok := e.cached[target]; ok {
+		return cached.values, fmt.Errorf("%w; serving the values of %s", err, cached.fetched.Format(time.RFC3339))
+	}
+	return nil, err
+}
+
+func (e *leaderElection) fetchLeaderValues(target string) (map[string]float64, error) {
+	leader := e.LeaderURL()
+	if leader == "" {
+		return nil, errors.New("no leader")
+	}
+	res, err := e.client.Get(leader + "/ha/" + url.PathEscape(target) + ".json")
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("leader %s returned %s", leader, res.Status)
+	}
+	var doc map[string]any
+	if err := json.NewDecoder(res.Body).Decode(&doc); err != nil {
+		return nil, err
+	}
+	values := make(map[string]float64)
+	for key, v := range doc {
+		if f, ok := v.(float64); ok {
+			values["ups_"+key] = f
+		}
+	}
+	return values, nil
+}
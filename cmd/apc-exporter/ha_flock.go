@@ -0,0 +1,73 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// fileLock is an exclusive flock on a file that the holder writes its identity to.
+// The kernel releases it when the holder dies, so no expiry is needed; over NFS the
+// lock is only as reliable as the server's lock manager.
+type fileLock struct {
+	path string
+
+	mu   sync.Mutex
+	file *os.File // while held
+}
+
+func newFileLock(path string) (*fileLock, error) {
+	return &fileLock{path: path}, nil
+}
+
+func (l *fileLock) acquire(ctx context.Context, identity string) (string, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file != nil {
+		return identity, nil
+	}
+
+	f, err := os.OpenFile(l.path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return "", err
+	}
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		holder, err := io.ReadAll(f)
+		f.Close()
+		return strings.TrimSpace(string(holder)), err
+	}
+	if err == nil {
+		err = f.Truncate(0)
+	}
+	if err == nil {
+		_, err = f.WriteAt([]byte(identity+"\n"), 0)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Close()
+		return "", err
+	}
+	l.file = f
+	return identity, nil
+}
+
+func (l *fileLock) release(ctx context.Context, identity string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	l.file.Truncate(0)
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// serviceAccountDir holds the credentials Kubernetes mounts into every pod.
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// kubernetesLock is a coordination.k8s.io/v1 Lease, renewed by its holder and taken
+// over by another replica once it has not been renewed for its duration. Updates use
+// the resource version, so two replicas cannot both take it.
+type kubernetesLock struct {
+	client   *http.Client
+	leases   string // URL of the namespace's leases
+	name     string
+	duration time.Duration
+}
+
+type lease struct {
+	APIVersion string        `json:"apiVersion"`
+	Kind       string        `json:"kind"`
+	Metadata   leaseMetadata `json:"metadata"`
+	Spec       leaseSpec     `json:"spec"`
+}
+
+type leaseMetadata struct {
+	Name            string `json:"name"`
+	Namespace       string `json:"namespace"`
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+}
+
+type leaseSpec struct {
+	HolderIdentity       string `json:"holderIdentity"`
+	LeaseDurationSeconds int    `json:"leaseDurationSeconds"`
+	AcquireTime          string `json:"acquireTime,omitempty"`
+	RenewTime            string `json:"renewTime,omitempty"`
+	LeaseTransitions     int    `json:"leaseTransitions"`
+}
+
+// leaseTimeFormat is the MicroTime format of the Lease times.
+const leaseTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+// newKubernetesLock uses the service account of the pod. The namespace defaults to the
+// pod's own.
+func newKubernetesLock(namespace, name string, duration time.Duration) (*kubernetesLock, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("not running in a Kubernetes pod")
+	}
+	if namespace == "" {
+		ns, err := os.ReadFile(serviceAccountDir + "/namespace")
+		if err != nil {
+			return nil, err
+		}
+		namespace = strings.TrimSpace(string(ns))
+	}
+	ca, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("no certificates in the service account CA")
+	}
+	return &kubernetesLock{
+		client: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		},
+		leases:   "https://" + net.JoinHostPort(host, port) + "/apis/coordination.k8s.io/v1/namespaces/" + namespace + "/leases",
+		name:     name,
+		duration: duration,
+	}, nil
+}
+
+func (l *kubernetesLock) acquire(ctx context.Context, identity string) (string, error) {
+	var current lease
+	status, err := l.do(ctx, http.MethodGet, l.leases+"/"+l.name, nil, &current)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	if status == http.StatusNotFound {
+		created := lease{
+			APIVersion: "coordination.k8s.io/v1",
+			Kind:       "Lease",
+			Metadata:   leaseMetadata{Name: l.name},
+			Spec:       l.spec(identity, now, now, 0),
+		}
+		status, err = l.do(ctx, http.MethodPost, l.leases, created, nil)
+		if err != nil || status == http.StatusConflict {
+			// Another replica created it first.
+			return "", err
+		}
+		return identity, nil
+	}
+
+	spec := current.Spec
+	renewed, _ := time.Parse(leaseTimeFormat, spec.RenewTime)
+	expired := now.Sub(renewed) > time.Duration(spec.LeaseDurationSeconds)*time.Second
+	if spec.HolderIdentity != identity && spec.HolderIdentity != "" && !expired {
+		return spec.HolderIdentity, nil
+	}
+
+	acquired, transitions := now, spec.LeaseTransitions
+	if spec.HolderIdentity == identity {
+		acquired, _ = time.Parse(leaseTimeFormat, spec.AcquireTime)
+	} else {
+		transitions++
+	}
+	current.Spec = l.spec(identity, acquired, now, transitions)
+	status, err = l.do(ctx, http.MethodPut, l.leases+"/"+l.name, current, nil)
+	if err != nil {
+		return "", err
+	}
+	if status == http.StatusConflict {
+		// Another replica updated it since it was read; look again next time.
+		return spec.HolderIdentity, nil
+	}
+	return identity, nil
+}
+
+func (l *kubernetesLock) release(ctx context.Context, identity string) error {
+	var current lease
+	if _, err := l.do(ctx, http.MethodGet, l.leases+"/"+l.name, nil, &current); err != nil {
+		return err
+	}
+	if current.Spec.HolderIdentity != identity {
+		return nil
+	}
+	current.Spec.HolderIdentity = ""
+	_, err := l.do(ctx, http.MethodPut, l.leases+"/"+l.name, current, nil)
+	return err
+}
+
+func (l *kubernetesLock) spec(identity string, acquired, renewed time.Time, transitions int) leaseSpec {
+	return leaseSpec{
+		HolderIdentity:       identity,
+		LeaseDurationSeconds: int(l.duration.Seconds()),
+		AcquireTime:          acquired.UTC().Format(leaseTimeFormat),
+		RenewTime:            renewed.UTC().Format(leaseTimeFormat),
+		LeaseTransitions:     transitions,
+	}
+}
+
+// do sends a request to the API server and decodes a successful response into out.
+// Not found and conflict are returned as statuses; other failures as errors.
+func (l *kubernetesLock) do(ctx context.Context, method, url string, in, out any) (int, error) {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return 0, err
+		}
+		body = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return 0, err
+	}
+	// The token is read on every request, as Kubernetes rotates it.
+	token, err := os.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := l.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	switch {
+	case res.StatusCode == http.StatusNotFound || res.StatusCode == http.StatusConflict:
+		return res.StatusCode, nil
+	case res.StatusCode/100 != 2:
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return res.StatusCode, fmt.Errorf("%s %s: %s: %s", method, url, res.Status, strings.TrimSpace(string(msg)))
+	case out != nil:
+		return res.StatusCode, json.NewDecoder(res.Body).Decode(out)
+	}
+	return res.StatusCode, nil
+}
@@ -0,0 +1,9 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd)
+
+package main
+
+import "errors"
+
+func newFileLock(path string) (leaderLock, error) {
+	return nil, errors.New("the file lock is not supported on this platform")
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// haRESTHandler serves /ha/<target>.json: a flat JSON document per target for Home
+// Assistant's RESTful sensor platform. Keys are the metric names without the "ups_"
+// prefix and are kept stable across releases, so templates keep working. Like /probe,
+// a request scrapes only the card of its target and derives the metrics from it alone.
+func haRESTHandler(targets *targetSet, derived []DerivedMetricConfig) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name, ok := strings.CutSuffix(strings.TrimPrefix(r.URL.Path, "/ha/"), ".json")
+		if !ok || name == "" {
+			http.NotFound(w, r)
+			return
+		}
+
+		i := slices.Index(targets.names(), name)
+		if i < 0 {
+			http.NotFound(w, r)
+			return
+		}
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(targets.collectors[i])
+		samples, err := gatherSamples(newDerivedGatherer(registry, derived), "ups_")
+		if err != nil {
+			slog.Error("Error gathering metrics for /ha/", "err", err)
+			http.Error(w, "gather failed", http.StatusInternalServerError)
+			return
+		}
+		_, states := samplesByTarget(samples)
+		state, ok := states[name]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+
+		doc := map[string]any{
+			"target":     name,
+			"updated_at": time.Now().UTC().Format(time.RFC3339),
+			"online":     state["ups_device_status_up"] == 1,
+			"outlet_on":  state["ups_outlet_status"] == 1,
+		}
+		for metric, value := range state {
+			doc[strings.TrimPrefix(metric, "ups_")] = value
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(doc)
+	})
+}
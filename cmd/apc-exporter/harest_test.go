@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/veter2005/apc-exporter/pkg/nmc"
+	"github.com/veter2005/apc-exporter/pkg/nmcsim"
+)
+
+// TestHARESTHandler checks that a document is served for a known target only, and
+// that the request scrapes the card of that target and no other.
+func TestHARESTHandler(t *testing.T) {
+	targets := &targetSet{}
+	requests := make(map[string]*atomic.Int64)
+	for _, name := range []string{"rack-a", "rack-b"} {
+		sim, err := nmcsim.New(nmcsim.Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		count := new(atomic.Int64)
+		requests[name] = count
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			count.Add(1)
+			sim.ServeHTTP(w, r)
+		}))
+		t.Cleanup(srv.Close)
+
+		target := TargetConfig{Target: nmc.Target{Name: name, URL: srv.URL, Username: "apc", Password: "apc"}}
+		client, err := newTargetHTTPClient(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := newUPSCollector(Config{}, client, target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		targets.collectors = append(targets.collectors, c)
+	}
+	derived := []DerivedMetricConfig{{Name: "load_twice", Expr: "load_percent * 2"}}
+	srv := httptest.NewServer(haRESTHandler(targets, derived))
+	defer srv.Close()
+
+	for _, path := range []string{"/ha/rack-c.json", "/ha/rack-a", "/ha/.json"} {
+		res, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusNotFound {
+			t.Errorf("%s: %s, want 404", path, res.Status)
+		}
+	}
+
+	res, err := http.Get(srv.URL + "/ha/rack-a.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("status %s", res.Status)
+	}
+	var doc map[string]any
+	if err := json.NewDecoder(res.Body).Decode(&doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc["target"] != "rack-a" || doc["online"] != true {
+		t.Errorf("target %v, online %v, want rack-a and true", doc["target"], doc["online"])
+	}
+	load, ok := doc["load_percent"].(float64)
+	if !ok {
+		t.Fatalf("no load_percent in %v", doc)
+	}
+	if doc["load_twice"] != 2*load {
+		t.Errorf("load_twice %v, want %v", doc["load_twice"], 2*load)
+	}
+	if requests["rack-a"].Load() == 0 || requests["rack-b"].Load() != 0 {
+		t.Errorf("requests to rack-a %d, rack-b %d, want some and none", requests["rack-a"].Load(), requests["rack-b"].Load())
+	}
+}
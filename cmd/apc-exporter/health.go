@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// healthHandler serves /-/healthy and /healthz, which answer as long as the exporter
+// serves HTTP.
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "Healthy.")
+}
+
+// runHealthcheckCommand implements the healthcheck command: it fails unless the
+// exporter at the URL answers /-/healthy in time, for container and Nomad checks.
+func runHealthcheckCommand(args []string) error {
+	flags := flag.NewFlagSet("healthcheck", flag.ContinueOnError)
+	endpoint := flags.String("url", "http://localhost"+listenPort()+"/-/healthy", "Health endpoint of the exporter")
+	timeout := flags.Duration("timeout", 5*time.Second, "Time to wait for the answer")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, *endpoint, nil)
+	if err != nil {
+		return err
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", *endpoint, res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// HistoryConfig holds the settings for the embedded history store.
+type HistoryConfig struct {
+	Path      string        `yaml:"path"`
+	Retention time.Duration `yaml:"retention"`
+	Interval  time.Duration `yaml:"interval"`
+}
+
+// historySchema is a table of every recorded value, keyed by target, metric and
+// millisecond timestamp so range queries are index scans that come out in time order,
+// and indexed by time for pruning.
+const historySchema = `
+CREATE TABLE IF NOT EXISTS history (
+	target TEXT NOT NULL,
+	metric TEXT NOT NULL,
+	time   INTEGER NOT NULL,
+	value  REAL NOT NULL,
+	PRIMARY KEY (target, metric, time)
+) WITHOUT ROWID;
+CREATE INDEX IF NOT EXISTS history_time ON history (time);
+`
+
+// historyStore records every poll in a local SQLite database.
+type historyStore struct {
+	cfg HistoryConfig
+	db  *sql.DB
+}
+
+// openHistoryStore opens (or creates) the history database. It returns nil without
+// an error if no path is configured.
+func openHistoryStore(cfg HistoryConfig) (*historyStore, error) {
+	if cfg.Path == "" {
+		return nil, nil
+	}
+	if cfg.Retention <= 0 {
+		cfg.Retention = 7 * 24 * time.Hour
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = time.Minute
+	}
+
+	// WAL lets the API read while a poll is recorded, and a busy timeout lets the
+	// process of a hot upgrade write while the old one still has the file open.
+	dsn := "file:" + (&url.URL{Path: cfg.Path}).EscapedPath() + "?_journal_mode=WAL&_busy_timeout=" + strconv.FormatInt(dbLockTimeout.Milliseconds(), 10)
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("opening %s: %w", cfg.Path, err)
+	}
+	if _, err := db.Exec(historySchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("opening %s: %w", cfg.Path, err)
+	}
+	return &historyStore{cfg: cfg, db: db}, nil
+}
+
+// run records the UPS metrics on every interval and prunes entries older than the
+// retention until the context is cancelled.
+func (h *historyStore) run(ctx context.Context, gatherer prometheus.Gatherer) {
+	gatherer = gatherWithin(gatherer, h.cfg.Interval)
+	slog.Info("Recording history", "path", h.cfg.Path, "interval", h.cfg.Interval, "retention", h.cfg.Retention)
+	ticker := time.NewTicker(h.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			if err := h.record(gatherer, now); err != nil {
+				slog.Error("Error recording history", "err", err)
+			}
+			if err := h.prune(now.Add(-h.cfg.Retention)); err != nil {
+				slog.Error("Error pruning history", "err", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Close closes the database.
+func (h *historyStore) Close() error {
+	return h.db.Close()
+}
+
+// record stores the UPS metrics of every target in one transaction. NaN values, which
+// neither SQLite nor JSON can hold, are left out.
+func (h *historyStore) record(gatherer prometheus.Gatherer, now time.Time) error {
+	samples, err := gatherSamples(gatherer, "ups_")
+	if err != nil {
+		return err
+	}
+	targets, states := samplesByTarget(samples)
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	insert, err := tx.Prepare("INSERT OR REPLACE INTO history (target, metric, time, value) VALUES (?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer insert.Close()
+	ts := historyTime(now)
+	for _, target := range targets {
+		for metric, value := range states[target] {
+			if math.IsNaN(value) {
+				continue
+			}
+			if _, err := insert.Exec(target, metric, ts, value); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// prune deletes every value recorded before cutoff.
+func (h *historyStore) prune(cutoff time.Time) error {
+	_, err := h.db.Exec("DELETE FROM history WHERE time < ?", historyTime(cutoff))
+	return err
+}
+
+// query returns the values of target's metrics recorded in [from, to], keyed by
+// metric name. An empty metric selects all metrics of the target. Metrics the target
+// has values of, but none in the range, are returned without values.
+func (h *historyStore) query(target, metric string, from, to time.Time) (map[string][][2]float64, error) {
+	result := make(map[string][][2]float64)
+	rows, err := h.db.Query("SELECT DISTINCT metric FROM history WHERE target = ? AND (? = '' OR metric = ?)", target, metric, metric)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		result[name] = [][2]float64{}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = h.db.Query("SELECT metric, time, value FROM history WHERE target = ? AND (? = '' OR metric = ?) AND time BETWEEN ? AND ? ORDER BY metric, time",
+		target, metric, metric, historyTime(from), historyTime(to))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			name  string
+			ms    int64
+			value float64
+		)
+		if err := rows.Scan(&name, &ms, &value); err != nil {
+			return nil, err
+		}
+		result[name] = append(result[name], [2]float64{float64(ms) / 1000, value})
+	}
+	return result, rows.Err()
+}
+
+// historyTime is the key of a time in the database, in Unix milliseconds.
+func historyTime(t time.Time) int64 {
+	return max(t.UnixMilli(), 0)
+}
+
+// ServeHTTP implements /api/v1/history?target=...&metric=...&from=...&to=...; from
+// and to accept RFC 3339 or Unix seconds and default to the last hour.
+func (h *historyStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	target, metric := q.Get("target"), q.Get("metric")
+	if target == "" {
+		http.Error(w, "missing target parameter", http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	from, err := parseHistoryTime(q.Get("from"), now.Add(-time.Hour))
+	if err != nil {
+		http.Error(w, "invalid from parameter: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	to, err := parseHistoryTime(q.Get("to"), now)
+	if err != nil {
+		http.Error(w, "invalid to parameter: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if from.After(to) {
+		http.Error(w, "from is after to", http.StatusBadRequest)
+		return
+	}
+
+	metrics, err := h.query(target, metric, from, to)
+	if err != nil {
+		slog.Error("Error querying history", "err", err)
+		http.Error(w, "query failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"target":  target,
+		"from":    from.UTC().Format(time.RFC3339),
+		"to":      to.UTC().Format(time.RFC3339),
+		"metrics": metrics,
+	})
+}
+
+func parseHistoryTime(s string, def time.Time) (time.Time, error) {
+	if s == "" {
+		return def, nil
+	}
+	if secs, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.UnixMilli(int64(secs * 1000)), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// historyTestTime is when the history tests start recording, more than an hour ago so
+// the default range of the API finds nothing.
+var historyTestTime = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+// newHistoryTest returns a history store in a temporary directory, with the loads of
+// rack-a and rack-b recorded every minute from historyTestTime for the given number of
+// minutes: 10, 11, 12, ... for rack-a and twice that for rack-b.
+func newHistoryTest(t *testing.T, minutes int) *historyStore {
+	t.Helper()
+	h, err := openHistoryStore(HistoryConfig{Path: filepath.Join(t.TempDir(), "history.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+
+	reg := prometheus.NewRegistry()
+	load := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "ups_load_percent", Help: "Output load in percent."}, []string{"target"})
+	status := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "ups_device_status_up", Help: "Whether the UPS is online (1=Yes, 0=No)."}, []string{"target"})
+	reg.MustRegister(load, status)
+	status.WithLabelValues("rack-a").Set(1)
+	status.WithLabelValues("rack-b").Set(1)
+	for i := range minutes {
+		load.WithLabelValues("rack-a").Set(float64(10 + i))
+		load.WithLabelValues("rack-b").Set(float64(2 * (10 + i)))
+		if err := h.record(reg, historyTestTime.Add(time.Duration(i)*time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return h
+}
+
+// historyPoint is a [unix_seconds, value] pair of the history API.
+type historyPoint = [2]float64
+
+// historyTestPoints returns the points of rack-a's load from minute first to last of
+// the test, inclusive.
+func historyTestPoints(first, last int) []historyPoint {
+	var points []historyPoint
+	for i := first; i <= last; i++ {
+		ts := historyTestTime.Add(time.Duration(i) * time.Minute).Unix()
+		points = append(points, historyPoint{float64(ts), float64(10 + i)})
+	}
+	return points
+}
+
+func TestHistoryOpen(t *testing.T) {
+	h, err := openHistoryStore(HistoryConfig{})
+	if h != nil || err != nil {
+		t.Errorf("without a path: %v, %v, want neither a store nor an error", h, err)
+	}
+	h = newHistoryTest(t, 0)
+	if h.cfg.Retention != 7*24*time.Hour || h.cfg.Interval != time.Minute {
+		t.Errorf("defaults %+v, want a retention of a week and an interval of a minute", h.cfg)
+	}
+	if _, err := openHistoryStore(HistoryConfig{Path: filepath.Join(t.TempDir(), "missing", "history.db")}); err == nil {
+		t.Error("opened a database in a missing directory")
+	}
+}
+
+// TestHistoryPrune checks that pruning drops the values recorded before the cutoff, of
+// every target and metric, and keeps those at and after it.
+func TestHistoryPrune(t *testing.T) {
+	h := newHistoryTest(t, 5)
+	if err := h.prune(historyTestTime.Add(2 * time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	got, err := h.query("rack-a", "ups_load_percent", historyTestTime.Add(-time.Hour), historyTestTime.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkHistoryPoints(t, got["ups_load_percent"], historyTestPoints(2, 4))
+	for _, target := range []string{"rack-a", "rack-b"} {
+		got, err := h.query(target, "", historyTestTime, historyTestTime.Add(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for metric, points := range got {
+			if len(points) != 3 {
+				t.Errorf("%s %s has %d points after pruning, want 3", target, metric, len(points))
+			}
+		}
+	}
+
+	// Pruning again with the same cutoff changes nothing, and a cutoff after the last
+	// value empties the buckets.
+	if err := h.prune(historyTestTime.Add(2 * time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	got, _ = h.query("rack-a", "ups_load_percent", historyTestTime, historyTestTime.Add(time.Hour))
+	checkHistoryPoints(t, got["ups_load_percent"], historyTestPoints(2, 4))
+	if err := h.prune(historyTestTime.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	got, _ = h.query("rack-a", "ups_load_percent", historyTestTime, historyTestTime.Add(time.Hour))
+	checkHistoryPoints(t, got["ups_load_percent"], nil)
+}
+
+// TestHistoryAPI checks the parameters and range of /api/v1/history.
+func TestHistoryAPI(t *testing.T) {
+	h := newHistoryTest(t, 5)
+	minute := func(i int) time.Time { return historyTestTime.Add(time.Duration(i) * time.Minute) }
+	unix := func(t time.Time) string { return strconv.FormatInt(t.Unix(), 10) }
+
+	for _, tc := range []struct {
+		name   string
+		params url.Values
+		status int
+		points []historyPoint // of rack-a's load
+	}{
+		{"RFC 3339", url.Values{"from": {minute(1).Format(time.RFC3339)}, "to": {minute(3).Format(time.RFC3339)}}, 200, historyTestPoints(1, 3)},
+		{"time zone", url.Values{"from": {minute(1).In(time.FixedZone("CEST", 2*3600)).Format(time.RFC3339)}, "to": {minute(1).Format(time.RFC3339)}}, 200, historyTestPoints(1, 1)},
+		{"Unix seconds", url.Values{"from": {unix(minute(2))}, "to": {unix(minute(4))}}, 200, historyTestPoints(2, 4)},
+		{"fractional seconds", url.Values{"from": {unix(minute(2)) + ".5"}, "to": {unix(minute(4)) + ".5"}}, 200, historyTestPoints(3, 4)},
+		{"open end", url.Values{"from": {unix(minute(3))}}, 200, historyTestPoints(3, 4)},
+		{"empty range", url.Values{"from": {unix(minute(10))}, "to": {unix(minute(20))}}, 200, []historyPoint{}},
+		{"default range", url.Values{}, 200, []historyPoint{}},
+		{"invalid from", url.Values{"from": {"yesterday"}}, 400, nil},
+		{"invalid to", url.Values{"to": {"2026-10-16"}}, 400, nil},
+		{"inverted range", url.Values{"from": {unix(minute(3))}, "to": {unix(minute(1))}}, 400, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.params.Set("target", "rack-a")
+			tc.params.Set("metric", "ups_load_percent")
+			status, res := historyRequest(t, h, tc.params)
+			if status != tc.status {
+				t.Fatalf("status %d, want %d", status, tc.status)
+			}
+			if status != 200 {
+				return
+			}
+			if len(res.Metrics) != 1 {
+				t.Errorf("got metrics %v, want ups_load_percent only", res.Metrics)
+			}
+			checkHistoryPoints(t, res.Metrics["ups_load_percent"], tc.points)
+		})
+	}
+
+	// The echoed range is the one queried, and to defaults to now.
+	params := url.Values{"target": {"rack-a"}, "metric": {"ups_load_percent"}, "from": {unix(minute(3))}}
+	before := time.Now().Truncate(time.Second)
+	_, res := historyRequest(t, h, params)
+	if res.From != minute(3).Format(time.RFC3339) {
+		t.Errorf("from %q, want %q", res.From, minute(3).Format(time.RFC3339))
+	}
+	if to, err := time.Parse(time.RFC3339, res.To); err != nil || to.Before(before) || to.After(time.Now()) {
+		t.Errorf("to %q, want now", res.To)
+	}
+
+	// Without a metric all of the target's are returned; another target has its own.
+	params = url.Values{"target": {"rack-b"}, "from": {unix(minute(0))}, "to": {unix(minute(0))}}
+	if status, res := historyRequest(t, h, params); status != 200 || res.Target != "rack-b" ||
+		len(res.Metrics["ups_load_percent"]) != 1 || res.Metrics["ups_load_percent"][0][1] != 20 ||
+		len(res.Metrics["ups_device_status_up"]) != 1 {
+		t.Errorf("all metrics of rack-b: status %d, %+v", status, res)
+	}
+	params = url.Values{"target": {"rack-a"}, "metric": {"ups_unknown"}, "from": {unix(minute(0))}, "to": {unix(minute(4))}}
+	if status, res := historyRequest(t, h, params); status != 200 || len(res.Metrics) != 0 {
+		t.Errorf("unknown metric: status %d, %+v, want no metrics", status, res)
+	}
+	params = url.Values{"target": {"rack-c"}, "from": {unix(minute(0))}, "to": {unix(minute(4))}}
+	if status, res := historyRequest(t, h, params); status != 200 || len(res.Metrics) != 0 {
+		t.Errorf("unknown target: status %d, %+v, want no metrics", status, res)
+	}
+	if status, _ := historyRequest(t, h, url.Values{"metric": {"ups_load_percent"}}); status != 400 {
+		t.Errorf("without a target: status %d, want 400", status)
+	}
+}
+
+// historyResponse is the body of /api/v1/history.
+type historyResponse struct {
+	Target  string                    `json:"target"`
+	From    string                    `json:"from"`
+	To      string                    `json:"to"`
+	Metrics map[string][]historyPoint `json:"metrics"`
+}
+
+func historyRequest(t *testing.T, h *historyStore, params url.Values) (int, historyResponse) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/api/v1/history?"+params.Encode(), nil))
+	var res historyResponse
+	if w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w.Code, res
+}
+
+func checkHistoryPoints(t *testing.T, got, want []historyPoint) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Errorf("got points %v, want %v", got, want)
+		return
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Errorf("got points %v, want %v", got, want)
+			return
+		}
+	}
+}
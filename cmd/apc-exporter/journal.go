@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Syslog priorities of journal entries.
+const (
+	priorityErr     = 3
+	priorityWarning = 4
+	priorityInfo    = 6
+	priorityDebug   = 7
+)
+
+// journalWriter sends log lines to journald over its native protocol, so entries carry
+// a priority and fields instead of being plain stderr lines.
+type journalWriter struct {
+	conn *net.UnixConn
+}
+
+// useJournal sends the log to journald if stderr is connected to it, as systemd
+// announces in JOURNAL_STREAM.
+func useJournal() {
+	stream := os.Getenv("JOURNAL_STREAM")
+	if stream == "" || stream != stderrStream() {
+		return
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: "/run/systemd/journal/socket", Net: "unixgram"})
+	if err != nil {
+		slog.Warn("Error connecting to journald, logging to stderr", "err", err)
+		return
+	}
+	logOutput.Lock()
+	logOutput.journal = &journalWriter{conn: conn}
+	logOutput.Unlock()
+}
+
+func (j *journalWriter) send(priority int, message string, fields map[string]string) error {
+	var b bytes.Buffer
+	field := func(name, value string) {
+		// Values with newlines are sent as name, newline, 64-bit length and value.
+		if strings.Contains(value, "\n") {
+			b.WriteString(name + "\n")
+			binary.Write(&b, binary.LittleEndian, uint64(len(value)))
+			b.WriteString(value + "\n")
+			return
+		}
+		b.WriteString(name + "=" + value + "\n")
+	}
+	field("MESSAGE", message)
+	field("PRIORITY", strconv.Itoa(priority))
+	field("SYSLOG_IDENTIFIER", "apc-exporter")
+	for name, value := range fields {
+		field(name, value)
+	}
+	_, err := j.conn.Write(b.Bytes())
+	return err
+}
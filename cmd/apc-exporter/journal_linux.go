@@ -0,0 +1,16 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// stderrStream identifies stderr as device:inode, the format of JOURNAL_STREAM.
+func stderrStream() string {
+	var st syscall.Stat_t
+	if err := syscall.Fstat(int(os.Stderr.Fd()), &st); err != nil {
+		return ""
+	}
+	return fmt.Sprintf("%d:%d", st.Dev, st.Ino)
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package main
+
+// stderrStream returns nothing outside Linux, where there is no journald.
+func stderrStream() string {
+	return ""
+}
@@ -0,0 +1,610 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Kafka API keys and the request versions used by the producer. These versions are
+// supported by every broker from Kafka 1.0 up to and including 4.x.
+const (
+	kafkaProduceKey          = 0
+	kafkaMetadataKey         = 3
+	kafkaSaslHandshakeKey    = 17
+	kafkaSaslAuthenticateKey = 36
+
+	kafkaProduceVersion          = 7
+	kafkaMetadataVersion         = 4
+	kafkaSaslHandshakeVersion    = 1
+	kafkaSaslAuthenticateVersion = 0
+)
+
+// KafkaConfig holds the settings for producing samples and events to Kafka.
+type KafkaConfig struct {
+	Brokers            []string      `yaml:"brokers"`
+	Topic              string        `yaml:"topic"`
+	EventsTopic        string        `yaml:"events_topic"`
+	Format             string        `yaml:"format"`
+	AvroSchemaID       int           `yaml:"avro_schema_id"`
+	AvroEventsSchemaID int           `yaml:"avro_events_schema_id"`
+	Interval           time.Duration `yaml:"interval"`
+	ClientID           string        `yaml:"client_id"`
+	TLS                bool          `yaml:"tls"`
+	InsecureSkipVerify bool          `yaml:"insecure_skip_verify"`
+	SASLUsername       string        `yaml:"sasl_username"`
+	SASLPassword       string        `yaml:"sasl_password"`
+}
+
+// kafkaRecord is a keyed message bound for a topic.
+type kafkaRecord struct {
+	topic string
+	key   []byte
+	value []byte
+	time  time.Time
+}
+
+// runKafka produces every poll's samples and the detected state changes on each
+// interval until the context is cancelled. It returns immediately if no brokers are
+// configured.
+func runKafka(ctx context.Context, cfg KafkaConfig, gatherer prometheus.Gatherer) {
+	if len(cfg.Brokers) == 0 {
+		return
+	}
+	if cfg.Topic == "" {
+		cfg.Topic = "ups-samples"
+	}
+	if cfg.EventsTopic == "" {
+		cfg.EventsTopic = "ups-events"
+	}
+	if cfg.Format == "" {
+		cfg.Format = "json"
+	}
+	if cfg.Format != "json" && cfg.Format != "avro" {
+		slog.Warn("Kafka output disabled: unsupported format", "format", cfg.Format)
+		return
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = time.Minute
+	}
+	gatherer = gatherWithin(gatherer, cfg.Interval)
+	if cfg.ClientID == "" {
+		cfg.ClientID = "apc-exporter"
+	}
+
+	var tracker stateTracker
+	slog.Info("Producing samples to Kafka", "format", cfg.Format, "topic", cfg.Topic, "interval", cfg.Interval)
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			records, err := kafkaPollRecords(cfg, gatherer, &tracker, now)
+			if err != nil {
+				slog.Error("Error gathering metrics for Kafka", "err", err)
+				continue
+			}
+			if err := produceKafka(ctx, cfg, records); err != nil {
+				slog.Warn("Error producing to Kafka", "err", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// kafkaPollRecords gathers the UPS metrics once and encodes one sample record per
+// target plus one event record per detected state change, keyed by target.
+func kafkaPollRecords(cfg KafkaConfig, gatherer prometheus.Gatherer, tracker *stateTracker, now time.Time) ([]kafkaRecord, error) {
+	samples, err := gatherSamples(gatherer, "ups_")
+	if err != nil {
+		return nil, err
+	}
+	targets, states := samplesByTarget(samples)
+
+	var records []kafkaRecord
+	for _, target := range targets {
+		var value []byte
+		if cfg.Format == "avro" {
+			value = avroSample(cfg.AvroSchemaID, now, target, states[target])
+		} else {
+			value, _ = json.Marshal(map[string]any{
+				"timestamp": now.UTC().Format(time.RFC3339),
+				"target":    target,
+				"metrics":   states[target],
+			})
+		}
+		records = append(records, kafkaRecord{topic: cfg.Topic, key: []byte(target), value: value, time: now})
+	}
+
+	for _, change := range tracker.update(now, states) {
+		var value []byte
+		if cfg.Format == "avro" {
+			value = avroStateChange(cfg.AvroEventsSchemaID, change)
+		} else {
+			value, _ = json.Marshal(change)
+		}
+		records = append(records, kafkaRecord{topic: cfg.EventsTopic, key: []byte(change.Target), value: value, time: now})
+	}
+	return records, nil
+}
+
+// Avro schemas of the records produced in avro format, for registering with a
+// schema registry or configuring consumers.
+const (
+	avroSampleSchema = `{"type":"record","name":"UPSSample","namespace":"apc_exporter","fields":[` +
+		`{"name":"timestamp","type":{"type":"long","logicalType":"timestamp-millis"}},` +
+		`{"name":"target","type":"string"},` +
+		`{"name":"metrics","type":{"type":"map","values":"double"}}]}`
+	avroStateChangeSchema = `{"type":"record","name":"UPSStateChange","namespace":"apc_exporter","fields":[` +
+		`{"name":"timestamp","type":{"type":"long","logicalType":"timestamp-millis"}},` +
+		`{"name":"target","type":"string"},` +
+		`{"name":"metric","type":"string"},` +
+		`{"name":"from","type":"double"},` +
+		`{"name":"to","type":"double"}]}`
+)
+
+// avroSample encodes a UPSSample datum. A non-zero schema ID selects the Confluent
+// wire format (magic byte and schema ID prefix).
+func avroSample(schemaID int, now time.Time, target string, metrics map[string]float64) []byte {
+	buf := avroPrefix(schemaID)
+	buf = avroLong(buf, now.UnixMilli())
+	buf = avroString(buf, target)
+
+	names := make([]string, 0, len(metrics))
+	for name := range metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if len(names) > 0 {
+		buf = avroLong(buf, int64(len(names)))
+		for _, name := range names {
+			buf = avroString(buf, name)
+			buf = avroDouble(buf, metrics[name])
+		}
+	}
+	return avroLong(buf, 0)
+}
+
+// avroStateChange encodes a UPSStateChange datum.
+func avroStateChange(schemaID int, change stateChange) []byte {
+	buf := avroPrefix(schemaID)
+	buf = avroLong(buf, change.Time.UnixMilli())
+	buf = avroString(buf, change.Target)
+	buf = avroString(buf, change.Metric)
+	buf = avroDouble(buf, change.From)
+	return avroDouble(buf, change.To)
+}
+
+func avroPrefix(schemaID int) []byte {
+	if schemaID == 0 {
+		return nil
+	}
+	return binary.BigEndian.AppendUint32([]byte{0}, uint32(schemaID))
+}
+
+func avroLong(buf []byte, n int64) []byte {
+	return binary.AppendVarint(buf, n)
+}
+
+func avroString(buf []byte, s string) []byte {
+	return append(avroLong(buf, int64(len(s))), s...)
+}
+
+func avroDouble(buf []byte, f float64) []byte {
+	return binary.LittleEndian.AppendUint64(buf, math.Float64bits(f))
+}
+
+// produceKafka sends the records to the leaders of their partitions, picking the
+// partition from the key the same way the Java client's default partitioner does.
+func produceKafka(ctx context.Context, cfg KafkaConfig, records []kafkaRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	topics := make(map[string]bool)
+	for _, r := range records {
+		topics[r.topic] = true
+	}
+
+	var bootstrap *kafkaConn
+	var err error
+	for _, broker := range cfg.Brokers {
+		if bootstrap, err = dialKafka(ctx, cfg, broker); err == nil {
+			break
+		}
+	}
+	if bootstrap == nil {
+		return fmt.Errorf("no broker reachable: %w", err)
+	}
+	defer bootstrap.Close()
+
+	meta, err := bootstrap.metadata(topics)
+	if err != nil {
+		return fmt.Errorf("metadata: %w", err)
+	}
+
+	// Group records per leader broker, topic and partition.
+	batches := make(map[int32]map[string]map[int32][]kafkaRecord)
+	for _, r := range records {
+		partitions := meta.partitions[r.topic]
+		if len(partitions) == 0 {
+			return fmt.Errorf("topic %s has no partitions available", r.topic)
+		}
+		partition := partitions[(murmur2(r.key)&0x7fffffff)%uint32(len(partitions))]
+		leader := meta.leaders[r.topic][partition]
+		if batches[leader] == nil {
+			batches[leader] = make(map[string]map[int32][]kafkaRecord)
+		}
+		if batches[leader][r.topic] == nil {
+			batches[leader][r.topic] = make(map[int32][]kafkaRecord)
+		}
+		batches[leader][r.topic][partition] = append(batches[leader][r.topic][partition], r)
+	}
+
+	var errs []error
+	for leader, byTopic := range batches {
+		addr, ok := meta.brokers[leader]
+		if !ok {
+			errs = append(errs, fmt.Errorf("leader %d unknown", leader))
+			continue
+		}
+		conn, err := dialKafka(ctx, cfg, addr)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if err := conn.produce(byTopic); err != nil {
+			errs = append(errs, fmt.Errorf("broker %s: %w", addr, err))
+		}
+		conn.Close()
+	}
+	return errors.Join(errs...)
+}
+
+// kafkaConn is a single broker connection speaking the Kafka binary protocol.
+type kafkaConn struct {
+	net.Conn
+	clientID      string
+	correlationID int32
+}
+
+func dialKafka(ctx context.Context, cfg KafkaConfig, addr string) (*kafkaConn, error) {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	var conn net.Conn
+	var err error
+	if cfg.TLS {
+		host, _, _ := net.SplitHostPort(addr)
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: &tls.Config{
+			ServerName:         host,
+			InsecureSkipVerify: cfg.InsecureSkipVerify,
+		}}).DialContext(ctx, "tcp", addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	c := &kafkaConn{Conn: conn, clientID: cfg.ClientID}
+	if cfg.SASLUsername != "" {
+		if err := c.saslPlain(cfg.SASLUsername, cfg.SASLPassword); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("SASL authentication with %s: %w", addr, err)
+		}
+	}
+	return c, nil
+}
+
+// roundTrip sends a request with a v1 request header and returns the response body
+// following the correlation ID.
+func (c *kafkaConn) roundTrip(apiKey, apiVersion int16, body []byte) ([]byte, error) {
+	c.correlationID++
+
+	var req kafkaEncoder
+	req.int16(apiKey)
+	req.int16(apiVersion)
+	req.int32(c.correlationID)
+	req.string(c.clientID)
+	req.buf.Write(body)
+
+	frame := binary.BigEndian.AppendUint32(nil, uint32(req.buf.Len()))
+	if _, err := c.Write(append(frame, req.buf.Bytes()...)); err != nil {
+		return nil, err
+	}
+
+	var size int32
+	if err := binary.Read(c, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+	if size < 4 || size > 16<<20 {
+		return nil, fmt.Errorf("invalid response size %d", size)
+	}
+	resp := make([]byte, size)
+	if _, err := io.ReadFull(c, resp); err != nil {
+		return nil, err
+	}
+	if int32(binary.BigEndian.Uint32(resp)) != c.correlationID {
+		return nil, errors.New("correlation ID mismatch")
+	}
+	return resp[4:], nil
+}
+
+// saslPlain performs a SASL/PLAIN handshake and authentication.
+func (c *kafkaConn) saslPlain(username, password string) error {
+	var handshake kafkaEncoder
+	handshake.string("PLAIN")
+	resp, err := c.roundTrip(kafkaSaslHandshakeKey, kafkaSaslHandshakeVersion, handshake.buf.Bytes())
+	if err != nil {
+		return err
+	}
+	d := kafkaDecoder{buf: resp}
+	if code := d.int16(); code != 0 {
+		return fmt.Errorf("handshake error code %d", code)
+	}
+
+	var auth kafkaEncoder
+	auth.bytes([]byte("\x00" + username + "\x00" + password))
+	if resp, err = c.roundTrip(kafkaSaslAuthenticateKey, kafkaSaslAuthenticateVersion, auth.buf.Bytes()); err != nil {
+		return err
+	}
+	d = kafkaDecoder{buf: resp}
+	if code := d.int16(); code != 0 {
+		return fmt.Errorf("error code %d: %s", code, d.string())
+	}
+	return d.err
+}
+
+// kafkaMetadata is the subset of a metadata response needed for producing.
+type kafkaMetadata struct {
+	brokers    map[int32]string
+	partitions map[string][]int32
+	leaders    map[string]map[int32]int32
+}
+
+func (c *kafkaConn) metadata(topics map[string]bool) (*kafkaMetadata, error) {
+	names := make([]string, 0, len(topics))
+	for topic := range topics {
+		names = append(names, topic)
+	}
+	sort.Strings(names)
+
+	var req kafkaEncoder
+	req.int32(int32(len(names)))
+	for _, name := range names {
+		req.string(name)
+	}
+	req.int8(0) // allow_auto_topic_creation
+
+	resp, err := c.roundTrip(kafkaMetadataKey, kafkaMetadataVersion, req.buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	meta := &kafkaMetadata{
+		brokers:    make(map[int32]string),
+		partitions: make(map[string][]int32),
+		leaders:    make(map[string]map[int32]int32),
+	}
+	d := kafkaDecoder{buf: resp}
+	d.int32() // throttle_time_ms
+	for n := d.int32(); n > 0 && d.err == nil; n-- {
+		id, host, port := d.int32(), d.string(), d.int32()
+		d.string() // rack
+		meta.brokers[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	d.string() // cluster_id
+	d.int32()  // controller_id
+	for n := d.int32(); n > 0 && d.err == nil; n-- {
+		code, topic := d.int16(), d.string()
+		d.int8() // is_internal
+		if code != 0 {
+			return nil, fmt.Errorf("topic %s: error code %d", topic, code)
+		}
+		meta.leaders[topic] = make(map[int32]int32)
+		for p := d.int32(); p > 0 && d.err == nil; p-- {
+			d.int16() // error_code
+			partition, leader := d.int32(), d.int32()
+			d.int32Array() // replica_nodes
+			d.int32Array() // isr_nodes
+			meta.partitions[topic] = append(meta.partitions[topic], partition)
+			meta.leaders[topic][partition] = leader
+		}
+		sort.Slice(meta.partitions[topic], func(i, j int) bool { return meta.partitions[topic][i] < meta.partitions[topic][j] })
+	}
+	return meta, d.err
+}
+
+// produce writes one record batch per partition with acks=all.
+func (c *kafkaConn) produce(byTopic map[string]map[int32][]kafkaRecord) error {
+	var req kafkaEncoder
+	req.int16(-1) // null transactional_id
+	req.int16(-1) // acks=all
+	req.int32(10000)
+	req.int32(int32(len(byTopic)))
+	for topic, partitions := range byTopic {
+		req.string(topic)
+		req.int32(int32(len(partitions)))
+		for partition, records := range partitions {
+			req.int32(partition)
+			req.bytes(kafkaRecordBatch(records))
+		}
+	}
+
+	resp, err := c.roundTrip(kafkaProduceKey, kafkaProduceVersion, req.buf.Bytes())
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	d := kafkaDecoder{buf: resp}
+	for n := d.int32(); n > 0 && d.err == nil; n-- {
+		topic := d.string()
+		for p := d.int32(); p > 0 && d.err == nil; p-- {
+			partition, code := d.int32(), d.int16()
+			d.int64() // base_offset
+			d.int64() // log_append_time_ms
+			d.int64() // log_start_offset
+			if code != 0 {
+				errs = append(errs, fmt.Errorf("%s[%d]: error code %d", topic, partition, code))
+			}
+		}
+	}
+	if d.err != nil {
+		return d.err
+	}
+	return errors.Join(errs...)
+}
+
+// kafkaRecordBatch encodes records in the v2 (magic 2) record batch format.
+func kafkaRecordBatch(records []kafkaRecord) []byte {
+	base := records[0].time.UnixMilli()
+	maxTimestamp := base
+
+	var recs []byte
+	for i, r := range records {
+		ts := r.time.UnixMilli()
+		maxTimestamp = max(maxTimestamp, ts)
+
+		var rec []byte
+		rec = append(rec, 0) // attributes
+		rec = binary.AppendVarint(rec, ts-base)
+		rec = binary.AppendVarint(rec, int64(i))
+		rec = binary.AppendVarint(rec, int64(len(r.key)))
+		rec = append(rec, r.key...)
+		rec = binary.AppendVarint(rec, int64(len(r.value)))
+		rec = append(rec, r.value...)
+		rec = binary.AppendVarint(rec, 0) // headers
+
+		recs = binary.AppendVarint(recs, int64(len(rec)))
+		recs = append(recs, rec...)
+	}
+
+	// Everything from attributes onwards is covered by the CRC-32C.
+	var tail kafkaEncoder
+	tail.int16(0) // attributes: no compression, create time
+	tail.int32(int32(len(records) - 1))
+	tail.int64(base)
+	tail.int64(maxTimestamp)
+	tail.int64(-1) // producer_id
+	tail.int16(-1) // producer_epoch
+	tail.int32(-1) // base_sequence
+	tail.int32(int32(len(records)))
+	tail.buf.Write(recs)
+
+	var batch kafkaEncoder
+	batch.int64(0) // base_offset
+	batch.int32(int32(4 + 1 + 4 + tail.buf.Len()))
+	batch.int32(-1) // partition_leader_epoch
+	batch.int8(2)   // magic
+	batch.int32(int32(crc32.Checksum(tail.buf.Bytes(), crc32.MakeTable(crc32.Castagnoli))))
+	batch.buf.Write(tail.buf.Bytes())
+	return batch.buf.Bytes()
+}
+
+// murmur2 is the hash used by Kafka's default partitioner for keyed records.
+func murmur2(data []byte) uint32 {
+	const (
+		seed = 0x9747b28c
+		m    = 0x5bd1e995
+		r    = 24
+	)
+	h := uint32(seed) ^ uint32(len(data))
+	for len(data) >= 4 {
+		k := binary.LittleEndian.Uint32(data)
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+		data = data[4:]
+	}
+	switch len(data) {
+	case 3:
+		h ^= uint32(data[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(data[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(data[0])
+		h *= m
+	}
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return h
+}
+
+// kafkaEncoder writes big-endian Kafka protocol primitives.
+type kafkaEncoder struct {
+	buf bytes.Buffer
+}
+
+func (e *kafkaEncoder) int8(v int8)   { e.buf.WriteByte(byte(v)) }
+func (e *kafkaEncoder) int16(v int16) { binary.Write(&e.buf, binary.BigEndian, v) }
+func (e *kafkaEncoder) int32(v int32) { binary.Write(&e.buf, binary.BigEndian, v) }
+func (e *kafkaEncoder) int64(v int64) { binary.Write(&e.buf, binary.BigEndian, v) }
+
+func (e *kafkaEncoder) string(s string) {
+	e.int16(int16(len(s)))
+	e.buf.WriteString(s)
+}
+
+func (e *kafkaEncoder) bytes(b []byte) {
+	e.int32(int32(len(b)))
+	e.buf.Write(b)
+}
+
+// kafkaDecoder reads big-endian Kafka protocol primitives, remembering the first
+// error so callers can check once at the end.
+type kafkaDecoder struct {
+	buf []byte
+	err error
+}
+
+func (d *kafkaDecoder) next(n int) []byte {
+	if d.err != nil || n < 0 || len(d.buf) < n {
+		if d.err == nil {
+			d.err = errors.New("truncated response")
+		}
+		return make([]byte, max(n, 0))
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *kafkaDecoder) int8() int8   { return int8(d.next(1)[0]) }
+func (d *kafkaDecoder) int16() int16 { return int16(binary.BigEndian.Uint16(d.next(2))) }
+func (d *kafkaDecoder) int32() int32 { return int32(binary.BigEndian.Uint32(d.next(4))) }
+func (d *kafkaDecoder) int64() int64 { return int64(binary.BigEndian.Uint64(d.next(8))) }
+
+func (d *kafkaDecoder) string() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(d.next(int(n)))
+}
+
+func (d *kafkaDecoder) int32Array() {
+	for n := d.int32(); n > 0 && d.err == nil; n-- {
+		d.int32()
+	}
+}
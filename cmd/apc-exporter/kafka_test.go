@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/linkedin/goavro/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/twmb/franz-go/pkg/kmsg"
+)
+
+// kafkaTestPartitions is the number of partitions of every topic of the test broker.
+const kafkaTestPartitions = 3
+
+// kafkaTestBroker is a single broker that leads every partition. It decodes the
+// requests with the protocol messages of franz-go, answers metadata requests, accepts
+// every produce request and sends it on the channel.
+func kafkaTestBroker(t *testing.T) (string, <-chan *kmsg.ProduceRequest) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	portNumber, _ := strconv.Atoi(port)
+
+	produced := make(chan *kmsg.ProduceRequest, 10)
+	serve := func(conn net.Conn) {
+		defer conn.Close()
+		for {
+			var size int32
+			if err := binary.Read(conn, binary.BigEndian, &size); err != nil {
+				return
+			}
+			frame := make([]byte, size)
+			if _, err := io.ReadFull(conn, frame); err != nil {
+				t.Error(err)
+				return
+			}
+			// Request header v1: api_key, api_version, correlation_id, client_id.
+			key, version := int16(binary.BigEndian.Uint16(frame)), int16(binary.BigEndian.Uint16(frame[2:]))
+			correlationID := frame[4:8]
+			clientID := int(binary.BigEndian.Uint16(frame[8:]))
+			body := frame[10+clientID:]
+
+			req := kmsg.RequestForKey(key)
+			if req == nil {
+				t.Errorf("unexpected API key %d", key)
+				return
+			}
+			req.SetVersion(version)
+			if err := req.ReadFrom(body); err != nil {
+				t.Errorf("decoding %s v%d: %v", kmsg.NameForKey(key), version, err)
+				return
+			}
+			var res kmsg.Response
+			switch req := req.(type) {
+			case *kmsg.MetadataRequest:
+				meta := req.ResponseKind().(*kmsg.MetadataResponse)
+				meta.Brokers = []kmsg.MetadataResponseBroker{{NodeID: 1, Host: host, Port: int32(portNumber)}}
+				for _, topic := range req.Topics {
+					rt := kmsg.MetadataResponseTopic{Topic: topic.Topic}
+					for p := range int32(kafkaTestPartitions) {
+						rt.Partitions = append(rt.Partitions, kmsg.MetadataResponseTopicPartition{Partition: p, Leader: 1, Replicas: []int32{1}, ISR: []int32{1}})
+					}
+					meta.Topics = append(meta.Topics, rt)
+				}
+				res = meta
+			case *kmsg.ProduceRequest:
+				produced <- req
+				resp := req.ResponseKind().(*kmsg.ProduceResponse)
+				for _, topic := range req.Topics {
+					rt := kmsg.ProduceResponseTopic{Topic: topic.Topic}
+					for _, p := range topic.Partitions {
+						rt.Partitions = append(rt.Partitions, kmsg.ProduceResponseTopicPartition{Partition: p.Partition})
+					}
+					resp.Topics = append(resp.Topics, rt)
+				}
+				res = resp
+			default:
+				t.Errorf("unexpected %s request", kmsg.NameForKey(key))
+				return
+			}
+			res.SetVersion(version)
+			out := append(append([]byte(nil), correlationID...), res.AppendTo(nil)...)
+			conn.Write(append(binary.BigEndian.AppendUint32(nil, uint32(len(out))), out...))
+		}
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+	return ln.Addr().String(), produced
+}
+
+// kafkaTestRecords decodes the record batch of a partition and returns its records,
+// checking the CRC-32C the brokers verify.
+func kafkaTestRecords(t *testing.T, raw []byte) (kmsg.RecordBatch, []kmsg.Record) {
+	t.Helper()
+	var batch kmsg.RecordBatch
+	if err := batch.ReadFrom(raw); err != nil {
+		t.Fatal(err)
+	}
+	// The CRC covers everything from the attributes on, after the first 21 bytes.
+	if crc := int32(crc32.Checksum(raw[21:], crc32.MakeTable(crc32.Castagnoli))); batch.Magic != 2 || batch.CRC != crc {
+		t.Errorf("magic %d, CRC %x, want 2 and %x", batch.Magic, batch.CRC, crc)
+	}
+	var records []kmsg.Record
+	for rest := batch.Records; len(rest) > 0; {
+		length, n := binary.Varint(rest)
+		var r kmsg.Record
+		if err := r.ReadFrom(rest[:n+int(length)]); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, r)
+		rest = rest[n+int(length):]
+	}
+	if len(records) != int(batch.NumRecords) || batch.LastOffsetDelta != batch.NumRecords-1 {
+		t.Errorf("%d records, batch has %d with last offset delta %d", len(records), batch.NumRecords, batch.LastOffsetDelta)
+	}
+	return batch, records
+}
+
+// TestProduceKafka checks the produce requests a broker receives: every record in
+// the partition its key hashes to, in a batch a broker accepts, with the JSON samples
+// and state changes as values.
+func TestProduceKafka(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	load := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "ups_load_percent", Help: "Output load in percent."}, []string{"target"})
+	up := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "ups_device_status_up", Help: "Whether the UPS is online."}, []string{"target"})
+	reg.MustRegister(load, up)
+	for _, target := range []string{"rack-a", "rack-b", "rack-c"} {
+		load.WithLabelValues(target).Set(20)
+		up.WithLabelValues(target).Set(1)
+	}
+
+	addr, produced := kafkaTestBroker(t)
+	cfg := KafkaConfig{Brokers: []string{addr}, Topic: "ups-samples", EventsTopic: "ups-events", Format: "json", ClientID: "apc-exporter"}
+	var tracker stateTracker
+	if _, err := kafkaPollRecords(cfg, reg, &tracker, historyTestTime); err != nil {
+		t.Fatal(err)
+	}
+	up.WithLabelValues("rack-b").Set(0)
+	now := historyTestTime.Add(time.Minute)
+	records, err := kafkaPollRecords(cfg, reg, &tracker, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := produceKafka(t.Context(), cfg, records); err != nil {
+		t.Fatal(err)
+	}
+
+	req := <-produced
+	if req.Acks != -1 || req.TransactionID != nil {
+		t.Errorf("acks %d, transactional ID %v, want acks=all and none", req.Acks, req.TransactionID)
+	}
+	samples := make(map[string]map[string]float64)
+	var changes []stateChange
+	for _, topic := range req.Topics {
+		for _, p := range topic.Partitions {
+			batch, recs := kafkaTestRecords(t, p.Records)
+			if batch.FirstTimestamp != now.UnixMilli() {
+				t.Errorf("first timestamp %d, want %d", batch.FirstTimestamp, now.UnixMilli())
+			}
+			for _, r := range recs {
+				if want := int32(murmur2(r.Key)&0x7fffffff) % kafkaTestPartitions; p.Partition != want {
+					t.Errorf("record of %s in partition %d, want %d", r.Key, p.Partition, want)
+				}
+				switch topic.Topic {
+				case "ups-samples":
+					var sample struct {
+						Timestamp time.Time          `json:"timestamp"`
+						Target    string             `json:"target"`
+						Metrics   map[string]float64 `json:"metrics"`
+					}
+					if err := json.Unmarshal(r.Value, &sample); err != nil {
+						t.Fatal(err)
+					}
+					if sample.Target != string(r.Key) || !sample.Timestamp.Equal(now) {
+						t.Errorf("sample of %s at %v keyed %s", sample.Target, sample.Timestamp, r.Key)
+					}
+					samples[sample.Target] = sample.Metrics
+				case "ups-events":
+					var change stateChange
+					if err := json.Unmarshal(r.Value, &change); err != nil {
+						t.Fatal(err)
+					}
+					changes = append(changes, change)
+				default:
+					t.Errorf("record for topic %s", topic.Topic)
+				}
+			}
+		}
+	}
+	if len(samples) != 3 || samples["rack-b"]["ups_device_status_up"] != 0 || samples["rack-a"]["ups_load_percent"] != 20 {
+		t.Errorf("samples %v", samples)
+	}
+	want := stateChange{Time: now, Target: "rack-b", Metric: "ups_device_status_up", From: 1, To: 0}
+	if len(changes) == 1 && changes[0].Time.Equal(now) {
+		changes[0].Time = now // decoded in UTC
+	}
+	if len(changes) != 1 || changes[0] != want {
+		t.Errorf("state changes %v, want %v", changes, want)
+	}
+}
+
+// TestMurmur2 checks the partitioner hash against the known answers of Kafka's own
+// tests (org.apache.kafka.common.utils.UtilsTest).
+func TestMurmur2(t *testing.T) {
+	for key, want := range map[string]int32{
+		"21":                         -973932308,
+		"foobar":                     -790332482,
+		"a-little-bit-long-string":   -985981536,
+		"a-little-bit-longer-string": -1486304829,
+		"lkjh234lh9fiuh90y23oiuhsafujhadof229phr9h19h89h8": -58897971,
+		"abc": 479470107,
+	} {
+		if got := int32(murmur2([]byte(key))); got != want {
+			t.Errorf("murmur2(%q) = %d, want %d", key, got, want)
+		}
+	}
+}
+
+// TestKafkaAvro checks that the Avro records decode with their schemas, with and
+// without the prefix of the Confluent wire format.
+func TestKafkaAvro(t *testing.T) {
+	sampleCodec, err := goavro.NewCodec(avroSampleSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changeCodec, err := goavro.NewCodec(avroStateChangeSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, schemaID := range []int{0, 42} {
+		metrics := map[string]float64{"ups_load_percent": 23.5, "ups_device_status_up": 1}
+		sample := avroSample(schemaID, historyTestTime, "rack-a", metrics)
+		change := avroStateChange(schemaID, stateChange{Time: historyTestTime, Target: "rack-a", Metric: "ups_device_status_up", From: 1, To: 0})
+		if schemaID != 0 {
+			prefix := []byte{0, 0, 0, 0, 42}
+			if string(sample[:5]) != string(prefix) || string(change[:5]) != string(prefix) {
+				t.Fatalf("prefixes % x and % x, want % x", sample[:5], change[:5], prefix)
+			}
+			sample, change = sample[5:], change[5:]
+		}
+
+		native, rest, err := sampleCodec.NativeFromBinary(sample)
+		if err != nil || len(rest) > 0 {
+			t.Fatalf("decoding the sample: %v, %d bytes left", err, len(rest))
+		}
+		record := native.(map[string]any)
+		decoded := record["metrics"].(map[string]any)
+		if !record["timestamp"].(time.Time).Equal(historyTestTime) || record["target"] != "rack-a" || len(decoded) != 2 || decoded["ups_load_percent"] != 23.5 || decoded["ups_device_status_up"] != 1.0 {
+			t.Errorf("sample %v", record)
+		}
+
+		native, rest, err = changeCodec.NativeFromBinary(change)
+		if err != nil || len(rest) > 0 {
+			t.Fatalf("decoding the state change: %v, %d bytes left", err, len(rest))
+		}
+		record = native.(map[string]any)
+		if !record["timestamp"].(time.Time).Equal(historyTestTime) || record["target"] != "rack-a" || record["metric"] != "ups_device_status_up" || record["from"] != 1.0 || record["to"] != 0.0 {
+			t.Errorf("state change %v", record)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"log/slog"
+	"math"
+	"os"
+	"runtime"
+	"runtime/debug"
+)
+
+// applyResourceLimits sizes the Go runtime to the container: GOMAXPROCS follows the
+// cgroup CPU limit unless maxProcs is given, and the Go memory limit is memoryRatio of
+// the cgroup memory limit, so the garbage collector works harder before the container
+// is OOM-killed. The GOMAXPROCS and GOMEMLIMIT environment variables take precedence.
+func applyResourceLimits(maxProcs int, memoryRatio float64) {
+	if os.Getenv("GOMAXPROCS") == "" {
+		if maxProcs <= 0 {
+			if cpus, ok := cgroupCPULimit(); ok {
+				maxProcs = max(1, int(math.Ceil(cpus)))
+			}
+		}
+		if maxProcs > 0 && maxProcs != runtime.GOMAXPROCS(0) {
+			runtime.GOMAXPROCS(maxProcs)
+			slog.Info("GOMAXPROCS set", "procs", maxProcs)
+		}
+	}
+	if os.Getenv("GOMEMLIMIT") == "" && memoryRatio > 0 {
+		if limit, ok := cgroupMemoryLimit(); ok {
+			debug.SetMemoryLimit(int64(float64(limit) * memoryRatio))
+			slog.Info("Go memory limit set", "limit_mib", int64(float64(limit)*memoryRatio)>>20, "ratio", memoryRatio, "container_mib", limit>>20)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// cgroupRoot is where the cgroup file systems are mounted.
+var cgroupRoot = "/sys/fs/cgroup"
+
+// cgroupFile reads a file of the cgroup of this process, from the cgroup v2 hierarchy
+// if controller is empty and from the v1 controller otherwise. Inside a container the
+// cgroup is usually mounted as the root, so that is tried as well.
+func cgroupFile(controller, name string) (string, bool) {
+	data, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		if controller == "" && (parts[0] != "0" || parts[1] != "") ||
+			controller != "" && !slices.Contains(strings.Split(parts[1], ","), controller) {
+			continue
+		}
+		dir := filepath.Join(cgroupRoot, controller)
+		for _, d := range []string{filepath.Join(dir, parts[2]), dir} {
+			if b, err := os.ReadFile(filepath.Join(d, name)); err == nil {
+				return strings.TrimSpace(string(b)), true
+			}
+		}
+	}
+	return "", false
+}
+
+// cgroupCPULimit returns the CPU limit in cores, if there is one.
+func cgroupCPULimit() (float64, bool) {
+	var quota, period string
+	if s, ok := cgroupFile("", "cpu.max"); ok {
+		quota, period, _ = strings.Cut(s, " ")
+	} else {
+		quota, _ = cgroupFile("cpu", "cpu.cfs_quota_us")
+		period, _ = cgroupFile("cpu", "cpu.cfs_period_us")
+	}
+	q, err1 := strconv.ParseFloat(quota, 64)
+	p, err2 := strconv.ParseFloat(period, 64)
+	// The quota is "max" (v2) or -1 (v1) without a limit.
+	if err1 != nil || err2 != nil || q <= 0 || p <= 0 {
+		return 0, false
+	}
+	return q / p, true
+}
+
+// cgroupMemoryLimit returns the memory limit in bytes, if there is one.
+func cgroupMemoryLimit() (int64, bool) {
+	s, ok := cgroupFile("", "memory.max")
+	if !ok {
+		s, ok = cgroupFile("memory", "memory.limit_in_bytes")
+	}
+	limit, err := strconv.ParseInt(s, 10, 64)
+	// The limit is "max" (v2) or close to the largest int64 (v1) without a limit.
+	if !ok || err != nil || limit <= 0 || limit > 1<<60 {
+		return 0, false
+	}
+	return limit, true
+}
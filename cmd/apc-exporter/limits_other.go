@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+// cgroupCPULimit reports no limit outside Linux.
+func cgroupCPULimit() (float64, bool) {
+	return 0, false
+}
+
+// cgroupMemoryLimit reports no limit outside Linux.
+func cgroupMemoryLimit() (int64, bool) {
+	return 0, false
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// logOutput is where the log goes: the journal if the exporter runs under systemd, or
+// else stderr, the log file or whatever a command sends it to with setLogOutput.
+var logOutput = struct {
+	sync.Mutex
+	w       io.Writer
+	journal *journalWriter
+}{w: os.Stderr}
+
+// setLogOutput sends the log to w instead of stderr or the journal.
+func setLogOutput(w io.Writer) {
+	logOutput.Lock()
+	defer logOutput.Unlock()
+	logOutput.w, logOutput.journal = w, nil
+}
+
+// logSink writes the lines of the text and JSON handlers to the log output.
+type logSink struct{}
+
+func (logSink) Write(p []byte) (int, error) {
+	logOutput.Lock()
+	defer logOutput.Unlock()
+	return logOutput.w.Write(p)
+}
+
+// setupLogging sends the log through slog, at the level given (debug, info, warn or
+// error) and as text or JSON lines. The lines of the standard logger, which only
+// libraries still use, are passed on at info level.
+func setupLogging(level, format string) error {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return fmt.Errorf("-log.level: %w", err)
+	}
+	opts := &slog.HandlerOptions{Level: l}
+	var inner slog.Handler
+	switch format {
+	case "text":
+		inner = slog.NewTextHandler(logSink{}, opts)
+	case "json":
+		inner = slog.NewJSONHandler(logSink{}, opts)
+	default:
+		return fmt.Errorf("-log.format: unknown format %q, must be text or json", format)
+	}
+	slog.SetDefault(slog.New(&logHandler{level: l, inner: inner}))
+	return nil
+}
+
+// fatal logs an error and exits, as log.Fatalf did.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// logHandler writes records with the text or JSON handler, or sends them to the
+// journal with their attributes as fields, such as TARGET and STAGE.
+type logHandler struct {
+	level slog.Level
+	inner slog.Handler
+	attrs []slog.Attr // for the journal, added by WithAttrs
+}
+
+func (h *logHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.level
+}
+
+func (h *logHandler) Handle(ctx context.Context, r slog.Record) error {
+	logOutput.Lock()
+	journal := logOutput.journal
+	logOutput.Unlock()
+	if journal == nil {
+		return h.inner.Handle(ctx, r)
+	}
+	fields := make(map[string]string)
+	add := func(a slog.Attr) bool {
+		fields[journalField(a.Key)] = a.Value.String()
+		return true
+	}
+	for _, a := range h.attrs {
+		add(a)
+	}
+	r.Attrs(add)
+	if err := journal.send(levelPriority(r.Level), r.Message, fields); err != nil {
+		return h.inner.Handle(ctx, r)
+	}
+	return nil
+}
+
+func (h *logHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &logHandler{level: h.level, inner: h.inner.WithAttrs(attrs), attrs: append(slices.Clone(h.attrs), attrs...)}
+}
+
+func (h *logHandler) WithGroup(name string) slog.Handler {
+	return &logHandler{level: h.level, inner: h.inner.WithGroup(name), attrs: h.attrs}
+}
+
+// journalField turns an attribute key into a journal field name, such as TARGET.
+func journalField(key string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, key)
+}
+
+// priorityLevel returns the slog level of a syslog priority.
+func priorityLevel(priority int) slog.Level {
+	switch {
+	case priority <= priorityErr:
+		return slog.LevelError
+	case priority == priorityWarning:
+		return slog.LevelWarn
+	case priority >= priorityDebug:
+		return slog.LevelDebug
+	}
+	return slog.LevelInfo
+}
+
+// levelPriority returns the syslog priority of a slog level.
+func levelPriority(level slog.Level) int {
+	switch {
+	case level >= slog.LevelError:
+		return priorityErr
+	case level >= slog.LevelWarn:
+		return priorityWarning
+	case level >= slog.LevelInfo:
+		return priorityInfo
+	}
+	return priorityDebug
+}
+
+// logStage logs a message about a stage of polling a target, such as login, scrape or
+// parse, with the target and stage as attributes.
+func logStage(priority int, target, stage, format string, args ...any) {
+	ctx := context.Background()
+	level := priorityLevel(priority)
+	if !slog.Default().Enabled(ctx, level) {
+		return
+	}
+	slog.Log(ctx, level, fmt.Sprintf(format, args...), "target", target, "stage", stage)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+
+	"github.com/veter2005/apc-exporter/pkg/nmc"
+)
+
+// runLoginTestCommand implements the login-test command: it goes through the login
+// of one target step by step and prints the outcome of each, to tell wrong
+// credentials from a card the exporter cannot parse. With -v it also prints the
+// redirects followed.
+func runLoginTestCommand(cfg Config, args []string) error {
+	flags := flag.NewFlagSet("login-test", flag.ContinueOnError)
+	name := flags.String("target", "", "Name or URL of the target to log in to (default the only configured target)")
+	username := flags.String("username", "", "Username to log in with instead of the configured one")
+	password := flags.String("password", "", "Password to log in with instead of the configured one")
+	verbose := flags.Bool("v", false, "Print the redirects followed")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	target, err := cardTarget(cfg, *name, *username, *password)
+	if err != nil {
+		return err
+	}
+
+	client, err := newTargetHTTPClient(target)
+	if err != nil {
+		return err
+	}
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if *verbose {
+			fmt.Printf("   -> %d redirect to %s\n", req.Response.StatusCode, req.URL)
+		}
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		return nil
+	}
+	useRecordings(client, target)
+	fmt.Printf("Logging in to %s at %s as %q\n", target.Name, target.URL, target.Username)
+
+	// Step 1: the logon page and its form tokens.
+	doc, res, err := loginTestGet(client, target.URL+LOGONPAGEURL)
+	fmt.Printf("1. GET %s%s: %s\n", target.URL, LOGONPAGEURL, loginTestStatus(res, err))
+	if err != nil {
+		return fmt.Errorf("the logon page cannot be loaded: %w", err)
+	}
+	formToken, hasToken := doc.Find("input[name=\"formtoken\"]").Attr("value")
+	formTokenID, hasTokenID := doc.Find("input[name=\"formtokenid\"]").Attr("value")
+	switch {
+	case hasToken && hasTokenID:
+		fmt.Printf("   form token found\n")
+	case doc.Find("input[name=\"j_username\"]").Length() > 0:
+		fmt.Printf("   no form token, but a login form; logging in without one\n")
+	default:
+		fmt.Printf("   no form token and no login form: this does not look like a logon page\n")
+	}
+	profile, matched := nmc.DetectProfile(doc)
+	switch p := nmc.LookupProfile(target.Profile); {
+	case p != nil:
+		profile = p
+		fmt.Printf("   parser profile %s, as configured\n", profile.Name)
+	case matched:
+		fmt.Printf("   parser profile %s detected\n", profile.Name)
+	default:
+		fmt.Printf("   no parser profile matches, using %s\n", profile.Name)
+	}
+	deviceStatus := profile.Status.DeviceStatus
+
+	// Step 2: the login itself. Cards answer wrong credentials with the logon page.
+	res, err = client.Post(target.URL+LOGINURL, "application/x-www-form-urlencoded", strings.NewReader(nmc.LoginForm(target.Target, formToken, formTokenID)))
+	fmt.Printf("2. POST %s%s: %s\n", target.URL, LOGINURL, loginTestStatus(res, err))
+	if err != nil {
+		return fmt.Errorf("the login failed: %w", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("the login failed with status %s", res.Status)
+	}
+	if strings.HasPrefix(res.Request.URL.Path, LOGONPAGEURL) {
+		return errors.New("the card sent the logon page again: the credentials are wrong")
+	}
+	session := nmc.SessionPath(res.Request.URL)
+	if session != "" {
+		fmt.Printf("   session path %s\n", session)
+	}
+
+	// Step 3: the status page the metrics are read from, in the session path if any.
+	doc, res, err = loginTestGet(client, target.URL+session+STATUSURL)
+	fmt.Printf("3. GET %s%s%s: %s\n", target.URL, session, STATUSURL, loginTestStatus(res, err))
+	if err != nil {
+		return fmt.Errorf("the status page cannot be loaded: %w", err)
+	}
+	if strings.HasPrefix(res.Request.URL.Path, LOGONPAGEURL) || doc.Find("input[name=\"formtoken\"]").Length() > 0 && doc.Find(deviceStatus).Length() == 0 {
+		return errors.New("the card sent the logon page instead of the status page: the credentials are wrong")
+	}
+	if doc.Find(deviceStatus).Length() == 0 {
+		return fmt.Errorf("logged in, but the status page has no device status where parser profile %s expects it: set parser_profile for the target, or report it with the pages saved by dump-pages", profile.Name)
+	}
+	fmt.Printf("   device status %q found\n", strings.TrimSpace(doc.Find(deviceStatus).Text()))
+	fmt.Printf("Login to %s OK\n", target.Name)
+	return nil
+}
+
+// loginTestGet loads and parses a page. Statuses other than 200 are errors.
+func loginTestGet(client *http.Client, url string) (*goquery.Document, *http.Response, error) {
+	res, err := client.Get(url)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, res, fmt.Errorf("status %s", res.Status)
+	}
+	doc, err := goquery.NewDocumentFromReader(res.Body)
+	return doc, res, err
+}
+
+// loginTestStatus describes the response of a step, or why there is none. The URL
+// is given if it was redirected.
+func loginTestStatus(res *http.Response, err error) string {
+	switch {
+	case res == nil:
+		return err.Error()
+	case res.Request.Response != nil:
+		return res.Status + " from " + res.Request.URL.String()
+	}
+	return res.Status
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// LokiConfig holds the settings for pushing event log entries to Grafana Loki.
+type LokiConfig struct {
+	URL      string            `yaml:"url"`
+	TenantID string            `yaml:"tenant_id"`
+	Username string            `yaml:"username"`
+	Password string            `yaml:"password"`
+	Labels   map[string]string `yaml:"labels"`
+	Timeout  time.Duration     `yaml:"timeout"`
+}
+
+// lokiStream is one stream of the push API's JSON body.
+type lokiStream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+}
+
+// newLokiSink returns an event sink pushing to Loki, or nil if no URL is configured.
+func newLokiSink(cfg LokiConfig) eventSink {
+	if cfg.URL == "" {
+		return nil
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+
+	pushURL := cfg.URL
+	if u, err := url.Parse(cfg.URL); err == nil && (u.Path == "" || u.Path == "/") {
+		u.Path = "/loki/api/v1/push"
+		pushURL = u.String()
+	}
+	client := &http.Client{Timeout: cfg.Timeout}
+
+	slog.Info("Pushing event log entries to Loki", "url", pushURL)
+	return func(ctx context.Context, events []event) error {
+		return pushLoki(ctx, client, cfg, pushURL, events)
+	}
+}
+
+// pushLoki sends the events as one stream per target and severity, carrying the
+// configured static labels as well. Events are sent as received, e.g. the full
+// event log row.
+func pushLoki(ctx context.Context, client *http.Client, cfg LokiConfig, pushURL string, events []event) error {
+	streams := make(map[[2]string]*lokiStream)
+	var order []*lokiStream
+	for _, e := range events {
+		key := [2]string{e.Target, e.Severity}
+		stream, ok := streams[key]
+		if !ok {
+			labels := map[string]string{"job": "apc-exporter"}
+			for k, v := range cfg.Labels {
+				labels[k] = v
+			}
+			labels["target"], labels["severity"] = e.Target, e.Severity
+			stream = &lokiStream{Stream: labels}
+			streams[key] = stream
+			order = append(order, stream)
+		}
+		line := e.Raw
+		if line == "" {
+			line = e.Message
+		}
+		stream.Values = append(stream.Values, [2]string{strconv.FormatInt(e.Time.UnixNano(), 10), line})
+	}
+
+	body, err := json.Marshal(map[string]any{"streams": order})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, pushURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if cfg.TenantID != "" {
+		req.Header.Set("X-Scope-OrgID", cfg.TenantID)
+	}
+	if cfg.Username != "" {
+		req.SetBasicAuth(cfg.Username, cfg.Password)
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return fmt.Errorf("server returned HTTP status %d: %s", res.StatusCode, bytes.TrimSpace(msg))
+	}
+	return nil
+}
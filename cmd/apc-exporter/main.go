@@ -0,0 +1,534 @@
+package main
+
+import (
+	"context"
+	"flag" // Import the flag package
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"slices"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/exporter-toolkit/web"
+
+	"github.com/veter2005/apc-exporter/pkg/collector"
+	"github.com/veter2005/apc-exporter/pkg/nmc"
+)
+
+// Config holds the values read from the configuration file.
+type Config struct {
+	UPSURL   string `yaml:"ups_url"`
+	USERNAME string `yaml:"username"`
+	PASSWORD string `yaml:"password"`
+	// PasswordFile is read into the password, so it need not be in the config.
+	PasswordFile string `yaml:"password_file"`
+
+	Targets []TargetConfig `yaml:"targets"`
+	// StatusStrings map the device statuses of all targets, after those of each target.
+	StatusStrings []nmc.StatusString `yaml:"status_strings"`
+	// AuthModules are the credentials for /probe by name.
+	AuthModules map[string]AuthModule `yaml:"auth_modules"`
+
+	Graphite GraphiteConfig `yaml:"graphite"`
+	StatsD   StatsDConfig   `yaml:"statsd"`
+	MQTT     MQTTConfig     `yaml:"mqtt"`
+	OTLP     OTLPConfig     `yaml:"otlp"`
+
+	FileOutput FileOutputConfig `yaml:"file_output"`
+	Zabbix     ZabbixConfig     `yaml:"zabbix"`
+	SNMPAgent  SNMPAgentConfig  `yaml:"snmp_agent"`
+	Kafka      KafkaConfig      `yaml:"kafka"`
+	NATS       NATSConfig       `yaml:"nats"`
+
+	RemoteWrite RemoteWriteConfig   `yaml:"remote_write"`
+	Webhooks    WebhookConfig       `yaml:"webhooks"`
+	Transitions TransitionsConfig   `yaml:"transitions"`
+	Email       EmailConfig         `yaml:"email"`
+	Chat        []ChatConfig        `yaml:"chat"`
+	Ntfy        NtfyConfig          `yaml:"ntfy"`
+	PagerDuty   PagerDutyConfig     `yaml:"pagerduty"`
+	Maintenance []MaintenanceWindow `yaml:"maintenance"`
+
+	Alertmanager AlertmanagerConfig `yaml:"alertmanager"`
+
+	PassiveChecks PassiveCheckConfig `yaml:"passive_checks"`
+
+	Energy         EnergyConfig          `yaml:"energy"`
+	DerivedMetrics []DerivedMetricConfig `yaml:"derived_metrics"`
+
+	EventLog  EventLogConfig     `yaml:"event_log"`
+	SNMPTraps TrapReceiverConfig `yaml:"snmp_traps"`
+	Syslog    SyslogConfig       `yaml:"syslog"`
+	Loki      LokiConfig         `yaml:"loki"`
+
+	Control  ControlConfig  `yaml:"control"`
+	Shutdown ShutdownConfig `yaml:"shutdown"`
+
+	History HistoryConfig `yaml:"history"`
+	State   StateConfig   `yaml:"state"`
+
+	HA HAConfig `yaml:"high_availability"`
+}
+
+// TargetConfig describes a single UPS to scrape: a network management card, read through
+// its web interface, with backend snmp over SNMP or with backend modbus over Modbus TCP,
+// a UPS attached to a host running apcupsd with backend apcupsd, or a device read by an
+// external program with backend exec.
+type TargetConfig struct {
+	nmc.Target `yaml:",inline"`
+	// PasswordFile is read into the password, so it need not be in the config.
+	PasswordFile string `yaml:"password_file"`
+
+	Backend string `yaml:"backend"` // web (the default), snmp, modbus, apcupsd or exec
+	// Mode is another name of Backend, as in mode: snmp, which other exporters use.
+	Mode    string        `yaml:"mode"`
+	Exec    ExecConfig    `yaml:"exec"`
+	SNMP    SNMPConfig    `yaml:"snmp"`
+	Modbus  ModbusConfig  `yaml:"modbus"`
+	Apcupsd ApcupsdConfig `yaml:"apcupsd"`
+	// Fahrenheit also exports the internal temperature in Fahrenheit.
+	Fahrenheit bool `yaml:"fahrenheit"`
+	// Strict fails scrapes with values missing, instead of sending 0 for them.
+	Strict bool `yaml:"strict"`
+	// Units exports the gauges in legacy units (the default), base units, or both.
+	Units string `yaml:"units"`
+	// InfoRefresh is how long the about and battery pages are cached, an hour if zero.
+	InfoRefresh time.Duration `yaml:"info_refresh"`
+
+	// InsecureSkipVerify accepts any certificate of the card, such as the self-signed
+	// one it ships with.
+	InsecureSkipVerify bool `yaml:"insecure_skip_verify"`
+	// CAFile verifies the certificate of the card against the CAs of this PEM file
+	// instead of the system ones.
+	CAFile string `yaml:"ca_file"`
+	// CertFile and KeyFile are a client certificate presented to the card.
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// ScrapeTimeout bounds a scrape of the target, including the login, and every
+	// request to its card; 30s if zero.
+	ScrapeTimeout time.Duration `yaml:"scrape_timeout"`
+	// PollInterval, if set, scrapes the target in the background at this interval, and
+	// scrapes of the exporter are served the metrics of the last one.
+	PollInterval time.Duration `yaml:"poll_interval"`
+}
+
+// targetConfigs returns the configured targets. The top-level ups_url, username and
+// password are treated as one more target so existing single-UPS configs keep working.
+// Targets without a name are named after the host of their URL, and the top-level
+// status_strings follow those of each target.
+func (c Config) targetConfigs() []TargetConfig {
+	targets := append([]TargetConfig(nil), c.Targets...)
+	if c.UPSURL != "" {
+		targets = append(targets, TargetConfig{Target: nmc.Target{URL: c.UPSURL, Username: c.USERNAME, Password: c.PASSWORD}})
+	}
+	for i := range targets {
+		targets[i].StatusStrings = slices.Concat(targets[i].StatusStrings, c.StatusStrings)
+		if targets[i].Name == "" {
+			if u, err := url.Parse(targets[i].URL); err == nil && u.Hostname() != "" {
+				targets[i].Name = u.Hostname()
+			} else {
+				targets[i].Name = targets[i].URL
+			}
+		}
+	}
+	return targets
+}
+
+// Define your application constants.
+const (
+	LOGINURL     = nmc.LoginPath
+	LOGONPAGEURL = nmc.LogonPagePath
+	STATUSURL    = nmc.StatusPath
+)
+
+// upsCollector scrapes one card.
+type upsCollector = collector.Collector
+
+// newUPSCollector returns the collector of a target, which logs through logStage so
+// the target and stage reach the journal. The trap receiver and the rated power of the
+// energy settings of cfg shape its metrics.
+func newUPSCollector(cfg Config, client *http.Client, target TargetConfig) (*upsCollector, error) {
+	if client != nil {
+		useRecordings(client, target)
+	}
+	nc := nmc.NewClient(client, target.Target)
+	nc.Log = func(priority int, stage, format string, args ...any) {
+		logStage(priority, target.Name, stage, format, args...)
+	}
+	opts := []collector.Option{collector.WithClient(nc), collector.WithLogger(logStage), collector.WithTimeout(target.scrapeTimeout())}
+	if target.Fahrenheit {
+		opts = append(opts, collector.WithFahrenheit())
+	}
+	if target.Strict {
+		opts = append(opts, collector.WithStrict())
+	}
+	if target.Units != "" {
+		opts = append(opts, collector.WithUnits(target.Units))
+	}
+	// The trap receiver sets ups_on_battery as soon as a trap arrives.
+	if cfg.SNMPTraps.ListenAddress != "" {
+		opts = append(opts, collector.WithoutOnBattery())
+	}
+	if target.InfoRefresh > 0 {
+		opts = append(opts, collector.WithInfoRefresh(target.InfoRefresh))
+	}
+	if rated := cfg.Energy.ratedWatts(target.Name); rated > 0 {
+		opts = append(opts, collector.WithRatedWatts(rated))
+	}
+	if target.Backend == "modbus" {
+		opts = append(opts, collector.WithExtraMetrics(modbusExtraMetrics...))
+	}
+	c, err := collector.New(opts...)
+	if err != nil {
+		return nil, err
+	}
+	switch target.Backend {
+	case "exec":
+		c.Backend = newExecBackend(target, c)
+	case "snmp":
+		client, err := newSNMPClient(target.SNMP, target.URL)
+		if err != nil {
+			return nil, err
+		}
+		c.Backend = &snmpBackend{client: client}
+	case "modbus":
+		c.Backend = newModbusBackend(target)
+	case "apcupsd":
+		c.Backend = newApcupsdBackend(target)
+	}
+	return c, nil
+}
+
+func main() {
+	// Define the default config path and a flag to override it.
+	defaultConfigPath := "/etc/apc-exporter/config.yaml"
+	configPath := flag.String("config", "", "Path to the configuration file")
+	flag.StringVar(&listenAddress, "web.listen-address", defaultListenAddress, "Address to serve metrics and the APIs on")
+	flag.StringVar(&webConfigFile, "web.config.file", "", "Path to a web config file enabling TLS and basic auth")
+	textfileDir := flag.String("textfile.directory", "", "Directory to write "+textfileName+" into for node_exporter's textfile collector")
+	textfileInterval := flag.Duration("textfile.interval", 30*time.Second, "Interval between textfile writes")
+	textfileOnly := flag.Bool("textfile.only", false, "Only write the textfile and do not serve metrics over HTTP")
+	logLevel := flag.String("log.level", "info", "Only log messages at or above this level: debug, info, warn or error")
+	logFormat := flag.String("log.format", "text", "Format of the log lines: text or json")
+	logFile := flag.String("log.file", "", "Write the log to this file instead of stderr")
+	logMaxSizeMB := flag.Int("log.max_size_mb", 100, "Rotate the log file once it reaches this size (0 disables)")
+	logMaxAge := flag.Duration("log.max_age", 0, "Rotate the log file once it is this old, e.g. 24h (0 disables)")
+	logMaxBackups := flag.Int("log.max_backups", 5, "Number of rotated log files to keep")
+	maxProcs := flag.Int("runtime.gomaxprocs", 0, "Number of CPUs to use (0 follows the container's CPU limit)")
+	memoryLimitRatio := flag.Float64("runtime.memory_limit_ratio", 0.9, "Share of the container's memory limit to use as the Go memory limit (0 disables)")
+	storagePath := flag.String("storage.path", defaultStoragePath(), "Directory for the state store, buffers and relative paths in the config (default $STATE_DIRECTORY)")
+	startupCheck := flag.Bool("startup.check", false, "Log in to every target at startup and log which ones fail")
+	startupCheckRequired := flag.Bool("startup.check_required", false, "Exit if the startup check fails for all targets")
+	startupCheckTimeout := flag.Duration("startup.check_timeout", 30*time.Second, "Time to wait for the targets in the startup check")
+	shardFlag := flag.String("shard", "", "Poll only the N-th of M shares of the targets, as N/M, e.g. 2/3")
+	flag.StringVar(&recordDir, "record-dir", "", "Save every request to the cards and its response below this directory")
+	flag.StringVar(&replayDir, "replay-dir", "", "Serve the requests to the cards from the recordings below this directory instead of the network")
+	flag.Parse()
+
+	if err := setupLogging(*logLevel, *logFormat); err != nil {
+		fatal("Invalid log flags", "err", err)
+	}
+	// Under systemd, log to the journal with priorities and fields, unless a log file is given.
+	if *logFile == "" {
+		useJournal()
+	}
+
+	// Under the Windows service control manager, stop requests end the exporter like signals.
+	serviceStop, serviceStopped := startService()
+	defer serviceStopped()
+
+	if *logFile != "" {
+		file, err := openRotatingFile(*logFile, int64(*logMaxSizeMB)*1024*1024, *logMaxBackups)
+		if err != nil {
+			fatal("Failed to open the log file", "path", *logFile, "err", err)
+		}
+		file.maxAge = *logMaxAge
+		defer file.Close()
+		setLogOutput(file)
+	}
+
+	if *textfileOnly && *textfileDir == "" {
+		fatal("-textfile.only requires -textfile.directory")
+	}
+	if recordDir != "" && replayDir != "" {
+		fatal("-record-dir and -replay-dir cannot be used together")
+	}
+	if replayDir != "" {
+		if _, err := os.Stat(replayDir); err != nil {
+			fatal("Failed to open the recordings", "path", replayDir, "err", err)
+		}
+	}
+
+	// The healthcheck, version, discover, gen-rules and completion commands need no config.
+	switch flag.Arg(0) {
+	case "healthcheck":
+		if err := runHealthcheckCommand(flag.Args()[1:]); err != nil {
+			fatal("Command failed", "command", "healthcheck", "err", err)
+		}
+		return
+	case "version":
+		fmt.Println(versionString())
+		return
+	case "discover":
+		if err := runDiscoverCommand(flag.Args()[1:]); err != nil {
+			fatal("Command failed", "command", "discover", "err", err)
+		}
+		return
+	case "gen-rules":
+		if err := runGenRulesCommand(flag.Args()[1:]); err != nil {
+			fatal("Command failed", "command", "gen-rules", "err", err)
+		}
+		return
+	case "completion":
+		if err := runCompletionCommand(flag.Args()[1:]); err != nil {
+			fatal("Command failed", "command", "completion", "err", err)
+		}
+		return
+	}
+
+	applyResourceLimits(*maxProcs, *memoryLimitRatio)
+
+	// Determine which config path to use.
+	var finalConfigPath string
+	if *configPath != "" {
+		finalConfigPath = *configPath
+	} else {
+		finalConfigPath = defaultConfigPath
+	}
+
+	// check-config validates the file instead of loading it.
+	if flag.Arg(0) == "check-config" {
+		if err := runCheckConfigCommand(finalConfigPath, flag.Args()[1:]); err != nil {
+			fatal("Command failed", "command", "check-config", "err", err)
+		}
+		return
+	}
+
+	// Read configuration from file
+	config, err := loadConfig(finalConfigPath)
+	if err != nil {
+		fatal("Failed to load the config file", "path", finalConfigPath, "err", err)
+	}
+	if err := useStoragePath(*storagePath, &config); err != nil {
+		fatal("Failed to create the storage directory", "err", err)
+	}
+
+	targets := config.targetConfigs()
+	if len(targets) == 0 && len(config.AuthModules) == 0 {
+		fatal("No UPS configured: set ups_url, add entries under targets, or add auth_modules to probe cards")
+	}
+	if targetShard, err = parseShard(*shardFlag); err != nil {
+		fatal("Invalid -shard", "err", err)
+	}
+
+	// A command given after the flags is run against the targets instead of serving metrics.
+	if flag.NArg() > 0 {
+		set, err := newTargetSet(config)
+		if err != nil {
+			fatal("Invalid config", "err", err)
+		}
+		switch flag.Arg(0) {
+		case "selftest":
+			if err := runSelfTestCommand(config.Control, set.collectors, flag.Args()[1:]); err != nil {
+				fatal("Command failed", "command", "selftest", "err", err)
+			}
+		case "login-test":
+			if err := runLoginTestCommand(config, flag.Args()[1:]); err != nil {
+				fatal("Command failed", "command", "login-test", "err", err)
+			}
+		case "status":
+			if err := runStatusCommand(config, flag.Args()[1:]); err != nil {
+				fatal("Command failed", "command", "status", "err", err)
+			}
+		case "watch":
+			if err := runWatchCommand(config, flag.Args()[1:]); err != nil {
+				fatal("Command failed", "command", "watch", "err", err)
+			}
+		case "check":
+			os.Exit(runCheckCommand(config, flag.Args()[1:]))
+		case "dump-pages":
+			if err := runDumpPagesCommand(config, flag.Args()[1:]); err != nil {
+				fatal("Command failed", "command", "dump-pages", "err", err)
+			}
+		case "diff":
+			if err := runDiffCommand(config, flag.Args()[1:]); err != nil {
+				fatal("Command failed", "command", "diff", "err", err)
+			}
+		case "scrape":
+			if err := runScrapeCommand(config, flag.Args()[1:]); err != nil {
+				fatal("Command failed", "command", "scrape", "err", err)
+			}
+		case "service":
+			if err := runServiceCommand(finalConfigPath, flag.Args()[1:]); err != nil {
+				fatal("Command failed", "command", "service", "err", err)
+			}
+		default:
+			fatal("Unknown command", "command", flag.Arg(0))
+		}
+		return
+	}
+
+	// With several replicas, only the elected leader talks to the cards.
+	election, err := newLeaderElection(config.HA)
+	if err != nil {
+		fatal("Invalid high availability settings", "err", err)
+	}
+	landingPage, err := newLandingPage()
+	if err != nil {
+		fatal("Could not create the landing page", "err", err)
+	}
+	reload := &reloader{
+		path:             finalConfigPath,
+		storagePath:      *storagePath,
+		startup:          config,
+		election:         election,
+		textfileDir:      *textfileDir,
+		textfileInterval: *textfileInterval,
+		landingPage:      landingPage,
+	}
+
+	// Everything the config describes is built here and started below; a reload of the
+	// config builds it anew and swaps it in.
+	svc, err := newServices(config, reload)
+	if err != nil {
+		fatal("Invalid config", "err", err)
+	}
+	prometheus.MustRegister(newBuildInfoGauge())
+	if targetShard.count > 1 {
+		slog.Info("Polling a shard of the targets", "shard", targetShard.String(), "targets", len(svc.targets.collectors), "total", len(targets))
+	}
+
+	// Catch bad credentials and unreachable cards at deploy time rather than as zeroed
+	// metrics later.
+	if *startupCheck || *startupCheckRequired {
+		if err := runStartupCheck(svc.targets.collectors, *startupCheckTimeout); err != nil {
+			if *startupCheckRequired {
+				fatal("Startup check failed", "err", err)
+			}
+			slog.Warn("Startup check failed", "err", err)
+		}
+	}
+
+	slog.Info("Starting", "version", versionString())
+
+	// Bind the listener before anything else starts: during a hot upgrade the old process
+	// shuts down as soon as this one listens, and scrapes wait in the backlog meanwhile.
+	var listener net.Listener
+	if !*textfileOnly {
+		if upgrading() {
+			dbLockTimeout = time.Minute
+		}
+		if err := web.Validate(webConfigFile); err != nil {
+			fatal("Invalid web config file", "path", webConfigFile, "err", err)
+		}
+		listener, err = listen(listenAddress)
+		if err != nil {
+			fatal("Could not start server", "address", listenAddress, "err", err)
+		}
+		upgradeReady()
+	}
+
+	// The services stop when ctx is cancelled.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reload.ctx = ctx
+
+	if election != nil {
+		prometheus.MustRegister(haLeader)
+		election.campaign(ctx)
+		go election.run(ctx)
+	}
+	prometheus.MustRegister(configReloadSuccess, configReloadTime, eventLogEntries, eventsTotal, eventsDropped)
+	configReloadSuccess.Set(1)
+	configReloadTime.SetToCurrentTime()
+
+	if reload.state, err = openStateStore(config.State); err != nil {
+		slog.Warn("State store disabled", "err", err)
+	}
+	if reload.state != nil {
+		defer reload.state.Close()
+	}
+	if reload.history, err = openHistoryStore(config.History); err != nil {
+		slog.Warn("History store disabled", "err", err)
+	}
+	if reload.history != nil {
+		defer reload.history.Close()
+	}
+	svc.start(reload, nil)
+	reload.current.Store(svc)
+
+	// Create a channel to listen for OS signals.
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	reloadSignals := make(chan os.Signal, 1)
+	signal.Notify(reloadSignals, syscall.SIGHUP)
+
+	// Start the HTTP server in a separate goroutine, unless only the textfile is wanted.
+	if !*textfileOnly {
+		slog.Info("Starting Prometheus exporter", "address", listenAddress)
+		reload.web = &webServer{handler: reload.handler(), listener: listener}
+		if err := reload.web.start(); err != nil {
+			fatal("Could not start server", "address", listenAddress, "err", err)
+		}
+	}
+
+	// Tell systemd that the exporter is up, and pet its watchdog until a signal arrives.
+	if err := sdNotify("READY=1"); err != nil {
+		slog.Warn("Error notifying systemd", "err", err)
+	}
+	upgrade := upgradeSignals()
+	upgraded := false
+	var watchdog <-chan time.Time
+	if interval := watchdogInterval(); interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		watchdog = ticker.C
+	}
+wait:
+	for {
+		select {
+		case <-sigChan:
+			break wait
+		case <-reloadSignals:
+			reload.reload()
+		case <-serviceStop:
+			break wait
+		case <-upgrade:
+			if err := startUpgrade(); err != nil {
+				slog.Error("Upgrade failed, keeping this process", "err", err)
+				continue
+			}
+			upgraded = true
+			break wait
+		case <-watchdog:
+			if err := sdNotify("WATCHDOG=1"); err != nil {
+				slog.Warn("Error petting the systemd watchdog", "err", err)
+			}
+		}
+	}
+	slog.Info("Shutting down gracefully")
+	if !upgraded {
+		sdNotify("STOPPING=1")
+	}
+
+	// Let running scrapes finish before the outputs and stores stop.
+	if reload.web != nil {
+		shutdownCtx, stop := context.WithTimeout(context.Background(), 10*time.Second)
+		if err := reload.web.shutdown(shutdownCtx); err != nil {
+			slog.Warn("Error shutting down the HTTP server", "err", err)
+		}
+		stop()
+	}
+	// Stop the services, which closes the idle connections to the cards, before the
+	// stores close.
+	reload.current.Load().stop()
+	cancel()
+
+	slog.Info("Server gracefully stopped")
+}
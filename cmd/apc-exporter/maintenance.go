@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// MaintenanceWindow is a scheduled period during which no notifications are sent for
+// its targets. It either recurs, starting whenever the cron schedule matches and
+// lasting Duration, or is a single period from Start to End.
+type MaintenanceWindow struct {
+	Name     string        `yaml:"name"`
+	Targets  []string      `yaml:"targets"`
+	Schedule string        `yaml:"schedule"`
+	Duration time.Duration `yaml:"duration"`
+	Start    time.Time     `yaml:"start"`
+	End      time.Time     `yaml:"end"`
+	Timezone string        `yaml:"timezone"`
+}
+
+// maxMaintenanceDuration bounds recurring windows, which are checked minute by minute.
+const maxMaintenanceDuration = 7 * 24 * time.Hour
+
+var maintenanceModeDesc = prometheus.NewDesc("ups_maintenance_mode", "Whether a maintenance window is active for the target (1) or not (0).", []string{"target"}, nil)
+
+type maintenanceWindow struct {
+	MaintenanceWindow
+	cron     *cronSchedule
+	location *time.Location
+}
+
+// maintenanceSchedule knows the maintenance windows of all targets.
+type maintenanceSchedule struct {
+	targets []string
+	windows []*maintenanceWindow
+}
+
+// newMaintenanceSchedule compiles the windows, logging and skipping invalid ones. It
+// returns nil if no windows are configured.
+func newMaintenanceSchedule(windows []MaintenanceWindow, targets []string) *maintenanceSchedule {
+	if len(windows) == 0 {
+		return nil
+	}
+	m := &maintenanceSchedule{targets: targets}
+	for i, cfg := range windows {
+		w, err := compileMaintenanceWindow(cfg)
+		if err != nil {
+			slog.Warn("Maintenance window disabled", "index", i+1, "name", cfg.Name, "err", err)
+			continue
+		}
+		m.windows = append(m.windows, w)
+	}
+	return m
+}
+
+func compileMaintenanceWindow(cfg MaintenanceWindow) (*maintenanceWindow, error) {
+	w := &maintenanceWindow{MaintenanceWindow: cfg, location: time.Local}
+	if cfg.Timezone != "" {
+		loc, err := time.LoadLocation(cfg.Timezone)
+		if err != nil {
+			return nil, err
+		}
+		w.location = loc
+	}
+	switch {
+	case cfg.Schedule != "" && !cfg.Start.IsZero():
+		return nil, fmt.Errorf("use either schedule and duration or start and end")
+	case cfg.Schedule != "":
+		if cfg.Duration <= 0 || cfg.Duration > maxMaintenanceDuration {
+			return nil, fmt.Errorf("duration must be positive and at most %s", maxMaintenanceDuration)
+		}
+		cron, err := parseCron(cfg.Schedule)
+		if err != nil {
+			return nil, fmt.Errorf("schedule: %w", err)
+		}
+		w.cron = cron
+	case !cfg.Start.IsZero():
+		if !cfg.End.After(cfg.Start) {
+			return nil, fmt.Errorf("end must be after start")
+		}
+	default:
+		return nil, fmt.Errorf("either schedule and duration or start and end are required")
+	}
+	return w, nil
+}
+
+// active reports whether the window covers the time.
+func (w *maintenanceWindow) active(now time.Time) bool {
+	if w.cron == nil {
+		return !now.Before(w.Start) && now.Before(w.End)
+	}
+	// Look for a start within the last Duration.
+	now = now.In(w.location)
+	start := now.Truncate(time.Minute)
+	for t := start; now.Sub(t) < w.Duration; t = t.Add(-time.Minute) {
+		if w.cron.matches(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// inMaintenance returns the name of an active window covering the target, if any.
+func (m *maintenanceSchedule) inMaintenance(target string, now time.Time) (string, bool) {
+	if m == nil {
+		return "", false
+	}
+	for _, w := range m.windows {
+		if (len(w.Targets) == 0 || slices.Contains(w.Targets, target)) && w.active(now) {
+			return w.Name, true
+		}
+	}
+	return "", false
+}
+
+func (m *maintenanceSchedule) Describe(ch chan<- *prometheus.Desc) {
+	ch <- maintenanceModeDesc
+}
+
+func (m *maintenanceSchedule) Collect(ch chan<- prometheus.Metric) {
+	now := time.Now()
+	for _, target := range m.targets {
+		value := 0.0
+		if _, ok := m.inMaintenance(target, now); ok {
+			value = 1
+		}
+		ch <- prometheus.MustNewConstMetric(maintenanceModeDesc, prometheus.GaugeValue, value, target)
+	}
+}
+
+// suppress wraps the notifiers so that nothing is sent for targets in maintenance.
+// The transitions are still recorded as events.
+func (m *maintenanceSchedule) suppress(notifiers []transitionNotifier) []transitionNotifier {
+	if m == nil || len(notifiers) == 0 {
+		return notifiers
+	}
+	return []transitionNotifier{func(ctx context.Context, tr transition) error {
+		if window, ok := m.inMaintenance(tr.Target, tr.Time); ok {
+			slog.Info("Not notifying during a maintenance window", "condition", tr.Condition, "target", tr.Target, "window", window)
+			notificationsSuppressed.WithLabelValues(tr.Target, "maintenance").Inc()
+			return nil
+		}
+		var errs []error
+		for _, notify := range notifiers {
+			errs = append(errs, notify(ctx, tr))
+		}
+		return errors.Join(errs...)
+	}}
+}
+
+// cronSchedule is a standard five-field cron expression: minute, hour, day of month,
+// month and day of week (0 or 7 is Sunday). Fields accept *, numbers, ranges (a-b),
+// lists (a,b) and steps (*/n, a-b/n). The day of week also accepts d#n for the nth
+// such day of the month, e.g. 0#1 for the first Sunday.
+type cronSchedule struct {
+	minute, hour, dom, month, dow []bool
+	domAny, dowAny                bool
+	nth                           [][2]int // day of week and week of month
+}
+
+func parseCron(spec string) (*cronSchedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("expected 5 fields, got %d", len(fields))
+	}
+	c := &cronSchedule{}
+	var err error
+	if c.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, fmt.Errorf("minute: %w", err)
+	}
+	if c.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, fmt.Errorf("hour: %w", err)
+	}
+	if c.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, fmt.Errorf("day of month: %w", err)
+	}
+	if c.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, fmt.Errorf("month: %w", err)
+	}
+	var dow []string
+	for _, part := range strings.Split(fields[4], ",") {
+		d, n, ok := strings.Cut(part, "#")
+		if !ok {
+			dow = append(dow, part)
+			continue
+		}
+		day, err1 := strconv.Atoi(d)
+		week, err2 := strconv.Atoi(n)
+		if err1 != nil || err2 != nil || day < 0 || day > 7 || week < 1 || week > 5 {
+			return nil, fmt.Errorf("day of week: invalid value %q", part)
+		}
+		c.nth = append(c.nth, [2]int{day % 7, week})
+	}
+	c.dow = make([]bool, 8)
+	if len(dow) > 0 {
+		if c.dow, err = parseCronField(strings.Join(dow, ","), 0, 7); err != nil {
+			return nil, fmt.Errorf("day of week: %w", err)
+		}
+	}
+	c.dow[0] = c.dow[0] || c.dow[7]
+	c.domAny, c.dowAny = fields[2] == "*", fields[4] == "*"
+	return c, nil
+}
+
+func parseCronField(field string, lo, hi int) ([]bool, error) {
+	set := make([]bool, hi+1)
+	for _, part := range strings.Split(field, ",") {
+		rangePart, step := part, 1
+		if i := strings.IndexByte(part, '/'); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step <= 0 {
+				return nil, fmt.Errorf("invalid step in %q", part)
+			}
+			rangePart = part[:i]
+		}
+		from, to := lo, hi
+		if rangePart != "*" {
+			bounds := strings.SplitN(rangePart, "-", 2)
+			var err error
+			if from, err = strconv.Atoi(bounds[0]); err != nil {
+				return nil, fmt.Errorf("invalid value %q", part)
+			}
+			to = from
+			if len(bounds) == 2 {
+				if to, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, fmt.Errorf("invalid value %q", part)
+				}
+			} else if step > 1 {
+				to = hi
+			}
+		}
+		if from < lo || to > hi || from > to {
+			return nil, fmt.Errorf("%q out of range %d-%d", part, lo, hi)
+		}
+		for v := from; v <= to; v += step {
+			set[v] = true
+		}
+	}
+	return set, nil
+}
+
+// matches reports whether the schedule fires at the minute of t. As in cron, a
+// restricted day of month and day of week match if either does.
+func (c *cronSchedule) matches(t time.Time) bool {
+	if !c.minute[t.Minute()] || !c.hour[t.Hour()] || !c.month[int(t.Month())] {
+		return false
+	}
+	dom, dow := c.dom[t.Day()], c.dow[int(t.Weekday())]
+	for _, nth := range c.nth {
+		dow = dow || nth[0] == int(t.Weekday()) && nth[1] == (t.Day()-1)/7+1
+	}
+	switch {
+	case c.domAny && c.dowAny:
+		return true
+	case c.domAny:
+		return dow
+	case c.dowAny:
+		return dom
+	default:
+		return dom || dow
+	}
+}
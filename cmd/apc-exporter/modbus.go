@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"time"
+)
+
+// ModbusConfig configures a target with backend modbus, read from the Modbus registers
+// of a Smart-UPS SRT or SMT over Modbus TCP, served by its network management card.
+type ModbusConfig struct {
+	// Address is the host:port of the Modbus TCP server, by default the host of ups_url
+	// on port 502.
+	Address string        `yaml:"address"`
+	UnitID  byte          `yaml:"unit_id"` // default 1
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// Modbus registers of the Smart-UPS, from the application note on its Modbus
+// implementation. Values are unsigned, or signed where noted, and scaled by a power
+// of two.
+const (
+	modbusUPSStatus        = 0   // UPSStatus_BF, 2 registers
+	modbusRuntimeRemaining = 128 // seconds, 2 registers
+	modbusStateOfCharge    = 130 // percent, 2^9
+	modbusBatteryVoltage   = 131 // VDC, signed, 2^5
+	modbusBatteryTemp      = 135 // Celsius, signed, 2^7
+	modbusOutputRealPower  = 136 // percent of the rated real power, 2^8
+	modbusOutputApparent   = 138 // percent of the rated apparent power, 2^8
+	modbusOutputCurrent    = 140 // A, 2^5
+	modbusOutputVoltage    = 142 // VAC, 2^6
+	modbusOutputFrequency  = 144 // Hz, 2^7
+	modbusOutputEnergy     = 145 // Wh, 2 registers
+	modbusInputVoltage     = 151 // VAC, 2^6
+	modbusEfficiency       = 154 // percent, signed, 2^7; negative while not measured
+
+	// The dynamic registers are read in one request.
+	modbusDynamicStart = modbusRuntimeRemaining
+	modbusDynamicCount = modbusEfficiency - modbusDynamicStart + 1
+)
+
+// Bits of UPSStatus_BF.
+const (
+	modbusStatusOnline         = 1 << 1
+	modbusStatusOutputOff      = 1 << 4
+	modbusStatusHighEfficiency = 1 << 13
+)
+
+// modbusMetrics are the gauges of the registers read with a plain scale.
+var modbusMetrics = []struct {
+	metric   string
+	register int
+	signed   bool
+	scale    float64
+}{
+	{"ups_battery_charge_percent", modbusStateOfCharge, false, 1.0 / (1 << 9)},
+	{"ups_battery_voltage_vdc", modbusBatteryVoltage, true, 1.0 / (1 << 5)},
+	{"ups_internal_temperature_celsius", modbusBatteryTemp, true, 1.0 / (1 << 7)},
+	{"ups_load_percent", modbusOutputRealPower, false, 1.0 / (1 << 8)},
+	{"ups_load_power_percent_va", modbusOutputApparent, false, 1.0 / (1 << 8)},
+	{"ups_load_current_amps", modbusOutputCurrent, false, 1.0 / (1 << 5)},
+	{"ups_output_voltage_vac", modbusOutputVoltage, false, 1.0 / (1 << 6)},
+	{"ups_output_frequency_hz", modbusOutputFrequency, false, 1.0 / (1 << 7)},
+	{"ups_input_voltage_vac", modbusInputVoltage, false, 1.0 / (1 << 6)},
+}
+
+// modbusExtraMetrics are the gauges the modbus backend reads beyond those of the web
+// scraper.
+var modbusExtraMetrics = []string{"ups_efficiency_percent", "ups_output_energy_kwh"}
+
+// modbusAddress returns the address of the Modbus TCP server of a target.
+func modbusAddress(cfg ModbusConfig, upsURL string) string {
+	if cfg.Address != "" {
+		if _, _, err := net.SplitHostPort(cfg.Address); err != nil {
+			return net.JoinHostPort(cfg.Address, "502")
+		}
+		return cfg.Address
+	}
+	if u, err := url.Parse(upsURL); err == nil && u.Hostname() != "" {
+		return net.JoinHostPort(u.Hostname(), "502")
+	}
+	return ""
+}
+
+// modbusBackend reads a target from its Modbus registers, as the collector's backend.
+type modbusBackend struct {
+	addr    string
+	unitID  byte
+	timeout time.Duration
+}
+
+func newModbusBackend(target TargetConfig) *modbusBackend {
+	b := &modbusBackend{addr: modbusAddress(target.Modbus, target.URL), unitID: target.Modbus.UnitID, timeout: target.Modbus.Timeout}
+	if b.unitID == 0 {
+		b.unitID = 1
+	}
+	if b.timeout <= 0 {
+		b.timeout = 5 * time.Second
+	}
+	return b
+}
+
+// Values reads the status and the dynamic registers under the metric names of the web
+// scraper. The device status is up while the UPS is online, also in high-efficiency
+// mode, and the outlets are on unless the output is off.
+func (b *modbusBackend) Values(ctx context.Context) (map[string]float64, error) {
+	ctx, cancel := context.WithTimeout(ctx, b.timeout)
+	defer cancel()
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", b.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	status, err := b.readRegisters(conn, 1, modbusUPSStatus, 2)
+	if err != nil {
+		return nil, err
+	}
+	regs, err := b.readRegisters(conn, 2, modbusDynamicStart, modbusDynamicCount)
+	if err != nil {
+		return nil, err
+	}
+	reg := func(r int) uint16 { return regs[r-modbusDynamicStart] }
+	reg32 := func(r int) uint32 { return uint32(reg(r))<<16 | uint32(reg(r+1)) }
+
+	values := map[string]float64{"ups_device_status_up": 0, "ups_outlet_status": 1}
+	bits := uint32(status[0])<<16 | uint32(status[1])
+	if bits&(modbusStatusOnline|modbusStatusHighEfficiency) != 0 {
+		values["ups_device_status_up"] = 1
+	}
+	if bits&modbusStatusOutputOff != 0 {
+		values["ups_outlet_status"] = 0
+	}
+	for _, m := range modbusMetrics {
+		raw := float64(reg(m.register))
+		if m.signed {
+			raw = float64(int16(reg(m.register)))
+		}
+		values[m.metric] = raw * m.scale
+	}
+	values["ups_runtime_remaining_seconds"] = float64(reg32(modbusRuntimeRemaining))
+	values["ups_output_energy_kwh"] = float64(reg32(modbusOutputEnergy)) / 1000
+	// The UPS reports why it cannot measure the efficiency, such as being on battery or
+	// a load too low, as negative values.
+	values["ups_efficiency_percent"] = max(float64(int16(reg(modbusEfficiency)))/(1<<7), 0)
+	return values, nil
+}
+
+// Unsupported returns the metrics the registers of the UPS have no value for.
+func (b *modbusBackend) Unsupported() []string {
+	return []string{"ups_input_frequency_hz"}
+}
+
+// readRegisters reads holding registers with a Modbus TCP request.
+func (b *modbusBackend) readRegisters(conn net.Conn, transaction uint16, start, count int) ([]uint16, error) {
+	req := binary.BigEndian.AppendUint16(nil, transaction)
+	req = binary.BigEndian.AppendUint16(req, 0) // protocol
+	req = binary.BigEndian.AppendUint16(req, 6) // length of the rest
+	req = append(req, b.unitID, 0x03)           // read holding registers
+	req = binary.BigEndian.AppendUint16(req, uint16(start))
+	req = binary.BigEndian.AppendUint16(req, uint16(count))
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, 7)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, fmt.Errorf("reading registers %d-%d from %s: %w", start, start+count-1, b.addr, err)
+	}
+	n := int(binary.BigEndian.Uint16(header[4:6]))
+	if binary.BigEndian.Uint16(header) != transaction || n < 3 || n > 256 {
+		return nil, fmt.Errorf("invalid Modbus response from %s", b.addr)
+	}
+	body := make([]byte, n-1)
+	if _, err := io.ReadFull(conn, body); err != nil {
+		return nil, fmt.Errorf("reading registers %d-%d from %s: %w", start, start+count-1, b.addr, err)
+	}
+	if body[0] == 0x83 {
+		return nil, fmt.Errorf("%s refused to read registers %d-%d with Modbus exception %d", b.addr, start, start+count-1, body[1])
+	}
+	if body[0] != 0x03 || len(body) != 2+2*count || int(body[1]) != 2*count {
+		return nil, fmt.Errorf("invalid Modbus response from %s", b.addr)
+	}
+	regs := make([]uint16, count)
+	for i := range regs {
+		regs[i] = binary.BigEndian.Uint16(body[2+2*i:])
+	}
+	return regs, nil
+}
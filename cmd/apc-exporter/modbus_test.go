@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"maps"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// modbusTestRequest reads a read holding registers request, checking the framing of
+// Modbus TCP, and returns its transaction, unit, start and count.
+func modbusTestRequest(conn net.Conn) (transaction uint16, unit byte, start, count int, err error) {
+	req := make([]byte, 12)
+	if _, err := io.ReadFull(conn, req); err != nil {
+		return 0, 0, 0, 0, err
+	}
+	if protocol, length := binary.BigEndian.Uint16(req[2:]), binary.BigEndian.Uint16(req[4:]); protocol != 0 || length != 6 || req[7] != 0x03 {
+		return 0, 0, 0, 0, errors.New("not a read holding registers request")
+	}
+	return binary.BigEndian.Uint16(req), req[6], int(binary.BigEndian.Uint16(req[8:])), int(binary.BigEndian.Uint16(req[10:])), nil
+}
+
+// modbusTestResponse frames a response PDU for the transaction and unit.
+func modbusTestResponse(transaction uint16, unit byte, pdu ...byte) []byte {
+	res := binary.BigEndian.AppendUint16(nil, transaction)
+	res = binary.BigEndian.AppendUint16(res, 0)
+	res = binary.BigEndian.AppendUint16(res, uint16(1+len(pdu)))
+	return append(append(res, unit), pdu...)
+}
+
+// modbusTestServe answers read requests on conn from the register dump until the
+// connection is closed. Registers not in the dump read as 0.
+func modbusTestServe(conn net.Conn, regs map[int]uint16) {
+	defer conn.Close()
+	for {
+		transaction, unit, start, count, err := modbusTestRequest(conn)
+		if err != nil {
+			return
+		}
+		pdu := []byte{0x03, byte(2 * count)}
+		for r := start; r < start+count; r++ {
+			pdu = binary.BigEndian.AppendUint16(pdu, regs[r])
+		}
+		conn.Write(modbusTestResponse(transaction, unit, pdu...))
+	}
+}
+
+// TestModbusReadRegisters checks the responses readRegisters accepts and those it
+// rejects, answered by a fake server on the other end of a pipe.
+func TestModbusReadRegisters(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		respond func(transaction uint16, unit byte) []byte // the bytes written before closing
+		want    []uint16
+		err     string
+	}{
+		{"registers", func(tr uint16, unit byte) []byte {
+			return modbusTestResponse(tr, unit, 0x03, 4, 0x12, 0x34, 0xff, 0xfe)
+		}, []uint16{0x1234, 0xfffe}, ""},
+		{"exception", func(tr uint16, unit byte) []byte {
+			return modbusTestResponse(tr, unit, 0x83, 0x02)
+		}, nil, "Modbus exception 2"},
+		{"other transaction", func(tr uint16, unit byte) []byte {
+			return modbusTestResponse(tr+1, unit, 0x03, 4, 0, 1, 0, 2)
+		}, nil, "invalid Modbus response"},
+		{"too few registers", func(tr uint16, unit byte) []byte {
+			return modbusTestResponse(tr, unit, 0x03, 2, 0, 1)
+		}, nil, "invalid Modbus response"},
+		{"byte count", func(tr uint16, unit byte) []byte {
+			return modbusTestResponse(tr, unit, 0x03, 2, 0, 1, 0, 2)
+		}, nil, "invalid Modbus response"},
+		{"no exception code", func(tr uint16, unit byte) []byte {
+			return modbusTestResponse(tr, unit, 0x83)
+		}, nil, "invalid Modbus response"},
+		{"length beyond a PDU", func(tr uint16, unit byte) []byte {
+			res := modbusTestResponse(tr, unit, 0x03, 4, 0, 1, 0, 2)
+			binary.BigEndian.PutUint16(res[4:], 300)
+			return res
+		}, nil, "invalid Modbus response"},
+		{"short header", func(tr uint16, unit byte) []byte {
+			return modbusTestResponse(tr, unit, 0x03, 4, 0, 1, 0, 2)[:5]
+		}, nil, io.ErrUnexpectedEOF.Error()},
+		{"short body", func(tr uint16, unit byte) []byte {
+			return modbusTestResponse(tr, unit, 0x03, 4, 0, 1, 0, 2)[:10]
+		}, nil, io.ErrUnexpectedEOF.Error()},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			go func() {
+				defer server.Close()
+				transaction, unit, start, count, err := modbusTestRequest(server)
+				if err != nil || unit != 7 || start != 130 || count != 2 {
+					t.Errorf("request unit %d for %d registers at %d (%v), want unit 7 for 2 at 130", unit, count, start, err)
+					return
+				}
+				server.Write(tc.respond(transaction, unit))
+			}()
+			client.SetDeadline(time.Now().Add(5 * time.Second))
+
+			b := &modbusBackend{addr: "ups", unitID: 7}
+			regs, err := b.readRegisters(client, 9, 130, 2)
+			switch {
+			case tc.err == "" && err != nil:
+				t.Fatal(err)
+			case tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)):
+				t.Fatalf("error %v, want one with %q", err, tc.err)
+			}
+			if !slices.Equal(regs, tc.want) {
+				t.Errorf("registers %v, want %v", regs, tc.want)
+			}
+		})
+	}
+}
+
+// TestModbusValues checks the metrics read from a register dump of a Smart-UPS over
+// Modbus TCP: the status bits, the scaling by powers of two, signed registers and the
+// registers read as 32-bit counters.
+func TestModbusValues(t *testing.T) {
+	dump := map[int]uint16{
+		modbusUPSStatus + 1:        modbusStatusOnline,
+		modbusRuntimeRemaining:     0x0001, // 65536 + 3600 seconds
+		modbusRuntimeRemaining + 1: 3600,
+		modbusStateOfCharge:        100 << 9,
+		modbusBatteryVoltage:       54<<5 + 16,             // 54.5 VDC
+		modbusBatteryTemp:          uint16(0x10000 - 5<<7), // -5 Celsius
+		modbusOutputRealPower:      23<<8 + 128,            // 23.5 percent
+		modbusOutputApparent:       25 << 8,
+		modbusOutputCurrent:        3<<5 + 8, // 3.25 A
+		modbusOutputVoltage:        230 << 6,
+		modbusOutputFrequency:      50<<7 + 64, // 50.5 Hz
+		modbusOutputEnergy:         0x0002,     // 131072 + 1234 Wh
+		modbusOutputEnergy + 1:     1234,
+		modbusInputVoltage:         229<<6 + 16, // 229.25 VAC
+		modbusEfficiency:           95<<7 + 64,  // 95.5 percent
+	}
+	want := map[string]float64{
+		"ups_device_status_up":             1,
+		"ups_outlet_status":                1,
+		"ups_runtime_remaining_seconds":    65536 + 3600,
+		"ups_battery_charge_percent":       100,
+		"ups_battery_voltage_vdc":          54.5,
+		"ups_internal_temperature_celsius": -5,
+		"ups_load_percent":                 23.5,
+		"ups_load_power_percent_va":        25,
+		"ups_load_current_amps":            3.25,
+		"ups_output_voltage_vac":           230,
+		"ups_output_frequency_hz":          50.5,
+		"ups_output_energy_kwh":            132.306,
+		"ups_input_voltage_vac":            229.25,
+		"ups_efficiency_percent":           95.5,
+	}
+
+	for _, tc := range []struct {
+		name   string
+		status uint16 // of the low register of UPSStatus_BF
+		change map[string]float64
+	}{
+		{"online", modbusStatusOnline, nil},
+		{"high efficiency", modbusStatusHighEfficiency, nil},
+		{"on battery", 0, map[string]float64{"ups_device_status_up": 0}},
+		{"output off", modbusStatusOnline | modbusStatusOutputOff, map[string]float64{"ups_outlet_status": 0}},
+		{"efficiency not measured", modbusStatusOnline, map[string]float64{"ups_efficiency_percent": 0}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			regs := maps.Clone(dump)
+			regs[modbusUPSStatus+1] = tc.status
+			if _, ok := tc.change["ups_efficiency_percent"]; ok {
+				regs[modbusEfficiency] = uint16(0x10000 - 3) // a negative reason code
+			}
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+			go func() {
+				if conn, err := ln.Accept(); err == nil {
+					modbusTestServe(conn, regs)
+				}
+			}()
+
+			b := newModbusBackend(TargetConfig{Modbus: ModbusConfig{Address: ln.Addr().String()}})
+			values, err := b.Values(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := maps.Clone(want)
+			maps.Copy(expected, tc.change)
+			if !maps.Equal(values, expected) {
+				t.Errorf("values:\n%v\nwant:\n%v", values, expected)
+			}
+		})
+	}
+}
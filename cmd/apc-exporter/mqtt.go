@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"regexp"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// MQTTConfig holds the settings for publishing metrics to an MQTT broker.
+type MQTTConfig struct {
+	Broker             string        `yaml:"broker"`
+	Username           string        `yaml:"username"`
+	Password           string        `yaml:"password"`
+	ClientID           string        `yaml:"client_id"`
+	TopicPrefix        string        `yaml:"topic_prefix"`
+	DiscoveryPrefix    string        `yaml:"discovery_prefix"`
+	Interval           time.Duration `yaml:"interval"`
+	InsecureSkipVerify bool          `yaml:"insecure_skip_verify"`
+}
+
+// check checks the settings the broker would refuse: MQTT 3.1.1 does not allow a
+// password without a username (section 3.1.2.9).
+func (c MQTTConfig) check() error {
+	if c.Password != "" && c.Username == "" {
+		return errors.New("password requires a username")
+	}
+	return nil
+}
+
+// haEntity describes how a metric is announced through Home Assistant MQTT Discovery.
+type haEntity struct {
+	component   string
+	name        string
+	deviceClass string
+	unit        string
+}
+
+// haEntities maps the exported metrics to Home Assistant entities. Metrics missing
+// here are still part of the published state document, just not announced.
+var haEntities = map[string]haEntity{
+	"ups_device_status_up":             {"binary_sensor", "Online", "power", ""},
+	"ups_outlet_status":                {"binary_sensor", "Outlet", "power", ""},
+	"ups_load_percent":                 {"sensor", "Load", "", "%"},
+	"ups_runtime_remaining_minutes":    {"sensor", "Runtime remaining", "duration", "min"},
+	"ups_internal_temperature_celsius": {"sensor", "Internal temperature", "temperature", "°C"},
+	"ups_load_power_percent_va":        {"sensor", "Apparent power load", "", "%"},
+	"ups_load_current_amps":            {"sensor", "Load current", "current", "A"},
+	"ups_input_voltage_vac":            {"sensor", "Input voltage", "voltage", "V"},
+	"ups_output_voltage_vac":           {"sensor", "Output voltage", "voltage", "V"},
+	"ups_input_frequency_hz":           {"sensor", "Input frequency", "frequency", "Hz"},
+	"ups_output_frequency_hz":          {"sensor", "Output frequency", "frequency", "Hz"},
+	"ups_battery_charge_percent":       {"sensor", "Battery charge", "battery", "%"},
+	"ups_battery_voltage_vdc":          {"sensor", "Battery voltage", "voltage", "V"},
+}
+
+var mqttTopicUnsafe = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+// runMQTT publishes every target's metrics to the MQTT broker on each interval until
+// the context is cancelled, announcing the targets through Home Assistant discovery.
+// It returns immediately if no broker is configured.
+func runMQTT(ctx context.Context, cfg MQTTConfig, gatherer prometheus.Gatherer) {
+	if cfg.Broker == "" {
+		return
+	}
+	if err := cfg.check(); err != nil {
+		slog.Warn("MQTT output disabled", "err", err)
+		return
+	}
+	if cfg.ClientID == "" {
+		cfg.ClientID = "apc-exporter"
+	}
+	if cfg.TopicPrefix == "" {
+		cfg.TopicPrefix = "apc-exporter"
+	}
+	if cfg.DiscoveryPrefix == "" {
+		cfg.DiscoveryPrefix = "homeassistant"
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = 30 * time.Second
+	}
+	gatherer = gatherWithin(gatherer, cfg.Interval)
+
+	p := &mqttPublisher{cfg: cfg}
+	defer p.close()
+
+	slog.Info("Publishing metrics to MQTT", "broker", cfg.Broker, "interval", cfg.Interval)
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := p.publishSamples(gatherer); err != nil {
+				slog.Warn("Error publishing to MQTT", "err", err)
+				p.close()
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// mqttPublisher keeps the broker connection and remembers which targets have already
+// been announced on it.
+type mqttPublisher struct {
+	cfg       MQTTConfig
+	conn      net.Conn
+	announced map[string]bool
+}
+
+// availabilityTopic is shared by all entities; the broker flips it to "offline"
+// through the last will when the exporter goes away.
+func (p *mqttPublisher) availabilityTopic() string {
+	return p.cfg.TopicPrefix + "/status"
+}
+
+// publishSamples gathers the UPS metrics once and publishes a JSON state document
+// per target, connecting and announcing the targets first if necessary.
+func (p *mqttPublisher) publishSamples(gatherer prometheus.Gatherer) error {
+	samples, err := gatherSamples(gatherer, "ups_")
+	if err != nil {
+		return err
+	}
+
+	if p.conn == nil {
+		if err := p.connect(); err != nil {
+			return err
+		}
+	}
+
+	targets, states := samplesByTarget(samples)
+	for _, target := range targets {
+		state := states[target]
+		node := "apc_" + mqttTopicUnsafe.ReplaceAllString(target, "_")
+		if !p.announced[target] {
+			if err := p.announce(target, node, state); err != nil {
+				return err
+			}
+			p.announced[target] = true
+		}
+
+		payload, err := json.Marshal(state)
+		if err != nil {
+			return err
+		}
+		if err := p.publish(p.stateTopic(node), payload, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *mqttPublisher) stateTopic(node string) string {
+	return p.cfg.TopicPrefix + "/" + node + "/state"
+}
+
+// announce publishes the retained Home Assistant discovery configs for a target.
+func (p *mqttPublisher) announce(target, node string, state map[string]float64) error {
+	device := map[string]any{
+		"identifiers":  []string{node},
+		"name":         target,
+		"manufacturer": "APC",
+		"model":        "UPS",
+	}
+
+	for metric := range state {
+		entity, ok := haEntities[metric]
+		if !ok {
+			continue
+		}
+		objectID := mqttTopicUnsafe.ReplaceAllString(metric, "_")
+
+		discovery := map[string]any{
+			"name":               entity.name,
+			"unique_id":          node + "_" + objectID,
+			"state_topic":        p.stateTopic(node),
+			"availability_topic": p.availabilityTopic(),
+			"device":             device,
+		}
+		if entity.component == "binary_sensor" {
+			discovery["value_template"] = fmt.Sprintf("{{ 'ON' if value_json.%s == 1 else 'OFF' }}", metric)
+		} else {
+			discovery["value_template"] = fmt.Sprintf("{{ value_json.%s }}", metric)
+			discovery["state_class"] = "measurement"
+		}
+		if entity.deviceClass != "" {
+			discovery["device_class"] = entity.deviceClass
+		}
+		if entity.unit != "" {
+			discovery["unit_of_measurement"] = entity.unit
+		}
+
+		payload, err := json.Marshal(discovery)
+		if err != nil {
+			return err
+		}
+		topic := p.cfg.DiscoveryPrefix + "/" + entity.component + "/" + node + "/" + objectID + "/config"
+		if err := p.publish(topic, payload, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// connect dials the broker, performs the MQTT 3.1.1 handshake with a last will on
+// the availability topic and marks the exporter as online.
+func (p *mqttPublisher) connect() error {
+	u, err := url.Parse(p.cfg.Broker)
+	if err != nil {
+		return fmt.Errorf("invalid broker URL: %w", err)
+	}
+
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	var conn net.Conn
+	switch u.Scheme {
+	case "tcp", "mqtt":
+		conn, err = dialer.Dial("tcp", hostWithDefaultPort(u, "1883"))
+	case "ssl", "tls", "mqtts":
+		conn, err = tls.DialWithDialer(dialer, "tcp", hostWithDefaultPort(u, "8883"), &tls.Config{
+			ServerName:         u.Hostname(),
+			InsecureSkipVerify: p.cfg.InsecureSkipVerify,
+		})
+	default:
+		return fmt.Errorf("unsupported broker scheme %q", u.Scheme)
+	}
+	if err != nil {
+		return err
+	}
+
+	// The broker drops us after 1.5 keep-alive periods without traffic, so keep it
+	// comfortably above the publish interval.
+	keepAlive := 2 * p.cfg.Interval
+	if keepAlive < time.Minute {
+		keepAlive = time.Minute
+	}
+	if keepAlive > 0xffff*time.Second {
+		keepAlive = 0xffff * time.Second
+	}
+
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err := conn.Write(mqttConnectPacket(p.cfg, p.availabilityTopic(), keepAlive)); err != nil {
+		conn.Close()
+		return err
+	}
+	ack := make([]byte, 4)
+	if _, err := io.ReadFull(conn, ack); err != nil {
+		conn.Close()
+		return fmt.Errorf("reading CONNACK: %w", err)
+	}
+	if ack[0] != 0x20 || ack[1] != 0x02 {
+		conn.Close()
+		return errors.New("unexpected reply to CONNECT")
+	}
+	if ack[3] != 0 {
+		conn.Close()
+		return fmt.Errorf("broker refused connection (return code %d)", ack[3])
+	}
+	conn.SetDeadline(time.Time{})
+
+	p.conn = conn
+	p.announced = make(map[string]bool)
+	return p.publish(p.availabilityTopic(), []byte("online"), true)
+}
+
+// close marks the exporter offline and disconnects cleanly if connected.
+func (p *mqttPublisher) close() {
+	if p.conn == nil {
+		return
+	}
+	p.publish(p.availabilityTopic(), []byte("offline"), true)
+	p.conn.Write([]byte{0xe0, 0x00})
+	p.conn.Close()
+	p.conn = nil
+}
+
+// publish sends a QoS 0 PUBLISH packet.
+func (p *mqttPublisher) publish(topic string, payload []byte, retain bool) error {
+	var body bytes.Buffer
+	writeMQTTString(&body, topic)
+	body.Write(payload)
+
+	header := byte(0x30)
+	if retain {
+		header |= 0x01
+	}
+
+	p.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	_, err := p.conn.Write(mqttPacket(header, body.Bytes()))
+	return err
+}
+
+// mqttConnectPacket builds a CONNECT packet with a clean session and a retained
+// "offline" last will on the given topic.
+func mqttConnectPacket(cfg MQTTConfig, willTopic string, keepAlive time.Duration) []byte {
+	flags := byte(0x02 | 0x04 | 0x20) // clean session, will flag, will retain
+	if cfg.Username != "" {
+		flags |= 0x80
+	}
+	if cfg.Password != "" {
+		flags |= 0x40
+	}
+
+	var body bytes.Buffer
+	writeMQTTString(&body, "MQTT")
+	body.WriteByte(0x04) // protocol level 3.1.1
+	body.WriteByte(flags)
+	binary.Write(&body, binary.BigEndian, uint16(keepAlive/time.Second))
+	writeMQTTString(&body, cfg.ClientID)
+	writeMQTTString(&body, willTopic)
+	writeMQTTString(&body, "offline")
+	if cfg.Username != "" {
+		writeMQTTString(&body, cfg.Username)
+	}
+	if cfg.Password != "" {
+		writeMQTTString(&body, cfg.Password)
+	}
+	return mqttPacket(0x10, body.Bytes())
+}
+
+// mqttPacket prefixes a packet body with its fixed header.
+func mqttPacket(header byte, body []byte) []byte {
+	packet := []byte{header}
+	length := len(body)
+	for {
+		b := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			b |= 0x80
+		}
+		packet = append(packet, b)
+		if length == 0 {
+			break
+		}
+	}
+	return append(packet, body...)
+}
+
+func writeMQTTString(buf *bytes.Buffer, s string) {
+	binary.Write(buf, binary.BigEndian, uint16(len(s)))
+	buf.WriteString(s)
+}
+
+// hostWithDefaultPort returns the host:port of a URL, filling in the default port.
+func hostWithDefaultPort(u *url.URL, port string) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
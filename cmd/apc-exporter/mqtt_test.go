@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// mqttTestBroker accepts one client connection, decoding its packets with the packet
+// codec of the Paho MQTT client. It acknowledges the CONNECT, which is sent on the
+// channel first, followed by the PUBLISH packets until the DISCONNECT.
+func mqttTestBroker(t *testing.T) (string, <-chan packets.ControlPacket) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	received := make(chan packets.ControlPacket, 100)
+	go func() {
+		defer close(received)
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			packet, err := packets.ReadPacket(conn)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			received <- packet
+			switch packet.(type) {
+			case *packets.ConnectPacket:
+				ack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+				ack.ReturnCode = packets.Accepted
+				ack.Write(conn)
+			case *packets.DisconnectPacket:
+				return
+			}
+		}
+	}()
+	return ln.Addr().String(), received
+}
+
+// TestMQTTPublish checks the packets a broker receives: a CONNECT with the last will,
+// the retained availability, discovery configs and state document, and the offline
+// availability before the DISCONNECT.
+func TestMQTTPublish(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	load := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "ups_load_percent", Help: "Output load in percent."}, []string{"target"})
+	up := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "ups_device_status_up", Help: "Whether the UPS is online."}, []string{"target"})
+	reg.MustRegister(load, up)
+	load.WithLabelValues("rack a").Set(23.5)
+	up.WithLabelValues("rack a").Set(1)
+
+	addr, received := mqttTestBroker(t)
+	p := &mqttPublisher{cfg: MQTTConfig{
+		Broker: "tcp://" + addr, Username: "exporter", Password: "secret", ClientID: "apc-exporter",
+		TopicPrefix: "apc-exporter", DiscoveryPrefix: "homeassistant", Interval: 30 * time.Second,
+	}}
+	if err := p.publishSamples(reg); err != nil {
+		t.Fatal(err)
+	}
+	p.close()
+
+	connect, ok := (<-received).(*packets.ConnectPacket)
+	if !ok {
+		t.Fatal("first packet is not a CONNECT")
+	}
+	if code := connect.Validate(); code != packets.Accepted {
+		t.Errorf("CONNECT invalid: %s", packets.ConnackReturnCodes[code])
+	}
+	if connect.ProtocolName != "MQTT" || connect.ProtocolVersion != 4 || !connect.CleanSession || connect.Keepalive != 60 ||
+		connect.ClientIdentifier != "apc-exporter" || connect.Username != "exporter" || string(connect.Password) != "secret" {
+		t.Errorf("CONNECT %v", connect)
+	}
+	if !connect.WillFlag || !connect.WillRetain || connect.WillTopic != "apc-exporter/status" || string(connect.WillMessage) != "offline" {
+		t.Errorf("last will %q on %s, retained %v", connect.WillMessage, connect.WillTopic, connect.WillRetain)
+	}
+
+	published := make(map[string][]byte)
+	var order []string
+	for packet := range received {
+		switch packet := packet.(type) {
+		case *packets.PublishPacket:
+			if !packet.Retain || packet.Qos != 0 {
+				t.Errorf("%s published with QoS %d, retained %v", packet.TopicName, packet.Qos, packet.Retain)
+			}
+			published[packet.TopicName] = packet.Payload
+			order = append(order, packet.TopicName+" "+string(packet.Payload))
+		case *packets.DisconnectPacket:
+		default:
+			t.Errorf("unexpected %v", packet)
+		}
+	}
+	if len(order) < 2 || order[0] != "apc-exporter/status online" || order[len(order)-1] != "apc-exporter/status offline" {
+		t.Errorf("published %v, want online first and offline last", order)
+	}
+
+	var state map[string]float64
+	if err := json.Unmarshal(published["apc-exporter/apc_rack_a/state"], &state); err != nil {
+		t.Fatal(err)
+	}
+	if state["ups_load_percent"] != 23.5 || state["ups_device_status_up"] != 1 {
+		t.Errorf("state %v", state)
+	}
+	var discovery map[string]any
+	if err := json.Unmarshal(published["homeassistant/sensor/apc_rack_a/ups_load_percent/config"], &discovery); err != nil {
+		t.Fatal(err)
+	}
+	if discovery["unique_id"] != "apc_rack_a_ups_load_percent" || discovery["state_topic"] != "apc-exporter/apc_rack_a/state" ||
+		discovery["value_template"] != "{{ value_json.ups_load_percent }}" || discovery["unit_of_measurement"] != "%" {
+		t.Errorf("load discovery config %v", discovery)
+	}
+	discovery = nil
+	if err := json.Unmarshal(published["homeassistant/binary_sensor/apc_rack_a/ups_device_status_up/config"], &discovery); err != nil {
+		t.Fatal(err)
+	}
+	if discovery["device_class"] != "power" || discovery["availability_topic"] != "apc-exporter/status" {
+		t.Errorf("online discovery config %v", discovery)
+	}
+}
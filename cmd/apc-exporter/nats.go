@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// NATSConfig holds the settings for publishing snapshots and events to NATS.
+type NATSConfig struct {
+	URL                string        `yaml:"url"`
+	SubjectPrefix      string        `yaml:"subject_prefix"`
+	Username           string        `yaml:"username"`
+	Password           string        `yaml:"password"`
+	Token              string        `yaml:"token"`
+	Interval           time.Duration `yaml:"interval"`
+	InsecureSkipVerify bool          `yaml:"insecure_skip_verify"`
+}
+
+var natsSubjectUnsafe = regexp.MustCompile(`[^a-zA-Z0-9_-]`)
+
+// runNATS publishes a status snapshot per target on each interval, plus any state
+// changes since the previous poll, until the context is cancelled. It returns
+// immediately if no server URL is configured.
+func runNATS(ctx context.Context, cfg NATSConfig, gatherer prometheus.Gatherer) {
+	if cfg.URL == "" {
+		return
+	}
+	if cfg.SubjectPrefix == "" {
+		cfg.SubjectPrefix = "ups"
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = 30 * time.Second
+	}
+	gatherer = gatherWithin(gatherer, cfg.Interval)
+
+	var tracker stateTracker
+	slog.Info("Publishing status to NATS", "url", cfg.URL, "interval", cfg.Interval)
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			if err := publishNATS(ctx, cfg, gatherer, &tracker, now); err != nil {
+				slog.Warn("Error publishing to NATS", "err", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// publishNATS gathers the UPS metrics once and publishes them on a fresh
+// connection: the snapshot of each target on <prefix>.<target>.status and its state
+// changes on <prefix>.<target>.events.
+func publishNATS(ctx context.Context, cfg NATSConfig, gatherer prometheus.Gatherer, tracker *stateTracker, now time.Time) error {
+	samples, err := gatherSamples(gatherer, "ups_")
+	if err != nil {
+		return err
+	}
+	targets, states := samplesByTarget(samples)
+	changes := tracker.update(now, states)
+
+	conn, err := dialNATS(ctx, cfg)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	w := bufio.NewWriter(conn)
+	for _, target := range targets {
+		payload, err := json.Marshal(map[string]any{
+			"timestamp": now.UTC().Format(time.RFC3339),
+			"target":    target,
+			"metrics":   states[target],
+		})
+		if err != nil {
+			return err
+		}
+		writeNATSPub(w, natsSubject(cfg, target, "status"), payload)
+	}
+	for _, change := range changes {
+		payload, err := json.Marshal(change)
+		if err != nil {
+			return err
+		}
+		writeNATSPub(w, natsSubject(cfg, change.Target, "events"), payload)
+	}
+
+	// A PONG to our PING confirms that the server has processed every PUB before it.
+	w.WriteString("PING\r\n")
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return readNATSPong(bufio.NewReader(conn))
+}
+
+func natsSubject(cfg NATSConfig, target, kind string) string {
+	return cfg.SubjectPrefix + "." + natsSubjectUnsafe.ReplaceAllString(target, "_") + "." + kind
+}
+
+func writeNATSPub(w *bufio.Writer, subject string, payload []byte) {
+	fmt.Fprintf(w, "PUB %s %d\r\n", subject, len(payload))
+	w.Write(payload)
+	w.WriteString("\r\n")
+}
+
+// dialNATS connects to the server and completes the INFO/CONNECT handshake,
+// upgrading to TLS if the URL scheme or the server requires it.
+func dialNATS(ctx context.Context, cfg NATSConfig) (net.Conn, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid server URL: %w", err)
+	}
+	if u.Scheme != "nats" && u.Scheme != "tls" {
+		return nil, fmt.Errorf("unsupported server scheme %q", u.Scheme)
+	}
+
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", hostWithDefaultPort(u, "4222"))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("reading INFO: %w", err)
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		conn.Close()
+		return nil, errors.New("unexpected greeting from server")
+	}
+	var info struct {
+		TLSRequired bool `json:"tls_required"`
+	}
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "INFO ")), &info); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("decoding INFO: %w", err)
+	}
+
+	if u.Scheme == "tls" || info.TLSRequired {
+		tlsConn := tls.Client(conn, &tls.Config{
+			ServerName:         u.Hostname(),
+			InsecureSkipVerify: cfg.InsecureSkipVerify,
+		})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	options := map[string]any{
+		"verbose":  false,
+		"pedantic": false,
+		"lang":     "go",
+		"version":  "apc-exporter",
+		"name":     "apc-exporter",
+		"protocol": 0,
+	}
+	username, password, token := cfg.Username, cfg.Password, cfg.Token
+	if u.User != nil && username == "" && token == "" {
+		username = u.User.Username()
+		password, _ = u.User.Password()
+	}
+	if username != "" {
+		options["user"], options["pass"] = username, password
+	}
+	if token != "" {
+		options["auth_token"] = token
+	}
+	connect, err := json.Marshal(options)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if _, err := fmt.Fprintf(conn, "CONNECT %s\r\n", connect); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// readNATSPong waits for the PONG answering our PING, surfacing any -ERR the server
+// sent for the preceding commands.
+func readNATSPong(r *bufio.Reader) error {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "PONG":
+			return nil
+		case line == "PING":
+			// Server keep-alives are harmless here; the connection is closed shortly.
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("server error: %s", strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// natsTestConn is what the test server received on one client connection.
+type natsTestConn struct {
+	connect map[string]any
+	msgs    []natsTestMsg
+}
+
+// natsTestMsg is a message published by the client.
+type natsTestMsg struct {
+	subject string
+	payload []byte
+}
+
+// natsTestServer accepts client connections and parses them as the NATS client
+// protocol documentation describes it: the INFO greeting, a CONNECT with its JSON
+// options, "PUB <subject> [reply-to] <#bytes>" followed by exactly that many bytes and
+// CRLF, and PING answered with PONG, or with -ERR if reject is set. Each connection is
+// sent on the channel once the client closes it.
+func natsTestServer(t *testing.T, reject string) (string, <-chan natsTestConn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	conns := make(chan natsTestConn, 10)
+	serve := func(conn net.Conn) {
+		defer conn.Close()
+		conn.Write([]byte(`INFO {"server_id":"test","version":"2.10.0","proto":1,"max_payload":1048576,"auth_required":true}` + "\r\n"))
+		var received natsTestConn
+		defer func() { conns <- received }()
+		r := bufio.NewReader(conn)
+		for {
+			line, err := r.ReadString('\n')
+			if err == io.EOF {
+				return
+			}
+			if err != nil || !strings.HasSuffix(line, "\r\n") {
+				t.Errorf("line %q not terminated by CRLF: %v", line, err)
+				return
+			}
+			op, args, _ := strings.Cut(strings.TrimSuffix(line, "\r\n"), " ")
+			switch op {
+			case "CONNECT":
+				if received.connect != nil || json.Unmarshal([]byte(args), &received.connect) != nil {
+					t.Errorf("CONNECT %s", args)
+					return
+				}
+			case "PUB":
+				// The exporter sets no reply-to subject.
+				fields := strings.Fields(args)
+				if received.connect == nil || len(fields) != 2 {
+					t.Errorf("PUB %s, want a subject and a size after the CONNECT", args)
+					return
+				}
+				n, err := strconv.Atoi(fields[1])
+				if err != nil || n < 0 {
+					t.Errorf("PUB %s: invalid size", args)
+					return
+				}
+				payload := make([]byte, n+2)
+				if _, err := io.ReadFull(r, payload); err != nil || string(payload[n:]) != "\r\n" {
+					t.Errorf("payload of %s %q not followed by CRLF: %v", fields[0], payload, err)
+					return
+				}
+				received.msgs = append(received.msgs, natsTestMsg{fields[0], payload[:n]})
+			case "PING":
+				if reject != "" {
+					conn.Write([]byte("-ERR '" + reject + "'\r\n"))
+				} else {
+					conn.Write([]byte("PONG\r\n"))
+				}
+			default:
+				t.Errorf("unexpected %q", line)
+				return
+			}
+		}
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+	return ln.Addr().String(), conns
+}
+
+// TestPublishNATS checks what a server receives: a CONNECT with the credentials, the
+// status of each target and the state changes since the previous poll on subjects
+// with the target made safe, and the PING confirming them.
+func TestPublishNATS(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	load := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "ups_load_percent", Help: "Output load in percent."}, []string{"target"})
+	up := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "ups_device_status_up", Help: "Whether the UPS is online."}, []string{"target"})
+	reg.MustRegister(load, up)
+	for _, target := range []string{"rack-a", "10.0.0.12:80"} {
+		load.WithLabelValues(target).Set(20)
+		up.WithLabelValues(target).Set(1)
+	}
+
+	addr, conns := natsTestServer(t, "")
+	cfg := NATSConfig{URL: "nats://" + addr, SubjectPrefix: "ups", Token: "s3cr3t"}
+	var tracker stateTracker
+	if err := publishNATS(t.Context(), cfg, reg, &tracker, historyTestTime); err != nil {
+		t.Fatal(err)
+	}
+	if first := <-conns; len(first.msgs) != 2 {
+		t.Errorf("first poll published %d messages, want the 2 statuses", len(first.msgs))
+	}
+	up.WithLabelValues("10.0.0.12:80").Set(0)
+	now := historyTestTime.Add(time.Minute)
+	if err := publishNATS(t.Context(), cfg, reg, &tracker, now); err != nil {
+		t.Fatal(err)
+	}
+
+	conn := <-conns
+	if conn.connect["verbose"] != false || conn.connect["auth_token"] != "s3cr3t" || conn.connect["user"] != nil {
+		t.Errorf("CONNECT %v", conn.connect)
+	}
+	published := make(map[string][]byte)
+	for _, msg := range conn.msgs {
+		published[msg.subject] = msg.payload
+	}
+	if len(published) != 3 {
+		t.Errorf("published on %d subjects, want 3", len(published))
+	}
+	var status struct {
+		Timestamp time.Time          `json:"timestamp"`
+		Target    string             `json:"target"`
+		Metrics   map[string]float64 `json:"metrics"`
+	}
+	if err := json.Unmarshal(published["ups.10_0_0_12_80.status"], &status); err != nil {
+		t.Fatal(err)
+	}
+	if !status.Timestamp.Equal(now) || status.Target != "10.0.0.12:80" || status.Metrics["ups_device_status_up"] != 0 || status.Metrics["ups_load_percent"] != 20 {
+		t.Errorf("status %+v", status)
+	}
+	var change stateChange
+	if err := json.Unmarshal(published["ups.10_0_0_12_80.events"], &change); err != nil {
+		t.Fatal(err)
+	}
+	if !change.Time.Equal(now) || change.Target != "10.0.0.12:80" || change.Metric != "ups_device_status_up" || change.From != 1 || change.To != 0 {
+		t.Errorf("state change %+v", change)
+	}
+	if _, ok := published["ups.rack-a.status"]; !ok {
+		t.Errorf("no status of rack-a in %v", conn.msgs)
+	}
+}
+
+// TestPublishNATSError checks that the credentials of the URL are sent, and that an
+// -ERR answering the commands fails the publish.
+func TestPublishNATSError(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	load := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "ups_load_percent", Help: "Output load in percent."}, []string{"target"})
+	reg.MustRegister(load)
+	load.WithLabelValues("rack-a").Set(20)
+
+	addr, conns := natsTestServer(t, "Authorization Violation")
+	cfg := NATSConfig{URL: "nats://exporter:wrong@" + addr, SubjectPrefix: "ups"}
+	var tracker stateTracker
+	err := publishNATS(t.Context(), cfg, reg, &tracker, historyTestTime)
+	if err == nil || !strings.Contains(err.Error(), "Authorization Violation") {
+		t.Errorf("publish = %v, want the server error", err)
+	}
+	if conn := <-conns; conn.connect["user"] != "exporter" || conn.connect["pass"] != "wrong" {
+		t.Errorf("CONNECT %v, want the credentials of the URL", conn.connect)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// NotificationConfig holds the settings that keep a bouncing utility feed from
+// producing a notification storm. All of them are disabled by default.
+type NotificationConfig struct {
+	GroupWait      time.Duration `yaml:"group_wait"`
+	RepeatInterval time.Duration `yaml:"repeat_interval"`
+	FlapThreshold  int           `yaml:"flap_threshold"`
+	FlapWindow     time.Duration `yaml:"flap_window"`
+}
+
+var notificationsSuppressed = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "ups_notifications_suppressed_total",
+	Help: "Number of transitions not notified, by reason (grouped, repeated or flapping).",
+}, []string{"target", "reason"})
+
+// notificationState is what the gate knows about one condition of one target. It is
+// persisted with a state store, hence the exported fields.
+type notificationState struct {
+	Pending      *transition `json:"pending,omitempty"`
+	PendingSince time.Time   `json:"pending_since"`
+	Deferred     bool        `json:"deferred"`       // whether the pending set waits for the repeat interval
+	Active       bool        `json:"active"`         // the state last delivered, initially the state before the first transition
+	Last         *transition `json:"last,omitempty"` // the transition last delivered
+	LastSet      time.Time   `json:"last_set"`       // when the condition was last delivered as set
+	Changes      []time.Time `json:"changes"`        // within the flap window
+	Flapping     bool        `json:"flapping"`
+}
+
+// notificationGate sits between the transition tracker and the notifiers:
+//
+//   - transitions wait GroupWait before they are delivered; if the condition returns
+//     to the state last delivered in the meantime, nothing is delivered at all;
+//   - a condition is delivered as set at most once per RepeatInterval, and while it
+//     stays set it is delivered again as a reminder every RepeatInterval;
+//   - a condition that changes FlapThreshold times within FlapWindow is flapping and
+//     is not delivered until it has been stable for FlapWindow, after which its
+//     current state is delivered if it differs from the last one.
+type notificationGate struct {
+	cfg    NotificationConfig
+	states map[string]*notificationState // by target and condition
+}
+
+func newNotificationGate(cfg NotificationConfig) *notificationGate {
+	if cfg.FlapThreshold > 0 && cfg.FlapWindow <= 0 {
+		cfg.FlapWindow = 10 * time.Minute
+	}
+	return &notificationGate{cfg: cfg, states: make(map[string]*notificationState)}
+}
+
+// submit records a detected transition. It returns a message if the condition just
+// started flapping.
+func (g *notificationGate) submit(tr transition) string {
+	key := tr.Target + "\x00" + tr.Condition
+	s := g.states[key]
+	if s == nil {
+		s = &notificationState{Active: !tr.Active}
+		g.states[key] = s
+	}
+	if s.Pending == nil {
+		s.PendingSince = tr.Time
+	} else if s.Flapping {
+		notificationsSuppressed.WithLabelValues(tr.Target, "flapping").Inc()
+	} else {
+		notificationsSuppressed.WithLabelValues(tr.Target, "grouped").Inc()
+	}
+	s.Pending = &tr
+
+	if g.cfg.FlapThreshold <= 0 {
+		return ""
+	}
+	s.Changes = append(s.Changes, tr.Time)
+	for len(s.Changes) > 0 && tr.Time.Sub(s.Changes[0]) > g.cfg.FlapWindow {
+		s.Changes = s.Changes[1:]
+	}
+	if !s.Flapping && len(s.Changes) >= g.cfg.FlapThreshold {
+		s.Flapping = true
+		return fmt.Sprintf("%s changed %d times within %s; suppressing notifications until it is stable", tr.Condition, len(s.Changes), g.cfg.FlapWindow)
+	}
+	return ""
+}
+
+// flush returns the transitions that are due for delivery, oldest first.
+func (g *notificationGate) flush(now time.Time) []transition {
+	var due []transition
+	for _, s := range g.states {
+		if s.Pending == nil {
+			if g.cfg.RepeatInterval > 0 && s.Active && s.Last != nil && now.Sub(s.LastSet) >= g.cfg.RepeatInterval {
+				reminder := *s.Last
+				reminder.Time = now
+				s.LastSet = now
+				due = append(due, reminder)
+			}
+			continue
+		}
+		tr := *s.Pending
+		if s.Flapping {
+			if now.Sub(s.Changes[len(s.Changes)-1]) < g.cfg.FlapWindow {
+				continue
+			}
+			s.Flapping = false
+			s.Changes = nil
+		}
+		if now.Sub(s.PendingSince) < g.cfg.GroupWait {
+			continue
+		}
+		if tr.Active && g.cfg.RepeatInterval > 0 && !s.LastSet.IsZero() && now.Sub(s.LastSet) < g.cfg.RepeatInterval {
+			if !s.Deferred {
+				s.Deferred = true
+				notificationsSuppressed.WithLabelValues(tr.Target, "repeated").Inc()
+			}
+			continue
+		}
+		s.Pending, s.Deferred = nil, false
+
+		if tr.Active == s.Active {
+			// Back to the state last delivered: the intermediate changes cancel out.
+			notificationsSuppressed.WithLabelValues(tr.Target, "grouped").Inc()
+			continue
+		}
+		s.Active, s.Last = tr.Active, &tr
+		if tr.Active {
+			s.LastSet = now
+		}
+		due = append(due, tr)
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i].Time.Before(due[j].Time) })
+	return due
+}
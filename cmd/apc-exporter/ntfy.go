@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// NtfyConfig holds the settings for publishing transitions to an ntfy topic.
+type NtfyConfig struct {
+	Server     string            `yaml:"server"`
+	Topic      string            `yaml:"topic"`
+	Token      string            `yaml:"token"`
+	Username   string            `yaml:"username"`
+	Password   string            `yaml:"password"`
+	Priorities map[string]string `yaml:"priorities"`
+	Targets    []string          `yaml:"targets"`
+	Conditions []string          `yaml:"conditions"`
+	Template   string            `yaml:"template"`
+}
+
+// defaultNtfyPriorities maps transition severities to ntfy priorities.
+var defaultNtfyPriorities = map[string]string{
+	"critical": "urgent",
+	"warning":  "high",
+	"info":     "default",
+}
+
+var ntfyPriorityNames = []string{"1", "2", "3", "4", "5", "min", "low", "default", "high", "urgent", "max"}
+
+// newNtfyNotifier returns a notifier that publishes a templated message per
+// transition to the topic. It returns nil if no topic is configured.
+func newNtfyNotifier(cfg NtfyConfig) (transitionNotifier, error) {
+	if cfg.Topic == "" {
+		return nil, nil
+	}
+	if cfg.Server == "" {
+		cfg.Server = "https://ntfy.sh"
+	}
+	if cfg.Template == "" {
+		cfg.Template = defaultChatTemplate
+	}
+	tmpl, err := template.New("ntfy").Parse(cfg.Template)
+	if err != nil {
+		return nil, fmt.Errorf("template: %w", err)
+	}
+	priorities := make(map[string]string)
+	for severity, priority := range defaultNtfyPriorities {
+		priorities[severity] = priority
+	}
+	for severity, priority := range cfg.Priorities {
+		if !slices.Contains(ntfyPriorityNames, priority) {
+			return nil, fmt.Errorf("invalid priority %q for %s (use 1-5 or min, low, default, high, urgent)", priority, severity)
+		}
+		priorities[severity] = priority
+	}
+	endpoint := strings.TrimSuffix(cfg.Server, "/") + "/" + cfg.Topic
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	return func(ctx context.Context, tr transition) error {
+		if len(cfg.Targets) > 0 && !slices.Contains(cfg.Targets, tr.Target) {
+			return nil
+		}
+		if len(cfg.Conditions) > 0 && !slices.Contains(cfg.Conditions, tr.Condition) {
+			return nil
+		}
+		var text bytes.Buffer
+		if err := tmpl.Execute(&text, tr); err != nil {
+			return fmt.Errorf("ntfy template: %w", err)
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, &text)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("User-Agent", "apc-exporter")
+		req.Header.Set("Priority", priorities[tr.severity()])
+		if tr.Active {
+			req.Header.Set("Title", fmt.Sprintf("%s: %s", tr.Target, tr.Condition))
+			req.Header.Set("Tags", "warning,"+tr.Condition)
+		} else {
+			req.Header.Set("Title", fmt.Sprintf("%s: %s cleared", tr.Target, tr.Condition))
+			req.Header.Set("Tags", "white_check_mark,"+tr.Condition)
+		}
+		if cfg.Token != "" {
+			req.Header.Set("Authorization", "Bearer "+cfg.Token)
+		} else if cfg.Username != "" {
+			req.SetBasicAuth(cfg.Username, cfg.Password)
+		}
+
+		res, err := client.Do(req)
+		if err != nil {
+			return fmt.Errorf("ntfy: %w", err)
+		}
+		defer res.Body.Close()
+		io.Copy(io.Discard, res.Body)
+		if res.StatusCode/100 != 2 {
+			return fmt.Errorf("ntfy: server returned HTTP status %d", res.StatusCode)
+		}
+		return nil
+	}, nil
+}
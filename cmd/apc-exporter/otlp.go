@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"golang.org/x/net/http2"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// OTLPConfig holds the settings for exporting metrics to an OpenTelemetry collector.
+type OTLPConfig struct {
+	Endpoint           string            `yaml:"endpoint"`
+	Protocol           string            `yaml:"protocol"`
+	Insecure           bool              `yaml:"insecure"`
+	Headers            map[string]string `yaml:"headers"`
+	Interval           time.Duration     `yaml:"interval"`
+	Timeout            time.Duration     `yaml:"timeout"`
+	ResourceAttributes map[string]string `yaml:"resource_attributes"`
+}
+
+// otlpUnits maps metric name suffixes to UCUM units as used by OpenTelemetry.
+var otlpUnits = []struct{ suffix, unit string }{
+	{"_percent", "%"},
+	{"_percent_va", "%"},
+	{"_celsius", "Cel"},
+	{"_minutes", "min"},
+	{"_seconds", "s"},
+	{"_amps", "A"},
+	{"_vac", "V"},
+	{"_vdc", "V"},
+	{"_hz", "Hz"},
+}
+
+// runOTLP exports the UPS metrics to an OTLP endpoint on every interval until the
+// context is cancelled. It returns immediately if no endpoint is configured.
+func runOTLP(ctx context.Context, cfg OTLPConfig, gatherer prometheus.Gatherer) {
+	if cfg.Endpoint == "" {
+		return
+	}
+	if cfg.Protocol == "" {
+		cfg.Protocol = "grpc"
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = 30 * time.Second
+	}
+	gatherer = gatherWithin(gatherer, cfg.Interval)
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+
+	exporter, err := newOTLPExporter(cfg)
+	if err != nil {
+		slog.Warn("OTLP output disabled", "err", err)
+		return
+	}
+
+	slog.Info("Exporting metrics via OTLP", "protocol", cfg.Protocol, "url", exporter.url, "interval", cfg.Interval)
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := exporter.export(ctx, gatherer); err != nil {
+				slog.Warn("Error exporting via OTLP", "err", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// otlpExporter sends ExportMetricsServiceRequest messages over gRPC or HTTP.
+type otlpExporter struct {
+	cfg       OTLPConfig
+	url       string
+	client    *http.Client
+	startTime time.Time
+}
+
+func newOTLPExporter(cfg OTLPConfig) (*otlpExporter, error) {
+	e := &otlpExporter{cfg: cfg, startTime: time.Now()}
+
+	switch cfg.Protocol {
+	case "grpc":
+		endpoint := cfg.Endpoint
+		if !strings.Contains(endpoint, "://") {
+			if cfg.Insecure {
+				endpoint = "http://" + endpoint
+			} else {
+				endpoint = "https://" + endpoint
+			}
+		}
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return nil, err
+		}
+		u.Path = "/opentelemetry.proto.collector.metrics.v1.MetricsService/Export"
+		e.url = u.String()
+
+		transport := &http2.Transport{}
+		if u.Scheme == "http" {
+			// Plaintext gRPC needs HTTP/2 with prior knowledge (h2c).
+			transport.AllowHTTP = true
+			transport.DialTLSContext = func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, addr)
+			}
+		}
+		e.client = &http.Client{Transport: transport, Timeout: cfg.Timeout}
+	case "http", "http/protobuf":
+		u, err := url.Parse(cfg.Endpoint)
+		if err != nil {
+			return nil, err
+		}
+		if u.Path == "" || u.Path == "/" {
+			u.Path = "/v1/metrics"
+		}
+		e.url = u.String()
+		e.client = &http.Client{Timeout: cfg.Timeout}
+	default:
+		return nil, fmt.Errorf("unsupported protocol %q (use grpc or http/protobuf)", cfg.Protocol)
+	}
+	return e, nil
+}
+
+// export gathers the UPS metrics once and sends them to the collector.
+func (e *otlpExporter) export(ctx context.Context, gatherer prometheus.Gatherer) error {
+	samples, err := gatherSamples(gatherer, "ups_")
+	if err != nil {
+		return err
+	}
+	msg := e.encodeRequest(samples, time.Now())
+
+	var body []byte
+	contentType := "application/x-protobuf"
+	if e.cfg.Protocol == "grpc" {
+		// Length-prefixed message framing: compressed flag plus big-endian length.
+		body = make([]byte, 5, 5+len(msg))
+		binary.BigEndian.PutUint32(body[1:], uint32(len(msg)))
+		body = append(body, msg...)
+		contentType = "application/grpc"
+	} else {
+		body = msg
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if e.cfg.Protocol == "grpc" {
+		req.Header.Set("TE", "trailers")
+	}
+	for k, v := range e.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+
+	res, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("collector returned HTTP status %d", res.StatusCode)
+	}
+	if e.cfg.Protocol == "grpc" {
+		// Trailers-only responses carry the status in the headers instead.
+		status, message := res.Trailer.Get("Grpc-Status"), res.Trailer.Get("Grpc-Message")
+		if status == "" {
+			status, message = res.Header.Get("Grpc-Status"), res.Header.Get("Grpc-Message")
+		}
+		if status != "0" {
+			return fmt.Errorf("collector returned gRPC status %s: %s", status, message)
+		}
+	}
+	return nil
+}
+
+// encodeRequest builds an opentelemetry.proto.collector.metrics.v1.ExportMetricsServiceRequest
+// with a single resource and scope. Gauges become OTel gauges and counters become
+// cumulative monotonic sums starting at the exporter's start time.
+func (e *otlpExporter) encodeRequest(samples []sample, now time.Time) []byte {
+	var metrics [][]byte
+	for i := 0; i < len(samples); {
+		// Samples of one family are contiguous; each family becomes one metric.
+		j := i
+		var points []byte
+		for ; j < len(samples) && samples[j].Name == samples[i].Name; j++ {
+			points = appendOTLPMessage(points, 1, e.encodeDataPoint(samples[j], now))
+		}
+
+		var metric []byte
+		metric = protowire.AppendTag(metric, 1, protowire.BytesType)
+		metric = protowire.AppendString(metric, samples[i].Name)
+		metric = protowire.AppendTag(metric, 2, protowire.BytesType)
+		metric = protowire.AppendString(metric, samples[i].Help)
+		if unit := otlpUnit(samples[i].Name); unit != "" {
+			metric = protowire.AppendTag(metric, 3, protowire.BytesType)
+			metric = protowire.AppendString(metric, unit)
+		}
+		if samples[i].Type == dto.MetricType_COUNTER {
+			sum := points
+			sum = protowire.AppendTag(sum, 2, protowire.VarintType)
+			sum = protowire.AppendVarint(sum, 2) // AGGREGATION_TEMPORALITY_CUMULATIVE
+			sum = protowire.AppendTag(sum, 3, protowire.VarintType)
+			sum = protowire.AppendVarint(sum, 1) // is_monotonic
+			metric = appendOTLPMessage(metric, 7, sum)
+		} else {
+			metric = appendOTLPMessage(metric, 5, points)
+		}
+		metrics = append(metrics, metric)
+		i = j
+	}
+
+	var scope []byte
+	scope = protowire.AppendTag(scope, 1, protowire.BytesType)
+	scope = protowire.AppendString(scope, "apc-exporter")
+
+	var scopeMetrics []byte
+	scopeMetrics = appendOTLPMessage(scopeMetrics, 1, scope)
+	for _, m := range metrics {
+		scopeMetrics = appendOTLPMessage(scopeMetrics, 2, m)
+	}
+
+	attributes := map[string]string{"service.name": "apc-exporter"}
+	for k, v := range e.cfg.ResourceAttributes {
+		attributes[k] = v
+	}
+	var resource []byte
+	for k, v := range attributes {
+		resource = appendOTLPMessage(resource, 1, encodeOTLPKeyValue(k, v))
+	}
+
+	var resourceMetrics []byte
+	resourceMetrics = appendOTLPMessage(resourceMetrics, 1, resource)
+	resourceMetrics = appendOTLPMessage(resourceMetrics, 2, scopeMetrics)
+
+	return appendOTLPMessage(nil, 1, resourceMetrics)
+}
+
+// encodeDataPoint builds a NumberDataPoint carrying the sample's labels as attributes.
+func (e *otlpExporter) encodeDataPoint(s sample, now time.Time) []byte {
+	var point []byte
+	for _, name := range s.sortedLabelNames() {
+		point = appendOTLPMessage(point, 7, encodeOTLPKeyValue(name, s.Labels[name]))
+	}
+	point = protowire.AppendTag(point, 2, protowire.Fixed64Type)
+	point = protowire.AppendFixed64(point, uint64(e.startTime.UnixNano()))
+	point = protowire.AppendTag(point, 3, protowire.Fixed64Type)
+	point = protowire.AppendFixed64(point, uint64(now.UnixNano()))
+	point = protowire.AppendTag(point, 4, protowire.Fixed64Type)
+	point = protowire.AppendFixed64(point, math.Float64bits(s.Value))
+	return point
+}
+
+// encodeOTLPKeyValue builds a KeyValue with a string AnyValue.
+func encodeOTLPKeyValue(key, value string) []byte {
+	var anyValue []byte
+	anyValue = protowire.AppendTag(anyValue, 1, protowire.BytesType)
+	anyValue = protowire.AppendString(anyValue, value)
+
+	var kv []byte
+	kv = protowire.AppendTag(kv, 1, protowire.BytesType)
+	kv = protowire.AppendString(kv, key)
+	return appendOTLPMessage(kv, 2, anyValue)
+}
+
+func appendOTLPMessage(b []byte, num protowire.Number, msg []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, msg)
+}
+
+func otlpUnit(name string) string {
+	for _, u := range otlpUnits {
+		if strings.HasSuffix(name, u.suffix) {
+			return u.unit
+		}
+	}
+	return ""
+}
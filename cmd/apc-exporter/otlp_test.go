@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	collectormetrics "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/protobuf/proto"
+)
+
+// otlpTestRequest is a request received by the test collector.
+type otlpTestRequest struct {
+	path, contentType, token string
+	msg                      *collectormetrics.ExportMetricsServiceRequest
+}
+
+// otlpTestCollector answers OTLP exports over HTTP, or over gRPC with HTTP/2 without
+// TLS, decoding the messages with the OpenTelemetry protos. gRPC messages are unframed
+// first (the compressed flag and the big-endian length) and answered with the OK status
+// in the trailers. The decoded requests are sent on the channel.
+func otlpTestCollector(t *testing.T, grpc bool) (string, <-chan otlpTestRequest) {
+	t.Helper()
+	requests := make(chan otlpTestRequest, 1)
+	var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if grpc {
+			if len(body) < 5 || body[0] != 0 || int(binary.BigEndian.Uint32(body[1:])) != len(body)-5 {
+				t.Errorf("gRPC message % x not framed as uncompressed with its length", body[:min(len(body), 5)])
+				return
+			}
+			body = body[5:]
+		}
+		req := otlpTestRequest{path: r.URL.Path, contentType: r.Header.Get("Content-Type"), token: r.Header.Get("Authorization")}
+		req.msg = &collectormetrics.ExportMetricsServiceRequest{}
+		if err := proto.Unmarshal(body, req.msg); err != nil {
+			t.Errorf("decoding the request: %v", err)
+			return
+		}
+		requests <- req
+
+		if grpc {
+			w.Header().Set("Content-Type", "application/grpc")
+			res, _ := proto.Marshal(&collectormetrics.ExportMetricsServiceResponse{})
+			w.Write(append(binary.BigEndian.AppendUint32([]byte{0}, uint32(len(res))), res...))
+			w.Header().Set(http.TrailerPrefix+"Grpc-Status", "0")
+		} else {
+			w.Header().Set("Content-Type", "application/x-protobuf")
+		}
+	})
+	if grpc {
+		handler = h2c.NewHandler(handler, &http2.Server{})
+	}
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	return srv.URL, requests
+}
+
+// TestOTLPExport checks the requests a collector decodes over both protocols: the
+// resource attributes and scope, gauges and cumulative monotonic sums with their units,
+// and one data point per target with its labels as attributes and the timestamps.
+func TestOTLPExport(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	load := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "ups_load_percent", Help: "Output load in percent."}, []string{"target"})
+	transfers := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "ups_transfers_total", Help: "Transfers to battery."}, []string{"target"})
+	other := prometheus.NewGauge(prometheus.GaugeOpts{Name: "go_goroutines", Help: "Not a UPS metric."})
+	reg.MustRegister(load, transfers, other)
+	load.WithLabelValues("rack-a").Set(23.5)
+	load.WithLabelValues("rack-b").Set(41)
+	transfers.WithLabelValues("rack-a").Add(3)
+
+	for _, tc := range []struct {
+		protocol, path, contentType string
+	}{
+		{"grpc", "/opentelemetry.proto.collector.metrics.v1.MetricsService/Export", "application/grpc"},
+		{"http/protobuf", "/v1/metrics", "application/x-protobuf"},
+	} {
+		t.Run(tc.protocol, func(t *testing.T) {
+			endpoint, requests := otlpTestCollector(t, tc.protocol == "grpc")
+			e, err := newOTLPExporter(OTLPConfig{
+				Endpoint: endpoint, Protocol: tc.protocol, Insecure: true, Timeout: 5 * time.Second,
+				Headers:            map[string]string{"Authorization": "Bearer secret"},
+				ResourceAttributes: map[string]string{"deployment.environment": "lab"},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			before := time.Now()
+			if err := e.export(t.Context(), reg); err != nil {
+				t.Fatal(err)
+			}
+			after := time.Now()
+
+			req := <-requests
+			if req.path != tc.path || req.contentType != tc.contentType || req.token != "Bearer secret" {
+				t.Errorf("request to %s as %s with authorization %q", req.path, req.contentType, req.token)
+			}
+			if len(req.msg.ResourceMetrics) != 1 || len(req.msg.ResourceMetrics[0].ScopeMetrics) != 1 {
+				t.Fatalf("request %v, want one resource and scope", req.msg)
+			}
+			rm := req.msg.ResourceMetrics[0]
+			attributes := make(map[string]string)
+			for _, kv := range rm.Resource.Attributes {
+				attributes[kv.Key] = kv.Value.GetStringValue()
+			}
+			if len(attributes) != 2 || attributes["service.name"] != "apc-exporter" || attributes["deployment.environment"] != "lab" {
+				t.Errorf("resource attributes %v", attributes)
+			}
+			sm := rm.ScopeMetrics[0]
+			if sm.Scope.GetName() != "apc-exporter" {
+				t.Errorf("scope %q", sm.Scope.GetName())
+			}
+
+			metrics := make(map[string]*metricspb.Metric)
+			for _, m := range sm.Metrics {
+				metrics[m.Name] = m
+			}
+			if len(metrics) != 2 {
+				t.Errorf("%d metrics, want the 2 UPS metrics", len(metrics))
+			}
+			loadMetric, transfersMetric := metrics["ups_load_percent"], metrics["ups_transfers_total"]
+			if loadMetric.GetUnit() != "%" || loadMetric.GetDescription() != "Output load in percent." || loadMetric.GetGauge() == nil {
+				t.Errorf("load metric %v, want a gauge in %%", loadMetric)
+			}
+			sum := transfersMetric.GetSum()
+			if sum == nil || sum.AggregationTemporality != metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE || !sum.IsMonotonic || transfersMetric.GetUnit() != "" {
+				t.Fatalf("transfers metric %v, want a cumulative monotonic sum without unit", transfersMetric)
+			}
+
+			values := make(map[string]float64)
+			for name, points := range map[string][]*metricspb.NumberDataPoint{
+				"ups_load_percent":    loadMetric.GetGauge().GetDataPoints(),
+				"ups_transfers_total": sum.DataPoints,
+			} {
+				for _, point := range points {
+					if len(point.Attributes) != 1 || point.Attributes[0].Key != "target" {
+						t.Errorf("%s attributes %v, want the target", name, point.Attributes)
+						continue
+					}
+					if point.StartTimeUnixNano != uint64(e.startTime.UnixNano()) ||
+						point.TimeUnixNano < uint64(before.UnixNano()) || point.TimeUnixNano > uint64(after.UnixNano()) {
+						t.Errorf("%s from %d at %d, want from the exporter start at the export", name, point.StartTimeUnixNano, point.TimeUnixNano)
+					}
+					values[name+"{"+point.Attributes[0].Value.GetStringValue()+"}"] = point.GetAsDouble()
+				}
+			}
+			want := map[string]float64{"ups_load_percent{rack-a}": 23.5, "ups_load_percent{rack-b}": 41, "ups_transfers_total{rack-a}": 3}
+			if !maps.Equal(values, want) {
+				t.Errorf("data points %v, want %v", values, want)
+			}
+		})
+	}
+}
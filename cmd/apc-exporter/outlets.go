@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// outletActions maps the API actions to the values of the action field of the card's
+// outlet control form, immediate and delayed.
+var outletActions = map[string][2]string{
+	"on":     {"turnOnImmediate", "turnOnWithDelay"},
+	"off":    {"turnOffImmediate", "turnOffWithDelay"},
+	"reboot": {"rebootImmediate", "rebootWithDelay"},
+}
+
+// outletRequest is the body of POST /api/v1/outlets/{target}/{group}.
+type outletRequest struct {
+	Action  string `json:"action"`
+	Delayed bool   `json:"delayed"`
+}
+
+func parseOutletRequest(r *http.Request, rec *controlRecord) error {
+	var req outletRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return err
+	}
+	if _, ok := outletActions[req.Action]; !ok {
+		return fmt.Errorf("action must be on, off or reboot")
+	}
+	rec.Action, rec.Delayed, rec.destructive = req.Action, req.Delayed, req.Action != "on"
+	rec.description = outletDescription(rec)
+	return nil
+}
+
+func outletDescription(rec *controlRecord) string {
+	description := fmt.Sprintf("Outlet group %s %s", rec.Group, rec.Action)
+	if rec.Delayed {
+		description += " with delay"
+	}
+	return description
+}
+
+// controlOutletGroup submits the outlet control form of the card for one outlet group.
+func (ctl *controller) controlOutletGroup(c *upsCollector, rec *controlRecord) error {
+	action := outletActions[rec.Action][0]
+	if rec.Delayed {
+		action = outletActions[rec.Action][1]
+	}
+	return ctl.submit(c, rec, ctl.cfg.OutletPath, url.Values{"outletgroup": {rec.Group}, "action": {action}})
+}
+
+// outletDelays are the power-on and power-off delays of an outlet group in seconds.
+// When writing, a missing delay is left as it is.
+type outletDelays struct {
+	PowerOn  *int `json:"power_on_delay_seconds,omitempty"`
+	PowerOff *int `json:"power_off_delay_seconds,omitempty"`
+}
+
+// The names of the delay inputs of the outlet group configuration form.
+const (
+	powerOnDelayField  = "poweronDelay"
+	powerOffDelayField = "poweroffDelay"
+)
+
+func parseDelaysReadRequest(r *http.Request, rec *controlRecord) error {
+	rec.Action, rec.readOnly = "delays_read", true
+	return nil
+}
+
+func parseDelaysWriteRequest(r *http.Request, rec *controlRecord) error {
+	var delays outletDelays
+	if err := json.NewDecoder(r.Body).Decode(&delays); err != nil {
+		return err
+	}
+	if delays.PowerOn == nil && delays.PowerOff == nil {
+		return fmt.Errorf("power_on_delay_seconds or power_off_delay_seconds is required")
+	}
+	var changes []string
+	for _, d := range []struct {
+		name  string
+		value *int
+	}{{"power on", delays.PowerOn}, {"power off", delays.PowerOff}} {
+		if d.value == nil {
+			continue
+		}
+		// -1 stands for never, as in the card's web interface.
+		if *d.value < -1 {
+			return fmt.Errorf("%s delay must be -1 (never) or more", d.name)
+		}
+		changes = append(changes, fmt.Sprintf("%s %ds", d.name, *d.value))
+	}
+	rec.Action, rec.Delays = "delays_write", &delays
+	rec.description = fmt.Sprintf("Outlet group %s delays set to %s", rec.Group, strings.Join(changes, ", "))
+	return nil
+}
+
+// outletConfigPath returns the path of the configuration page of an outlet group.
+func (ctl *controller) outletConfigPath(group string) string {
+	return ctl.cfg.OutletConfigPath + "?" + url.Values{"outletgroup": {group}}.Encode()
+}
+
+// readOutletDelays reads the delays of an outlet group from its configuration page.
+func (ctl *controller) readOutletDelays(c *upsCollector, rec *controlRecord) error {
+	delays, err := readOutletDelays(c, ctl.outletConfigPath(rec.Group))
+	rec.Delays = delays
+	return err
+}
+
+// writeOutletDelays submits the configuration form of an outlet group with the
+// requested delays, keeping the current value of a delay that is not given.
+func (ctl *controller) writeOutletDelays(c *upsCollector, rec *controlRecord) error {
+	path := ctl.outletConfigPath(rec.Group)
+	current, err := readOutletDelays(c, path)
+	if err != nil {
+		return err
+	}
+	if rec.Delays.PowerOn == nil {
+		rec.Delays.PowerOn = current.PowerOn
+	}
+	if rec.Delays.PowerOff == nil {
+		rec.Delays.PowerOff = current.PowerOff
+	}
+	return ctl.submit(c, rec, path, url.Values{
+		"outletgroup":      {rec.Group},
+		powerOnDelayField:  {strconv.Itoa(*rec.Delays.PowerOn)},
+		powerOffDelayField: {strconv.Itoa(*rec.Delays.PowerOff)},
+	})
+}
+
+// readOutletDelays reads the delay inputs of an outlet group configuration page.
+func readOutletDelays(c *upsCollector, path string) (*outletDelays, error) {
+	var delays outletDelays
+	err := c.Client().WithPage(context.Background(), path, func(doc *goquery.Document) error {
+		for _, d := range []struct {
+			field string
+			value **int
+		}{{powerOnDelayField, &delays.PowerOn}, {powerOffDelayField, &delays.PowerOff}} {
+			text, ok := doc.Find("input[name=\"" + d.field + "\"]").Attr("value")
+			if !ok {
+				return fmt.Errorf("no %s field on %s", d.field, path)
+			}
+			v, err := strconv.Atoi(strings.TrimSpace(text))
+			if err != nil {
+				return fmt.Errorf("%s: %w", d.field, err)
+			}
+			*d.value = &v
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &delays, nil
+}
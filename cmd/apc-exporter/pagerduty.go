@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// PagerDutyConfig holds the settings for triggering and resolving PagerDuty incidents
+// through the Events API v2.
+type PagerDutyConfig struct {
+	RoutingKey string   `yaml:"routing_key"`
+	URL        string   `yaml:"url"`
+	Severities []string `yaml:"severities"`
+	Conditions []string `yaml:"conditions"`
+	Targets    []string `yaml:"targets"`
+}
+
+// pagerDutyEvent is an Events API v2 event. Resolve events only carry the routing and
+// dedup keys.
+type pagerDutyEvent struct {
+	RoutingKey  string            `json:"routing_key"`
+	EventAction string            `json:"event_action"`
+	DedupKey    string            `json:"dedup_key"`
+	Payload     *pagerDutyPayload `json:"payload,omitempty"`
+}
+
+type pagerDutyPayload struct {
+	Summary       string             `json:"summary"`
+	Source        string             `json:"source"`
+	Severity      string             `json:"severity"`
+	Timestamp     time.Time          `json:"timestamp"`
+	Component     string             `json:"component"`
+	Class         string             `json:"class"`
+	CustomDetails map[string]float64 `json:"custom_details"`
+}
+
+// newPagerDutyNotifier returns a notifier that triggers an incident when a condition
+// is set and resolves it when the condition clears. The dedup key is derived from the
+// target and the condition, so each condition of each UPS is one incident. Only
+// conditions with one of the configured severities are sent, critical by default. It
+// returns nil if no routing key is configured.
+func newPagerDutyNotifier(cfg PagerDutyConfig) transitionNotifier {
+	if cfg.RoutingKey == "" {
+		return nil
+	}
+	if cfg.URL == "" {
+		cfg.URL = "https://events.pagerduty.com/v2/enqueue"
+	}
+	if len(cfg.Severities) == 0 {
+		cfg.Severities = []string{"critical"}
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	return func(ctx context.Context, tr transition) error {
+		if !slices.Contains(cfg.Severities, tr.Severity) {
+			return nil
+		}
+		if len(cfg.Targets) > 0 && !slices.Contains(cfg.Targets, tr.Target) {
+			return nil
+		}
+		if len(cfg.Conditions) > 0 && !slices.Contains(cfg.Conditions, tr.Condition) {
+			return nil
+		}
+
+		e := pagerDutyEvent{RoutingKey: cfg.RoutingKey, EventAction: "resolve", DedupKey: "apc-exporter/" + tr.Target + "/" + tr.Condition}
+		if tr.Active {
+			e.EventAction = "trigger"
+			e.Payload = &pagerDutyPayload{
+				Summary:       fmt.Sprintf("%s: %s (%s)", tr.Target, tr.Condition, tr.To),
+				Source:        tr.Target,
+				Severity:      pagerDutySeverity(tr.Severity),
+				Timestamp:     tr.Time.UTC(),
+				Component:     "ups",
+				Class:         tr.Condition,
+				CustomDetails: tr.Metrics,
+			}
+		}
+		body, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.URL, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "apc-exporter")
+		res, err := client.Do(req)
+		if err != nil {
+			return fmt.Errorf("pagerduty: %w", err)
+		}
+		defer res.Body.Close()
+		io.Copy(io.Discard, res.Body)
+		if res.StatusCode/100 != 2 {
+			return fmt.Errorf("pagerduty: server returned HTTP status %d", res.StatusCode)
+		}
+		return nil
+	}
+}
+
+// pagerDutySeverity maps a transition severity to one PagerDuty accepts.
+func pagerDutySeverity(severity string) string {
+	switch severity {
+	case "critical", "error", "warning", "info":
+		return severity
+	default:
+		return "error"
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Nagios plugin return codes.
+const (
+	checkOK       = 0
+	checkWarning  = 1
+	checkCritical = 2
+	checkUnknown  = 3
+)
+
+var checkStateNames = []string{"OK", "WARNING", "CRITICAL", "UNKNOWN"}
+
+// PassiveCheckConfig holds the settings for submitting passive check results to
+// Icinga2 or an NSCA daemon.
+type PassiveCheckConfig struct {
+	Interval time.Duration     `yaml:"interval"`
+	Icinga2  Icinga2Config     `yaml:"icinga2"`
+	NSCA     NSCAConfig        `yaml:"nsca"`
+	Hosts    map[string]string `yaml:"hosts"`
+	Checks   []CheckConfig     `yaml:"checks"`
+}
+
+// Icinga2Config addresses the Icinga2 REST API.
+type Icinga2Config struct {
+	URL                string `yaml:"url"`
+	Username           string `yaml:"username"`
+	Password           string `yaml:"password"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+// NSCAConfig addresses an NSCA daemon. Only the "none" (0) and XOR (1) encryption
+// methods are supported.
+type NSCAConfig struct {
+	Address    string `yaml:"address"`
+	Password   string `yaml:"password"`
+	Encryption int    `yaml:"encryption"`
+}
+
+// CheckConfig maps a metric to a service check. Values at or above the thresholds
+// trigger the state, or at or below them with Below set.
+type CheckConfig struct {
+	Service  string  `yaml:"service"`
+	Metric   string  `yaml:"metric"`
+	Warning  float64 `yaml:"warning"`
+	Critical float64 `yaml:"critical"`
+	Below    bool    `yaml:"below"`
+}
+
+// defaultChecks are submitted when no checks are configured.
+var defaultChecks = []CheckConfig{
+	{Service: "UPS Status", Metric: "ups_device_status_up", Warning: 0, Critical: 0, Below: true},
+	{Service: "UPS Load", Metric: "ups_load_percent", Warning: 80, Critical: 90},
+	{Service: "UPS Battery Charge", Metric: "ups_battery_charge_percent", Warning: 50, Critical: 25, Below: true},
+	{Service: "UPS Runtime", Metric: "ups_runtime_remaining_minutes", Warning: 15, Critical: 5, Below: true},
+}
+
+// checkResult is one evaluated check for one host.
+type checkResult struct {
+	Host     string
+	Service  string
+	State    int
+	Output   string
+	PerfData string
+}
+
+// runPassiveChecks evaluates the checks for every target on each interval and submits
+// the results until the context is cancelled. It returns immediately if neither
+// Icinga2 nor NSCA is configured.
+func runPassiveChecks(ctx context.Context, cfg PassiveCheckConfig, gatherer prometheus.Gatherer) {
+	if cfg.Icinga2.URL == "" && cfg.NSCA.Address == "" {
+		return
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = time.Minute
+	}
+	gatherer = gatherWithin(gatherer, cfg.Interval)
+	if len(cfg.Checks) == 0 {
+		cfg.Checks = defaultChecks
+	}
+	if cfg.NSCA.Address != "" {
+		if _, _, err := net.SplitHostPort(cfg.NSCA.Address); err != nil {
+			cfg.NSCA.Address = net.JoinHostPort(cfg.NSCA.Address, "5667")
+		}
+		if cfg.NSCA.Encryption != 0 && cfg.NSCA.Encryption != 1 {
+			slog.Warn("Passive checks disabled: unsupported NSCA encryption method", "encryption", cfg.NSCA.Encryption)
+			return
+		}
+	}
+
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: cfg.Icinga2.InsecureSkipVerify},
+		},
+	}
+
+	slog.Info("Submitting passive checks", "checks", len(cfg.Checks), "interval", cfg.Interval)
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			results, err := evaluateChecks(cfg, gatherer)
+			if err != nil {
+				slog.Error("Error gathering metrics for passive checks", "err", err)
+				continue
+			}
+			if cfg.Icinga2.URL != "" {
+				for _, r := range results {
+					if err := submitIcinga2(ctx, client, cfg.Icinga2, r); err != nil {
+						slog.Warn("Error submitting a passive check to Icinga2", "host", r.Host, "service", r.Service, "err", err)
+					}
+				}
+			}
+			if cfg.NSCA.Address != "" {
+				if err := submitNSCA(cfg.NSCA, results); err != nil {
+					slog.Warn("Error submitting passive checks to NSCA", "err", err)
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// evaluateChecks gathers the UPS metrics once and evaluates every check per target.
+// A metric missing for a target yields UNKNOWN.
+func evaluateChecks(cfg PassiveCheckConfig, gatherer prometheus.Gatherer) ([]checkResult, error) {
+	samples, err := gatherSamples(gatherer, "ups_")
+	if err != nil {
+		return nil, err
+	}
+	targets, states := samplesByTarget(samples)
+
+	var results []checkResult
+	for _, target := range targets {
+		host := target
+		if mapped, ok := cfg.Hosts[target]; ok {
+			host = mapped
+		}
+		for _, check := range cfg.Checks {
+			results = append(results, evaluateCheck(check, host, states[target]))
+		}
+	}
+	return results, nil
+}
+
+func evaluateCheck(check CheckConfig, host string, state map[string]float64) checkResult {
+	r := checkResult{Host: host, Service: check.Service}
+	value, ok := state[check.Metric]
+	if !ok {
+		r.State = checkUnknown
+		r.Output = fmt.Sprintf("UNKNOWN - %s not available", check.Metric)
+		return r
+	}
+
+	breaches := func(threshold float64) bool {
+		if check.Below {
+			return value <= threshold
+		}
+		return value >= threshold
+	}
+	switch {
+	case breaches(check.Critical):
+		r.State = checkCritical
+	case breaches(check.Warning):
+		r.State = checkWarning
+	default:
+		r.State = checkOK
+	}
+
+	formatted := strconv.FormatFloat(value, 'f', -1, 64)
+	r.Output = fmt.Sprintf("%s - %s is %s", checkStateNames[r.State], check.Metric, formatted)
+	r.PerfData = fmt.Sprintf("%s=%s;%s;%s", strings.TrimPrefix(check.Metric, "ups_"), formatted,
+		strconv.FormatFloat(check.Warning, 'f', -1, 64), strconv.FormatFloat(check.Critical, 'f', -1, 64))
+	return r
+}
+
+// submitIcinga2 posts a result to the process-check-result action of the API.
+func submitIcinga2(ctx context.Context, client *http.Client, cfg Icinga2Config, r checkResult) error {
+	result := map[string]any{
+		"type":          "Service",
+		"exit_status":   r.State,
+		"plugin_output": r.Output,
+		"check_source":  hostname(),
+	}
+	if r.PerfData != "" {
+		result["performance_data"] = []string{r.PerfData}
+	}
+	body, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+
+	// Icinga2 does not decode "+" as a space in object names.
+	service := strings.ReplaceAll(url.QueryEscape(r.Host+"!"+r.Service), "+", "%20")
+	endpoint := strings.TrimSuffix(cfg.URL, "/") + "/v1/actions/process-check-result?service=" + service
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth(cfg.Username, cfg.Password)
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("server returned HTTP status %d: %s", res.StatusCode, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// NSCA packet layout (version 3) with the classic 512 byte plugin output, which
+// NSCA 2.7 and 2.9 daemons both accept.
+const (
+	nscaIVSize         = 128
+	nscaHostSize       = 64
+	nscaServiceSize    = 128
+	nscaOutputSize     = 512
+	nscaPacketSize     = 2 + 2 + 4 + 4 + 2 + nscaHostSize + nscaServiceSize + nscaOutputSize + 2
+	nscaPacketVersion3 = 3
+)
+
+// submitNSCA sends the results over one connection: the daemon opens with an IV and
+// timestamp, then accepts one fixed size packet per result.
+func submitNSCA(cfg NSCAConfig, results []checkResult) error {
+	conn, err := net.DialTimeout("tcp", cfg.Address, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	init := make([]byte, nscaIVSize+4)
+	if _, err := io.ReadFull(conn, init); err != nil {
+		return fmt.Errorf("reading initialization packet: %w", err)
+	}
+	iv, timestamp := init[:nscaIVSize], binary.BigEndian.Uint32(init[nscaIVSize:])
+
+	for _, r := range results {
+		packet := make([]byte, nscaPacketSize)
+		binary.BigEndian.PutUint16(packet[0:], nscaPacketVersion3)
+		binary.BigEndian.PutUint32(packet[8:], timestamp)
+		binary.BigEndian.PutUint16(packet[12:], uint16(r.State))
+		offset := 14
+		output := r.Output
+		if r.PerfData != "" {
+			output += "|" + r.PerfData
+		}
+		for _, field := range []struct {
+			value string
+			size  int
+		}{{r.Host, nscaHostSize}, {r.Service, nscaServiceSize}, {output, nscaOutputSize}} {
+			copy(packet[offset:offset+field.size-1], field.value)
+			offset += field.size
+		}
+		binary.BigEndian.PutUint32(packet[4:], crc32.ChecksumIEEE(packet))
+
+		if cfg.Encryption == 1 {
+			for i := range packet {
+				packet[i] ^= iv[i%len(iv)]
+				if cfg.Password != "" {
+					packet[i] ^= cfg.Password[i%len(cfg.Password)]
+				}
+			}
+		}
+		if _, err := conn.Write(packet); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+)
+
+// powerNetObject maps an exported metric onto a PowerNet-MIB (APC enterprise 318)
+// scalar. The metric value equals the raw SNMP value multiplied by scale.
+type powerNetObject struct {
+	metric string
+	oid    snmpOID
+	typ    byte
+	scale  float64
+}
+
+// PowerNet-MIB status values of upsBasicOutputStatus.
+const (
+	powerNetStatusUnknown                  = 1
+	powerNetStatusOnLine                   = 2
+	powerNetStatusOnSmartBoost             = 4
+	powerNetStatusTimedSleeping            = 5
+	powerNetStatusOff                      = 7
+	powerNetStatusRebooting                = 8
+	powerNetStatusSleepingUntilPowerReturn = 11
+	powerNetStatusOnSmartTrim              = 12
+)
+
+// powerNetBasicOutputStatus is upsBasicOutputStatus.0.
+var powerNetBasicOutputStatus = mustParseOID("1.3.6.1.4.1.318.1.1.1.4.1.1.0")
+
+// powerNetHighPrecObjects are the upsHighPrec* scalars, reported in tenths.
+var powerNetHighPrecObjects = []powerNetObject{
+	{"ups_battery_charge_percent", mustParseOID("1.3.6.1.4.1.318.1.1.1.2.3.1.0"), snmpGauge32, 0.1},
+	{"ups_internal_temperature_celsius", mustParseOID("1.3.6.1.4.1.318.1.1.1.2.3.2.0"), snmpGauge32, 0.1},
+	{"ups_battery_voltage_vdc", mustParseOID("1.3.6.1.4.1.318.1.1.1.2.3.4.0"), snmpInteger, 0.1},
+	{"ups_input_voltage_vac", mustParseOID("1.3.6.1.4.1.318.1.1.1.3.3.1.0"), snmpGauge32, 0.1},
+	{"ups_input_frequency_hz", mustParseOID("1.3.6.1.4.1.318.1.1.1.3.3.4.0"), snmpGauge32, 0.1},
+	{"ups_output_voltage_vac", mustParseOID("1.3.6.1.4.1.318.1.1.1.4.3.1.0"), snmpGauge32, 0.1},
+	{"ups_output_frequency_hz", mustParseOID("1.3.6.1.4.1.318.1.1.1.4.3.2.0"), snmpGauge32, 0.1},
+	{"ups_load_percent", mustParseOID("1.3.6.1.4.1.318.1.1.1.4.3.3.0"), snmpGauge32, 0.1},
+	{"ups_load_current_amps", mustParseOID("1.3.6.1.4.1.318.1.1.1.4.3.4.0"), snmpGauge32, 0.1},
+}
+
+// powerNetAdvObjects are the older integer upsAdv* scalars. Runtime is TimeTicks
+// (hundredths of a second) converted to minutes.
+var powerNetAdvObjects = []powerNetObject{
+	{"ups_battery_charge_percent", mustParseOID("1.3.6.1.4.1.318.1.1.1.2.2.1.0"), snmpGauge32, 1},
+	{"ups_internal_temperature_celsius", mustParseOID("1.3.6.1.4.1.318.1.1.1.2.2.2.0"), snmpGauge32, 1},
+	{"ups_runtime_remaining_minutes", mustParseOID("1.3.6.1.4.1.318.1.1.1.2.2.3.0"), snmpTimeTicks, 1.0 / 6000},
+	{"ups_battery_voltage_vdc", mustParseOID("1.3.6.1.4.1.318.1.1.1.2.2.8.0"), snmpInteger, 1},
+	{"ups_input_voltage_vac", mustParseOID("1.3.6.1.4.1.318.1.1.1.3.2.1.0"), snmpGauge32, 1},
+	{"ups_input_frequency_hz", mustParseOID("1.3.6.1.4.1.318.1.1.1.3.2.4.0"), snmpGauge32, 1},
+	{"ups_output_voltage_vac", mustParseOID("1.3.6.1.4.1.318.1.1.1.4.2.1.0"), snmpGauge32, 1},
+	{"ups_output_frequency_hz", mustParseOID("1.3.6.1.4.1.318.1.1.1.4.2.2.0"), snmpGauge32, 1},
+	{"ups_load_percent", mustParseOID("1.3.6.1.4.1.318.1.1.1.4.2.3.0"), snmpGauge32, 1},
+	{"ups_load_current_amps", mustParseOID("1.3.6.1.4.1.318.1.1.1.4.2.4.0"), snmpGauge32, 1},
+}
+
+// readPowerNetState reads the values of a card over SNMP under the metric names of
+// the web scraper, preferring the high-precision scalars, and returns the OID each
+// value was read from along with the resolution of that OID. The device status is up
+// while the UPS is online, also boosting or trimming the voltage, as on the status
+// page, and the outlets are off while the output is off, asleep or rebooting.
+func readPowerNetState(client *snmpClient) (map[string]float64, map[string]powerNetObject, error) {
+	oids := []snmpOID{powerNetBasicOutputStatus}
+	objects := slices.Concat(powerNetHighPrecObjects, powerNetAdvObjects)
+	for _, obj := range objects {
+		oids = append(oids, obj.oid)
+	}
+	vbs, err := client.Get(oids...)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(vbs) != len(oids) {
+		return nil, nil, fmt.Errorf("got %d values for %d OIDs", len(vbs), len(oids))
+	}
+
+	state := make(map[string]float64)
+	sources := make(map[string]powerNetObject)
+	if status, ok := vbs[0].Float(); ok {
+		state["ups_device_status_up"] = 0
+		switch status {
+		case powerNetStatusOnLine, powerNetStatusOnSmartBoost, powerNetStatusOnSmartTrim:
+			state["ups_device_status_up"] = 1
+		}
+		state["ups_outlet_status"] = 1
+		switch status {
+		case powerNetStatusOff, powerNetStatusTimedSleeping, powerNetStatusRebooting, powerNetStatusSleepingUntilPowerReturn:
+			state["ups_outlet_status"] = 0
+		}
+		sources["ups_device_status_up"] = powerNetObject{metric: "ups_device_status_up", oid: powerNetBasicOutputStatus, typ: snmpInteger, scale: 1}
+		sources["ups_outlet_status"] = sources["ups_device_status_up"]
+	}
+	for i, obj := range objects {
+		if _, done := state[obj.metric]; done {
+			continue
+		}
+		if raw, ok := vbs[i+1].Float(); ok {
+			state[obj.metric] = raw * obj.scale
+			sources[obj.metric] = obj
+		}
+	}
+	if len(state) == 0 {
+		return nil, nil, fmt.Errorf("the agent at %s has none of the PowerNet-MIB objects", client.addr)
+	}
+	return state, sources, nil
+}
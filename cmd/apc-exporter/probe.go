@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const (
+	// probeIdleTimeout is how long the session with a probed card is kept after its last
+	// probe.
+	probeIdleTimeout = time.Hour
+	// maxProbedCards is how many probed cards are kept at most. Beyond it, the card
+	// probed least recently is dropped, so probes of ever new targets cannot grow the
+	// exporter without bound.
+	maxProbedCards = 1000
+)
+
+// AuthModule is a set of credentials for /probe, and the settings of the cards probed
+// with it as for a target. The name and ups_url come from the probe.
+type AuthModule struct {
+	TargetConfig `yaml:",inline"`
+	// Hosts are patterns of the hosts that may be probed with the module, such as
+	// "*.ups.example.com". They are required, so the credentials are not sent to any
+	// host asked for; "*" allows every host.
+	Hosts []string `yaml:"hosts"`
+}
+
+// allows reports whether a host may be probed with the module. A module without hosts
+// allows none.
+func (m AuthModule) allows(host string) bool {
+	return slices.ContainsFunc(m.Hosts, func(pattern string) bool {
+		ok, _ := path.Match(pattern, host)
+		return ok
+	})
+}
+
+var probeDuration = prometheus.NewDesc("apc_exporter_probe_duration_seconds", "How long the probe of the card took.", nil, nil)
+
+// prober serves /probe?target=<url>&auth_module=<name>: it scrapes the card at target,
+// logged in with the credentials of the auth module, and serves the metrics of just
+// that card, as the blackbox and SNMP exporters do. The collector of each card is
+// kept between probes, so its session is reused instead of logging in every time.
+type prober struct {
+	modules map[string]AuthModule
+	cfg     Config
+
+	mu         sync.Mutex
+	collectors map[string]*probedCard // by auth module and target URL
+}
+
+// probedCard is the collector of a probed card and the time of its last probe.
+type probedCard struct {
+	collector *upsCollector
+	client    *http.Client
+	used      time.Time
+}
+
+// newProber returns the prober of the auth modules. Errors in their settings are
+// returned, as those of targets are, rather than failing the first probe.
+func newProber(cfg Config) (*prober, error) {
+	for _, name := range slices.Sorted(maps.Keys(cfg.AuthModules)) {
+		module := cfg.AuthModules[name]
+		if len(module.Hosts) == 0 {
+			return nil, fmt.Errorf(`auth_modules.%s: hosts is required, list the hosts the credentials may be sent to, or "*" for any`, name)
+		}
+		// A stand-in for the probed card, which an snmp backend takes its address from.
+		t := module.TargetConfig
+		t.Name, t.URL = "auth_modules."+name, "https://localhost"
+		if _, err := newUPSCollector(cfg, nil, t); err != nil {
+			return nil, fmt.Errorf("auth_modules.%s: %w", name, err)
+		}
+	}
+	return &prober{modules: cfg.AuthModules, cfg: cfg, collectors: make(map[string]*probedCard)}, nil
+}
+
+func (p *prober) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	moduleName := query.Get("auth_module")
+	if moduleName == "" {
+		moduleName = "default"
+	}
+	module, ok := p.modules[moduleName]
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown auth_module %q", moduleName), http.StatusBadRequest)
+		return
+	}
+	target, host, err := probeTarget(query.Get("target"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !module.allows(host) {
+		http.Error(w, fmt.Sprintf("auth_module %q may not probe %s", moduleName, host), http.StatusForbidden)
+		return
+	}
+
+	c, err := p.collector(moduleName, module, target, host)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	start := time.Now()
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(c)
+	mfs, err := newDerivedGatherer(registry, p.cfg.DerivedMetrics).Gather()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	duration := prometheus.NewRegistry()
+	duration.MustRegister(probeDurationCollector(time.Since(start)))
+	probed := prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) { return mfs, nil })
+	promhttp.HandlerFor(prometheus.Gatherers{probed, duration}, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
+
+// probeTarget returns the URL of a card to probe and its host. A target without a
+// scheme is taken as https.
+func probeTarget(target string) (string, string, error) {
+	if target == "" {
+		return "", "", fmt.Errorf("target parameter is missing")
+	}
+	if !strings.Contains(target, "://") {
+		target = "https://" + target
+	}
+	u, err := url.Parse(target)
+	if err != nil || u.Hostname() == "" || u.Scheme != "http" && u.Scheme != "https" {
+		return "", "", fmt.Errorf("target %q is not a card URL", target)
+	}
+	return strings.TrimSuffix(target, "/"), u.Hostname(), nil
+}
+
+// collector returns the collector of a card, made on its first probe. Cards not
+// probed for probeIdleTimeout are dropped along with their sessions, as is the card
+// probed least recently when maxProbedCards are kept.
+func (p *prober) collector(moduleName string, module AuthModule, target, host string) (*upsCollector, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	for key, card := range p.collectors {
+		if now.Sub(card.used) > probeIdleTimeout {
+			card.client.CloseIdleConnections()
+			delete(p.collectors, key)
+		}
+	}
+
+	key := moduleName + " " + target
+	card, ok := p.collectors[key]
+	if !ok {
+		if len(p.collectors) >= maxProbedCards {
+			p.dropLeastRecent()
+		}
+		t := module.TargetConfig
+		t.Name, t.URL = host, target
+		t.StatusStrings = slices.Concat(t.StatusStrings, p.cfg.StatusStrings)
+		client, err := newTargetHTTPClient(t)
+		if err != nil {
+			return nil, err
+		}
+		c, err := newUPSCollector(p.cfg, client, t)
+		if err != nil {
+			return nil, err
+		}
+		card = &probedCard{collector: c, client: client}
+		p.collectors[key] = card
+	}
+	card.used = now
+	return card.collector, nil
+}
+
+// dropLeastRecent drops the card probed least recently. p.mu must be held.
+func (p *prober) dropLeastRecent() {
+	var oldest string
+	for key, card := range p.collectors {
+		if oldest == "" || card.used.Before(p.collectors[oldest].used) {
+			oldest = key
+		}
+	}
+	if card, ok := p.collectors[oldest]; ok {
+		card.client.CloseIdleConnections()
+		delete(p.collectors, oldest)
+	}
+}
+
+// probeDurationCollector exports the duration of a probe.
+type probeDurationCollector time.Duration
+
+func (d probeDurationCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- probeDuration
+}
+
+func (d probeDurationCollector) Collect(ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(probeDuration, prometheus.GaugeValue, time.Duration(d).Seconds())
+}
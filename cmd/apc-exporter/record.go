@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/veter2005/apc-exporter/pkg/nmc"
+)
+
+// recordDir and replayDir are set by -record-dir and -replay-dir: the card traffic of
+// every target is saved to, or served from, a directory of the target's name below.
+var recordDir, replayDir string
+
+var unsafeFileCharsRE = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// recordingFileName makes a target name or path safe to use in a file name.
+func recordingFileName(s string) string {
+	return strings.Trim(unsafeFileCharsRE.ReplaceAllString(s, "_"), "_")
+}
+
+// useRecordings wraps the transport of a card's HTTP client to record or replay its
+// traffic, if -record-dir or -replay-dir is set.
+func useRecordings(client *http.Client, target TargetConfig) {
+	dir := func(base string) string {
+		return filepath.Join(base, recordingFileName(target.Name))
+	}
+	switch {
+	case replayDir != "":
+		client.Transport = &replayTransport{dir: dir(replayDir)}
+	case recordDir != "":
+		next := client.Transport
+		if next == nil {
+			next = http.DefaultTransport
+		}
+		client.Transport = &recordTransport{next: next, dir: dir(recordDir), target: target}
+	}
+}
+
+// recordTransport saves every exchange with a card as a file holding the request line
+// and the response. Request bodies, which carry the credentials, are not saved, and the
+// pages are redacted like those saved by dump-pages.
+type recordTransport struct {
+	next   http.RoundTripper
+	dir    string
+	target TargetConfig
+
+	mu      sync.Mutex
+	started bool // whether the directory was created and read
+	seq     int  // number of the last file written
+}
+
+func (t *recordTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.next.RoundTrip(req)
+	if err != nil {
+		return res, err
+	}
+	body, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	res.Body = io.NopCloser(bytes.NewReader(body))
+	if err != nil {
+		return res, err
+	}
+	if err := t.save(req, res, body); err != nil {
+		logStage(nmc.PriorityWarning, t.target.Name, "record", "Recording %s %s of %s failed: %v", req.Method, req.URL.RequestURI(), t.target.Name, err)
+	}
+	return res, nil
+}
+
+func (t *recordTransport) save(req *http.Request, res *http.Response, body []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.started {
+		// Recordings of an earlier run are kept, and the new ones follow them.
+		if err := os.MkdirAll(t.dir, 0o755); err != nil {
+			return err
+		}
+		existing, err := filepath.Glob(filepath.Join(t.dir, "*.http"))
+		if err != nil {
+			return err
+		}
+		t.seq, t.started = len(existing), true
+	}
+	t.seq++
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %s HTTP/1.1\r\nHost: %s\r\n\r\n", req.Method, req.URL.RequestURI(), req.URL.Host)
+	saved := *res
+	redacted := redactPage(body, t.target)
+	saved.Body = io.NopCloser(bytes.NewReader(redacted))
+	saved.ContentLength = int64(len(redacted))
+	saved.TransferEncoding = nil
+	saved.Header = res.Header.Clone()
+	saved.Header.Del("Content-Length")
+	if err := saved.Write(&buf); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%06d-%s-%s.http", t.seq, req.Method, recordingFileName(req.URL.Path))
+	return os.WriteFile(filepath.Join(t.dir, name), buf.Bytes(), 0o644)
+}
+
+// replayTransport serves the exchanges recorded by recordTransport without touching the
+// network. The responses to a request are served in the order they were recorded, and
+// the last one again once they are used up, so a replay can run as long as needed.
+type replayTransport struct {
+	dir string
+
+	once      sync.Once
+	loadErr   error
+	mu        sync.Mutex
+	responses map[string][][]byte // by method and request URI
+	served    map[string]int
+}
+
+func (t *replayTransport) load() error {
+	files, err := filepath.Glob(filepath.Join(t.dir, "*.http"))
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("no recordings in %s", t.dir)
+	}
+	sort.Strings(files)
+	t.responses, t.served = make(map[string][][]byte), make(map[string]int)
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		r := bufio.NewReader(bytes.NewReader(data))
+		req, err := http.ReadRequest(r)
+		if err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+		rest, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		key := req.Method + " " + req.RequestURI
+		t.responses[key] = append(t.responses[key], rest)
+	}
+	return nil
+}
+
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	t.once.Do(func() { t.loadErr = t.load() })
+	if t.loadErr != nil {
+		return nil, t.loadErr
+	}
+
+	key := req.Method + " " + req.URL.RequestURI()
+	t.mu.Lock()
+	recorded := t.responses[key]
+	if len(recorded) == 0 {
+		t.mu.Unlock()
+		return nil, errors.New("no recording of " + key + " in " + t.dir)
+	}
+	i := t.served[key]
+	if i < len(recorded)-1 {
+		t.served[key]++
+	}
+	data := recorded[i]
+	t.mu.Unlock()
+
+	return http.ReadResponse(bufio.NewReader(bytes.NewReader(data)), req)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	configReloadSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "apc_exporter_config_last_reload_successful",
+		Help: "Whether the last reload of the config succeeded (1=Yes, 0=No).",
+	})
+	configReloadTime = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "apc_exporter_config_last_reload_success_timestamp_seconds",
+		Help: "When the config was last loaded successfully, as a Unix timestamp.",
+	})
+)
+
+// targetSet is the collectors of the targets this instance polls, with their HTTP
+// clients, as built from one version of the config.
+type targetSet struct {
+	collectors    []*upsCollector
+	httpClients   []*http.Client
+	pollIntervals map[*upsCollector]time.Duration
+	stopPolls     context.CancelFunc // set by start
+}
+
+// newTargetSet creates an HTTP client with a cookie jar and a collector for each of the
+// targets of the config owned by the shard, so every card keeps its own session.
+func newTargetSet(cfg Config) (*targetSet, error) {
+	s := &targetSet{pollIntervals: make(map[*upsCollector]time.Duration)}
+	seen := make(map[string]bool)
+	for _, target := range cfg.targetConfigs() {
+		if seen[target.Name] {
+			return nil, fmt.Errorf("duplicate target name %q in config", target.Name)
+		}
+		seen[target.Name] = true
+		if !targetShard.owns(target.Name) {
+			continue
+		}
+
+		httpClient, err := newTargetHTTPClient(target)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", target.Name, err)
+		}
+		s.httpClients = append(s.httpClients, httpClient)
+		collector, err := newUPSCollector(cfg, httpClient, target)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", target.Name, err)
+		}
+		s.collectors = append(s.collectors, collector)
+		if target.PollInterval > 0 {
+			s.pollIntervals[collector] = target.PollInterval
+		}
+	}
+	return s, nil
+}
+
+// names returns the names of the targets.
+func (s *targetSet) names() []string {
+	names := make([]string, len(s.collectors))
+	for i, c := range s.collectors {
+		names[i] = c.Target().Name
+	}
+	return names
+}
+
+// start lets the collectors follow the leader election, if any, and starts polling the
+// targets with a poll interval in the background.
+func (s *targetSet) start(ctx context.Context, election *leaderElection) {
+	if election != nil {
+		for _, c := range s.collectors {
+			c.Leader = election
+		}
+	}
+	ctx, s.stopPolls = context.WithCancel(ctx)
+	for c, interval := range s.pollIntervals {
+		go c.Poll(ctx, interval)
+	}
+}
+
+// stop stops the polls and closes the idle connections to the cards.
+func (s *targetSet) stop() {
+	if s.stopPolls != nil {
+		s.stopPolls()
+	}
+	for _, httpClient := range s.httpClients {
+		httpClient.CloseIdleConnections()
+	}
+}
+
+// Describe sends no descriptors, which makes the set an unchecked collector, as its
+// targets change with the config.
+func (s *targetSet) Describe(ch chan<- *prometheus.Desc) {}
+
+// Collect scrapes the targets in parallel.
+func (s *targetSet) Collect(ch chan<- prometheus.Metric) {
+	var wg sync.WaitGroup
+	for _, c := range s.collectors {
+		wg.Go(func() { c.Collect(ch) })
+	}
+	wg.Wait()
+}
+
+// reloader reloads the config file on SIGHUP and on POST /-/reload, replacing the
+// services of the old config with those of the new one. It holds what the process sets
+// up once: the leader election and the stores, whose settings need a restart.
+type reloader struct {
+	mu          sync.Mutex // one reload at a time
+	path        string
+	storagePath string
+	ctx         context.Context
+	startup     Config // the config the exporter started with
+
+	election         *leaderElection
+	state            *stateStore
+	history          *historyStore
+	textfileDir      string
+	textfileInterval time.Duration
+	landingPage      http.Handler
+	web              *webServer // nil if only the textfile is written
+
+	current atomic.Pointer[services]
+}
+
+// reload loads and checks the config file and, if it is valid, replaces the services
+// with those of the new config. An invalid config is rejected and the running services
+// are kept. The HTTP server is restarted if the web config file changed.
+func (r *reloader) reload() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	err := r.load()
+	if r.web != nil {
+		err = errors.Join(err, r.web.reload())
+	}
+	if err != nil {
+		configReloadSuccess.Set(0)
+		slog.Error("Reloading the config failed, keeping the running one", "err", err)
+		return err
+	}
+	configReloadSuccess.Set(1)
+	configReloadTime.SetToCurrentTime()
+	return nil
+}
+
+// load builds the services of the config file, if it is valid, and only once they are
+// complete stops the running ones and starts them instead.
+func (r *reloader) load() error {
+	cfg, err := loadConfig(r.path)
+	if err != nil {
+		return err
+	}
+	if errs := checkConfig(cfg); len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	if err := useStoragePath(r.storagePath, &cfg); err != nil {
+		return err
+	}
+	s, err := newServices(cfg, r)
+	if err != nil {
+		return err
+	}
+	if changed := restartOnlyChanges(r.startup, cfg); len(changed) > 0 {
+		slog.Warn("Settings changed which only a restart applies", "settings", strings.Join(changed, ", "))
+	}
+	old := r.current.Load()
+	old.stop()
+	s.start(r, old)
+	r.current.Store(s)
+	slog.Info("Reloaded the config", "path", r.path, "targets", len(s.targets.collectors))
+	return nil
+}
+
+// restartOnlyChanges returns the sections that differ between the configs and that a
+// reload cannot apply, as the process holds the leader lock and the stores.
+func restartOnlyChanges(old, cfg Config) []string {
+	var changed []string
+	if !reflect.DeepEqual(old.HA, cfg.HA) {
+		changed = append(changed, "high_availability")
+	}
+	if !reflect.DeepEqual(old.State, cfg.State) {
+		changed = append(changed, "state")
+	}
+	if !reflect.DeepEqual(old.History, cfg.History) {
+		changed = append(changed, "history")
+	}
+	return changed
+}
+
+// handler serves HTTP with the handlers of the current services.
+func (r *reloader) handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r.current.Load().mux.ServeHTTP(w, req)
+	})
+}
+
+// ServeHTTP serves /-/reload, which reloads the config on POST.
+func (r *reloader) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost && req.Method != http.MethodPut {
+		w.Header().Set("Allow", "POST, PUT")
+		http.Error(w, "Only POST or PUT requests allowed.", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.reload(); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to reload the config: %v", err), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintln(w, "Config reloaded.")
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	bolt "go.etcd.io/bbolt"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// RemoteWriteConfig holds the settings for pushing metrics with the Prometheus
+// remote write protocol.
+type RemoteWriteConfig struct {
+	URL          string            `yaml:"url"`
+	Username     string            `yaml:"username"`
+	Password     string            `yaml:"password"`
+	BearerToken  string            `yaml:"bearer_token"`
+	Headers      map[string]string `yaml:"headers"`
+	Interval     time.Duration     `yaml:"interval"`
+	Timeout      time.Duration     `yaml:"timeout"`
+	BufferPath   string            `yaml:"buffer_path"`
+	BufferMaxAge time.Duration     `yaml:"buffer_max_age"`
+}
+
+var remoteWriteBucket = []byte("pending")
+
+// errRemoteWriteRejected marks requests that the receiver will never accept, so they
+// are dropped instead of being retried.
+var errRemoteWriteRejected = errors.New("rejected by the receiver")
+
+// runRemoteWrite pushes the UPS metrics to the remote write endpoint on every
+// interval until the context is cancelled. With a buffer path, polls that cannot be
+// delivered are kept on disk and backfilled oldest first once the endpoint is
+// reachable again. It returns immediately if no URL is configured.
+func runRemoteWrite(ctx context.Context, cfg RemoteWriteConfig, gatherer prometheus.Gatherer) {
+	if cfg.URL == "" {
+		return
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = 30 * time.Second
+	}
+	gatherer = gatherWithin(gatherer, cfg.Interval)
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	if cfg.BufferMaxAge <= 0 {
+		cfg.BufferMaxAge = 24 * time.Hour
+	}
+
+	w := &remoteWriter{cfg: cfg, client: &http.Client{Timeout: cfg.Timeout}}
+	if cfg.BufferPath != "" {
+		db, err := bolt.Open(cfg.BufferPath, 0o644, &bolt.Options{Timeout: dbLockTimeout})
+		if err != nil {
+			slog.Warn("Remote write disabled: opening the buffer failed", "path", cfg.BufferPath, "err", err)
+			return
+		}
+		defer db.Close()
+		if err := db.Update(func(tx *bolt.Tx) error {
+			_, err := tx.CreateBucketIfNotExists(remoteWriteBucket)
+			return err
+		}); err != nil {
+			slog.Warn("Remote write disabled", "err", err)
+			return
+		}
+		w.buffer = db
+	}
+
+	slog.Info("Sending metrics via remote write", "url", cfg.URL, "interval", cfg.Interval)
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			if err := w.poll(ctx, gatherer, now); err != nil {
+				slog.Warn("Error sending via remote write", "err", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// remoteWriter sends one WriteRequest per poll, queueing them in the optional
+// on-disk buffer while the endpoint is unreachable.
+type remoteWriter struct {
+	cfg     RemoteWriteConfig
+	client  *http.Client
+	buffer  *bolt.DB
+	backlog bool
+}
+
+func (w *remoteWriter) poll(ctx context.Context, gatherer prometheus.Gatherer, now time.Time) error {
+	samples, err := gatherSamples(gatherer, "ups_")
+	if err != nil {
+		return err
+	}
+	request := encodeWriteRequest(samples, now)
+
+	if w.buffer == nil {
+		return w.send(ctx, request)
+	}
+
+	// Always queue first and drain oldest first, so receivers see every series in
+	// timestamp order even after an outage.
+	if err := w.enqueue(now, request); err != nil {
+		return err
+	}
+	return w.drain(ctx, now)
+}
+
+func (w *remoteWriter) enqueue(now time.Time, request []byte) error {
+	return w.buffer.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(remoteWriteBucket).Put(binary.BigEndian.AppendUint64(nil, uint64(now.UnixNano())), request)
+	})
+}
+
+// drain sends the buffered requests oldest first, dropping those older than the
+// maximum buffer age, and stops at the first one that cannot be delivered.
+func (w *remoteWriter) drain(ctx context.Context, now time.Time) error {
+	cutoff := uint64(now.Add(-w.cfg.BufferMaxAge).UnixNano())
+	sent, expired := 0, 0
+	for {
+		var key, request []byte
+		err := w.buffer.View(func(tx *bolt.Tx) error {
+			k, v := tx.Bucket(remoteWriteBucket).Cursor().First()
+			key, request = bytes.Clone(k), bytes.Clone(v)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if key == nil {
+			break
+		}
+
+		if binary.BigEndian.Uint64(key) >= cutoff {
+			err = w.send(ctx, request)
+			if err != nil && !errors.Is(err, errRemoteWriteRejected) {
+				if !w.backlog {
+					slog.Warn("Remote write endpoint unavailable, buffering samples", "path", w.cfg.BufferPath)
+					w.backlog = true
+				}
+				return fmt.Errorf("%w (%d polls buffered)", err, w.pending())
+			}
+			if err != nil {
+				slog.Warn("Dropping a buffered poll", "err", err)
+			} else {
+				sent++
+			}
+		} else {
+			expired++
+		}
+
+		if err := w.buffer.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket(remoteWriteBucket).Delete(key)
+		}); err != nil {
+			return err
+		}
+	}
+
+	if expired > 0 {
+		slog.Warn("Dropped expired buffered polls", "polls", expired, "max_age", w.cfg.BufferMaxAge)
+	}
+	if w.backlog {
+		slog.Info("Remote write endpoint reachable again, backfilled the buffer", "polls", sent)
+		w.backlog = false
+	}
+	return nil
+}
+
+// pending returns the number of buffered requests.
+func (w *remoteWriter) pending() int {
+	var n int
+	w.buffer.View(func(tx *bolt.Tx) error {
+		n = tx.Bucket(remoteWriteBucket).Stats().KeyN
+		return nil
+	})
+	return n
+}
+
+// send posts one encoded WriteRequest. Network errors, 5xx and 429 responses are
+// retryable; other failures are wrapped in errRemoteWriteRejected.
+func (w *remoteWriter) send(ctx context.Context, request []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.cfg.URL, bytes.NewReader(snappyEncode(request)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	req.Header.Set("User-Agent", "apc-exporter")
+	if w.cfg.Username != "" {
+		req.SetBasicAuth(w.cfg.Username, w.cfg.Password)
+	} else if w.cfg.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+w.cfg.BearerToken)
+	}
+	for k, v := range w.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+
+	res, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+
+	switch {
+	case res.StatusCode/100 == 2:
+		return nil
+	case res.StatusCode/100 == 5 || res.StatusCode == http.StatusTooManyRequests:
+		return fmt.Errorf("server returned HTTP status %d: %s", res.StatusCode, bytes.TrimSpace(msg))
+	default:
+		return fmt.Errorf("%w: HTTP status %d: %s", errRemoteWriteRejected, res.StatusCode, bytes.TrimSpace(msg))
+	}
+}
+
+// encodeWriteRequest builds a prometheus.WriteRequest with one time series per
+// sample, all stamped with the poll time.
+func encodeWriteRequest(samples []sample, now time.Time) []byte {
+	var request []byte
+	for _, s := range samples {
+		labels := map[string]string{"__name__": s.Name}
+		for k, v := range s.Labels {
+			labels[k] = v
+		}
+		names := make([]string, 0, len(labels))
+		for name := range labels {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		var series []byte
+		for _, name := range names {
+			var label []byte
+			label = protowire.AppendTag(label, 1, protowire.BytesType)
+			label = protowire.AppendString(label, name)
+			label = protowire.AppendTag(label, 2, protowire.BytesType)
+			label = protowire.AppendString(label, labels[name])
+			series = protowire.AppendTag(series, 1, protowire.BytesType)
+			series = protowire.AppendBytes(series, label)
+		}
+
+		var point []byte
+		point = protowire.AppendTag(point, 1, protowire.Fixed64Type)
+		point = protowire.AppendFixed64(point, math.Float64bits(s.Value))
+		point = protowire.AppendTag(point, 2, protowire.VarintType)
+		point = protowire.AppendVarint(point, uint64(now.UnixMilli()))
+		series = protowire.AppendTag(series, 2, protowire.BytesType)
+		series = protowire.AppendBytes(series, point)
+
+		request = protowire.AppendTag(request, 1, protowire.BytesType)
+		request = protowire.AppendBytes(request, series)
+	}
+	return request
+}
+
+// snappyEncode produces a valid snappy block made of literals only. Requests are a
+// few kilobytes, so skipping compression costs little and avoids a dependency.
+func snappyEncode(src []byte) []byte {
+	dst := binary.AppendUvarint(nil, uint64(len(src)))
+	for len(src) > 0 {
+		chunk := src[:min(len(src), 1<<16)]
+		src = src[len(chunk):]
+
+		n := len(chunk) - 1
+		switch {
+		case n < 60:
+			dst = append(dst, byte(n)<<2)
+		case n < 1<<8:
+			dst = append(dst, 60<<2, byte(n))
+		default:
+			dst = append(dst, 61<<2, byte(n), byte(n>>8))
+		}
+		dst = append(dst, chunk...)
+	}
+	return dst
+}
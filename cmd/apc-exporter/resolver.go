@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// targetResolver attributes packets from the cards (traps, syslog) to targets by
+// source address, resolving the hosts of the target URLs.
+type targetResolver struct {
+	targets []TargetConfig
+
+	mu       sync.Mutex
+	byIP     map[string]string
+	resolved time.Time
+}
+
+func newTargetResolver(targets []TargetConfig) *targetResolver {
+	return &targetResolver{targets: targets}
+}
+
+// lookup returns the name of the target with the given address, or the address
+// itself if no target matches. Unknown addresses trigger a fresh resolution at most
+// once a minute, so DHCP or DNS changes are picked up.
+func (r *targetResolver) lookup(ip net.IP) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if name, ok := r.byIP[ip.String()]; ok {
+		return name
+	}
+	if time.Since(r.resolved) > time.Minute {
+		r.resolve()
+		if name, ok := r.byIP[ip.String()]; ok {
+			return name
+		}
+	}
+	return ip.String()
+}
+
+func (r *targetResolver) resolve() {
+	r.byIP = make(map[string]string)
+	r.resolved = time.Now()
+	for _, target := range r.targets {
+		u, err := url.Parse(target.URL)
+		if err != nil || u.Hostname() == "" {
+			continue
+		}
+		if ip := net.ParseIP(u.Hostname()); ip != nil {
+			r.byIP[ip.String()] = target.Name
+			continue
+		}
+		addrs, err := net.LookupIP(u.Hostname())
+		if err != nil {
+			continue
+		}
+		for _, ip := range addrs {
+			r.byIP[ip.String()] = target.Name
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// rotatingFile is an append-only file that is rotated to path.1, path.2, ... once it
+// grows beyond maxSize bytes, keeping at most maxBackups old files. If maxAge is set, it
+// is also rotated once it has been written to for that long.
+type rotatingFile struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	maxAge     time.Duration
+	header     []byte // written first to every new file, such as a CSV header
+	file       *os.File
+	size       int64
+	opened     time.Time
+}
+
+// openRotatingFile opens (or creates) the file at path for appending. A maxSize of
+// zero disables rotation.
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	rf := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.file = f
+	rf.size = info.Size()
+	rf.opened = time.Now()
+	return nil
+}
+
+// Write appends p to the file, rotating first if p would push it past maxSize or the
+// file is older than maxAge. The header goes first if the file is empty.
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	tooBig := rf.maxSize > 0 && rf.size+int64(len(p)) > rf.maxSize
+	tooOld := rf.maxAge > 0 && time.Since(rf.opened) > rf.maxAge
+	if rf.size > 0 && (tooBig || tooOld) {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	if rf.size == 0 && len(rf.header) > 0 {
+		n, err := rf.file.Write(rf.header)
+		rf.size += int64(n)
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// Size returns the current size of the active file.
+func (rf *rotatingFile) Size() int64 {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return rf.size
+}
+
+// SetHeader sets what is written first to every new file from now on.
+func (rf *rotatingFile) SetHeader(header []byte) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	rf.header = header
+}
+
+// Rotate forces a rotation regardless of the current size.
+func (rf *rotatingFile) Rotate() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return rf.rotate()
+}
+
+func (rf *rotatingFile) rotate() error {
+	if err := rf.file.Close(); err != nil {
+		return err
+	}
+
+	if rf.maxBackups <= 0 {
+		if err := os.Remove(rf.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	} else {
+		for i := rf.maxBackups - 1; i >= 1; i-- {
+			src := fmt.Sprintf("%s.%d", rf.path, i)
+			if _, err := os.Stat(src); err == nil {
+				if err := os.Rename(src, fmt.Sprintf("%s.%d", rf.path, i+1)); err != nil {
+					return err
+				}
+			}
+		}
+		if err := os.Rename(rf.path, rf.path+".1"); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return rf.open()
+}
+
+// Close closes the active file.
+func (rf *rotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return rf.file.Close()
+}
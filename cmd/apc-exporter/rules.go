@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+	"time"
+)
+
+// RuleConfig defines a condition that is evaluated against the polled values of every
+// target. The rule fires once expr has held for the For duration and clears when the
+// clear expression holds, or, without one, as soon as expr no longer holds. A clear
+// expression with a margin gives hysteresis, for example
+// expr "runtime_remaining_minutes < 10" with clear "runtime_remaining_minutes > 15".
+type RuleConfig struct {
+	Name     string        `yaml:"name"`
+	Expr     string        `yaml:"expr"`
+	For      time.Duration `yaml:"for"`
+	Clear    string        `yaml:"clear"`
+	Severity string        `yaml:"severity"`
+	Targets  []string      `yaml:"targets"`
+}
+
+// ruleForSuffix matches the "<expr> for <duration>" shorthand.
+var ruleForSuffix = regexp.MustCompile(`^(.*\S)\s+for\s+(\S+)$`)
+
+// rule is a compiled RuleConfig.
+type rule struct {
+	RuleConfig
+	expr  expr
+	clear expr
+}
+
+func compileRule(cfg RuleConfig) (*rule, error) {
+	if cfg.Name == "" {
+		return nil, errors.New("name is required")
+	}
+	for _, c := range upsConditions {
+		if c.name == cfg.Name {
+			return nil, fmt.Errorf("name %s is a built-in condition", cfg.Name)
+		}
+	}
+	if cfg.Severity == "" {
+		cfg.Severity = "warning"
+	}
+	if m := ruleForSuffix.FindStringSubmatch(cfg.Expr); m != nil {
+		d, err := time.ParseDuration(m[2])
+		if err != nil {
+			return nil, fmt.Errorf("for: %w", err)
+		}
+		cfg.Expr, cfg.For = m[1], d
+	}
+
+	r := &rule{RuleConfig: cfg}
+	var err error
+	if r.expr, err = parseCondition(cfg.Expr); err != nil {
+		return nil, fmt.Errorf("expr: %w", err)
+	}
+	if cfg.Clear != "" {
+		if r.clear, err = parseCondition(cfg.Clear); err != nil {
+			return nil, fmt.Errorf("clear: %w", err)
+		}
+	}
+	return r, nil
+}
+
+// compileRules compiles the configured rules, logging and skipping invalid ones.
+func compileRules(configs []RuleConfig) []*rule {
+	var rules []*rule
+	for i, cfg := range configs {
+		r, err := compileRule(cfg)
+		if err != nil {
+			slog.Warn("Rule disabled", "index", i+1, "name", cfg.Name, "err", err)
+			continue
+		}
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+// updateRules evaluates the rules for one target, recording their state in previous
+// and returning the transitions. Rules that refer to metrics the target does not
+// have are skipped for it.
+func (t *transitionTracker) updateRules(now time.Time, target string, state map[string]float64, previous map[string]bool, baseline bool) []transition {
+	if t.Pending == nil {
+		t.Pending = make(map[string]time.Time)
+	}
+
+	// Rules can refer to the built-in conditions as 0 or 1, e.g. "on_battery == 1 for 10m".
+	env := make(map[string]float64, len(state)+len(upsConditions))
+	for k, v := range state {
+		env[k] = v
+	}
+	for _, c := range upsConditions {
+		if active, ok := previous[c.name]; ok {
+			env[c.name] = 0
+			if active {
+				env[c.name] = 1
+			}
+		}
+	}
+
+	var transitions []transition
+	for _, r := range t.rules {
+		if len(r.Targets) > 0 && !slices.Contains(r.Targets, target) {
+			continue
+		}
+		key := target + "\x00" + r.Name
+		tr := transition{Time: now, Target: target, Condition: r.Name, Severity: r.Severity, Metrics: state}
+
+		if !previous[r.Name] {
+			firing, err := evalBool(r.expr, env)
+			if err != nil {
+				logRuleError(r, target, err)
+				continue
+			}
+			if !firing {
+				delete(t.Pending, key)
+				continue
+			}
+			if baseline {
+				previous[r.Name] = true
+				continue
+			}
+			since, ok := t.Pending[key]
+			if !ok {
+				since = now
+				t.Pending[key] = now
+			}
+			if now.Sub(since) < r.For {
+				continue
+			}
+			delete(t.Pending, key)
+			previous[r.Name] = true
+			tr.Active, tr.From, tr.To = true, "ok", "firing"
+			transitions = append(transitions, tr)
+			continue
+		}
+
+		var cleared bool
+		var err error
+		if r.clear != nil {
+			cleared, err = evalBool(r.clear, env)
+		} else {
+			cleared, err = evalBool(r.expr, env)
+			cleared = !cleared
+		}
+		if err != nil {
+			logRuleError(r, target, err)
+			continue
+		}
+		if cleared {
+			previous[r.Name] = false
+			tr.From, tr.To = "firing", "ok"
+			transitions = append(transitions, tr)
+		}
+	}
+	return transitions
+}
+
+// logRuleError logs evaluation errors other than missing metrics, which are expected
+// for cards that do not report everything.
+func logRuleError(r *rule, target string, err error) {
+	if !errors.Is(err, errUnknownMetric) {
+		slog.Warn("Error evaluating a rule", "name", r.Name, "target", target, "err", err)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCompileRule(t *testing.T) {
+	for _, tt := range []struct {
+		cfg     RuleConfig
+		expr    string
+		forTime time.Duration
+		err     string
+	}{
+		{cfg: RuleConfig{Name: "low_runtime", Expr: "runtime_remaining_minutes < 10"}, expr: "runtime_remaining_minutes < 10"},
+		{cfg: RuleConfig{Name: "long_outage", Expr: "on_battery == 1 for 10m"}, expr: "on_battery == 1", forTime: 10 * time.Minute},
+		{cfg: RuleConfig{Name: "hot", Expr: "internal_temperature_celsius >= 40   for  1m30s", For: time.Hour}, expr: "internal_temperature_celsius >= 40", forTime: 90 * time.Second},
+		{cfg: RuleConfig{Name: "hot", Expr: "internal_temperature_celsius >= 40", For: 5 * time.Minute}, expr: "internal_temperature_celsius >= 40", forTime: 5 * time.Minute},
+		{cfg: RuleConfig{Name: "hot", Expr: "internal_temperature_celsius >= 40 for ever"}, err: "for: "},
+		{cfg: RuleConfig{Name: "hot", Expr: "internal_temperature_celsius >="}, err: "expr: "},
+		{cfg: RuleConfig{Name: "hot", Expr: "internal_temperature_celsius >= 40", Clear: "internal_temperature_celsius"}, err: "clear: expression yields a number"},
+		{cfg: RuleConfig{Name: "hot", Expr: "internal_temperature_celsius"}, err: "expr: expression yields a number"},
+		{cfg: RuleConfig{Name: "hot", Expr: "internal_temperature_celsius >= 40", Clear: "internal_temperature_celsius <"}, err: "clear: "},
+		{cfg: RuleConfig{Expr: "load_percent > 80"}, err: "name is required"},
+		{cfg: RuleConfig{Name: "on_battery", Expr: "load_percent > 80"}, err: "built-in condition"},
+	} {
+		r, err := compileRule(tt.cfg)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("compileRule(%+v) = %v, want an error containing %q", tt.cfg, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("compileRule(%+v): %v", tt.cfg, err)
+			continue
+		}
+		if r.Expr != tt.expr || r.For != tt.forTime || r.Severity != "warning" {
+			t.Errorf("compileRule(%+v) = expr %q for %s severity %s, want expr %q for %s severity warning",
+				tt.cfg, r.Expr, r.For, r.Severity, tt.expr, tt.forTime)
+		}
+	}
+}
+
+// ruleStep is one poll of a target in a rule test: the metrics at an offset from the
+// start, and the transition expected, if any.
+type ruleStep struct {
+	at      time.Duration
+	metrics map[string]float64
+	want    string // "firing", "ok" or "" for no transition
+}
+
+func runRuleSteps(t *testing.T, cfg RuleConfig, steps []ruleStep) {
+	t.Helper()
+	r, err := compileRule(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker := &transitionTracker{rules: []*rule{r}}
+	previous := make(map[string]bool)
+	start := time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+	for i, step := range steps {
+		transitions := tracker.updateRules(start.Add(step.at), "ups1", step.metrics, previous, false)
+		var got string
+		if len(transitions) > 0 {
+			got = transitions[0].To
+		}
+		if len(transitions) > 1 || got != step.want {
+			t.Errorf("step %d at %s: transitions %+v, want %q", i, step.at, transitions, step.want)
+		}
+	}
+}
+
+func runtimeLeft(minutes float64) map[string]float64 {
+	return map[string]float64{"ups_runtime_remaining_minutes": minutes}
+}
+
+func TestRuleFor(t *testing.T) {
+	runRuleSteps(t, RuleConfig{Name: "low_runtime", Expr: "runtime_remaining_minutes < 10 for 2m"}, []ruleStep{
+		{at: 0, metrics: runtimeLeft(8)},
+		{at: time.Minute, metrics: runtimeLeft(7)},
+		// Recovering resets the for duration.
+		{at: 90 * time.Second, metrics: runtimeLeft(12)},
+		{at: 2 * time.Minute, metrics: runtimeLeft(6)},
+		{at: 3 * time.Minute, metrics: runtimeLeft(6)},
+		{at: 4 * time.Minute, metrics: runtimeLeft(5), want: "firing"},
+		{at: 5 * time.Minute, metrics: runtimeLeft(4)},
+		// Without clear, the rule clears as soon as expr no longer holds.
+		{at: 6 * time.Minute, metrics: runtimeLeft(10), want: "ok"},
+		// A target that lacks the metric keeps its state.
+		{at: 7 * time.Minute, metrics: map[string]float64{}},
+	})
+}
+
+func TestRuleHysteresis(t *testing.T) {
+	runRuleSteps(t, RuleConfig{
+		Name:  "low_runtime",
+		Expr:  "runtime_remaining_minutes < 10",
+		Clear: "runtime_remaining_minutes > 15",
+	}, []ruleStep{
+		{at: 0, metrics: runtimeLeft(20)},
+		{at: time.Minute, metrics: runtimeLeft(9), want: "firing"},
+		// Between the thresholds, the rule keeps firing.
+		{at: 2 * time.Minute, metrics: runtimeLeft(12)},
+		{at: 3 * time.Minute, metrics: runtimeLeft(15)},
+		{at: 4 * time.Minute, metrics: runtimeLeft(9.5)},
+		{at: 5 * time.Minute, metrics: runtimeLeft(16), want: "ok"},
+		// And does not fire again before falling below 10.
+		{at: 6 * time.Minute, metrics: runtimeLeft(12)},
+		{at: 7 * time.Minute, metrics: runtimeLeft(9.9), want: "firing"},
+	})
+}
+
+func TestRuleBuiltInConditions(t *testing.T) {
+	r, err := compileRule(RuleConfig{Name: "overloaded_on_battery", Expr: "on_battery == 1 && load_percent > 80"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker := &transitionTracker{rules: []*rule{r}}
+	previous := map[string]bool{"on_battery": true}
+	transitions := tracker.updateRules(time.Now(), "ups1", map[string]float64{"ups_load_percent": 85}, previous, false)
+	if len(transitions) != 1 || !transitions[0].Active || transitions[0].Severity != "warning" {
+		t.Errorf("transitions %+v, want the rule firing", transitions)
+	}
+	if !previous["overloaded_on_battery"] {
+		t.Error("rule state not recorded as firing")
+	}
+}
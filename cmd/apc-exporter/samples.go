@@ -0,0 +1,91 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/veter2005/apc-exporter/pkg/collector"
+)
+
+// sample is a single flattened metric value taken from a Prometheus gather.
+type sample struct {
+	Name   string
+	Help   string
+	Type   dto.MetricType
+	Labels map[string]string
+	Value  float64
+}
+
+// gatherSamples gathers all metric families and flattens the gauges, counters and
+// untyped metrics whose name starts with prefix into a list of samples.
+func gatherSamples(g prometheus.Gatherer, prefix string) ([]sample, error) {
+	mfs, err := g.Gather()
+	if err != nil && len(mfs) == 0 {
+		return nil, err
+	}
+
+	var samples []sample
+	for _, mf := range mfs {
+		if !strings.HasPrefix(mf.GetName(), prefix) {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			var value float64
+			switch mf.GetType() {
+			case dto.MetricType_GAUGE:
+				value = m.GetGauge().GetValue()
+			case dto.MetricType_COUNTER:
+				value = m.GetCounter().GetValue()
+			case dto.MetricType_UNTYPED:
+				value = m.GetUntyped().GetValue()
+			default:
+				continue
+			}
+
+			labels := make(map[string]string, len(m.GetLabel()))
+			for _, lp := range m.GetLabel() {
+				labels[lp.GetName()] = lp.GetValue()
+			}
+			samples = append(samples, sample{Name: mf.GetName(), Help: mf.GetHelp(), Type: mf.GetType(), Labels: labels, Value: value})
+		}
+	}
+	return samples, err
+}
+
+// sortedLabelNames returns the label names of a sample in a stable order.
+func (s sample) sortedLabelNames() []string {
+	names := make([]string, 0, len(s.Labels))
+	for name := range s.Labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// samplesByTarget groups samples by their target label into name/value maps and
+// returns the target names in sorted order alongside. Samples with labels besides
+// target, such as per-category counters, do not fit a name/value map and are left out.
+// Gauges exported only in base units are added under their legacy names as well.
+func samplesByTarget(samples []sample) ([]string, map[string]map[string]float64) {
+	states := make(map[string]map[string]float64)
+	var targets []string
+	for _, s := range samples {
+		if len(s.Labels) > 1 {
+			continue
+		}
+		target := s.Labels["target"]
+		if states[target] == nil {
+			states[target] = make(map[string]float64)
+			targets = append(targets, target)
+		}
+		states[target][s.Name] = s.Value
+	}
+	for _, state := range states {
+		collector.LegacyValues(state)
+	}
+	sort.Strings(targets)
+	return targets, states
+}
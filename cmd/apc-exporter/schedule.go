@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ControlSchedule runs a control action whenever its cron schedule matches, e.g. a
+// self-test on the first Sunday of every month with "0 3 * * 0#1". Without targets it
+// runs on all of them, one after the other.
+type ControlSchedule struct {
+	Name     string   `yaml:"name"`
+	Schedule string   `yaml:"schedule"`
+	Timezone string   `yaml:"timezone"`
+	Action   string   `yaml:"action"`
+	Targets  []string `yaml:"targets"`
+	Group    string   `yaml:"group"`
+	Delayed  bool     `yaml:"delayed"`
+	DryRun   bool     `yaml:"dry_run"`
+}
+
+var (
+	scheduledActionLastRun = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ups_scheduled_action_last_run_timestamp_seconds",
+		Help: "Time of the last run of a scheduled control action as a Unix timestamp.",
+	}, []string{"schedule", "target"})
+	scheduledActionSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "ups_scheduled_action_success",
+		Help: "Whether the last run of a scheduled control action succeeded (1) or not (0).",
+	}, []string{"schedule", "target"})
+)
+
+type controlSchedule struct {
+	ControlSchedule
+	cron        *cronSchedule
+	location    *time.Location
+	perform     func(*upsCollector, *controlRecord) error
+	description string
+
+	// running is held while the action runs, so that slow runs do not overlap.
+	running sync.Mutex
+}
+
+// compileSchedule checks a schedule against the targets and the enabled actions.
+// Reading and writing outlet delays cannot be scheduled.
+func (ctl *controller) compileSchedule(cfg ControlSchedule) (*controlSchedule, error) {
+	s := &controlSchedule{ControlSchedule: cfg, location: time.Local}
+	if cfg.Timezone != "" {
+		loc, err := time.LoadLocation(cfg.Timezone)
+		if err != nil {
+			return nil, err
+		}
+		s.location = loc
+	}
+	cron, err := parseCron(cfg.Schedule)
+	if err != nil {
+		return nil, fmt.Errorf("schedule: %w", err)
+	}
+	s.cron = cron
+
+	if len(s.Targets) == 0 {
+		s.Targets = slices.Sorted(maps.Keys(ctl.collectors))
+	}
+	// Targets of other shards are run by their own instance.
+	s.Targets = slices.DeleteFunc(slices.Clone(s.Targets), func(target string) bool { return !targetShard.owns(target) })
+	for _, target := range s.Targets {
+		if ctl.collectors[target] == nil {
+			return nil, fmt.Errorf("unknown target %q", target)
+		}
+	}
+
+	outlet := false
+	switch cfg.Action {
+	case "on", "off", "reboot":
+		if cfg.Group == "" {
+			return nil, fmt.Errorf("group is required for outlet action %s", cfg.Action)
+		}
+		outlet = true
+		s.perform, s.description = ctl.controlOutletGroup, outletDescription(&controlRecord{Group: cfg.Group, Action: cfg.Action, Delayed: cfg.Delayed})
+	case "self_test":
+		s.perform, s.description = ctl.startSelfTest, selfTestDescription
+	case "calibration_start", "calibration_cancel":
+		if !ctl.cfg.AllowCalibration {
+			return nil, fmt.Errorf("%s: %w", cfg.Action, errControlDisabled)
+		}
+		s.perform, s.description = ctl.controlCalibration, calibrationDescription(cfg.Action)
+	case "alarm_mute", "alarm_acknowledge":
+		s.perform, s.description = ctl.controlAlarm, alarmActions[strings.TrimPrefix(cfg.Action, "alarm_")][1]
+	case "card_reboot":
+		s.perform, s.description = ctl.rebootCard, cardRebootDescription
+	default:
+		return nil, fmt.Errorf("action %q cannot be scheduled", cfg.Action)
+	}
+	if !outlet && (cfg.Group != "" || cfg.Delayed) {
+		return nil, fmt.Errorf("group and delayed only apply to outlet actions")
+	}
+	return s, nil
+}
+
+// runSchedules runs the scheduled actions at the start of every matching minute until
+// the context is cancelled, registering their metrics with reg. It returns immediately
+// if no schedules are configured.
+func (ctl *controller) runSchedules(ctx context.Context, reg prometheus.Registerer) {
+	if len(ctl.schedules) == 0 {
+		return
+	}
+	reg.MustRegister(scheduledActionLastRun, scheduledActionSuccess)
+	slog.Info("Running scheduled control actions", "schedules", len(ctl.schedules))
+	for {
+		now := time.Now()
+		timer := time.NewTimer(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+		select {
+		case now = <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+		for _, s := range ctl.schedules {
+			if !s.cron.matches(now.In(s.location)) {
+				continue
+			}
+			if !s.running.TryLock() {
+				slog.Warn("Scheduled action skipped: the previous run has not finished", "name", s.Name)
+				continue
+			}
+			go func() {
+				defer s.running.Unlock()
+				ctl.runSchedule(ctx, s)
+			}()
+		}
+	}
+}
+
+// runSchedule runs the action of a schedule on its targets in turn. Runs are audited
+// and recorded as events like API requests, with the schedule in place of the token.
+func (ctl *controller) runSchedule(ctx context.Context, s *controlSchedule) {
+	for _, target := range s.Targets {
+		if ctx.Err() != nil {
+			return
+		}
+		if ctl.collectors[target].Following() {
+			slog.Info("Scheduled action skipped: not the leader", "name", s.Name, "target", target)
+			continue
+		}
+		rec := controlRecord{
+			Time:        time.Now(),
+			Token:       "schedule/" + s.Name,
+			Remote:      "local",
+			Target:      target,
+			Group:       s.Group,
+			Action:      s.Action,
+			Delayed:     s.Delayed,
+			DryRun:      s.DryRun,
+			description: s.description,
+		}
+		success := 1.0
+		if err := ctl.execute(ctl.collectors[target], &rec, s.perform); err != nil {
+			success = 0
+		}
+		scheduledActionLastRun.WithLabelValues(s.Name, target).Set(float64(rec.Time.Unix()))
+		scheduledActionSuccess.WithLabelValues(s.Name, target).Set(success)
+	}
+}
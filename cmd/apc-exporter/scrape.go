@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+
+	"github.com/veter2005/apc-exporter/pkg/nmc"
+)
+
+// runScrapeCommand implements the scrape command: it scrapes one target once and
+// prints its metrics, including the derived ones, in the text exposition format. The
+// target is a configured name or URL, or the URL of any other card, which is logged
+// in to with the top-level credentials unless -username and -password are given.
+func runScrapeCommand(cfg Config, args []string) error {
+	flags := flag.NewFlagSet("scrape", flag.ContinueOnError)
+	name := flags.String("target", "", "Name or URL of the target to scrape (default the only configured target)")
+	username := flags.String("username", "", "Username to log in with instead of the configured one")
+	password := flags.String("password", "", "Password to log in with instead of the configured one")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	target, err := commandTarget(cfg, *name, *username, *password)
+	if err != nil {
+		return err
+	}
+
+	httpClient, err := newTargetHTTPClient(target)
+	if err != nil {
+		return err
+	}
+	collector, err := newUPSCollector(cfg, httpClient, target)
+	if err != nil {
+		return err
+	}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collector)
+	mfs, err := newDerivedGatherer(registry, cfg.DerivedMetrics).Gather()
+	if err != nil {
+		return err
+	}
+	for _, mf := range mfs {
+		if _, err := expfmt.MetricFamilyToText(os.Stdout, mf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// commandTarget finds the target of a command by name or URL, and replaces its
+// credentials with the given ones.
+func commandTarget(cfg Config, name, username, password string) (TargetConfig, error) {
+	target, err := findTarget(cfg, name)
+	if username != "" {
+		target.Username = username
+	}
+	if password != "" {
+		target.Password = password
+	}
+	return target, err
+}
+
+// cardTarget returns the target like commandTarget, for the commands that need its card.
+func cardTarget(cfg Config, name, username, password string) (TargetConfig, error) {
+	target, err := commandTarget(cfg, name, username, password)
+	switch {
+	case err != nil:
+	case target.Backend == "exec":
+		err = fmt.Errorf("%s is read by a plugin, not through a card", target.Name)
+	case target.Backend == "apcupsd":
+		err = fmt.Errorf("%s is read from apcupsd, not through a card", target.Name)
+	}
+	return target, err
+}
+
+func findTarget(cfg Config, name string) (TargetConfig, error) {
+	targets := cfg.targetConfigs()
+	if name == "" {
+		if len(targets) != 1 {
+			return TargetConfig{}, errors.New("-target is required with several targets")
+		}
+		return targets[0], nil
+	}
+	for _, t := range targets {
+		if t.Name == name || t.URL == name {
+			return t, nil
+		}
+	}
+	u, err := url.Parse(name)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return TargetConfig{}, fmt.Errorf("unknown target %q", name)
+	}
+	return TargetConfig{Target: nmc.Target{
+		Name:     u.Hostname(),
+		URL:      strings.TrimSuffix(name, "/"),
+		Username: cfg.USERNAME,
+		Password: cfg.PASSWORD,
+	}}, nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	selfTestResultDesc    = prometheus.NewDesc("ups_self_test_result", "Result of the last self-test (1=passed, 0=failed).", []string{"target"}, nil)
+	selfTestTimestampDesc = prometheus.NewDesc("ups_self_test_timestamp_seconds", "Time of the last self-test result as a Unix timestamp.", []string{"target"}, nil)
+)
+
+const selfTestDescription = "Self-test"
+
+func parseSelfTestRequest(r *http.Request, rec *controlRecord) error {
+	rec.Action, rec.description = "self_test", selfTestDescription
+	return nil
+}
+
+// startSelfTest submits the self-test form of the card's diagnostics page.
+func (ctl *controller) startSelfTest(c *upsCollector, rec *controlRecord) error {
+	return ctl.submit(c, rec, ctl.cfg.DiagnosticsPath, url.Values{"action": {"startSelfTest"}})
+}
+
+// runSelfTestCommand implements the selftest command: it starts a self-test on the
+// named targets, or on all targets if none are named. With -dry-run it only logs in
+// and loads the diagnostics page.
+func runSelfTestCommand(cfg ControlConfig, collectors []*upsCollector, args []string) error {
+	cfg = cfg.withDefaults()
+	flags := flag.NewFlagSet("selftest", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "Log in and load the diagnostics page, but do not start the self-test")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	names := flags.Args()
+
+	byName := make(map[string]*upsCollector)
+	for _, c := range collectors {
+		byName[c.Target().Name] = c
+	}
+	selected := collectors
+	if len(names) > 0 {
+		selected = nil
+		for _, name := range names {
+			c, ok := byName[name]
+			if !ok {
+				return fmt.Errorf("unknown target %q", name)
+			}
+			selected = append(selected, c)
+		}
+	}
+
+	var errs []error
+	for _, c := range selected {
+		if err := submitControlForm(c, cfg.DiagnosticsPath, url.Values{"action": {"startSelfTest"}}, *dryRun); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", c.Target().Name, err))
+			continue
+		}
+		if !*dryRun {
+			slog.Info("Self-test started", "target", c.Target().Name)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// selfTestResult is the outcome of a self-test as reported by an event.
+type selfTestResult struct {
+	passed bool
+	time   time.Time
+}
+
+// selfTestTracker exposes the result of the last self-test of every target, taken
+// from the events of the card event log, traps and syslog.
+type selfTestTracker struct {
+	mu      sync.Mutex
+	results map[string]selfTestResult
+}
+
+func newSelfTestTracker() *selfTestTracker {
+	return &selfTestTracker{results: make(map[string]selfTestResult)}
+}
+
+// observe is an eventSink that records self-test results.
+func (t *selfTestTracker) observe(_ context.Context, events []event) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, e := range events {
+		passed, ok := parseSelfTestEvent(e)
+		if !ok || e.Time.Before(t.results[e.Target].time) {
+			continue
+		}
+		t.results[e.Target] = selfTestResult{passed: passed, time: e.Time}
+	}
+	return nil
+}
+
+// parseSelfTestEvent reports whether the event is a self-test result and whether the
+// test passed, e.g. "UPS: Passed a self-test." or the upsDiagnosticsFailed trap.
+func parseSelfTestEvent(e event) (passed, ok bool) {
+	if e.Source == "control" {
+		return false, false
+	}
+	text := strings.ToLower(e.Message + " " + e.Raw)
+	switch {
+	case strings.Contains(text, "upsdiagnosticspassed"):
+		return true, true
+	case strings.Contains(text, "upsdiagnosticsfailed"):
+		return false, true
+	case !strings.Contains(text, "self-test") && !strings.Contains(text, "self test"):
+		return false, false
+	case strings.Contains(text, "passed"):
+		return true, true
+	case strings.Contains(text, "failed"):
+		return false, true
+	}
+	return false, false
+}
+
+func (t *selfTestTracker) Describe(ch chan<- *prometheus.Desc) {
+	ch <- selfTestResultDesc
+	ch <- selfTestTimestampDesc
+}
+
+func (t *selfTestTracker) Collect(ch chan<- prometheus.Metric) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for target, r := range t.results {
+		value := 0.0
+		if r.passed {
+			value = 1
+		}
+		ch <- prometheus.MustNewConstMetric(selfTestResultDesc, prometheus.GaugeValue, value, target)
+		ch <- prometheus.MustNewConstMetric(selfTestTimestampDesc, prometheus.GaugeValue, float64(r.time.Unix()), target)
+	}
+}
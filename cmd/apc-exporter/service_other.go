@@ -0,0 +1,14 @@
+//go:build !windows
+
+package main
+
+import "errors"
+
+// startService does nothing outside Windows.
+func startService() (stop <-chan struct{}, stopped func()) {
+	return nil, func() {}
+}
+
+func runServiceCommand(configPath string, args []string) error {
+	return errors.New("the service command is only supported on Windows")
+}
@@ -0,0 +1,148 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/eventlog"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// serviceName is the name of the Windows service and its event log source.
+const serviceName = "apc-exporter"
+
+// startService reports to the service control manager when the exporter runs as a
+// Windows service, and sends the log to the Windows event log. The returned channel
+// receives the stop request; stopped must be called once the exporter has shut down.
+// Outside a service the channel is nil.
+func startService() (stop <-chan struct{}, stopped func()) {
+	isService, err := svc.IsWindowsService()
+	if err != nil {
+		slog.Error("Error detecting the Windows service", "err", err)
+	}
+	if !isService {
+		return nil, func() {}
+	}
+	if elog, err := eventlog.Open(serviceName); err == nil {
+		setLogOutput(eventLogWriter{elog})
+	}
+
+	h := &serviceHandler{stop: make(chan struct{}), done: make(chan struct{})}
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		if err := svc.Run(serviceName, h); err != nil {
+			slog.Error("Error running as a Windows service", "err", err)
+		}
+	}()
+	return h.stop, func() {
+		close(h.done)
+		<-finished
+	}
+}
+
+// serviceHandler forwards stop and shutdown requests to the exporter and waits for it
+// to shut down before reporting the service stopped.
+type serviceHandler struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+func (h *serviceHandler) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		select {
+		case r := <-requests:
+			switch r.Cmd {
+			case svc.Interrogate:
+				status <- r.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				close(h.stop)
+				<-h.done
+				return false, 0
+			}
+		case <-h.done:
+			return false, 0
+		}
+	}
+}
+
+// eventLogWriter writes log lines to the Windows event log.
+type eventLogWriter struct {
+	elog *eventlog.Log
+}
+
+func (w eventLogWriter) Write(p []byte) (int, error) {
+	msg := strings.TrimSpace(string(p))
+	var err error
+	if strings.Contains(strings.ToLower(msg), "error") {
+		err = w.elog.Error(1, msg)
+	} else {
+		err = w.elog.Info(1, msg)
+	}
+	return len(p), err
+}
+
+// runServiceCommand implements the service command: install registers the exporter as
+// an automatically started Windows service that uses the given config file, and
+// uninstall removes it again.
+func runServiceCommand(configPath string, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: service install|uninstall")
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		return err
+	}
+	defer m.Disconnect()
+
+	switch args[0] {
+	case "install":
+		exe, err := os.Executable()
+		if err != nil {
+			return err
+		}
+		configPath, err = filepath.Abs(configPath)
+		if err != nil {
+			return err
+		}
+		s, err := m.CreateService(serviceName, exe, mgr.Config{
+			DisplayName: "APC UPS Prometheus Exporter",
+			Description: "Exports the status of APC UPS network management cards to Prometheus.",
+			StartType:   mgr.StartAutomatic,
+		}, "-config", configPath)
+		if err != nil {
+			return err
+		}
+		defer s.Close()
+		if err := eventlog.InstallAsEventCreate(serviceName, eventlog.Error|eventlog.Warning|eventlog.Info); err != nil {
+			slog.Warn("Error registering the event log source", "err", err)
+		}
+		slog.Info("Service installed; start it with: sc start "+serviceName, "service", serviceName, "config", configPath)
+		return nil
+	case "uninstall":
+		s, err := m.OpenService(serviceName)
+		if err != nil {
+			return err
+		}
+		defer s.Close()
+		if err := s.Delete(); err != nil {
+			return err
+		}
+		if err := eventlog.Remove(serviceName); err != nil {
+			slog.Warn("Error removing the event log source", "err", err)
+		}
+		slog.Info("Service removed", "service", serviceName)
+		return nil
+	default:
+		return fmt.Errorf("unknown service command %q, expected install or uninstall", args[0])
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// servicesStopTimeout is how long a reload waits for the services of the old config to
+// stop, so the new ones can listen on the same ports and open the same files.
+const servicesStopTimeout = 10 * time.Second
+
+// services are what the exporter runs for one version of the config: the targets, the
+// outputs, notifiers and listeners, the event store, the /probe auth modules, the
+// control API and the HTTP handlers serving them. A reload builds new services and
+// swaps them for the running ones at once.
+type services struct {
+	cfg       Config
+	targets   *targetSet
+	registry  *prometheus.Registry // the metrics of the services, served along with the default registry
+	gatherer  prometheus.Gatherer  // with the derived metrics
+	unlabeled prometheus.Gatherer  // without the target label if the config has only ups_url
+	meter     *energyMeter
+	notifiers []transitionNotifier
+	selfTests *selfTestTracker
+	events    *eventStore
+	resolver  *targetResolver
+	ctl       *controller
+	mux       *http.ServeMux
+
+	stopRun context.CancelFunc // set by start
+	running sync.WaitGroup
+}
+
+// newServices builds the services of a config without starting them. Errors in the
+// targets and auth modules are returned, so a reload can reject the config.
+func newServices(cfg Config, r *reloader) (*services, error) {
+	s := &services{cfg: cfg, registry: prometheus.NewRegistry()}
+	var err error
+	if s.targets, err = newTargetSet(cfg); err != nil {
+		return nil, err
+	}
+	s.registry.MustRegister(s.targets)
+
+	// Derived metrics are added on every gather, for the HTTP endpoint and all outputs alike.
+	s.gatherer = newDerivedGatherer(prometheus.Gatherers{prometheus.DefaultGatherer, s.registry}, cfg.DerivedMetrics)
+	// With only the top-level ups_url, /metrics, Graphite and StatsD leave out the target
+	// label, as they did before targets were added.
+	s.unlabeled = s.gatherer
+	if cfg.singleTarget() {
+		s.unlabeled = unlabeledGatherer{s.gatherer}
+	}
+	if s.meter = newEnergyMeter(cfg.Energy); s.meter != nil {
+		s.registry.MustRegister(s.meter)
+	}
+
+	// Transitions detected between polls are passed to the notifiers.
+	var notifiers []transitionNotifier
+	if len(cfg.Transitions.Webhooks) > 0 {
+		notifiers = append(notifiers, newWebhookNotifier(cfg.Transitions.Webhooks))
+	}
+	if notify, err := newEmailNotifier(cfg.Email); err != nil {
+		slog.Warn("Email notifications disabled", "err", err)
+	} else if notify != nil {
+		notifiers = append(notifiers, notify)
+	}
+	if notify, err := newNtfyNotifier(cfg.Ntfy); err != nil {
+		slog.Warn("ntfy notifications disabled", "err", err)
+	} else if notify != nil {
+		notifiers = append(notifiers, notify)
+	}
+	if notify := newPagerDutyNotifier(cfg.PagerDuty); notify != nil {
+		notifiers = append(notifiers, notify)
+	}
+	for i, chat := range cfg.Chat {
+		notify, err := newChatNotifier(chat)
+		if err != nil {
+			slog.Warn("Chat notifier disabled", "index", i+1, "err", err)
+			continue
+		}
+		notifiers = append(notifiers, notify)
+	}
+	maintenance := newMaintenanceSchedule(cfg.Maintenance, s.targets.names())
+	if maintenance != nil {
+		s.registry.MustRegister(maintenance)
+	}
+	s.notifiers = r.election.suppress(maintenance.suppress(notifiers))
+
+	// Events from the card event logs, traps, syslog and transitions end up in the event store,
+	// which serves them over the API and forwards them to the configured sinks.
+	var eventSinks []eventSink
+	if sink := newLokiSink(cfg.Loki); sink != nil {
+		eventSinks = append(eventSinks, sink)
+	}
+	if len(eventSinks) > 0 && !cfg.EventLog.Enabled && cfg.SNMPTraps.ListenAddress == "" && cfg.Syslog.ListenAddress == "" && len(s.notifiers) == 0 {
+		slog.Warn("Event sinks are configured but no event source is enabled; nothing will be forwarded")
+	}
+	s.selfTests = newSelfTestTracker()
+	s.registry.MustRegister(s.selfTests)
+	eventSinks = append(eventSinks, s.selfTests.observe)
+	s.events = newEventStore(eventSinks)
+	s.resolver = newTargetResolver(cfg.targetConfigs())
+
+	// Metrics are served on every path but /, which shows a landing page; the JSON APIs
+	// take precedence on theirs.
+	s.mux = http.NewServeMux()
+	s.mux.Handle("/", promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer, promhttp.HandlerFor(s.unlabeled, promhttp.HandlerOpts{})))
+	s.mux.Handle("/{$}", r.landingPage)
+	s.mux.HandleFunc("/-/healthy", healthHandler)
+	s.mux.HandleFunc("/healthz", healthHandler)
+	s.mux.Handle("/-/reload", r)
+	s.mux.Handle("/ha/", haRESTHandler(s.targets, cfg.DerivedMetrics))
+	s.mux.Handle("/api/v1/events", s.events)
+	if len(cfg.AuthModules) > 0 {
+		p, err := newProber(cfg)
+		if err != nil {
+			return nil, err
+		}
+		s.mux.Handle("/probe", p)
+	}
+
+	if s.ctl, err = newController(cfg.Control, s.targets.collectors, s.events); err != nil {
+		slog.Warn("Control API disabled", "err", err)
+	}
+	if s.ctl != nil {
+		s.registry.MustRegister(controlRequests)
+		s.ctl.register(s.mux)
+	}
+	return s, nil
+}
+
+// start starts the services, continuing the event store and energy counters of the
+// services they replace, if any, which must have been stopped.
+func (s *services) start(r *reloader, old *services) {
+	ctx, stop := context.WithCancel(r.ctx)
+	s.stopRun = stop
+
+	switch {
+	case old != nil:
+		s.events.takeOver(old.events)
+		if s.meter != nil && old.meter != nil {
+			s.meter.takeOver(old.meter, s.targets.names())
+		}
+	case r.state != nil:
+		if err := s.events.restore(r.state); err != nil {
+			slog.Error("Error restoring events", "err", err)
+		}
+	}
+	s.selfTests.observe(ctx, s.events.all())
+
+	// The targets follow the election, and those with a poll interval are scraped in the
+	// background from now on.
+	s.targets.start(ctx, r.election)
+
+	// The outputs and watchers below gather on their own tickers, sharing their gathers
+	// so the cards are not scraped once for each of them.
+	shared := newSharedGatherer(s.gatherer)
+	var gatherer, unlabeled prometheus.Gatherer = shared, shared
+	if s.cfg.singleTarget() {
+		unlabeled = unlabeledGatherer{shared}
+	}
+
+	cfg, run := s.cfg, s.running.Go
+	run(func() { s.events.forward(ctx) })
+	if s.meter != nil {
+		run(func() { s.meter.run(ctx, gatherer, r.state) })
+	}
+	run(func() { runGraphite(ctx, cfg.Graphite, unlabeled) })
+	run(func() { runStatsD(ctx, cfg.StatsD, unlabeled) })
+	run(func() { runMQTT(ctx, cfg.MQTT, gatherer) })
+	run(func() { runOTLP(ctx, cfg.OTLP, gatherer) })
+	run(func() { runFileOutput(ctx, cfg.FileOutput, gatherer) })
+	run(func() { runZabbix(ctx, cfg.Zabbix, gatherer) })
+	run(func() { runSNMPAgent(ctx, cfg.SNMPAgent, gatherer) })
+	run(func() { runKafka(ctx, cfg.Kafka, gatherer) })
+	run(func() { runNATS(ctx, cfg.NATS, gatherer) })
+	run(func() { runRemoteWrite(ctx, cfg.RemoteWrite, gatherer) })
+	run(func() { runWebhooks(ctx, cfg.Webhooks, gatherer) })
+	run(func() { runAlertmanager(ctx, cfg.Alertmanager, gatherer) })
+	run(func() { runPassiveChecks(ctx, cfg.PassiveChecks, gatherer) })
+	run(func() { runTextfile(ctx, r.textfileDir, r.textfileInterval, gatherer) })
+
+	run(func() { runEventLog(ctx, cfg.EventLog, s.targets.collectors, s.events) })
+	run(func() { runTrapReceiver(ctx, cfg.SNMPTraps, s.resolver, s.events, r.state, s.registry) })
+	run(func() { runSyslog(ctx, cfg.Syslog, s.resolver, s.events, s.registry) })
+	run(func() { runTransitions(ctx, cfg.Transitions, gatherer, s.events, s.notifiers, r.state, s.registry) })
+	run(func() { runShutdown(ctx, cfg.Shutdown, gatherer, s.events, r.election, s.registry) })
+	if s.ctl != nil {
+		run(func() { s.ctl.runSchedules(ctx, s.registry) })
+	}
+	if r.history != nil {
+		s.mux.Handle("/api/v1/history", r.history)
+		run(func() { r.history.run(ctx, gatherer) })
+	}
+}
+
+// stop stops the services and waits, for up to servicesStopTimeout, for them to return,
+// then closes the idle connections to the cards and the audit log.
+func (s *services) stop() {
+	if s.stopRun != nil {
+		s.stopRun()
+	}
+	done := make(chan struct{})
+	go func() {
+		s.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(servicesStopTimeout):
+		slog.Warn("Some services did not stop in time", "timeout", servicesStopTimeout)
+	}
+	s.targets.stop()
+	if s.ctl != nil {
+		s.ctl.Close()
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+)
+
+// targetShard is the share of the targets this instance polls, set with -shard. The
+// zero shard polls all of them.
+var targetShard shard
+
+// shard is the index-th of count instances, counting from 1. Targets are assigned by a
+// hash of their name, so every instance can share one config file and a target stays
+// with its instance as long as the number of instances does not change.
+type shard struct {
+	index, count int
+}
+
+// parseShard parses "N/M", e.g. "2/3" for the second of three instances.
+func parseShard(s string) (shard, error) {
+	if s == "" {
+		return shard{}, nil
+	}
+	n, m, ok := strings.Cut(s, "/")
+	index, err1 := strconv.Atoi(n)
+	count, err2 := strconv.Atoi(m)
+	if !ok || err1 != nil || err2 != nil || count < 1 || index < 1 || index > count {
+		return shard{}, fmt.Errorf("invalid shard %q, expected N/M with 1 <= N <= M", s)
+	}
+	return shard{index: index, count: count}, nil
+}
+
+// owns reports whether the target is polled by this shard.
+func (s shard) owns(target string) bool {
+	if s.count <= 1 {
+		return true
+	}
+	h := fnv.New32a()
+	h.Write([]byte(target))
+	return int(h.Sum32()%uint32(s.count)) == s.index-1
+}
+
+func (s shard) String() string {
+	return strconv.Itoa(s.index) + "/" + strconv.Itoa(s.count)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// sharedGatherer lets the outputs, stores and watchers that gather on tickers of their
+// own share their gathers, so that a card without poll_interval is scraped once per
+// interval of the most frequent of them rather than once per output. A gather is
+// taken by those waiting for it while it runs, and by those of gatherWithin for as long
+// as it is younger than their interval.
+type sharedGatherer struct {
+	gatherer prometheus.Gatherer
+
+	mu       sync.Mutex
+	inFlight chan struct{} // closed when the running gather ends
+	started  time.Time     // of the last gather
+	mfs      []*dto.MetricFamily
+	err      error
+}
+
+func newSharedGatherer(g prometheus.Gatherer) *sharedGatherer {
+	return &sharedGatherer{gatherer: g}
+}
+
+// Gather waits for the running gather, if any, or else starts one.
+func (s *sharedGatherer) Gather() ([]*dto.MetricFamily, error) {
+	return s.gather(0)
+}
+
+// gather returns the last gather if it started less than maxAge ago, waiting for it if
+// it still runs, or else gathers anew. Every caller gets a copy of the metric families,
+// so that none sees the changes another makes to them.
+func (s *sharedGatherer) gather(maxAge time.Duration) ([]*dto.MetricFamily, error) {
+	s.mu.Lock()
+	waited := false
+	for s.inFlight != nil {
+		done := s.inFlight
+		s.mu.Unlock()
+		<-done
+		s.mu.Lock()
+		waited = true
+	}
+	if waited || !s.started.IsZero() && time.Since(s.started) < maxAge {
+		mfs, err := cloneFamilies(s.mfs), s.err
+		s.mu.Unlock()
+		return mfs, err
+	}
+	done := make(chan struct{})
+	s.inFlight = done
+	started := time.Now()
+	s.mu.Unlock()
+
+	mfs, err := s.gatherer.Gather()
+	s.mu.Lock()
+	s.inFlight, s.started, s.mfs, s.err = nil, started, mfs, err
+	s.mu.Unlock()
+	close(done)
+	return cloneFamilies(mfs), err
+}
+
+// cloneFamilies returns deep copies of metric families.
+func cloneFamilies(mfs []*dto.MetricFamily) []*dto.MetricFamily {
+	clones := make([]*dto.MetricFamily, len(mfs))
+	for i, mf := range mfs {
+		clones[i] = proto.Clone(mf).(*dto.MetricFamily)
+	}
+	return clones
+}
+
+// sharedView gathers through a sharedGatherer, taking gathers up to maxAge old.
+type sharedView struct {
+	shared *sharedGatherer
+	maxAge time.Duration
+}
+
+func (v sharedView) Gather() ([]*dto.MetricFamily, error) {
+	return v.shared.gather(v.maxAge)
+}
+
+// gatherWithin returns a gatherer that answers from the gathers of g up to maxAge old,
+// the interval of the caller, if g is shared, and g itself if not.
+func gatherWithin(g prometheus.Gatherer, maxAge time.Duration) prometheus.Gatherer {
+	switch g := g.(type) {
+	case *sharedGatherer:
+		return sharedView{shared: g, maxAge: maxAge}
+	case unlabeledGatherer:
+		return unlabeledGatherer{gatherWithin(g.Gatherer, maxAge)}
+	}
+	return g
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// countingGatherer gathers the metrics of a registry, counting the gathers and holding
+// each until release is closed, if set.
+type countingGatherer struct {
+	gatherer prometheus.Gatherer
+	gathers  atomic.Int32
+	release  chan struct{}
+}
+
+func (g *countingGatherer) Gather() ([]*dto.MetricFamily, error) {
+	g.gathers.Add(1)
+	if g.release != nil {
+		<-g.release
+	}
+	return g.gatherer.Gather()
+}
+
+// TestSharedGatherer checks that concurrent gathers share one, that gathers younger
+// than the interval of the caller are taken again, and that no caller sees the changes
+// another makes to its metric families.
+func TestSharedGatherer(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	load := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "ups_load_percent", Help: "Output load in percent."}, []string{"target"})
+	reg.MustRegister(load)
+	load.WithLabelValues("rack-a").Set(23.5)
+	if g := gatherWithin(reg, time.Minute); g != prometheus.Gatherer(reg) {
+		t.Errorf("gatherWithin returned %T for a gatherer not shared", g)
+	}
+
+	counting := &countingGatherer{gatherer: reg, release: make(chan struct{})}
+	shared := newSharedGatherer(counting)
+
+	var wg sync.WaitGroup
+	var callers atomic.Int32
+	for range 5 {
+		wg.Go(func() {
+			callers.Add(1)
+			if _, err := shared.Gather(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+	for counting.gathers.Load() == 0 || callers.Load() < 5 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond) // for the others to wait for the running gather
+	close(counting.release)
+	wg.Wait()
+	if n := counting.gathers.Load(); n != 1 {
+		t.Fatalf("5 concurrent gathers gathered %d times, want once", n)
+	}
+
+	// An output with a minute interval takes the gather just made; one with a
+	// nanosecond interval, or the HTTP endpoint gathering directly, gathers anew.
+	if _, err := gatherWithin(shared, time.Minute).Gather(); err != nil {
+		t.Fatal(err)
+	}
+	if n := counting.gathers.Load(); n != 1 {
+		t.Errorf("a gather within the interval gathered anew, %d gathers", n)
+	}
+	time.Sleep(time.Millisecond)
+	if _, err := gatherWithin(shared, time.Nanosecond).Gather(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := shared.Gather(); err != nil {
+		t.Fatal(err)
+	}
+	if n := counting.gathers.Load(); n != 3 {
+		t.Errorf("gathers after the interval gathered %d times in all, want 3", n)
+	}
+
+	// unlabeledGatherer drops the target label in place, which must not reach the
+	// other outputs sharing the gather.
+	unlabeled := gatherWithin(unlabeledGatherer{shared}, time.Minute)
+	if _, ok := unlabeled.(unlabeledGatherer); !ok {
+		t.Fatalf("gatherWithin returned %T for an unlabeled shared gatherer", unlabeled)
+	}
+	mfs, err := unlabeled.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range mfs {
+		if labels := mf.GetMetric()[0].GetLabel(); mf.GetName() == "ups_load_percent" && len(labels) != 0 {
+			t.Errorf("unlabeled gather has labels %v", labels)
+		}
+	}
+	samples, err := gatherSamples(gatherWithin(shared, time.Minute), "ups_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := counting.gathers.Load(); n != 3 {
+		t.Errorf("gathers within the interval gathered anew, %d gathers", n)
+	}
+	for _, s := range samples {
+		if s.Labels["target"] == "" {
+			t.Fatalf("%s lost its target label to the unlabeled gatherer", s.Name)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ShutdownConfig holds the settings for shutting down the hosts fed by a UPS when it
+// runs on battery with little runtime left.
+type ShutdownConfig struct {
+	Interval            time.Duration   `yaml:"interval"`
+	RuntimeMinutes      float64         `yaml:"runtime_minutes"`
+	OnBatteryInputVolts float64         `yaml:"on_battery_input_voltage"`
+	Timeout             time.Duration   `yaml:"timeout"`
+	DryRun              bool            `yaml:"dry_run"`
+	Groups              []ShutdownGroup `yaml:"groups"`
+}
+
+// ShutdownGroup is a group of hosts that is shut down together, by running a local
+// command and/or calling webhooks. Groups are shut down in the order they are
+// configured, each Delay after the previous one. A group without targets is fed by
+// all of them.
+type ShutdownGroup struct {
+	Name     string            `yaml:"name"`
+	Targets  []string          `yaml:"targets"`
+	Delay    time.Duration     `yaml:"delay"`
+	Command  []string          `yaml:"command"`
+	Webhooks []WebhookEndpoint `yaml:"webhooks"`
+}
+
+var shutdownGroupsRun = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "ups_shutdown_groups_total",
+	Help: "Number of host groups shut down because the UPS ran low on battery, by result (ok or error).",
+}, []string{"target", "group", "result"})
+
+// shutdownRequest is the JSON body posted to the shutdown webhooks.
+type shutdownRequest struct {
+	Time           time.Time `json:"timestamp"`
+	Target         string    `json:"target"`
+	Group          string    `json:"group"`
+	RuntimeMinutes float64   `json:"runtime_minutes"`
+}
+
+// shutdownOrchestrator starts a shutdown sequence per target when it runs low on
+// battery, and cancels the groups not yet shut down if power returns.
+type shutdownOrchestrator struct {
+	cfg    ShutdownConfig
+	client *http.Client
+	store  *eventStore
+
+	mu        sync.Mutex
+	sequences map[string]context.CancelFunc // by target
+	done      map[string]bool               // groups shut down, by name
+}
+
+// runShutdown evaluates the targets on every interval until the context is cancelled,
+// on the leader only, registering its metric with reg. It returns immediately if no
+// groups are configured.
+func runShutdown(ctx context.Context, cfg ShutdownConfig, gatherer prometheus.Gatherer, store *eventStore, election *leaderElection, reg prometheus.Registerer) {
+	if len(cfg.Groups) == 0 {
+		return
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = 15 * time.Second
+	}
+	gatherer = gatherWithin(gatherer, cfg.Interval)
+	if cfg.RuntimeMinutes <= 0 {
+		cfg.RuntimeMinutes = 5
+	}
+	if cfg.OnBatteryInputVolts <= 0 {
+		cfg.OnBatteryInputVolts = 1
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = time.Minute
+	}
+	for i := range cfg.Groups {
+		if cfg.Groups[i].Name == "" {
+			cfg.Groups[i].Name = fmt.Sprintf("group%d", i+1)
+		}
+	}
+	reg.MustRegister(shutdownGroupsRun)
+	o := &shutdownOrchestrator{
+		cfg:       cfg,
+		client:    &http.Client{Timeout: cfg.Timeout},
+		store:     store,
+		sequences: make(map[string]context.CancelFunc),
+		done:      make(map[string]bool),
+	}
+
+	slog.Info("Shutting down host groups when on battery with little runtime left", "groups", len(cfg.Groups), "runtime_minutes", cfg.RuntimeMinutes, "dry_run", cfg.DryRun)
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if election.Following() {
+				continue
+			}
+			samples, err := gatherSamples(gatherer, "ups_")
+			if err != nil {
+				slog.Error("Error gathering metrics for shutdown", "err", err)
+				continue
+			}
+			targets, states := samplesByTarget(samples)
+			for _, target := range targets {
+				o.evaluate(ctx, target, states[target])
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// evaluate starts the shutdown sequence of a target that is on battery and below the
+// runtime threshold, and cancels it once the target is back on mains power. A failed
+// poll leaves out the values; it is recognised by the missing output voltage and never
+// starts a sequence.
+func (o *shutdownOrchestrator) evaluate(ctx context.Context, target string, state map[string]float64) {
+	if state["ups_output_voltage_vac"] <= 0 {
+		return
+	}
+	onBattery := state["ups_input_voltage_vac"] < o.cfg.OnBatteryInputVolts
+	if trap, ok := state["ups_on_battery"]; ok {
+		onBattery = trap == 1
+	}
+	runtime, ok := state["ups_runtime_remaining_minutes"]
+
+	o.mu.Lock()
+	cancel, running := o.sequences[target]
+	start := onBattery && !running && ok && runtime < o.cfg.RuntimeMinutes
+	var seqCtx context.Context
+	switch {
+	case !onBattery && running:
+		cancel()
+		delete(o.sequences, target)
+		for _, g := range o.cfg.Groups {
+			if g.feeds(target) {
+				delete(o.done, g.Name)
+			}
+		}
+	case start:
+		seqCtx, cancel = context.WithCancel(ctx)
+		o.sequences[target] = cancel
+	}
+	o.mu.Unlock()
+
+	if start {
+		o.addEvent(target, "critical", fmt.Sprintf("Shutdown started: on battery with %g minutes of runtime left", runtime))
+		go o.sequence(ctx, seqCtx, target, runtime)
+	}
+}
+
+func (g ShutdownGroup) feeds(target string) bool {
+	return len(g.Targets) == 0 || slices.Contains(g.Targets, target)
+}
+
+// sequence shuts down the groups fed by the target in order. Waiting for a group's
+// delay ends when seqCtx is cancelled, but a group being shut down is always finished
+// (within the timeout) unless the exporter itself stops.
+func (o *shutdownOrchestrator) sequence(ctx, seqCtx context.Context, target string, runtime float64) {
+	for _, g := range o.cfg.Groups {
+		if !g.feeds(target) {
+			continue
+		}
+		if g.Delay > 0 {
+			select {
+			case <-time.After(g.Delay):
+			case <-seqCtx.Done():
+			}
+		}
+		if seqCtx.Err() != nil {
+			if ctx.Err() == nil {
+				o.addEvent(target, "info", "Shutdown cancelled: power restored before group "+g.Name)
+			}
+			return
+		}
+
+		o.mu.Lock()
+		already := o.done[g.Name]
+		o.done[g.Name] = true
+		o.mu.Unlock()
+		if already {
+			continue
+		}
+
+		result := "ok"
+		if err := o.shutdownGroup(ctx, target, g, runtime); err != nil {
+			result = "error"
+			o.addEvent(target, "critical", fmt.Sprintf("Shutdown of group %s failed: %v", g.Name, err))
+		} else {
+			o.addEvent(target, "critical", "Group "+g.Name+" shut down")
+		}
+		shutdownGroupsRun.WithLabelValues(target, g.Name, result).Inc()
+	}
+}
+
+// shutdownGroup runs the group's command and calls its webhooks.
+func (o *shutdownOrchestrator) shutdownGroup(ctx context.Context, target string, g ShutdownGroup, runtime float64) error {
+	if o.cfg.DryRun {
+		slog.Info("Dry run: would shut down a group", "group", g.Name, "target", target, "command", g.Command, "webhooks", len(g.Webhooks))
+		return nil
+	}
+
+	var errs []error
+	if len(g.Command) > 0 {
+		cmdCtx, cancel := context.WithTimeout(ctx, o.cfg.Timeout)
+		out, err := exec.CommandContext(cmdCtx, g.Command[0], g.Command[1:]...).CombinedOutput()
+		cancel()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("command: %w: %s", err, strings.TrimSpace(string(out))))
+		}
+	}
+	body, err := json.Marshal(shutdownRequest{Time: time.Now(), Target: target, Group: g.Name, RuntimeMinutes: runtime})
+	if err != nil {
+		return err
+	}
+	for _, endpoint := range g.Webhooks {
+		if err := postWebhook(ctx, o.client, endpoint, body); err != nil {
+			errs = append(errs, fmt.Errorf("webhook %s: %w", endpoint.URL, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// addEvent logs a step of a shutdown sequence and records it as an event.
+func (o *shutdownOrchestrator) addEvent(target, severity, message string) {
+	level := slog.LevelInfo
+	if severity == "critical" {
+		level = slog.LevelError
+	}
+	slog.Log(context.Background(), level, message, "target", target, "stage", "shutdown")
+	o.store.add(context.Background(), []event{{Time: time.Now(), Target: target, Source: "shutdown", Severity: severity, Category: "power", Message: message}})
+}
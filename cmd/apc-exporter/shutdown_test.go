@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// shutdownTestCall is a call of a shutdown webhook.
+type shutdownTestCall struct {
+	shutdownRequest
+	received time.Time
+}
+
+// shutdownTest is an orchestrator whose groups call the webhook of a test server.
+type shutdownTest struct {
+	o   *shutdownOrchestrator
+	ctx context.Context
+
+	mu    sync.Mutex
+	calls []shutdownTestCall
+}
+
+func newShutdownTest(t *testing.T, cfg ShutdownConfig) *shutdownTest {
+	t.Helper()
+	st := &shutdownTest{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var call shutdownTestCall
+		if err := json.NewDecoder(r.Body).Decode(&call.shutdownRequest); err != nil {
+			t.Error(err)
+		}
+		call.received = time.Now()
+		st.mu.Lock()
+		st.calls = append(st.calls, call)
+		st.mu.Unlock()
+	}))
+	t.Cleanup(srv.Close)
+	for i := range cfg.Groups {
+		cfg.Groups[i].Webhooks = []WebhookEndpoint{{URL: srv.URL}}
+	}
+	if cfg.RuntimeMinutes == 0 {
+		cfg.RuntimeMinutes = 5
+	}
+	cfg.OnBatteryInputVolts = 1
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	st.ctx = ctx
+	st.o = &shutdownOrchestrator{
+		cfg:       cfg,
+		client:    http.DefaultClient,
+		store:     newEventStore(nil),
+		sequences: make(map[string]context.CancelFunc),
+		done:      make(map[string]bool),
+	}
+	return st
+}
+
+// Polled states of a target: on mains power, and on battery with little runtime left.
+var (
+	shutdownTestOnline  = map[string]float64{"ups_input_voltage_vac": 230, "ups_output_voltage_vac": 230, "ups_runtime_remaining_minutes": 3}
+	shutdownTestLowBatt = map[string]float64{"ups_input_voltage_vac": 0, "ups_output_voltage_vac": 230, "ups_runtime_remaining_minutes": 3}
+)
+
+// waitEvent waits for an event of the target whose message starts with prefix.
+func (st *shutdownTest) waitEvent(t *testing.T, target, prefix string) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		if slices.ContainsFunc(st.o.store.all(), func(e event) bool { return e.Target == target && strings.HasPrefix(e.Message, prefix) }) {
+			return
+		}
+	}
+	t.Fatalf("no event %q for %s in %v", prefix, target, st.o.store.all())
+}
+
+// groups returns the groups whose webhooks were called, in order.
+func (st *shutdownTest) groups() []string {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	var groups []string
+	for _, call := range st.calls {
+		groups = append(groups, call.Group)
+	}
+	return groups
+}
+
+// TestShutdownStart checks that a sequence starts only on battery below the runtime
+// threshold, and neither after a failed poll nor on mains power.
+func TestShutdownStart(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		state map[string]float64
+		start bool
+	}{
+		{"on battery, little runtime", shutdownTestLowBatt, true},
+		{"on battery, enough runtime", map[string]float64{"ups_input_voltage_vac": 0, "ups_output_voltage_vac": 230, "ups_runtime_remaining_minutes": 20}, false},
+		{"on battery, no runtime", map[string]float64{"ups_input_voltage_vac": 0, "ups_output_voltage_vac": 230}, false},
+		{"on mains power", shutdownTestOnline, false},
+		{"on battery by trap", map[string]float64{"ups_input_voltage_vac": 230, "ups_output_voltage_vac": 230, "ups_runtime_remaining_minutes": 3, "ups_on_battery": 1}, true},
+		{"on mains power by trap", map[string]float64{"ups_input_voltage_vac": 0, "ups_output_voltage_vac": 230, "ups_runtime_remaining_minutes": 3, "ups_on_battery": 0}, false},
+		{"failed poll", map[string]float64{"ups_runtime_remaining_minutes": 0}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			st := newShutdownTest(t, ShutdownConfig{DryRun: true, Groups: []ShutdownGroup{{Name: "servers"}}})
+			st.o.evaluate(st.ctx, "rack-a", tc.state)
+			st.o.mu.Lock()
+			_, started := st.o.sequences["rack-a"]
+			st.o.mu.Unlock()
+			if started != tc.start {
+				t.Errorf("started %v, want %v", started, tc.start)
+			}
+		})
+	}
+}
+
+// TestShutdownSequence checks that the groups fed by a target are shut down in order,
+// each after its delay, and that a group shared by targets is shut down once.
+func TestShutdownSequence(t *testing.T) {
+	st := newShutdownTest(t, ShutdownConfig{Groups: []ShutdownGroup{
+		{Name: "workers"},
+		{Name: "storage-b", Targets: []string{"rack-b"}},
+		{Name: "storage-a", Targets: []string{"rack-a"}, Delay: 100 * time.Millisecond},
+		{Name: "core", Delay: 100 * time.Millisecond},
+	}})
+	st.o.evaluate(st.ctx, "rack-a", shutdownTestLowBatt)
+	st.waitEvent(t, "rack-a", "Group core shut down")
+	if want := []string{"workers", "storage-a", "core"}; !slices.Equal(st.groups(), want) {
+		t.Fatalf("groups shut down %v, want %v", st.groups(), want)
+	}
+	st.mu.Lock()
+	for i := 1; i < len(st.calls); i++ {
+		if gap := st.calls[i].received.Sub(st.calls[i-1].received); gap < 100*time.Millisecond {
+			t.Errorf("%s shut down %v after %s, want the delay of 100ms", st.calls[i].Group, gap, st.calls[i-1].Group)
+		}
+	}
+	if call := st.calls[0]; call.Target != "rack-a" || call.RuntimeMinutes != 3 {
+		t.Errorf("webhook called for %s with %g minutes, want rack-a with 3", call.Target, call.RuntimeMinutes)
+	}
+	st.mu.Unlock()
+
+	// rack-b shares workers and core with rack-a, which are already down.
+	st.o.evaluate(st.ctx, "rack-b", shutdownTestLowBatt)
+	st.waitEvent(t, "rack-b", "Group storage-b shut down")
+	time.Sleep(300 * time.Millisecond) // for the delay of core
+	if want := []string{"workers", "storage-a", "core", "storage-b"}; !slices.Equal(st.groups(), want) {
+		t.Errorf("groups shut down %v, want %v", st.groups(), want)
+	}
+}
+
+// TestShutdownCancel checks that power returning cancels the groups not yet shut down,
+// and that the groups of the target may be shut down again in the next outage.
+func TestShutdownCancel(t *testing.T) {
+	st := newShutdownTest(t, ShutdownConfig{Groups: []ShutdownGroup{
+		{Name: "workers"},
+		{Name: "core", Delay: time.Hour},
+	}})
+	st.o.evaluate(st.ctx, "rack-a", shutdownTestLowBatt)
+	st.waitEvent(t, "rack-a", "Group workers shut down")
+	st.o.evaluate(st.ctx, "rack-a", shutdownTestOnline)
+	st.waitEvent(t, "rack-a", "Shutdown cancelled: power restored before group core")
+	if want := []string{"workers"}; !slices.Equal(st.groups(), want) {
+		t.Errorf("groups shut down %v, want %v", st.groups(), want)
+	}
+
+	st.o.evaluate(st.ctx, "rack-a", shutdownTestLowBatt)
+	for deadline := time.Now().Add(5 * time.Second); len(st.groups()) < 2 && time.Now().Before(deadline); {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if want := []string{"workers", "workers"}; !slices.Equal(st.groups(), want) {
+		t.Errorf("groups shut down in the next outage %v, want %v", st.groups(), want)
+	}
+}
+
+// TestShutdownDryRun checks that a dry run goes through the sequence without calling
+// the webhooks.
+func TestShutdownDryRun(t *testing.T) {
+	st := newShutdownTest(t, ShutdownConfig{DryRun: true, Groups: []ShutdownGroup{{Name: "workers"}, {Name: "core"}}})
+	st.o.evaluate(st.ctx, "rack-a", shutdownTestLowBatt)
+	st.waitEvent(t, "rack-a", "Group core shut down")
+	if groups := st.groups(); len(groups) > 0 {
+		t.Errorf("webhooks called for %v in a dry run", groups)
+	}
+}
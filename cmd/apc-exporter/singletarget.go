@@ -0,0 +1,37 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// singleTarget reports whether the config has only the top-level ups_url, as configs
+// did before targets were added.
+func (c Config) singleTarget() bool {
+	return c.UPSURL != "" && len(c.Targets) == 0
+}
+
+// unlabeledGatherer leaves out the target label of the metrics, so a config with only
+// the top-level ups_url serves them as it did before targets were added, and the
+// dashboards and rules of single-UPS setups keep matching.
+type unlabeledGatherer struct {
+	prometheus.Gatherer
+}
+
+func (g unlabeledGatherer) Gather() ([]*dto.MetricFamily, error) {
+	mfs, err := g.Gatherer.Gather()
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			// The label pairs of constant metrics are shared with their descriptor, so
+			// they are copied rather than changed in place.
+			labels := make([]*dto.LabelPair, 0, len(m.GetLabel()))
+			for _, lp := range m.GetLabel() {
+				if lp.GetName() != "target" {
+					labels = append(labels, lp)
+				}
+			}
+			m.Label = labels
+		}
+	}
+	return mfs, err
+}
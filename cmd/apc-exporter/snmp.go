@@ -0,0 +1,550 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// SNMP/BER type tags used by the agent, trap receiver and SNMP backend.
+const (
+	snmpInteger        byte = 0x02
+	snmpOctetString    byte = 0x04
+	snmpNull           byte = 0x05
+	snmpObjectID       byte = 0x06
+	snmpSequence       byte = 0x30
+	snmpIPAddress      byte = 0x40
+	snmpCounter32      byte = 0x41
+	snmpGauge32        byte = 0x42
+	snmpTimeTicks      byte = 0x43
+	snmpOpaque         byte = 0x44
+	snmpCounter64      byte = 0x46
+	snmpNoSuchObject   byte = 0x80
+	snmpNoSuchInstance byte = 0x81
+	snmpEndOfMibView   byte = 0x82
+
+	snmpGetRequest     byte = 0xa0
+	snmpGetNextRequest byte = 0xa1
+	snmpGetResponse    byte = 0xa2
+	snmpSetRequest     byte = 0xa3
+	snmpTrapV1         byte = 0xa4
+	snmpGetBulkRequest byte = 0xa5
+	snmpInformRequest  byte = 0xa6
+	snmpTrapV2         byte = 0xa7
+	snmpReport         byte = 0xa8
+)
+
+// SNMP versions as encoded on the wire.
+const (
+	snmpV1  = 0
+	snmpV2c = 1
+	snmpV3  = 3
+)
+
+// SNMP error-status values used in responses.
+const (
+	snmpNoError     = 0
+	snmpTooBig      = 1
+	snmpNoSuchName  = 2
+	snmpGenErr      = 5
+	snmpNotWritable = 17
+)
+
+// snmpOID is a numeric object identifier.
+type snmpOID []uint32
+
+// parseOID parses a dotted OID such as "1.3.6.1.2.1.1.1.0"; a leading dot is allowed.
+func parseOID(s string) (snmpOID, error) {
+	s = strings.TrimPrefix(s, ".")
+	if s == "" {
+		return nil, errors.New("empty OID")
+	}
+	parts := strings.Split(s, ".")
+	oid := make(snmpOID, len(parts))
+	for i, p := range parts {
+		n, err := strconv.ParseUint(p, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid OID %q", s)
+		}
+		oid[i] = uint32(n)
+	}
+	return oid, nil
+}
+
+// mustParseOID is parseOID for OIDs known at compile time.
+func mustParseOID(s string) snmpOID {
+	oid, err := parseOID(s)
+	if err != nil {
+		panic(err)
+	}
+	return oid
+}
+
+func (o snmpOID) String() string {
+	parts := make([]string, len(o))
+	for i, n := range o {
+		parts[i] = strconv.FormatUint(uint64(n), 10)
+	}
+	return strings.Join(parts, ".")
+}
+
+// Compare orders OIDs lexicographically, as required for GETNEXT walks.
+func (o snmpOID) Compare(other snmpOID) int {
+	for i := 0; i < len(o) && i < len(other); i++ {
+		if o[i] != other[i] {
+			if o[i] < other[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case len(o) < len(other):
+		return -1
+	case len(o) > len(other):
+		return 1
+	}
+	return 0
+}
+
+// HasPrefix reports whether prefix is an ancestor of (or equal to) o.
+func (o snmpOID) HasPrefix(prefix snmpOID) bool {
+	if len(prefix) > len(o) {
+		return false
+	}
+	return o[:len(prefix)].Compare(prefix) == 0
+}
+
+// Append returns a new OID with the sub-identifiers appended.
+func (o snmpOID) Append(ids ...uint32) snmpOID {
+	return append(append(snmpOID(nil), o...), ids...)
+}
+
+// snmpVarBind is a single OID/value pair. Value holds an int64 for INTEGER, a uint64
+// for the unsigned types, a []byte for OCTET STRING and Opaque, an snmpOID for
+// OBJECT IDENTIFIER, a net.IP for IpAddress and nil for NULL and the exceptions.
+type snmpVarBind struct {
+	OID   snmpOID
+	Type  byte
+	Value any
+}
+
+// Float returns the numeric value of the var bind, if it has one.
+func (vb snmpVarBind) Float() (float64, bool) {
+	switch v := vb.Value.(type) {
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case []byte:
+		f, err := strconv.ParseFloat(strings.TrimSpace(string(v)), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// String renders the value of the var bind for logs and events.
+func (vb snmpVarBind) String() string {
+	switch v := vb.Value.(type) {
+	case []byte:
+		return string(v)
+	case nil:
+		return ""
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// snmpPDU is a protocol data unit. For GetBulk requests ErrorStatus and ErrorIndex
+// carry non-repeaters and max-repetitions. The Enterprise to Timestamp fields are
+// only used by SNMPv1 traps.
+type snmpPDU struct {
+	Type        byte
+	RequestID   int32
+	ErrorStatus int
+	ErrorIndex  int
+	VarBinds    []snmpVarBind
+
+	Enterprise   snmpOID
+	AgentAddr    net.IP
+	GenericTrap  int
+	SpecificTrap int
+	Timestamp    uint32
+}
+
+// snmpMessage is a community-based (v1/v2c) SNMP message.
+type snmpMessage struct {
+	Version   int
+	Community string
+	PDU       snmpPDU
+}
+
+// Marshal encodes the message in BER.
+func (m *snmpMessage) Marshal() ([]byte, error) {
+	pdu, err := m.PDU.marshal()
+	if err != nil {
+		return nil, err
+	}
+	var body []byte
+	body = append(body, berTLV(snmpInteger, berInt(int64(m.Version)))...)
+	body = append(body, berTLV(snmpOctetString, []byte(m.Community))...)
+	body = append(body, pdu...)
+	return berTLV(snmpSequence, body), nil
+}
+
+func (p *snmpPDU) marshal() ([]byte, error) {
+	var body []byte
+	if p.Type == snmpTrapV1 {
+		addr := p.AgentAddr.To4()
+		if addr == nil {
+			addr = net.IPv4zero.To4()
+		}
+		body = append(body, berTLV(snmpObjectID, berOID(p.Enterprise))...)
+		body = append(body, berTLV(snmpIPAddress, addr)...)
+		body = append(body, berTLV(snmpInteger, berInt(int64(p.GenericTrap)))...)
+		body = append(body, berTLV(snmpInteger, berInt(int64(p.SpecificTrap)))...)
+		body = append(body, berTLV(snmpTimeTicks, berUint(uint64(p.Timestamp)))...)
+	} else {
+		body = append(body, berTLV(snmpInteger, berInt(int64(p.RequestID)))...)
+		body = append(body, berTLV(snmpInteger, berInt(int64(p.ErrorStatus)))...)
+		body = append(body, berTLV(snmpInteger, berInt(int64(p.ErrorIndex)))...)
+	}
+
+	var vbs []byte
+	for _, vb := range p.VarBinds {
+		value, err := vb.marshalValue()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", vb.OID, err)
+		}
+		vbs = append(vbs, berTLV(snmpSequence, append(berTLV(snmpObjectID, berOID(vb.OID)), value...))...)
+	}
+	body = append(body, berTLV(snmpSequence, vbs)...)
+	return berTLV(p.Type, body), nil
+}
+
+func (vb snmpVarBind) marshalValue() ([]byte, error) {
+	switch vb.Type {
+	case snmpInteger:
+		v, ok := vb.Value.(int64)
+		if !ok {
+			return nil, errors.New("INTEGER value must be int64")
+		}
+		return berTLV(vb.Type, berInt(v)), nil
+	case snmpCounter32, snmpGauge32, snmpTimeTicks, snmpCounter64:
+		v, ok := vb.Value.(uint64)
+		if !ok {
+			return nil, errors.New("unsigned value must be uint64")
+		}
+		return berTLV(vb.Type, berUint(v)), nil
+	case snmpOctetString, snmpOpaque:
+		switch v := vb.Value.(type) {
+		case []byte:
+			return berTLV(vb.Type, v), nil
+		case string:
+			return berTLV(vb.Type, []byte(v)), nil
+		}
+		return nil, errors.New("OCTET STRING value must be []byte or string")
+	case snmpObjectID:
+		v, ok := vb.Value.(snmpOID)
+		if !ok {
+			return nil, errors.New("OBJECT IDENTIFIER value must be snmpOID")
+		}
+		return berTLV(vb.Type, berOID(v)), nil
+	case snmpIPAddress:
+		v, ok := vb.Value.(net.IP)
+		if !ok || v.To4() == nil {
+			return nil, errors.New("IpAddress value must be an IPv4 net.IP")
+		}
+		return berTLV(vb.Type, v.To4()), nil
+	case snmpNull, snmpNoSuchObject, snmpNoSuchInstance, snmpEndOfMibView:
+		return berTLV(vb.Type, nil), nil
+	}
+	return nil, fmt.Errorf("unsupported value type 0x%02x", vb.Type)
+}
+
+// unmarshalSNMPMessage decodes a community-based (v1/v2c) SNMP message.
+func unmarshalSNMPMessage(b []byte) (*snmpMessage, error) {
+	tag, body, _, err := berRead(b)
+	if err != nil {
+		return nil, err
+	}
+	if tag != snmpSequence {
+		return nil, errors.New("message is not a SEQUENCE")
+	}
+
+	m := &snmpMessage{}
+	version, body, err := berReadInt(body)
+	if err != nil {
+		return nil, fmt.Errorf("version: %w", err)
+	}
+	m.Version = int(version)
+	if m.Version != snmpV1 && m.Version != snmpV2c {
+		return nil, fmt.Errorf("unsupported SNMP version %d", m.Version)
+	}
+
+	tag, community, body, err := berRead(body)
+	if err != nil || tag != snmpOctetString {
+		return nil, errors.New("invalid community")
+	}
+	m.Community = string(community)
+
+	pdu, err := unmarshalSNMPPDU(body)
+	if err != nil {
+		return nil, err
+	}
+	m.PDU = *pdu
+	return m, nil
+}
+
+func unmarshalSNMPPDU(b []byte) (*snmpPDU, error) {
+	tag, body, _, err := berRead(b)
+	if err != nil {
+		return nil, fmt.Errorf("PDU: %w", err)
+	}
+	p := &snmpPDU{Type: tag}
+
+	if tag == snmpTrapV1 {
+		var raw []byte
+		var t byte
+		if t, raw, body, err = berRead(body); err != nil || t != snmpObjectID {
+			return nil, errors.New("invalid trap enterprise")
+		}
+		if p.Enterprise, err = berParseOID(raw); err != nil {
+			return nil, err
+		}
+		if t, raw, body, err = berRead(body); err != nil || t != snmpIPAddress || len(raw) != 4 {
+			return nil, errors.New("invalid trap agent address")
+		}
+		p.AgentAddr = net.IP(append([]byte(nil), raw...))
+		var n int64
+		if n, body, err = berReadInt(body); err != nil {
+			return nil, errors.New("invalid generic trap")
+		}
+		p.GenericTrap = int(n)
+		if n, body, err = berReadInt(body); err != nil {
+			return nil, errors.New("invalid specific trap")
+		}
+		p.SpecificTrap = int(n)
+		if t, raw, body, err = berRead(body); err != nil || t != snmpTimeTicks {
+			return nil, errors.New("invalid trap timestamp")
+		}
+		p.Timestamp = uint32(berParseUint(raw))
+	} else {
+		var n int64
+		if n, body, err = berReadInt(body); err != nil {
+			return nil, errors.New("invalid request-id")
+		}
+		p.RequestID = int32(n)
+		if n, body, err = berReadInt(body); err != nil {
+			return nil, errors.New("invalid error-status")
+		}
+		p.ErrorStatus = int(n)
+		if n, body, err = berReadInt(body); err != nil {
+			return nil, errors.New("invalid error-index")
+		}
+		p.ErrorIndex = int(n)
+	}
+
+	tag, vbs, _, err := berRead(body)
+	if err != nil || tag != snmpSequence {
+		return nil, errors.New("invalid variable bindings")
+	}
+	for len(vbs) > 0 {
+		var vb []byte
+		if tag, vb, vbs, err = berRead(vbs); err != nil || tag != snmpSequence {
+			return nil, errors.New("invalid variable binding")
+		}
+		tag, rawOID, rest, err := berRead(vb)
+		if err != nil || tag != snmpObjectID {
+			return nil, errors.New("invalid variable binding OID")
+		}
+		oid, err := berParseOID(rawOID)
+		if err != nil {
+			return nil, err
+		}
+		tag, raw, _, err := berRead(rest)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", oid, err)
+		}
+		value, err := berParseValue(tag, raw)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", oid, err)
+		}
+		p.VarBinds = append(p.VarBinds, snmpVarBind{OID: oid, Type: tag, Value: value})
+	}
+	return p, nil
+}
+
+func berParseValue(tag byte, raw []byte) (any, error) {
+	switch tag {
+	case snmpInteger:
+		return berParseInt(raw)
+	case snmpCounter32, snmpGauge32, snmpTimeTicks, snmpCounter64:
+		return berParseUint(raw), nil
+	case snmpOctetString, snmpOpaque:
+		return append([]byte(nil), raw...), nil
+	case snmpObjectID:
+		return berParseOID(raw)
+	case snmpIPAddress:
+		if len(raw) != 4 {
+			return nil, errors.New("invalid IpAddress")
+		}
+		return net.IP(append([]byte(nil), raw...)), nil
+	case snmpNull, snmpNoSuchObject, snmpNoSuchInstance, snmpEndOfMibView:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unsupported value type 0x%02x", tag)
+}
+
+// berTLV encodes a tag, definite length and value.
+func berTLV(tag byte, value []byte) []byte {
+	out := []byte{tag}
+	n := len(value)
+	switch {
+	case n < 0x80:
+		out = append(out, byte(n))
+	default:
+		var lenBytes []byte
+		for ; n > 0; n >>= 8 {
+			lenBytes = append([]byte{byte(n)}, lenBytes...)
+		}
+		out = append(out, 0x80|byte(len(lenBytes)))
+		out = append(out, lenBytes...)
+	}
+	return append(out, value...)
+}
+
+// berRead splits the first TLV off b, returning its tag, value and the remainder.
+func berRead(b []byte) (byte, []byte, []byte, error) {
+	if len(b) < 2 {
+		return 0, nil, nil, errors.New("truncated BER element")
+	}
+	tag := b[0]
+	length := int(b[1])
+	offset := 2
+	if length&0x80 != 0 {
+		numBytes := length & 0x7f
+		if numBytes == 0 || numBytes > 4 || len(b) < 2+numBytes {
+			return 0, nil, nil, errors.New("invalid BER length")
+		}
+		length = 0
+		for _, c := range b[2 : 2+numBytes] {
+			length = length<<8 | int(c)
+		}
+		offset += numBytes
+	}
+	if length < 0 || len(b)-offset < length {
+		return 0, nil, nil, errors.New("truncated BER element")
+	}
+	return tag, b[offset : offset+length], b[offset+length:], nil
+}
+
+func berReadInt(b []byte) (int64, []byte, error) {
+	tag, raw, rest, err := berRead(b)
+	if err != nil {
+		return 0, nil, err
+	}
+	if tag != snmpInteger {
+		return 0, nil, errors.New("expected INTEGER")
+	}
+	n, err := berParseInt(raw)
+	return n, rest, err
+}
+
+func berInt(n int64) []byte {
+	var out []byte
+	for {
+		out = append([]byte{byte(n)}, out...)
+		n >>= 8
+		if (n == 0 && out[0]&0x80 == 0) || (n == -1 && out[0]&0x80 != 0) {
+			return out
+		}
+	}
+}
+
+func berUint(n uint64) []byte {
+	var out []byte
+	for {
+		out = append([]byte{byte(n)}, out...)
+		n >>= 8
+		if n == 0 {
+			break
+		}
+	}
+	if out[0]&0x80 != 0 {
+		out = append([]byte{0}, out...)
+	}
+	return out
+}
+
+func berParseInt(raw []byte) (int64, error) {
+	if len(raw) == 0 || len(raw) > 8 {
+		return 0, errors.New("invalid INTEGER length")
+	}
+	n := int64(int8(raw[0]))
+	for _, c := range raw[1:] {
+		n = n<<8 | int64(c)
+	}
+	return n, nil
+}
+
+func berParseUint(raw []byte) uint64 {
+	var n uint64
+	for _, c := range raw {
+		n = n<<8 | uint64(c)
+	}
+	return n
+}
+
+func berOID(oid snmpOID) []byte {
+	if len(oid) < 2 {
+		return []byte{0}
+	}
+	out := berBase128(uint64(oid[0])*40 + uint64(oid[1]))
+	for _, n := range oid[2:] {
+		out = append(out, berBase128(uint64(n))...)
+	}
+	return out
+}
+
+func berBase128(n uint64) []byte {
+	out := []byte{byte(n & 0x7f)}
+	for n >>= 7; n > 0; n >>= 7 {
+		out = append([]byte{byte(n&0x7f) | 0x80}, out...)
+	}
+	return out
+}
+
+func berParseOID(raw []byte) (snmpOID, error) {
+	if len(raw) == 0 {
+		return nil, errors.New("empty OID")
+	}
+	var oid snmpOID
+	var n uint64
+	for i, c := range raw {
+		n = n<<7 | uint64(c&0x7f)
+		if n > math.MaxUint32 {
+			return nil, errors.New("OID sub-identifier too large")
+		}
+		if c&0x80 != 0 {
+			if i == len(raw)-1 {
+				return nil, errors.New("truncated OID")
+			}
+			continue
+		}
+		if oid == nil {
+			if n < 80 {
+				oid = snmpOID{uint32(n / 40), uint32(n % 40)}
+			} else {
+				oid = snmpOID{2, uint32(n - 80)}
+			}
+		} else {
+			oid = append(oid, uint32(n))
+		}
+		n = 0
+	}
+	return oid, nil
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// maxSNMPResponseSize keeps responses within a single unfragmented UDP datagram.
+const maxSNMPResponseSize = 1472
+
+// defaultSNMPAgentBaseOID is NET-SNMP's experimentation subtree (netSnmpPlaypen),
+// used until a site assigns its own enterprise OID.
+const defaultSNMPAgentBaseOID = "1.3.6.1.4.1.8072.9999.9999.318"
+
+// SNMPAgentConfig holds the settings for the embedded read-only SNMP agent.
+type SNMPAgentConfig struct {
+	ListenAddress  string        `yaml:"listen_address"`
+	Community      string        `yaml:"community"`
+	BaseOID        string        `yaml:"base_oid"`
+	Interval       time.Duration `yaml:"interval"`
+	PowerNetTarget string        `yaml:"powernet_target"`
+}
+
+// snmpAgentColumns are the metric columns of the private UPS table, in column order
+// starting at column 3 (column 1 is the index, column 2 the target name).
+var snmpAgentColumns = []string{
+	"ups_device_status_up",
+	"ups_load_percent",
+	"ups_runtime_remaining_minutes",
+	"ups_internal_temperature_celsius",
+	"ups_load_power_percent_va",
+	"ups_load_current_amps",
+	"ups_input_voltage_vac",
+	"ups_output_voltage_vac",
+	"ups_input_frequency_hz",
+	"ups_output_frequency_hz",
+	"ups_battery_charge_percent",
+	"ups_battery_voltage_vdc",
+	"ups_outlet_status",
+}
+
+// Well-known MIB-2 system group scalars answered by the agent.
+var (
+	sysDescrOID    = mustParseOID("1.3.6.1.2.1.1.1.0")
+	sysObjectIDOID = mustParseOID("1.3.6.1.2.1.1.2.0")
+	sysUpTimeOID   = mustParseOID("1.3.6.1.2.1.1.3.0")
+	sysNameOID     = mustParseOID("1.3.6.1.2.1.1.5.0")
+)
+
+// snmpAgent answers GET, GETNEXT and GETBULK requests from a snapshot of the
+// gathered metrics that is refreshed on an interval, so walks never trigger scrapes.
+type snmpAgent struct {
+	cfg     SNMPAgentConfig
+	base    snmpOID
+	started time.Time
+
+	mu       sync.RWMutex
+	snapshot []snmpVarBind // sorted by OID
+}
+
+// runSNMPAgent serves the SNMP agent until the context is cancelled. It returns
+// immediately if no listen address is configured.
+func runSNMPAgent(ctx context.Context, cfg SNMPAgentConfig, gatherer prometheus.Gatherer) {
+	if cfg.ListenAddress == "" {
+		return
+	}
+	if cfg.Community == "" {
+		cfg.Community = "public"
+	}
+	if cfg.BaseOID == "" {
+		cfg.BaseOID = defaultSNMPAgentBaseOID
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = 30 * time.Second
+	}
+	gatherer = gatherWithin(gatherer, cfg.Interval)
+
+	base, err := parseOID(cfg.BaseOID)
+	if err != nil {
+		slog.Warn("SNMP agent disabled: invalid base_oid", "err", err)
+		return
+	}
+	conn, err := listenPacket(cfg.ListenAddress)
+	if err != nil {
+		slog.Warn("SNMP agent disabled", "err", err)
+		return
+	}
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	agent := &snmpAgent{cfg: cfg, base: base, started: time.Now()}
+	agent.refresh(gatherer)
+	go func() {
+		ticker := time.NewTicker(cfg.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				agent.refresh(gatherer)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	slog.Info("SNMP agent listening", "address", conn.LocalAddr().String(), "base_oid", base.String())
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.Error("SNMP agent stopped", "err", err)
+			}
+			return
+		}
+		if resp := agent.handle(buf[:n]); resp != nil {
+			conn.WriteTo(resp, addr)
+		}
+	}
+}
+
+// refresh rebuilds the OID snapshot from a fresh gather.
+func (a *snmpAgent) refresh(gatherer prometheus.Gatherer) {
+	samples, err := gatherSamples(gatherer, "ups_")
+	if err != nil {
+		slog.Error("SNMP agent: error gathering metrics", "err", err)
+		return
+	}
+	targets, states := samplesByTarget(samples)
+
+	// Private MIB: base.1.1.1.<column>.<index> where the index is the 1-based
+	// position of the target in name order. Values are integers in tenths.
+	entry := a.base.Append(1, 1, 1)
+	var vbs []snmpVarBind
+	for i, target := range targets {
+		index := uint32(i + 1)
+		vbs = append(vbs,
+			snmpVarBind{OID: entry.Append(1, index), Type: snmpInteger, Value: int64(index)},
+			snmpVarBind{OID: entry.Append(2, index), Type: snmpOctetString, Value: []byte(target)},
+		)
+		for col, metric := range snmpAgentColumns {
+			if value, ok := states[target][metric]; ok {
+				vbs = append(vbs, snmpVarBind{OID: entry.Append(uint32(col+3), index), Type: snmpInteger, Value: int64(math.Round(value * 10))})
+			}
+		}
+	}
+
+	if state, ok := states[a.cfg.PowerNetTarget]; ok && a.cfg.PowerNetTarget != "" {
+		vbs = append(vbs, powerNetVarBinds(state)...)
+	}
+
+	vbs = append(vbs,
+		snmpVarBind{OID: sysDescrOID, Type: snmpOctetString, Value: []byte("apc-exporter SNMP agent")},
+		snmpVarBind{OID: sysObjectIDOID, Type: snmpObjectID, Value: a.base},
+		snmpVarBind{OID: sysNameOID, Type: snmpOctetString, Value: []byte(hostname())},
+	)
+
+	sort.Slice(vbs, func(i, j int) bool { return vbs[i].OID.Compare(vbs[j].OID) < 0 })
+
+	a.mu.Lock()
+	a.snapshot = vbs
+	a.mu.Unlock()
+}
+
+// powerNetVarBinds renders a target's values under the PowerNet-MIB OIDs, so NMS
+// templates written for APC cards can read the exporter directly.
+func powerNetVarBinds(state map[string]float64) []snmpVarBind {
+	var vbs []snmpVarBind
+	for _, objects := range [][]powerNetObject{powerNetAdvObjects, powerNetHighPrecObjects} {
+		for _, obj := range objects {
+			value, ok := state[obj.metric]
+			if !ok {
+				continue
+			}
+			raw := math.Round(value / obj.scale)
+			if obj.typ == snmpInteger {
+				vbs = append(vbs, snmpVarBind{OID: obj.oid, Type: obj.typ, Value: int64(raw)})
+			} else {
+				vbs = append(vbs, snmpVarBind{OID: obj.oid, Type: obj.typ, Value: uint64(math.Max(raw, 0))})
+			}
+		}
+	}
+	if status, ok := state["ups_device_status_up"]; ok {
+		value := int64(powerNetStatusUnknown)
+		if status == 1 {
+			value = powerNetStatusOnLine
+		}
+		vbs = append(vbs, snmpVarBind{OID: powerNetBasicOutputStatus, Type: snmpInteger, Value: value})
+	}
+	return vbs
+}
+
+// handle decodes a request and returns the encoded response, or nil to drop it.
+func (a *snmpAgent) handle(packet []byte) []byte {
+	msg, err := unmarshalSNMPMessage(packet)
+	if err != nil || msg.Community != a.cfg.Community {
+		return nil
+	}
+
+	req := msg.PDU
+	resp := snmpPDU{Type: snmpGetResponse, RequestID: req.RequestID}
+
+	a.mu.RLock()
+	snapshot := make([]snmpVarBind, len(a.snapshot), len(a.snapshot)+1)
+	copy(snapshot, a.snapshot)
+	a.mu.RUnlock()
+	snapshot = append(snapshot, snmpVarBind{OID: sysUpTimeOID, Type: snmpTimeTicks, Value: uint64(time.Since(a.started) / (10 * time.Millisecond))})
+	sort.Slice(snapshot, func(i, j int) bool { return snapshot[i].OID.Compare(snapshot[j].OID) < 0 })
+
+	switch req.Type {
+	case snmpGetRequest, snmpGetNextRequest:
+		for i, vb := range req.VarBinds {
+			var found snmpVarBind
+			var ok bool
+			if req.Type == snmpGetRequest {
+				found, ok = lookupOID(snapshot, vb.OID)
+			} else {
+				found, ok = nextOID(snapshot, vb.OID)
+			}
+			if !ok {
+				if msg.Version == snmpV1 {
+					resp.ErrorStatus, resp.ErrorIndex = snmpNoSuchName, i+1
+					resp.VarBinds = req.VarBinds
+					break
+				}
+				found = snmpVarBind{OID: vb.OID, Type: snmpNoSuchInstance}
+				if req.Type == snmpGetNextRequest {
+					found.Type = snmpEndOfMibView
+				}
+			}
+			resp.VarBinds = append(resp.VarBinds, found)
+		}
+	case snmpGetBulkRequest:
+		if msg.Version == snmpV1 {
+			return nil
+		}
+		nonRepeaters, maxRepetitions := max(req.ErrorStatus, 0), max(req.ErrorIndex, 0)
+		for i, vb := range req.VarBinds {
+			if i < nonRepeaters {
+				next, ok := nextOID(snapshot, vb.OID)
+				if !ok {
+					next = snmpVarBind{OID: vb.OID, Type: snmpEndOfMibView}
+				}
+				resp.VarBinds = append(resp.VarBinds, next)
+				continue
+			}
+			oid := vb.OID
+			for r := 0; r < maxRepetitions; r++ {
+				next, ok := nextOID(snapshot, oid)
+				if !ok {
+					resp.VarBinds = append(resp.VarBinds, snmpVarBind{OID: oid, Type: snmpEndOfMibView})
+					break
+				}
+				resp.VarBinds = append(resp.VarBinds, next)
+				oid = next.OID
+			}
+		}
+	case snmpSetRequest:
+		resp.VarBinds = req.VarBinds
+		resp.ErrorStatus, resp.ErrorIndex = snmpNotWritable, 1
+		if msg.Version == snmpV1 {
+			resp.ErrorStatus = snmpNoSuchName
+		}
+	default:
+		return nil
+	}
+
+	out := &snmpMessage{Version: msg.Version, Community: msg.Community, PDU: resp}
+	data, err := out.Marshal()
+	for err == nil && len(data) > maxSNMPResponseSize {
+		if req.Type != snmpGetBulkRequest || len(out.PDU.VarBinds) <= 1 {
+			out.PDU = snmpPDU{Type: snmpGetResponse, RequestID: req.RequestID, ErrorStatus: snmpTooBig, VarBinds: nil}
+			data, err = out.Marshal()
+			break
+		}
+		// GETBULK responses may simply be truncated.
+		out.PDU.VarBinds = out.PDU.VarBinds[:len(out.PDU.VarBinds)/2]
+		data, err = out.Marshal()
+	}
+	if err != nil {
+		slog.Warn("SNMP agent: error encoding a response", "err", err)
+		return nil
+	}
+	return data
+}
+
+// lookupOID finds the exact OID in a sorted snapshot.
+func lookupOID(snapshot []snmpVarBind, oid snmpOID) (snmpVarBind, bool) {
+	i := sort.Search(len(snapshot), func(i int) bool { return snapshot[i].OID.Compare(oid) >= 0 })
+	if i < len(snapshot) && snapshot[i].OID.Compare(oid) == 0 {
+		return snapshot[i], true
+	}
+	return snmpVarBind{}, false
+}
+
+// nextOID finds the first OID in a sorted snapshot that follows oid.
+func nextOID(snapshot []snmpVarBind, oid snmpOID) (snmpVarBind, bool) {
+	i := sort.Search(len(snapshot), func(i int) bool { return snapshot[i].OID.Compare(oid) > 0 })
+	if i < len(snapshot) {
+		return snapshot[i], true
+	}
+	return snmpVarBind{}, false
+}
+
+func hostname() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return "apc-exporter"
+	}
+	return name
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/hex"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestBEREncoding(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		got  []byte
+		want string
+	}{
+		{"int 0", berInt(0), "00"},
+		{"int 127", berInt(127), "7f"},
+		{"int 128", berInt(128), "0080"},
+		{"int 256", berInt(256), "0100"},
+		{"int -1", berInt(-1), "ff"},
+		{"int -128", berInt(-128), "80"},
+		{"int -129", berInt(-129), "ff7f"},
+		{"uint 0", berUint(0), "00"},
+		{"uint 255", berUint(255), "00ff"},
+		{"uint max32", berUint(4294967295), "00ffffffff"},
+		{"oid", berOID(mustParseOID("1.3.6.1.4.1.318")), "2b06010401823e"},
+		{"oid sysDescr", berOID(mustParseOID("1.3.6.1.2.1.1.1.0")), "2b06010201010100"},
+		{"short length", berTLV(snmpOctetString, []byte("ab")), "04026162"},
+		{"long length", berTLV(snmpOctetString, make([]byte, 200))[:3], "0481c8"},
+		{"two-byte length", berTLV(snmpOctetString, make([]byte, 300))[:4], "0482012c"},
+	} {
+		if got := hex.EncodeToString(tt.got); got != tt.want {
+			t.Errorf("%s: encoded to %s, want %s", tt.name, got, tt.want)
+		}
+	}
+
+	for _, n := range []int64{0, 1, 127, 128, 255, 256, -1, -128, -129, 1<<31 - 1, -1 << 31} {
+		if got, err := berParseInt(berInt(n)); err != nil || got != n {
+			t.Errorf("berParseInt(berInt(%d)) = %d, %v", n, got, err)
+		}
+	}
+	for _, n := range []uint64{0, 1, 255, 256, 1<<32 - 1, 1<<64 - 1} {
+		if got := berParseUint(berUint(n)); got != n {
+			t.Errorf("berParseUint(berUint(%d)) = %d", n, got)
+		}
+	}
+	for _, s := range []string{"1.3", "1.3.6.1.2.1.1.1.0", "1.3.6.1.4.1.318.1.1.1.2.2.1.0", "2.999.4294967295"} {
+		oid := mustParseOID(s)
+		if got, err := berParseOID(berOID(oid)); err != nil || got.String() != oid.String() {
+			t.Errorf("berParseOID(berOID(%s)) = %s, %v", s, got, err)
+		}
+	}
+}
+
+// TestSNMPMessageEncoding encodes a v2c get of sysDescr.0 to the bytes any agent
+// expects, and decodes them back.
+func TestSNMPMessageEncoding(t *testing.T) {
+	msg := &snmpMessage{
+		Version:   snmpV2c,
+		Community: "public",
+		PDU: snmpPDU{
+			Type:      snmpGetRequest,
+			RequestID: 1,
+			VarBinds:  []snmpVarBind{{OID: mustParseOID("1.3.6.1.2.1.1.1.0"), Type: snmpNull}},
+		},
+	}
+	const want = "302602010104067075626c6963a019020101020100020100300e300c06082b060102010101000500"
+	got, err := msg.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(got) != want {
+		t.Errorf("encoded to\n%x\nwant\n%s", got, want)
+	}
+	decoded, err := unmarshalSNMPMessage(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded, msg) {
+		t.Errorf("decoded to %+v, want %+v", decoded, msg)
+	}
+}
+
+// TestSNMPMessageRoundTrip encodes and decodes a message with a value of every type.
+func TestSNMPMessageRoundTrip(t *testing.T) {
+	oid := mustParseOID("1.3.6.1.4.1.318.1.1.1.2.2.1.0")
+	for _, pdu := range []snmpPDU{
+		{
+			Type:        snmpGetResponse,
+			RequestID:   -12345,
+			ErrorStatus: snmpNoSuchName,
+			ErrorIndex:  2,
+			VarBinds: []snmpVarBind{
+				{OID: oid, Type: snmpInteger, Value: int64(-42)},
+				{OID: oid, Type: snmpGauge32, Value: uint64(100)},
+				{OID: oid, Type: snmpCounter32, Value: uint64(4294967295)},
+				{OID: oid, Type: snmpCounter64, Value: uint64(1 << 40)},
+				{OID: oid, Type: snmpTimeTicks, Value: uint64(360000)},
+				{OID: oid, Type: snmpOctetString, Value: []byte("Smart-UPS 1500")},
+				{OID: oid, Type: snmpOpaque, Value: []byte{0x9f, 0x78, 0x04}},
+				{OID: oid, Type: snmpObjectID, Value: mustParseOID("1.3.6.1.4.1.318")},
+				{OID: oid, Type: snmpIPAddress, Value: net.IP{10, 0, 0, 12}},
+				{OID: oid, Type: snmpNull},
+				{OID: oid, Type: snmpNoSuchObject},
+				{OID: oid, Type: snmpNoSuchInstance},
+				{OID: oid, Type: snmpEndOfMibView},
+			},
+		},
+		{
+			Type:         snmpTrapV1,
+			Enterprise:   mustParseOID("1.3.6.1.4.1.318"),
+			AgentAddr:    net.IP{192, 168, 1, 10},
+			GenericTrap:  6,
+			SpecificTrap: 5,
+			Timestamp:    123456,
+			VarBinds:     []snmpVarBind{{OID: oid, Type: snmpOctetString, Value: []byte("UPS: On battery power in response to an input power problem.")}},
+		},
+	} {
+		msg := &snmpMessage{Version: snmpV1, Community: "private", PDU: pdu}
+		b, err := msg.Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := unmarshalSNMPMessage(b)
+		if err != nil {
+			t.Fatalf("PDU 0x%02x: %v", pdu.Type, err)
+		}
+		if !reflect.DeepEqual(decoded, msg) {
+			t.Errorf("PDU 0x%02x decoded to\n%+v\nwant\n%+v", pdu.Type, decoded, msg)
+		}
+	}
+
+	for _, b := range [][]byte{nil, {0x30}, {0x30, 0x05, 0x02, 0x01}, {0x04, 0x00}, mustHex(t, "3003020103")} {
+		if _, err := unmarshalSNMPMessage(b); err == nil {
+			t.Errorf("unmarshalSNMPMessage(%x) succeeded", b)
+		}
+	}
+}
+
+// TestSNMPV3MessageRoundTrip encodes and decodes SNMPv3 messages with and without
+// privacy.
+func TestSNMPV3MessageRoundTrip(t *testing.T) {
+	msg := &snmpV3Message{
+		ID:              42,
+		Flags:           snmpFlagAuth | snmpFlagReportable,
+		EngineID:        mustHex(t, "000000000000000000000002"),
+		Boots:           1,
+		Time:            1000,
+		User:            "monitor",
+		AuthParams:      make([]byte, 12),
+		PrivParams:      []byte{},
+		ContextEngineID: mustHex(t, "000000000000000000000002"),
+		ContextName:     "",
+		PDU: snmpPDU{
+			Type:      snmpGetRequest,
+			RequestID: 7,
+			VarBinds:  []snmpVarBind{{OID: mustParseOID("1.3.6.1.2.1.1.1.0"), Type: snmpNull}},
+		},
+	}
+	scoped, err := msg.scopedPDU()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := msg.marshal(scoped)
+	decoded, err := unmarshalSNMPV3Message(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.ID != msg.ID || decoded.Flags != msg.Flags || !bytes.Equal(decoded.EngineID, msg.EngineID) ||
+		decoded.Boots != msg.Boots || decoded.Time != msg.Time || decoded.User != msg.User ||
+		!bytes.Equal(decoded.AuthParams, msg.AuthParams) || !bytes.Equal(decoded.ContextEngineID, msg.ContextEngineID) ||
+		!reflect.DeepEqual(decoded.PDU, msg.PDU) {
+		t.Errorf("decoded to\n%+v\nwant\n%+v", decoded, msg)
+	}
+	if again := decoded.marshal(scoped); !bytes.Equal(again, b) {
+		t.Errorf("encoded again to\n%x\nwant\n%x", again, b)
+	}
+
+	msg.Flags |= snmpFlagPriv
+	decoded, err = unmarshalSNMPV3Message(msg.marshal([]byte("ciphertext")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(decoded.Encrypted) != "ciphertext" {
+		t.Errorf("encrypted PDU decoded to %q", decoded.Encrypted)
+	}
+}
+
+// TestSNMPLocalizedKey checks the key localization of RFC 3414 A.3.1 and A.3.2.
+func TestSNMPLocalizedKey(t *testing.T) {
+	engineID := mustHex(t, "000000000000000000000002")
+	for _, tt := range []struct {
+		name string
+		got  []byte
+		want string
+	}{
+		{"MD5", snmpLocalizedKey(md5.New, "maplesyrup", engineID), "526f5eed9fcce26f8964c2930787d82b"},
+		{"SHA", snmpLocalizedKey(sha1.New, "maplesyrup", engineID), "6695febc9288e36282235fc7151f128497b38f3f"},
+	} {
+		if got := hex.EncodeToString(tt.got); got != tt.want {
+			t.Errorf("%s: localized key %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+// TestSNMPUSM checks the digests and the DES and AES privacy of the user-based security
+// model against other implementations, with the keys of RFC 3414 A.3.
+func TestSNMPUSM(t *testing.T) {
+	engineID := mustHex(t, "000000000000000000000002")
+	md5Key := snmpLocalizedKey(md5.New, "maplesyrup", engineID)
+	shaKey := snmpLocalizedKey(sha1.New, "maplesyrup", engineID)
+
+	for _, tt := range []struct {
+		auth string
+		key  []byte
+		want string
+	}{
+		{"MD5", md5Key, "2af4b941ba9f2fd9ef81541b"},
+		{"SHA", shaKey, "2ef55d56f1ec3be4b8ab4970"},
+	} {
+		auth := snmpAuthProtocols[tt.auth]
+		c := &snmpClient{auth: &auth, authKey: tt.key}
+		if got := hex.EncodeToString(c.digest([]byte("hello snmp"))); got != tt.want {
+			t.Errorf("HMAC-%s-96 digest %s, want %s", tt.auth, got, tt.want)
+		}
+	}
+
+	for _, tt := range []struct {
+		priv   string
+		key    []byte
+		plain  string
+		cipher string
+		salt   string
+	}{
+		// The salt of DES is the engine boots and the counter, of AES the counter.
+		{"DES", md5Key, "0123456789abcdef", "380959d3b9e320d273d9ff84d70168cb", "0000000100000001"},
+		{"AES", shaKey, "snmp scoped pdu!xyz", "7c9f9a071dbe78daf156645dc605fb314599f1", "0000000000000001"},
+	} {
+		c := &snmpClient{cfg: SNMPConfig{PrivProtocol: tt.priv}, privKey: tt.key}
+		const boots, engineTime = 1, 1000
+		encrypted, salt, err := c.encrypt([]byte(tt.plain), boots, engineTime)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.priv, err)
+		}
+		if got := hex.EncodeToString(encrypted); got != tt.cipher {
+			t.Errorf("%s: encrypted to %s, want %s", tt.priv, got, tt.cipher)
+		}
+		if got := hex.EncodeToString(salt); got != tt.salt {
+			t.Errorf("%s: salt %s, want %s", tt.priv, got, tt.salt)
+		}
+		decrypted, err := c.decrypt(encrypted, salt, boots, engineTime)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.priv, err)
+		}
+		if string(decrypted) != tt.plain {
+			t.Errorf("%s: decrypted to %q, want %q", tt.priv, decrypted, tt.plain)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SNMPConfig configures a target with backend snmp, read from the PowerNet-MIB of its
+// card over SNMP v2c or v3.
+type SNMPConfig struct {
+	// Address is the host:port of the agent, by default the host of ups_url on port 161.
+	Address string        `yaml:"address"`
+	Version string        `yaml:"version"` // 2c (the default) or 3
+	Timeout time.Duration `yaml:"timeout"`
+
+	// Community is the community of SNMP v2c, by default public.
+	Community string `yaml:"community"`
+
+	// Username and the protocols and passwords below are the user of SNMP v3. Without
+	// an auth_protocol requests are neither authenticated nor encrypted, without a
+	// priv_protocol they are not encrypted.
+	Username     string `yaml:"username"`
+	AuthProtocol string `yaml:"auth_protocol"` // MD5, SHA or SHA256
+	AuthPassword string `yaml:"auth_password"`
+	PrivProtocol string `yaml:"priv_protocol"` // DES or AES
+	PrivPassword string `yaml:"priv_password"`
+	ContextName  string `yaml:"context_name"`
+}
+
+// snmpClient reads objects from the agent of a card. For SNMP v3 it keeps the engine of
+// the agent and the keys localized to it between requests.
+type snmpClient struct {
+	addr    string
+	cfg     SNMPConfig
+	timeout time.Duration
+	auth    *snmpAuthProtocol
+
+	mu      sync.Mutex
+	engine  snmpEngine
+	authKey []byte
+	privKey []byte
+	salt    uint64
+}
+
+// newSNMPClient checks the SNMP settings of a target and returns its client. The
+// agent is not contacted until the first request.
+func newSNMPClient(cfg SNMPConfig, upsURL string) (*snmpClient, error) {
+	// The salts of privacy start at random, so restarts do not reuse them.
+	c := &snmpClient{addr: cfg.Address, cfg: cfg, timeout: cfg.Timeout, salt: rand.Uint64()}
+	if c.addr == "" {
+		u, err := url.Parse(upsURL)
+		if err != nil || u.Hostname() == "" {
+			return nil, fmt.Errorf("snmp.address is required without a ups_url to take the host from")
+		}
+		c.addr = net.JoinHostPort(u.Hostname(), "161")
+	} else if _, _, err := net.SplitHostPort(c.addr); err != nil {
+		c.addr = net.JoinHostPort(c.addr, "161")
+	}
+	if c.timeout <= 0 {
+		c.timeout = 5 * time.Second
+	}
+
+	switch cfg.Version {
+	case "", "2c":
+		if c.cfg.Community == "" {
+			c.cfg.Community = "public"
+		}
+	case "3":
+		if cfg.Username == "" {
+			return nil, fmt.Errorf("snmp.username is required with SNMP v3")
+		}
+		if cfg.AuthProtocol != "" {
+			auth, ok := snmpAuthProtocols[strings.ToUpper(cfg.AuthProtocol)]
+			if !ok {
+				return nil, fmt.Errorf("unknown snmp.auth_protocol %q, known are MD5, SHA and SHA256", cfg.AuthProtocol)
+			}
+			if len(cfg.AuthPassword) < 8 {
+				return nil, fmt.Errorf("snmp.auth_password must have at least 8 characters")
+			}
+			c.auth = &auth
+		}
+		if cfg.PrivProtocol != "" {
+			c.cfg.PrivProtocol = strings.ToUpper(cfg.PrivProtocol)
+			if !slices.Contains(snmpPrivProtocols, c.cfg.PrivProtocol) {
+				return nil, fmt.Errorf("unknown snmp.priv_protocol %q, known are DES and AES", cfg.PrivProtocol)
+			}
+			if c.auth == nil {
+				return nil, fmt.Errorf("snmp.auth_protocol is required with a priv_protocol")
+			}
+			if len(cfg.PrivPassword) < 8 {
+				return nil, fmt.Errorf("snmp.priv_password must have at least 8 characters")
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown snmp.version %q, must be 2c or 3", cfg.Version)
+	}
+	return c, nil
+}
+
+// Get reads the objects in one request.
+func (c *snmpClient) Get(oids ...snmpOID) ([]snmpVarBind, error) {
+	if c.cfg.Version != "3" {
+		return snmpGet(c.addr, c.cfg.Community, c.timeout, oids...)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.v3Get(oids)
+}
+
+// snmpBackend reads a target from the PowerNet-MIB of its card, as the collector's
+// backend.
+type snmpBackend struct {
+	client *snmpClient
+}
+
+// Values reads the values of the card under the metric names of the web scraper.
+func (b *snmpBackend) Values(ctx context.Context) (map[string]float64, error) {
+	state, _, err := readPowerNetState(b.client)
+	return state, err
+}
+
+// Unsupported returns the metrics the PowerNet-MIB has no object for.
+func (b *snmpBackend) Unsupported() []string {
+	return []string{"ups_load_power_percent_va"}
+}
@@ -0,0 +1,494 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"math/rand/v2"
+	"net"
+	"time"
+)
+
+// SNMPv3 message flags and the user-based security model.
+const (
+	snmpFlagAuth       = 0x01
+	snmpFlagPriv       = 0x02
+	snmpFlagReportable = 0x04
+
+	snmpUSM     = 3
+	snmpMaxSize = 65507
+)
+
+// usmStats* are the counters an agent reports a refused SNMPv3 request with.
+var (
+	usmStatsPrefix = mustParseOID("1.3.6.1.6.3.15.1.1")
+	usmStatsErrors = map[uint32]string{
+		1: "the agent does not support the security level",
+		2: "the request is not in the agent's time window",
+		3: "the agent does not know the user",
+		4: "the agent does not know the engine ID",
+		5: "the agent rejected the authentication, check auth_protocol and auth_password",
+		6: "the agent could not decrypt the request, check priv_protocol and priv_password",
+	}
+)
+
+// snmpAuthProtocol is an authentication protocol of the user-based security model.
+type snmpAuthProtocol struct {
+	hash   func() hash.Hash
+	macLen int
+}
+
+// snmpAuthProtocols are the authentication protocols by their name in the config:
+// HMAC-MD5-96 and HMAC-SHA-96 of RFC 3414, and HMAC-192-SHA-256 of RFC 7860.
+var snmpAuthProtocols = map[string]snmpAuthProtocol{
+	"MD5":    {md5.New, 12},
+	"SHA":    {sha1.New, 12},
+	"SHA256": {sha256.New, 24},
+}
+
+// snmpPrivProtocols are the privacy protocols by their name in the config: CBC-DES of
+// RFC 3414 and CFB128-AES-128 of RFC 3826.
+var snmpPrivProtocols = []string{"DES", "AES"}
+
+// snmpEngine is the SNMP engine of an agent as discovered, for SNMPv3 requests.
+type snmpEngine struct {
+	id    []byte
+	boots int64
+	time  int64
+	at    time.Time // when time was learned
+}
+
+// now returns the engine time of the agent.
+func (e snmpEngine) now() int64 {
+	return e.time + int64(time.Since(e.at).Seconds())
+}
+
+// snmpV3Message is an SNMPv3 message with user-based security. With privacy, the
+// scoped PDU is sent as Encrypted and PDU is only set after decryption.
+type snmpV3Message struct {
+	ID    int32
+	Flags byte
+
+	EngineID   []byte
+	Boots      int64
+	Time       int64
+	User       string
+	AuthParams []byte
+	PrivParams []byte
+
+	ContextEngineID []byte
+	ContextName     string
+	PDU             snmpPDU
+	Encrypted       []byte
+}
+
+// scopedPDU encodes the PDU with its context.
+func (m *snmpV3Message) scopedPDU() ([]byte, error) {
+	pdu, err := m.PDU.marshal()
+	if err != nil {
+		return nil, err
+	}
+	var body []byte
+	body = append(body, berTLV(snmpOctetString, m.ContextEngineID)...)
+	body = append(body, berTLV(snmpOctetString, []byte(m.ContextName))...)
+	body = append(body, pdu...)
+	return berTLV(snmpSequence, body), nil
+}
+
+// marshal encodes the message in BER, with data as the scoped PDU, or the encrypted
+// scoped PDU with privacy.
+func (m *snmpV3Message) marshal(data []byte) []byte {
+	var global []byte
+	global = append(global, berTLV(snmpInteger, berInt(int64(m.ID)))...)
+	global = append(global, berTLV(snmpInteger, berInt(snmpMaxSize))...)
+	global = append(global, berTLV(snmpOctetString, []byte{m.Flags})...)
+	global = append(global, berTLV(snmpInteger, berInt(snmpUSM))...)
+
+	var usm []byte
+	usm = append(usm, berTLV(snmpOctetString, m.EngineID)...)
+	usm = append(usm, berTLV(snmpInteger, berInt(m.Boots))...)
+	usm = append(usm, berTLV(snmpInteger, berInt(m.Time))...)
+	usm = append(usm, berTLV(snmpOctetString, []byte(m.User))...)
+	usm = append(usm, berTLV(snmpOctetString, m.AuthParams)...)
+	usm = append(usm, berTLV(snmpOctetString, m.PrivParams)...)
+
+	var body []byte
+	body = append(body, berTLV(snmpInteger, berInt(snmpV3))...)
+	body = append(body, berTLV(snmpSequence, global)...)
+	body = append(body, berTLV(snmpOctetString, berTLV(snmpSequence, usm))...)
+	if m.Flags&snmpFlagPriv != 0 {
+		body = append(body, berTLV(snmpOctetString, data)...)
+	} else {
+		body = append(body, data...)
+	}
+	return berTLV(snmpSequence, body)
+}
+
+// unmarshalSNMPV3Message decodes an SNMPv3 message with user-based security. The
+// scoped PDU of an encrypted message is left in Encrypted.
+func unmarshalSNMPV3Message(b []byte) (*snmpV3Message, error) {
+	tag, body, _, err := berRead(b)
+	if err != nil || tag != snmpSequence {
+		return nil, errors.New("message is not a SEQUENCE")
+	}
+	version, body, err := berReadInt(body)
+	if err != nil || version != snmpV3 {
+		return nil, fmt.Errorf("not an SNMPv3 message")
+	}
+
+	m := &snmpV3Message{}
+	tag, global, body, err := berRead(body)
+	if err != nil || tag != snmpSequence {
+		return nil, errors.New("invalid global data")
+	}
+	id, global, err := berReadInt(global)
+	if err != nil {
+		return nil, errors.New("invalid message ID")
+	}
+	m.ID = int32(id)
+	if _, global, err = berReadInt(global); err != nil {
+		return nil, errors.New("invalid maximum size")
+	}
+	tag, flags, global, err := berRead(global)
+	if err != nil || tag != snmpOctetString || len(flags) != 1 {
+		return nil, errors.New("invalid flags")
+	}
+	m.Flags = flags[0]
+	if model, _, err := berReadInt(global); err != nil || model != snmpUSM {
+		return nil, errors.New("not the user-based security model")
+	}
+
+	tag, params, body, err := berRead(body)
+	if err != nil || tag != snmpOctetString {
+		return nil, errors.New("invalid security parameters")
+	}
+	tag, usm, _, err := berRead(params)
+	if err != nil || tag != snmpSequence {
+		return nil, errors.New("invalid security parameters")
+	}
+	if tag, m.EngineID, usm, err = berRead(usm); err != nil || tag != snmpOctetString {
+		return nil, errors.New("invalid engine ID")
+	}
+	if m.Boots, usm, err = berReadInt(usm); err != nil {
+		return nil, errors.New("invalid engine boots")
+	}
+	if m.Time, usm, err = berReadInt(usm); err != nil {
+		return nil, errors.New("invalid engine time")
+	}
+	var user []byte
+	if tag, user, usm, err = berRead(usm); err != nil || tag != snmpOctetString {
+		return nil, errors.New("invalid user name")
+	}
+	m.User = string(user)
+	if tag, m.AuthParams, usm, err = berRead(usm); err != nil || tag != snmpOctetString {
+		return nil, errors.New("invalid authentication parameters")
+	}
+	if tag, m.PrivParams, _, err = berRead(usm); err != nil || tag != snmpOctetString {
+		return nil, errors.New("invalid privacy parameters")
+	}
+
+	if m.Flags&snmpFlagPriv != 0 {
+		if tag, m.Encrypted, _, err = berRead(body); err != nil || tag != snmpOctetString {
+			return nil, errors.New("invalid encrypted PDU")
+		}
+		return m, nil
+	}
+	return m, m.unmarshalScopedPDU(body)
+}
+
+// unmarshalScopedPDU decodes the scoped PDU of a message. Trailing bytes, such as the
+// padding of DES, are ignored.
+func (m *snmpV3Message) unmarshalScopedPDU(b []byte) error {
+	tag, scoped, _, err := berRead(b)
+	if err != nil || tag != snmpSequence {
+		return errors.New("invalid scoped PDU")
+	}
+	if tag, m.ContextEngineID, scoped, err = berRead(scoped); err != nil || tag != snmpOctetString {
+		return errors.New("invalid context engine ID")
+	}
+	var name []byte
+	if tag, name, scoped, err = berRead(scoped); err != nil || tag != snmpOctetString {
+		return errors.New("invalid context name")
+	}
+	m.ContextName = string(name)
+	pdu, err := unmarshalSNMPPDU(scoped)
+	if err != nil {
+		return err
+	}
+	m.PDU = *pdu
+	return nil
+}
+
+// snmpLocalizedKey derives the key of a password localized to an engine, as in
+// RFC 3414 A.2: the password repeated to a megabyte is hashed, and the hash is hashed
+// again around the engine ID.
+func snmpLocalizedKey(h func() hash.Hash, password string, engineID []byte) []byte {
+	d := h()
+	const size = 1 << 20
+	repeated := bytes.Repeat([]byte(password), 64/len(password)+2)
+	for n := 0; n < size; n += 64 {
+		d.Write(repeated[n%len(password) : n%len(password)+64])
+	}
+	ku := d.Sum(nil)
+	d.Reset()
+	d.Write(ku)
+	d.Write(engineID)
+	d.Write(ku)
+	return d.Sum(nil)
+}
+
+// v3Get reads the objects with SNMPv3. The engine of the agent is discovered on the
+// first request, and again when the agent no longer knows it, as after a restart. The
+// caller must hold c.mu.
+func (c *snmpClient) v3Get(oids []snmpOID) ([]snmpVarBind, error) {
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if c.engine.id == nil {
+			if err := c.discover(); err != nil {
+				return nil, fmt.Errorf("discovering the SNMP engine of %s: %w", c.addr, err)
+			}
+		}
+		var res *snmpV3Message
+		res, err = c.v3Request(oids)
+		if err != nil {
+			return nil, err
+		}
+		if res.PDU.Type != snmpReport {
+			if res.PDU.ErrorStatus != snmpNoError {
+				return nil, fmt.Errorf("SNMP error status %d", res.PDU.ErrorStatus)
+			}
+			return res.PDU.VarBinds, nil
+		}
+
+		err = errors.New("the agent sent a report")
+		if len(res.PDU.VarBinds) > 0 && res.PDU.VarBinds[0].OID.HasPrefix(usmStatsPrefix) && len(res.PDU.VarBinds[0].OID) > len(usmStatsPrefix) {
+			stat := res.PDU.VarBinds[0].OID[len(usmStatsPrefix)]
+			if msg, ok := usmStatsErrors[stat]; ok {
+				err = errors.New(msg)
+			}
+			switch stat {
+			case 2:
+				// The report holds the engine's boots and time.
+				c.engine.boots, c.engine.time, c.engine.at = res.Boots, res.Time, time.Now()
+				continue
+			case 4:
+				c.engine = snmpEngine{}
+				continue
+			}
+		}
+		return nil, err
+	}
+	return nil, err
+}
+
+// discover learns the engine ID, boots and time of the agent from the report it
+// answers an empty request with, and localizes the keys to the engine.
+func (c *snmpClient) discover() error {
+	req := &snmpV3Message{ID: rand.Int32(), Flags: snmpFlagReportable, PDU: snmpPDU{Type: snmpGetRequest, RequestID: rand.Int32()}}
+	scoped, err := req.scopedPDU()
+	if err != nil {
+		return err
+	}
+	res, err := c.v3Exchange(req.ID, req.marshal(scoped))
+	if err != nil {
+		return err
+	}
+	if len(res.EngineID) == 0 {
+		return errors.New("the agent sent no engine ID")
+	}
+	c.engine = snmpEngine{id: res.EngineID, boots: res.Boots, time: res.Time, at: time.Now()}
+	if c.auth != nil {
+		c.authKey = snmpLocalizedKey(c.auth.hash, c.cfg.AuthPassword, c.engine.id)
+		if c.cfg.PrivProtocol != "" {
+			c.privKey = snmpLocalizedKey(c.auth.hash, c.cfg.PrivPassword, c.engine.id)
+		}
+	}
+	return nil
+}
+
+// v3Request sends a get request for the objects to the discovered engine and returns
+// the response, authenticated and decrypted.
+func (c *snmpClient) v3Request(oids []snmpOID) (*snmpV3Message, error) {
+	req := &snmpV3Message{
+		ID:              rand.Int32(),
+		Flags:           snmpFlagReportable,
+		EngineID:        c.engine.id,
+		Boots:           c.engine.boots,
+		Time:            c.engine.now(),
+		User:            c.cfg.Username,
+		ContextEngineID: c.engine.id,
+		ContextName:     c.cfg.ContextName,
+		PDU:             snmpPDU{Type: snmpGetRequest, RequestID: rand.Int32()},
+	}
+	for _, oid := range oids {
+		req.PDU.VarBinds = append(req.PDU.VarBinds, snmpVarBind{OID: oid, Type: snmpNull})
+	}
+	data, err := req.scopedPDU()
+	if err != nil {
+		return nil, err
+	}
+	if c.auth != nil {
+		req.Flags |= snmpFlagAuth
+		req.AuthParams = make([]byte, c.auth.macLen)
+	}
+	if c.privKey != nil {
+		req.Flags |= snmpFlagPriv
+		if data, req.PrivParams, err = c.encrypt(data, req.Boots, req.Time); err != nil {
+			return nil, err
+		}
+	}
+	b := req.marshal(data)
+	if c.auth != nil {
+		// The digest is taken over the message with zeros in its place.
+		req.AuthParams = c.digest(b)
+		b = req.marshal(data)
+	}
+
+	res, err := c.v3Exchange(req.ID, b)
+	if err != nil {
+		return nil, err
+	}
+	if res.Encrypted != nil {
+		if c.privKey == nil {
+			return nil, errors.New("the agent sent an encrypted response")
+		}
+		plain, err := c.decrypt(res.Encrypted, res.PrivParams, res.Boots, res.Time)
+		if err != nil {
+			return nil, err
+		}
+		if err := res.unmarshalScopedPDU(plain); err != nil {
+			return nil, fmt.Errorf("decrypting the response: %w", err)
+		}
+	}
+	return res, nil
+}
+
+// v3Exchange sends a message to the agent and returns its response, checking the
+// digest of authenticated responses.
+func (c *snmpClient) v3Exchange(id int32, req []byte) (*snmpV3Message, error) {
+	conn, err := net.Dial("udp", c.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(c.timeout))
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		res, err := unmarshalSNMPV3Message(buf[:n])
+		if err != nil || res.ID != id {
+			continue
+		}
+		if res.Flags&snmpFlagAuth != 0 && c.authKey != nil {
+			// The digest is checked over the message with zeros in its place.
+			b := bytes.Clone(buf[:n])
+			if i := bytes.Index(b, res.AuthParams); len(res.AuthParams) == c.auth.macLen && i >= 0 {
+				clear(b[i : i+len(res.AuthParams)])
+				if !hmac.Equal(c.digest(b), res.AuthParams) {
+					return nil, errors.New("the response failed authentication")
+				}
+			} else {
+				return nil, errors.New("the response has no valid digest")
+			}
+		}
+		return res, nil
+	}
+}
+
+// digest returns the truncated HMAC of a message.
+func (c *snmpClient) digest(b []byte) []byte {
+	mac := hmac.New(c.auth.hash, c.authKey)
+	mac.Write(b)
+	return mac.Sum(nil)[:c.auth.macLen]
+}
+
+// encrypt encrypts a scoped PDU and returns it with the salt for the privacy
+// parameters.
+func (c *snmpClient) encrypt(plain []byte, boots, engineTime int64) ([]byte, []byte, error) {
+	c.salt++
+	salt := make([]byte, 8)
+	switch c.cfg.PrivProtocol {
+	case "DES":
+		binary.BigEndian.PutUint32(salt, uint32(boots))
+		binary.BigEndian.PutUint32(salt[4:], uint32(c.salt))
+		block, err := des.NewCipher(c.privKey[:8])
+		if err != nil {
+			return nil, nil, err
+		}
+		iv := make([]byte, 8)
+		for i := range iv {
+			iv[i] = c.privKey[8+i] ^ salt[i]
+		}
+		padded := append(bytes.Clone(plain), make([]byte, (8-len(plain)%8)%8)...)
+		out := make([]byte, len(padded))
+		cipher.NewCBCEncrypter(block, iv).CryptBlocks(out, padded)
+		return out, salt, nil
+	default:
+		binary.BigEndian.PutUint64(salt, c.salt)
+		block, err := aes.NewCipher(c.privKey[:16])
+		if err != nil {
+			return nil, nil, err
+		}
+		out := make([]byte, len(plain))
+		cipher.NewCFBEncrypter(block, aesIV(boots, engineTime, salt)).XORKeyStream(out, plain)
+		return out, salt, nil
+	}
+}
+
+// decrypt decrypts the scoped PDU of a response with the salt of its privacy
+// parameters.
+func (c *snmpClient) decrypt(data, salt []byte, boots, engineTime int64) ([]byte, error) {
+	if len(salt) != 8 {
+		return nil, errors.New("the response has invalid privacy parameters")
+	}
+	switch c.cfg.PrivProtocol {
+	case "DES":
+		if len(data)%8 != 0 {
+			return nil, errors.New("the encrypted response is not a multiple of the DES block size")
+		}
+		block, err := des.NewCipher(c.privKey[:8])
+		if err != nil {
+			return nil, err
+		}
+		iv := make([]byte, 8)
+		for i := range iv {
+			iv[i] = c.privKey[8+i] ^ salt[i]
+		}
+		out := make([]byte, len(data))
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(out, data)
+		return out, nil
+	default:
+		block, err := aes.NewCipher(c.privKey[:16])
+		if err != nil {
+			return nil, err
+		}
+		out := make([]byte, len(data))
+		cipher.NewCFBDecrypter(block, aesIV(boots, engineTime, salt)).XORKeyStream(out, data)
+		return out, nil
+	}
+}
+
+// aesIV is the initialization vector of AES privacy: the engine boots and time, and
+// the salt.
+func aesIV(boots, engineTime int64, salt []byte) []byte {
+	iv := make([]byte, 16)
+	binary.BigEndian.PutUint32(iv, uint32(boots))
+	binary.BigEndian.PutUint32(iv[4:], uint32(engineTime))
+	copy(iv[8:], salt)
+	return iv
+}
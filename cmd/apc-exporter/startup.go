@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/veter2005/apc-exporter/pkg/nmc"
+)
+
+var startupCheckSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "ups_startup_check_success",
+	Help: "Whether logging in to the target and reading its status page succeeded at startup (1) or not (0).",
+}, []string{"target"})
+
+// checkTarget logs in to the card and loads its status page. A card that answers
+// with its logon page again has rejected the credentials, so the status page must
+// show the device status. The plugin of a target with backend exec is run once.
+func checkTarget(c *upsCollector) error {
+	if c.Backend != nil {
+		_, err := c.Backend.Values(context.Background())
+		return err
+	}
+	_, err := c.Client().Status(context.Background())
+	if errors.Is(err, nmc.ErrNoStatus) || errors.Is(err, nmc.ErrLoggedOut) {
+		return errors.New("no device status on the status page, check the credentials")
+	}
+	return err
+}
+
+// runStartupCheck checks all targets in parallel and logs the result of each. Targets
+// that have not answered within the timeout count as failed. It returns an error if
+// every target failed.
+func runStartupCheck(collectors []*upsCollector, timeout time.Duration) error {
+	prometheus.MustRegister(startupCheckSuccess)
+	type result struct {
+		target string
+		err    error
+	}
+	results := make(chan result, len(collectors))
+	for _, c := range collectors {
+		go func() {
+			results <- result{c.Target().Name, checkTarget(c)}
+		}()
+	}
+
+	pending := make(map[string]bool)
+	for _, c := range collectors {
+		pending[c.Target().Name] = true
+	}
+	deadline := time.After(timeout)
+	failed := 0
+	for len(pending) > 0 {
+		select {
+		case r := <-results:
+			delete(pending, r.target)
+			if r.err != nil {
+				failed++
+				startupCheckSuccess.WithLabelValues(r.target).Set(0)
+				logStage(priorityErr, r.target, "login", "Startup check of %s failed: %v", r.target, r.err)
+				continue
+			}
+			startupCheckSuccess.WithLabelValues(r.target).Set(1)
+			logStage(priorityInfo, r.target, "login", "Startup check of %s passed", r.target)
+		case <-deadline:
+			for target := range pending {
+				failed++
+				startupCheckSuccess.WithLabelValues(target).Set(0)
+				logStage(priorityErr, target, "login", "Startup check of %s failed: no answer within %s", target, timeout)
+			}
+			pending = nil
+		}
+	}
+
+	slog.Info("Startup check finished", "reachable", len(collectors)-failed, "targets", len(collectors))
+	if failed > 0 && failed == len(collectors) {
+		return fmt.Errorf("none of the %d targets is reachable", failed)
+	}
+	return nil
+}
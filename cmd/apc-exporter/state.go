@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// StateConfig holds the settings for the persistent event and state store.
+type StateConfig struct {
+	Path string `yaml:"path"`
+}
+
+var (
+	stateEventsBucket = []byte("events")
+	stateBucket       = []byte("state")
+)
+
+// stateStore persists the events and the transition and notification state in a
+// bbolt database, so restarts during an outage neither lose history nor re-fire
+// notifications. Events are kept in one bucket per target under increasing sequence
+// numbers; the rest is stored as JSON documents by key.
+type stateStore struct {
+	db *bolt.DB
+}
+
+// storedEvent is an event as persisted, including its raw form, which the event log
+// scraper needs to recognise entries it has already seen.
+type storedEvent struct {
+	event
+	Raw string `json:"raw,omitempty"`
+}
+
+// openStateStore opens (or creates) the store. It returns nil if no path is configured.
+func openStateStore(cfg StateConfig) (*stateStore, error) {
+	if cfg.Path == "" {
+		return nil, nil
+	}
+	db, err := bolt.Open(cfg.Path, 0o644, &bolt.Options{Timeout: dbLockTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("opening %s: %w", cfg.Path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(stateEventsBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(stateBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &stateStore{db: db}, nil
+}
+
+func (s *stateStore) Close() error {
+	return s.db.Close()
+}
+
+// saveEvents appends the events, keeping at most maxStoredEvents per target.
+func (s *stateStore) saveEvents(events []event) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		root := tx.Bucket(stateEventsBucket)
+		touched := make(map[string]*bolt.Bucket)
+		for _, e := range events {
+			b, err := root.CreateBucketIfNotExists([]byte(e.Target))
+			if err != nil {
+				return err
+			}
+			seq, err := b.NextSequence()
+			if err != nil {
+				return err
+			}
+			data, err := json.Marshal(storedEvent{event: e, Raw: e.Raw})
+			if err != nil {
+				return err
+			}
+			key := make([]byte, 8)
+			binary.BigEndian.PutUint64(key, seq)
+			if err := b.Put(key, data); err != nil {
+				return err
+			}
+			touched[e.Target] = b
+		}
+		for _, b := range touched {
+			c := b.Cursor()
+			for excess := b.Stats().KeyN - maxStoredEvents; excess > 0; excess-- {
+				if k, _ := c.First(); k == nil {
+					break
+				}
+				if err := c.Delete(); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// loadEvents returns the persisted events of all targets, oldest first per target.
+func (s *stateStore) loadEvents() ([]event, error) {
+	var events []event
+	err := s.db.View(func(tx *bolt.Tx) error {
+		root := tx.Bucket(stateEventsBucket)
+		return root.ForEachBucket(func(target []byte) error {
+			return root.Bucket(target).ForEach(func(_, v []byte) error {
+				var stored storedEvent
+				if err := json.Unmarshal(v, &stored); err != nil {
+					return err
+				}
+				stored.event.Raw = stored.Raw
+				events = append(events, stored.event)
+				return nil
+			})
+		})
+	})
+	return events, err
+}
+
+// save stores v as JSON under key.
+func (s *stateStore) save(key string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(stateBucket).Put([]byte(key), data)
+	})
+}
+
+// load decodes the JSON stored under key into v and reports whether it was found.
+func (s *stateStore) load(key string, v any) (bool, error) {
+	var data []byte
+	s.db.View(func(tx *bolt.Tx) error {
+		if value := tx.Bucket(stateBucket).Get([]byte(key)); value != nil {
+			data = append([]byte(nil), value...)
+		}
+		return nil
+	})
+	if data == nil {
+		return false, nil
+	}
+	return true, json.Unmarshal(data, v)
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// statusMetrics are the metrics whose changes between polls are reported as
+// state-change events.
+var statusMetrics = []string{"ups_device_status_up", "ups_outlet_status"}
+
+// stateChange describes a status metric of a target changing value between polls.
+type stateChange struct {
+	Time   time.Time `json:"timestamp"`
+	Target string    `json:"target"`
+	Metric string    `json:"metric"`
+	From   float64   `json:"from"`
+	To     float64   `json:"to"`
+}
+
+// stateTracker remembers the last polled status values per target.
+type stateTracker struct {
+	last map[string]map[string]float64
+}
+
+// update records the current per-target values and returns the status changes since
+// the previous update. The first poll of a target only establishes its baseline.
+func (t *stateTracker) update(now time.Time, states map[string]map[string]float64) []stateChange {
+	if t.last == nil {
+		t.last = make(map[string]map[string]float64)
+	}
+
+	var changes []stateChange
+	for target, state := range states {
+		previous, seen := t.last[target]
+		if !seen {
+			previous = make(map[string]float64)
+			t.last[target] = previous
+		}
+		for _, metric := range statusMetrics {
+			value, ok := state[metric]
+			if !ok {
+				continue
+			}
+			if old, had := previous[metric]; seen && had && old != value {
+				changes = append(changes, stateChange{Time: now, Target: target, Metric: metric, From: old, To: value})
+			}
+			previous[metric] = value
+		}
+	}
+	return changes
+}
+
+// TransitionsConfig holds the settings for detecting named state transitions
+// between polls and notifying webhooks about them.
+type TransitionsConfig struct {
+	Interval            time.Duration      `yaml:"interval"`
+	LowBatteryPercent   float64            `yaml:"low_battery_percent"`
+	OverloadPercent     float64            `yaml:"overload_percent"`
+	OnBatteryInputVolts float64            `yaml:"on_battery_input_voltage"`
+	Webhooks            []WebhookEndpoint  `yaml:"webhooks"`
+	Rules               []RuleConfig       `yaml:"rules"`
+	Notifications       NotificationConfig `yaml:"notifications"`
+}
+
+// upsCondition is a named condition of a target that is either set or cleared. The
+// trap-driven gauge, when the card sends traps, takes precedence over the thresholds.
+type upsCondition struct {
+	name      string
+	clearedAs string
+	setAs     string
+	severity  string
+	trapGauge string
+	evaluate  func(cfg TransitionsConfig, state map[string]float64) (active, ok bool)
+}
+
+var upsConditions = []upsCondition{
+	{"on_battery", "online", "on_battery", "warning", "ups_on_battery", func(cfg TransitionsConfig, state map[string]float64) (bool, bool) {
+		volts, ok := state["ups_input_voltage_vac"]
+		return volts < cfg.OnBatteryInputVolts, ok
+	}},
+	{"low_battery", "normal", "low", "critical", "ups_low_battery", func(cfg TransitionsConfig, state map[string]float64) (bool, bool) {
+		charge, ok := state["ups_battery_charge_percent"]
+		return charge < cfg.LowBatteryPercent, ok
+	}},
+	{"overload", "normal", "overload", "critical", "ups_overload", func(cfg TransitionsConfig, state map[string]float64) (bool, bool) {
+		load, ok := state["ups_load_percent"]
+		return load >= cfg.OverloadPercent, ok
+	}},
+}
+
+// transition describes a condition of a target being set or cleared between polls.
+type transition struct {
+	Time      time.Time          `json:"timestamp"`
+	Target    string             `json:"target"`
+	Condition string             `json:"condition"`
+	Active    bool               `json:"active"`
+	Severity  string             `json:"severity,omitempty"`
+	From      string             `json:"from"`
+	To        string             `json:"to"`
+	Metrics   map[string]float64 `json:"metrics"`
+}
+
+// severity returns the effective severity of a transition: that of its condition or
+// rule when it is set, and info when it clears.
+func (tr transition) severity() string {
+	if !tr.Active {
+		return "info"
+	}
+	return tr.Severity
+}
+
+// transitionTracker remembers the conditions of every target from the previous poll.
+type transitionTracker struct {
+	cfg   TransitionsConfig
+	rules []*rule
+
+	mu sync.Mutex // guards the snapshot against concurrent collection
+	transitionSnapshot
+}
+
+// transitionSnapshot is the part of the tracker that is persisted across restarts.
+type transitionSnapshot struct {
+	Conditions       map[string]map[string]bool `json:"conditions"`         // by target and condition
+	Pending          map[string]time.Time       `json:"pending"`            // when a rule's expression started to hold, by target and rule
+	LastPoll         map[string]time.Time       `json:"last_poll"`          // by target
+	Transfers        map[string]float64         `json:"transfers"`          // by target
+	OnBatterySeconds map[string]float64         `json:"on_battery_seconds"` // by target
+}
+
+var (
+	transfersDesc        = prometheus.NewDesc("ups_transfers_total", "Number of transfers to battery detected between polls.", []string{"target"}, nil)
+	onBatterySecondsDesc = prometheus.NewDesc("ups_on_battery_seconds_total", "Time spent on battery, accumulated between polls.", []string{"target"}, nil)
+)
+
+func (t *transitionTracker) Describe(ch chan<- *prometheus.Desc) {
+	ch <- transfersDesc
+	ch <- onBatterySecondsDesc
+}
+
+func (t *transitionTracker) Collect(ch chan<- prometheus.Metric) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for target, transfers := range t.Transfers {
+		ch <- prometheus.MustNewConstMetric(transfersDesc, prometheus.CounterValue, transfers, target)
+		ch <- prometheus.MustNewConstMetric(onBatterySecondsDesc, prometheus.CounterValue, t.OnBatterySeconds[target], target)
+	}
+}
+
+// update evaluates the conditions for the current poll and returns those that
+// changed. As with stateTracker, the first poll of a target only sets the baseline,
+// unless the state was restored from before a restart. It also counts the transfers
+// to battery and the time on battery; gaps of more than two intervals, such as the
+// exporter being down, count as two intervals at most.
+func (t *transitionTracker) update(now time.Time, targets []string, states map[string]map[string]float64) []transition {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.Conditions == nil {
+		t.Conditions = make(map[string]map[string]bool)
+	}
+	if t.LastPoll == nil {
+		t.LastPoll = make(map[string]time.Time)
+	}
+	if t.Transfers == nil {
+		t.Transfers = make(map[string]float64)
+	}
+	if t.OnBatterySeconds == nil {
+		t.OnBatterySeconds = make(map[string]float64)
+	}
+
+	var transitions []transition
+	for _, target := range targets {
+		state := states[target]
+		previous, seen := t.Conditions[target]
+		if !seen {
+			previous = make(map[string]bool)
+			t.Conditions[target] = previous
+		}
+		if previous["on_battery"] {
+			t.OnBatterySeconds[target] += min(now.Sub(t.LastPoll[target]), 2*t.cfg.Interval).Seconds()
+		}
+		t.LastPoll[target] = now
+		if _, ok := t.Transfers[target]; !ok {
+			t.Transfers[target] = 0
+		}
+
+		for _, c := range upsConditions {
+			active, ok := c.evaluate(t.cfg, state)
+			if trap, fromTrap := state[c.trapGauge]; fromTrap {
+				active, ok = trap == 1, true
+			}
+			if !ok {
+				continue
+			}
+			if was, had := previous[c.name]; seen && had && was != active {
+				tr := transition{Time: now, Target: target, Condition: c.name, Active: active, Severity: c.severity, From: c.clearedAs, To: c.setAs, Metrics: state}
+				if !active {
+					tr.From, tr.To = c.setAs, c.clearedAs
+				}
+				transitions = append(transitions, tr)
+				if c.name == "on_battery" && active {
+					t.Transfers[target]++
+				}
+			}
+			previous[c.name] = active
+		}
+		transitions = append(transitions, t.updateRules(now, target, state, previous, !seen)...)
+	}
+	return transitions
+}
+
+// transitionNotifier delivers a detected transition, for example to webhooks or by
+// email. Notifiers decide themselves which transitions they are interested in.
+type transitionNotifier func(ctx context.Context, tr transition) error
+
+// newWebhookNotifier posts every transition as JSON to the endpoints.
+func newWebhookNotifier(endpoints []WebhookEndpoint) transitionNotifier {
+	client := &http.Client{Timeout: 10 * time.Second}
+	return func(ctx context.Context, tr transition) error {
+		body, err := json.Marshal(tr)
+		if err != nil {
+			return err
+		}
+		var errs []error
+		for _, endpoint := range endpoints {
+			if err := postWebhook(ctx, client, endpoint, body); err != nil {
+				errs = append(errs, fmt.Errorf("webhook %s: %w", endpoint.URL, err))
+			}
+		}
+		return errors.Join(errs...)
+	}
+}
+
+func (cfg TransitionsConfig) withDefaults() TransitionsConfig {
+	if cfg.Interval <= 0 {
+		cfg.Interval = 15 * time.Second
+	}
+	if cfg.LowBatteryPercent <= 0 {
+		cfg.LowBatteryPercent = 25
+	}
+	if cfg.OverloadPercent <= 0 {
+		cfg.OverloadPercent = 100
+	}
+	if cfg.OnBatteryInputVolts <= 0 {
+		cfg.OnBatteryInputVolts = 1
+	}
+	return cfg
+}
+
+// runTransitions polls on every interval until the context is cancelled, adding an
+// event per detected transition and passing it to every notifier. With a state store,
+// the tracker and notification state are restored at startup and saved after every
+// poll. The metrics of the tracker are registered with reg. It returns immediately if
+// there are neither notifiers nor a state store.
+func runTransitions(ctx context.Context, cfg TransitionsConfig, gatherer prometheus.Gatherer, store *eventStore, notifiers []transitionNotifier, state *stateStore, reg prometheus.Registerer) {
+	if len(notifiers) == 0 && state == nil {
+		return
+	}
+	cfg = cfg.withDefaults()
+	gatherer = gatherWithin(gatherer, cfg.Interval)
+	tracker := &transitionTracker{cfg: cfg, rules: compileRules(cfg.Rules)}
+	gate := newNotificationGate(cfg.Notifications)
+	if state != nil {
+		if _, err := state.load("transitions", &tracker.transitionSnapshot); err != nil {
+			slog.Error("Error restoring the transition state", "err", err)
+		}
+		if _, err := state.load("notifications", &gate.states); err != nil || gate.states == nil {
+			gate.states = make(map[string]*notificationState)
+		}
+	}
+	reg.MustRegister(tracker, notificationsSuppressed)
+
+	slog.Info("Watching for state transitions", "interval", cfg.Interval)
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			samples, err := gatherSamples(gatherer, "ups_")
+			if err != nil {
+				slog.Error("Error gathering metrics for state transitions", "err", err)
+				continue
+			}
+			targets, states := samplesByTarget(samples)
+			for _, tr := range tracker.update(now, targets, states) {
+				store.add(ctx, []event{{
+					Time:     now,
+					Target:   tr.Target,
+					Source:   "transition",
+					Severity: tr.severity(),
+					Category: classifyEvent(tr.Condition),
+					Message:  fmt.Sprintf("%s: %s -> %s", tr.Condition, tr.From, tr.To),
+				}})
+
+				if message := gate.submit(tr); message != "" {
+					slog.Warn(message, "target", tr.Target)
+					store.add(ctx, []event{{Time: now, Target: tr.Target, Source: "transition", Severity: "warning", Category: classifyEvent(tr.Condition), Message: message}})
+				}
+			}
+			for _, tr := range gate.flush(now) {
+				for _, notify := range notifiers {
+					if err := notify(ctx, tr); err != nil {
+						slog.Error("Error notifying about a transition", "condition", tr.Condition, "target", tr.Target, "err", err)
+					}
+				}
+			}
+			if state != nil {
+				tracker.mu.Lock()
+				err := state.save("transitions", tracker.transitionSnapshot)
+				tracker.mu.Unlock()
+				if err == nil {
+					err = state.save("notifications", gate.states)
+				}
+				if err != nil {
+					slog.Error("Error saving the transition state", "err", err)
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
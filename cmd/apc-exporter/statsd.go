@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// maxStatsDPacketSize keeps UDP datagrams below a typical Ethernet MTU.
+const maxStatsDPacketSize = 1432
+
+// StatsDConfig holds the settings for emitting gauges to a StatsD/DogStatsD agent.
+type StatsDConfig struct {
+	Address  string        `yaml:"address"`
+	Protocol string        `yaml:"protocol"`
+	Prefix   string        `yaml:"prefix"`
+	Interval time.Duration `yaml:"interval"`
+	Tags     []string      `yaml:"tags"`
+}
+
+// runStatsD emits the UPS metrics as StatsD gauges on every interval until the
+// context is cancelled. It returns immediately if no StatsD address is configured.
+func runStatsD(ctx context.Context, cfg StatsDConfig, gatherer prometheus.Gatherer) {
+	if cfg.Address == "" {
+		return
+	}
+	if cfg.Protocol == "" {
+		cfg.Protocol = "udp"
+	}
+	if cfg.Protocol != "udp" && cfg.Protocol != "tcp" {
+		slog.Warn("StatsD output disabled: unsupported protocol", "protocol", cfg.Protocol)
+		return
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = 15 * time.Second
+	}
+	gatherer = gatherWithin(gatherer, cfg.Interval)
+
+	slog.Info("Emitting metrics to StatsD", "protocol", cfg.Protocol, "address", cfg.Address, "interval", cfg.Interval)
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := pushStatsD(cfg, gatherer); err != nil {
+				slog.Warn("Error emitting to StatsD", "err", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// pushStatsD gathers the UPS metrics once and writes them to the StatsD agent.
+func pushStatsD(cfg StatsDConfig, gatherer prometheus.Gatherer) error {
+	samples, err := gatherSamples(gatherer, "ups_")
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.DialTimeout(cfg.Protocol, cfg.Address, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+
+	var packet bytes.Buffer
+	for _, s := range samples {
+		line := formatStatsDGauge(cfg, s)
+
+		// UDP lines are batched into datagrams; TCP is a plain newline-delimited stream.
+		if cfg.Protocol == "udp" && packet.Len() > 0 && packet.Len()+len(line)+1 > maxStatsDPacketSize {
+			if _, err := conn.Write(packet.Bytes()); err != nil {
+				return err
+			}
+			packet.Reset()
+		}
+		if packet.Len() > 0 && cfg.Protocol == "udp" {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+		if cfg.Protocol == "tcp" {
+			packet.WriteByte('\n')
+		}
+	}
+	if packet.Len() > 0 {
+		if _, err := conn.Write(packet.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// formatStatsDGauge renders a sample as a DogStatsD gauge line, turning the
+// Prometheus labels and the configured static tags into DogStatsD tags.
+func formatStatsDGauge(cfg StatsDConfig, s sample) string {
+	name := s.Name
+	if cfg.Prefix != "" {
+		name = cfg.Prefix + "." + name
+	}
+
+	line := fmt.Sprintf("%s:%s|g", name, strconv.FormatFloat(s.Value, 'f', -1, 64))
+
+	tags := append([]string(nil), cfg.Tags...)
+	for _, label := range s.sortedLabelNames() {
+		tags = append(tags, label+":"+s.Labels[label])
+	}
+	if len(tags) > 0 {
+		line += "|#" + strings.Join(tags, ",")
+	}
+	return line
+}
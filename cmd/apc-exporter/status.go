@@ -0,0 +1,169 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// statusLines are the lines of the status command after the target and the status,
+// with the unit of each value.
+var statusLines = []struct {
+	label, metric, unit string
+}{
+	{"LOADPCT", "ups_load_percent", "%"},
+	{"LOADVA", "ups_load_power_percent_va", "% VA"},
+	{"LOADAMPS", "ups_load_current_amps", "A"},
+	{"BCHARGE", "ups_battery_charge_percent", "%"},
+	{"BATTV", "ups_battery_voltage_vdc", "V"},
+	{"LINEV", "ups_input_voltage_vac", "V"},
+	{"LINEFREQ", "ups_input_frequency_hz", "Hz"},
+	{"OUTPUTV", "ups_output_voltage_vac", "V"},
+	{"OUTFREQ", "ups_output_frequency_hz", "Hz"},
+	{"ITEMP", "ups_internal_temperature_celsius", "C"},
+}
+
+// runStatusCommand implements the status command: it scrapes the named target, or all
+// targets, once and prints their values as a table in the style of apcaccess. The
+// alarms are the built-in conditions and rules that hold, without their durations.
+func runStatusCommand(cfg Config, args []string) error {
+	flags := flag.NewFlagSet("status", flag.ContinueOnError)
+	name := flags.String("target", "", "Name or URL of the target to show (default all configured targets)")
+	username := flags.String("username", "", "Username to log in with instead of the configured one")
+	password := flags.String("password", "", "Password to log in with instead of the configured one")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	targets := cfg.targetConfigs()
+	if *name != "" || len(targets) == 1 {
+		target, err := findTarget(cfg, *name)
+		if err != nil {
+			return err
+		}
+		targets = []TargetConfig{target}
+	}
+
+	registry := prometheus.NewRegistry()
+	collectors := make([]*upsCollector, len(targets))
+	for i, target := range targets {
+		httpClient, err := newTargetHTTPClient(target)
+		if err != nil {
+			return err
+		}
+		if *username != "" {
+			target.Username = *username
+		}
+		if *password != "" {
+			target.Password = *password
+		}
+		if collectors[i], err = newUPSCollector(cfg, httpClient, target); err != nil {
+			return err
+		}
+		registry.MustRegister(collectors[i])
+	}
+	samples, err := gatherSamples(registry, "ups_")
+	if err != nil {
+		return err
+	}
+	_, states := samplesByTarget(samples)
+
+	transitions := cfg.Transitions.withDefaults()
+	rules := compileRules(transitions.Rules)
+	failed := 0
+	for i, c := range collectors {
+		if i > 0 {
+			fmt.Println()
+		}
+		if !c.Scraped() {
+			failed++
+			printStatus(os.Stdout, targets[i], nil, transitions, rules)
+			continue
+		}
+		printStatus(os.Stdout, targets[i], states[c.Target().Name], transitions, rules)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d targets could not be scraped", failed, len(collectors))
+	}
+	return nil
+}
+
+// printStatus prints the status table of one target. Without a state, the target
+// could not be scraped.
+func printStatus(w io.Writer, target TargetConfig, state map[string]float64, cfg TransitionsConfig, rules []*rule) {
+	line := func(label, format string, args ...any) {
+		fmt.Fprintf(w, "%-9s: %s\n", label, fmt.Sprintf(format, args...))
+	}
+	line("UPSNAME", "%s", target.Name)
+	line("URL", "%s", target.source())
+	if state == nil {
+		line("STATUS", "COMMLOST (the scrape failed, see the log)")
+		return
+	}
+
+	status, alarms := upsStatus(target, state, cfg, rules)
+	line("STATUS", "%s", status)
+	outlet := "OFF"
+	if state["ups_outlet_status"] == 1 {
+		outlet = "ON"
+	}
+	line("OUTLET", "%s", outlet)
+
+	runtime := state["ups_runtime_remaining_minutes"]
+	minutes := int(math.Round(runtime))
+	line("TIMELEFT", "%.1f Minutes (%dh %02dm)", runtime, minutes/60, minutes%60)
+	for _, l := range statusLines {
+		line(l.label, "%.1f %s", state[l.metric], l.unit)
+	}
+	if len(alarms) == 0 {
+		alarms = []string{"none"}
+	}
+	line("ALARMS", "%s", strings.Join(alarms, ", "))
+}
+
+// upsStatus returns the apcaccess status of a target, e.g. "ONBATT LOWBATT", and the
+// built-in conditions and rules that hold.
+func upsStatus(target TargetConfig, state map[string]float64, cfg TransitionsConfig, rules []*rule) (string, []string) {
+	env := make(map[string]float64, len(state)+len(upsConditions))
+	var alarms []string
+	for k, v := range state {
+		env[k] = v
+	}
+	for _, c := range upsConditions {
+		active, ok := c.evaluate(cfg, state)
+		env[c.name] = 0
+		if ok && active {
+			env[c.name] = 1
+			alarms = append(alarms, c.name)
+		}
+	}
+	for _, r := range rules {
+		if len(r.Targets) > 0 && !slices.Contains(r.Targets, target.Name) {
+			continue
+		}
+		if firing, err := evalBool(r.expr, env); err == nil && firing {
+			alarms = append(alarms, r.Name)
+		}
+	}
+
+	status := "ONLINE"
+	switch {
+	case state["ups_device_status_up"] != 1:
+		status = "NOT ONLINE"
+	case env["on_battery"] == 1:
+		status = "ONBATT"
+	}
+	if env["low_battery"] == 1 {
+		status += " LOWBATT"
+	}
+	if env["overload"] == 1 {
+		status += " OVERLOAD"
+	}
+	return status, alarms
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// defaultStoragePath is the state directory systemd creates for units with
+// StateDirectory=, if any.
+func defaultStoragePath() string {
+	dir, _, _ := strings.Cut(os.Getenv("STATE_DIRECTORY"), ":")
+	return dir
+}
+
+// useStoragePath keeps all persisted state in dir, so the rest of the file system can
+// be read-only: the state store is enabled by default, remote write buffers on disk,
+// and relative paths in the config are taken relative to dir. Nothing changes if dir
+// is empty.
+func useStoragePath(dir string, cfg *Config) error {
+	if dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	if cfg.State.Path == "" {
+		cfg.State.Path = "state.db"
+	}
+	if cfg.RemoteWrite.URL != "" && cfg.RemoteWrite.BufferPath == "" {
+		cfg.RemoteWrite.BufferPath = "remote_write.db"
+	}
+	for _, path := range []*string{&cfg.State.Path, &cfg.History.Path, &cfg.RemoteWrite.BufferPath, &cfg.FileOutput.Path, &cfg.Control.AuditLog} {
+		if *path != "" && !filepath.IsAbs(*path) {
+			*path = filepath.Join(dir, *path)
+		}
+	}
+	slog.Info("Keeping state", "path", dir)
+	return nil
+}
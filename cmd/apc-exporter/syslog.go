@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// SyslogConfig holds the settings for the built-in syslog listener.
+type SyslogConfig struct {
+	ListenAddress string `yaml:"listen_address"`
+}
+
+// syslogSeverities are the RFC 5424 severity keywords, indexed by severity code.
+var syslogSeverities = []string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+
+var syslogMessages = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "ups_syslog_messages_total",
+	Help: "Number of syslog messages received from the card, by syslog severity.",
+}, []string{"target", "severity"})
+
+// runSyslog receives syslog messages over UDP until the context is cancelled and adds
+// each one as an event of the target it was sent from, counting them in a metric
+// registered with reg. It returns immediately if no listen address is configured.
+func runSyslog(ctx context.Context, cfg SyslogConfig, resolver *targetResolver, store *eventStore, reg prometheus.Registerer) {
+	if cfg.ListenAddress == "" {
+		return
+	}
+	conn, err := listenPacket(cfg.ListenAddress)
+	if err != nil {
+		slog.Warn("Syslog listener disabled", "err", err)
+		return
+	}
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	reg.MustRegister(syslogMessages)
+
+	slog.Info("Listening for syslog messages", "address", conn.LocalAddr().String())
+	buf := make([]byte, 8192)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.Error("Syslog listener stopped", "err", err)
+			}
+			return
+		}
+		target := resolver.lookup(addr.(*net.UDPAddr).IP)
+		e, severity, ok := parseSyslog(string(buf[:n]), target, time.Now())
+		if !ok {
+			continue
+		}
+		syslogMessages.WithLabelValues(target, severity).Inc()
+		store.add(ctx, []event{e})
+	}
+}
+
+// parseSyslog parses an RFC 5424 or RFC 3164 (BSD) message into an event and returns
+// the syslog severity keyword alongside. BSD timestamps lack year and zone, so they
+// are replaced by the time of receipt.
+func parseSyslog(line, target string, now time.Time) (event, string, bool) {
+	line = strings.TrimRight(line, "\r\n\x00")
+	if !strings.HasPrefix(line, "<") {
+		return event{}, "", false
+	}
+	end := strings.IndexByte(line, '>')
+	if end < 2 || end > 4 {
+		return event{}, "", false
+	}
+	pri, err := strconv.Atoi(line[1:end])
+	if err != nil || pri > 191 {
+		return event{}, "", false
+	}
+	severity := syslogSeverities[pri%8]
+	rest := line[end+1:]
+
+	e := event{Time: now, Target: target, Source: "syslog", Raw: rest}
+	switch {
+	case strings.HasPrefix(rest, "1 "):
+		// VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA MSG
+		fields := strings.SplitN(rest, " ", 7)
+		if len(fields) < 7 {
+			return event{}, "", false
+		}
+		if t, err := time.Parse(time.RFC3339Nano, fields[1]); err == nil {
+			e.Time = t
+		}
+		e.Message = skipStructuredData(fields[6])
+	case len(rest) > 16 && isBSDTimestamp(rest[:15]):
+		// TIMESTAMP HOSTNAME MSG
+		msg := rest[16:]
+		if i := strings.IndexByte(msg, ' '); i >= 0 {
+			msg = msg[i+1:]
+		}
+		e.Message = msg
+	default:
+		e.Message = rest
+	}
+	e.Message = strings.TrimSpace(strings.TrimPrefix(e.Message, "\ufeff"))
+
+	switch {
+	case pri%8 <= 3:
+		e.Severity = "critical"
+	case pri%8 == 4:
+		e.Severity = "warning"
+	default:
+		e.Severity = "info"
+	}
+	e.Category = classifyEvent(e.Message)
+	return e, severity, true
+}
+
+func isBSDTimestamp(s string) bool {
+	_, err := time.Parse(time.Stamp, s)
+	return err == nil
+}
+
+// skipStructuredData strips the RFC 5424 STRUCTURED-DATA ("-" or [...] elements)
+// from the front of the remainder of a message.
+func skipStructuredData(s string) string {
+	if strings.HasPrefix(s, "-") {
+		return strings.TrimPrefix(s[1:], " ")
+	}
+	for strings.HasPrefix(s, "[") {
+		end := structuredDataEnd(s)
+		if end < 0 {
+			return ""
+		}
+		s = s[end+1:]
+	}
+	return strings.TrimPrefix(s, " ")
+}
+
+// structuredDataEnd returns the index of the "]" closing the SD-ELEMENT at the start
+// of s, honouring quoted and escaped parameter values, or -1 if it is not closed.
+func structuredDataEnd(s string) int {
+	escaped, quoted := false, false
+	for i := 1; i < len(s); i++ {
+		switch {
+		case escaped:
+			escaped = false
+		case s[i] == '\\':
+			escaped = true
+		case s[i] == '"':
+			quoted = !quoted
+		case s[i] == ']' && !quoted:
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// textfileName is the file written into the node_exporter textfile directory.
+const textfileName = "apc_exporter.prom"
+
+// runTextfile writes the UPS metrics atomically into dir for node_exporter's textfile
+// collector on every interval until the context is cancelled.
+func runTextfile(ctx context.Context, dir string, interval time.Duration, gatherer prometheus.Gatherer) {
+	if dir == "" {
+		return
+	}
+
+	// Only the UPS metrics are written; node_exporter exposes its own go_* and
+	// process_* metrics and would reject the duplicates.
+	upsGatherer := prefixGatherer(gatherWithin(gatherer, interval), "ups_")
+	filename := filepath.Join(dir, textfileName)
+
+	slog.Info("Writing textfile metrics", "path", filename, "interval", interval)
+	write := func() {
+		if err := prometheus.WriteToTextfile(filename, upsGatherer); err != nil {
+			slog.Error("Error writing textfile metrics", "path", filename, "err", err)
+		}
+	}
+
+	write()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			write()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// prefixGatherer returns a Gatherer that only yields the metric families of g whose
+// name starts with prefix.
+func prefixGatherer(g prometheus.Gatherer, prefix string) prometheus.Gatherer {
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		mfs, err := g.Gather()
+		filtered := mfs[:0]
+		for _, mf := range mfs {
+			if strings.HasPrefix(mf.GetName(), prefix) {
+				filtered = append(filtered, mf)
+			}
+		}
+		return filtered, err
+	})
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"os"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// defaultScrapeTimeout bounds the scrape of a target without scrape_timeout.
+const defaultScrapeTimeout = 30 * time.Second
+
+// scrapeTimeout returns how long a scrape of the target may take.
+func (t TargetConfig) scrapeTimeout() time.Duration {
+	if t.ScrapeTimeout > 0 {
+		return t.ScrapeTimeout
+	}
+	return defaultScrapeTimeout
+}
+
+// tlsConfig returns the TLS settings for the card of a target, or nil if it has none.
+func (t TargetConfig) tlsConfig() (*tls.Config, error) {
+	if !t.InsecureSkipVerify && t.CAFile == "" && t.CertFile == "" && t.KeyFile == "" {
+		return nil, nil
+	}
+	cfg := &tls.Config{InsecureSkipVerify: t.InsecureSkipVerify}
+	if t.CAFile != "" {
+		ca, err := os.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("ca_file: %w", err)
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("ca_file: no certificates in %s", t.CAFile)
+		}
+	}
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		return nil, errors.New("cert_file and key_file must be given together")
+	}
+	if t.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// newTargetHTTPClient returns an HTTP client for the card of a target, with a cookie
+// jar of its own for the session, the target's TLS settings, and its scrape timeout
+// as the limit of every request, for those made outside of scrapes as well.
+func newTargetHTTPClient(target TargetConfig) (*http.Client, error) {
+	jar, err := cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List})
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := target.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if tlsConfig != nil {
+		transport.TLSClientConfig = tlsConfig
+	}
+	return &http.Client{Jar: jar, Transport: transport, Timeout: target.scrapeTimeout()}, nil
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// TrapReceiverConfig holds the settings for the SNMP trap listener. Traps are accepted
+// only with the community, if set, and only from the allowed sources, addresses or
+// CIDR ranges, if any.
+type TrapReceiverConfig struct {
+	ListenAddress  string   `yaml:"listen_address"`
+	Community      string   `yaml:"community"`
+	AllowedSources []string `yaml:"allowed_sources"`
+}
+
+// allowedSources parses the allowed sources.
+func (c TrapReceiverConfig) allowedSources() ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, source := range c.AllowedSources {
+		if addr, err := netip.ParseAddr(source); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(source)
+		if err != nil {
+			return nil, fmt.Errorf("snmp_traps.allowed_sources: %q is neither an address nor a CIDR range", source)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// check requires an enabled receiver to have a community or allowed sources, as
+// anyone who can reach it could otherwise raise conditions such as ups_on_battery.
+func (c TrapReceiverConfig) check() error {
+	if c.ListenAddress == "" {
+		return nil
+	}
+	if c.Community == "" && len(c.AllowedSources) == 0 {
+		return errors.New("snmp_traps: community or allowed_sources must be set, so that only the cards can send traps")
+	}
+	_, err := c.allowedSources()
+	return err
+}
+
+// powerNetTrap describes a PowerNet-MIB trap. A condition, if set, is raised or
+// cleared by the trap.
+type powerNetTrap struct {
+	name      string
+	severity  string
+	condition string
+	active    bool
+}
+
+// powerNetTraps maps the specific trap numbers of the APC enterprise (318) to their
+// meaning.
+var powerNetTraps = map[int]powerNetTrap{
+	1:  {"communicationLost", "critical", "communication_lost", true},
+	2:  {"upsOverload", "critical", "overload", true},
+	3:  {"upsDiagnosticsFailed", "critical", "", false},
+	4:  {"upsDischarged", "critical", "", false},
+	5:  {"upsOnBattery", "warning", "on_battery", true},
+	6:  {"smartBoostOn", "warning", "", false},
+	7:  {"lowBattery", "critical", "low_battery", true},
+	8:  {"communicationEstablished", "info", "communication_lost", false},
+	9:  {"powerRestored", "info", "on_battery", false},
+	10: {"upsDiagnosticsPassed", "info", "", false},
+	11: {"returnFromLowBattery", "info", "low_battery", false},
+	12: {"upsTurnedOff", "warning", "", false},
+	13: {"upsSleeping", "warning", "", false},
+	14: {"upsWokeUp", "info", "", false},
+	15: {"upsRebootStarted", "warning", "", false},
+	17: {"upsBatteryNeedsReplacement", "warning", "replace_battery", true},
+	23: {"smartAvrReducing", "warning", "", false},
+	24: {"smartAvrReducingOff", "info", "", false},
+	25: {"upsBatteryReplaced", "info", "replace_battery", false},
+	26: {"calibrationStart", "info", "", false},
+	27: {"calibrationStop", "info", "", false},
+	60: {"upsOverloadCleared", "info", "overload", false},
+}
+
+var (
+	powerNetEnterprise = mustParseOID("1.3.6.1.4.1.318")
+	snmpTrapOIDOID     = mustParseOID("1.3.6.1.6.3.1.1.4.1.0")
+)
+
+// Trap-driven metrics, updated as soon as a trap arrives rather than on the next poll.
+var (
+	trapConditions = map[string]*prometheus.GaugeVec{
+		"on_battery":         trapConditionGauge("ups_on_battery", "Whether the UPS reported running on battery (1) or restored input power (0) by SNMP trap."),
+		"low_battery":        trapConditionGauge("ups_low_battery", "Whether the UPS reported a low battery (1) or its recovery (0) by SNMP trap."),
+		"communication_lost": trapConditionGauge("ups_communication_lost", "Whether the card reported losing (1) or re-establishing (0) communication with the UPS by SNMP trap."),
+		"overload":           trapConditionGauge("ups_overload", "Whether the UPS reported an overload (1) or its clearing (0) by SNMP trap."),
+		"replace_battery":    trapConditionGauge("ups_battery_replacement_needed", "Whether the UPS reported that its battery needs replacing (1) or was replaced (0) by SNMP trap."),
+	}
+	trapsReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "ups_traps_received_total",
+		Help: "Number of PowerNet SNMP traps received, by trap name.",
+	}, []string{"target", "trap"})
+)
+
+// trapConditionValues mirrors the trap-driven gauges by target and condition, so they
+// can be persisted and restored across restarts.
+var (
+	trapConditionMu     sync.Mutex
+	trapConditionValues = make(map[string]map[string]float64)
+)
+
+func setTrapCondition(target, condition string, value float64) {
+	trapConditionMu.Lock()
+	defer trapConditionMu.Unlock()
+	if trapConditionValues[target] == nil {
+		trapConditionValues[target] = make(map[string]float64)
+	}
+	trapConditionValues[target][condition] = value
+	trapConditions[condition].WithLabelValues(target).Set(value)
+}
+
+func trapConditionGauge(name, help string) *prometheus.GaugeVec {
+	return prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name, Help: help}, []string{"target"})
+}
+
+// runTrapReceiver listens for SNMP v1/v2c traps and informs until the context is
+// cancelled, updating the trap-driven metrics and adding an event per PowerNet trap.
+// With a state store, the trap-driven metrics are restored at startup and saved after
+// every trap, since the cards do not repeat them. The metrics are registered with reg.
+// It returns immediately if no listen address is configured.
+func runTrapReceiver(ctx context.Context, cfg TrapReceiverConfig, resolver *targetResolver, store *eventStore, state *stateStore, reg prometheus.Registerer) {
+	if cfg.ListenAddress == "" {
+		return
+	}
+	allowed, err := cfg.allowedSources()
+	if err != nil {
+		slog.Warn("SNMP trap receiver disabled", "err", err)
+		return
+	}
+	conn, err := listenPacket(cfg.ListenAddress)
+	if err != nil {
+		slog.Warn("SNMP trap receiver disabled", "err", err)
+		return
+	}
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	for _, gauge := range trapConditions {
+		reg.MustRegister(gauge)
+	}
+	reg.MustRegister(trapsReceived)
+	if state != nil {
+		var restored map[string]map[string]float64
+		if _, err := state.load("traps", &restored); err != nil {
+			slog.Error("Error restoring the trap state", "err", err)
+		}
+		for target, conditions := range restored {
+			for condition, value := range conditions {
+				if _, ok := trapConditions[condition]; ok {
+					setTrapCondition(target, condition, value)
+				}
+			}
+		}
+	}
+
+	slog.Info("Listening for SNMP traps", "address", conn.LocalAddr().String())
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.Error("SNMP trap receiver stopped", "err", err)
+			}
+			return
+		}
+		from := addr.(*net.UDPAddr).AddrPort().Addr().Unmap()
+		if len(allowed) > 0 && !slices.ContainsFunc(allowed, func(p netip.Prefix) bool { return p.Contains(from) }) {
+			continue
+		}
+		msg, err := unmarshalSNMPMessage(buf[:n])
+		if err != nil || (cfg.Community != "" && msg.Community != cfg.Community) {
+			continue
+		}
+
+		switch msg.PDU.Type {
+		case snmpTrapV1, snmpTrapV2:
+		case snmpInformRequest:
+			// Informs must be acknowledged with a response echoing the var binds.
+			ack := &snmpMessage{Version: msg.Version, Community: msg.Community, PDU: snmpPDU{
+				Type: snmpGetResponse, RequestID: msg.PDU.RequestID, VarBinds: msg.PDU.VarBinds,
+			}}
+			if data, err := ack.Marshal(); err == nil {
+				conn.WriteTo(data, addr)
+			}
+		default:
+			continue
+		}
+
+		source := addr.(*net.UDPAddr).IP
+		if msg.PDU.Type == snmpTrapV1 && len(msg.PDU.AgentAddr) == 4 && !msg.PDU.AgentAddr.IsUnspecified() {
+			source = msg.PDU.AgentAddr
+		}
+		if e, ok := decodePowerNetTrap(&msg.PDU, resolver.lookup(source), time.Now()); ok {
+			store.add(ctx, []event{e})
+			if state != nil {
+				trapConditionMu.Lock()
+				err := state.save("traps", trapConditionValues)
+				trapConditionMu.Unlock()
+				if err != nil {
+					slog.Error("Error saving the trap state", "err", err)
+				}
+			}
+		}
+	}
+}
+
+// decodePowerNetTrap turns a PowerNet trap into an event and applies its condition
+// to the trap-driven metrics. Traps from other enterprises are ignored.
+func decodePowerNetTrap(pdu *snmpPDU, target string, now time.Time) (event, bool) {
+	specific := -1
+	if pdu.Type == snmpTrapV1 {
+		if pdu.Enterprise.HasPrefix(powerNetEnterprise) && pdu.GenericTrap == 6 {
+			specific = pdu.SpecificTrap
+		}
+	} else {
+		// SNMPv2 notification OIDs of v1 traps are <enterprise>.0.<specific>.
+		for _, vb := range pdu.VarBinds {
+			if vb.OID.Compare(snmpTrapOIDOID) != 0 {
+				continue
+			}
+			if oid, ok := vb.Value.(snmpOID); ok && oid.HasPrefix(powerNetEnterprise.Append(0)) && len(oid) == len(powerNetEnterprise)+2 {
+				specific = int(oid[len(oid)-1])
+			}
+		}
+	}
+	if specific < 0 {
+		return event{}, false
+	}
+
+	trap, known := powerNetTraps[specific]
+	if !known {
+		trap = powerNetTrap{name: fmt.Sprintf("powerNetTrap%d", specific), severity: "info"}
+	}
+	trapsReceived.WithLabelValues(target, trap.name).Inc()
+	if trap.condition != "" {
+		value := 0.0
+		if trap.active {
+			value = 1
+		}
+		setTrapCondition(target, trap.condition, value)
+	}
+
+	// The cards describe the event in a string var bind (mtrapargsString).
+	message := trap.name
+	for _, vb := range pdu.VarBinds {
+		if text, ok := vb.Value.([]byte); ok && vb.Type == snmpOctetString && len(text) > 0 {
+			message = strings.TrimSpace(string(text))
+			break
+		}
+	}
+
+	return event{
+		Time:     now,
+		Target:   target,
+		Source:   "trap",
+		Severity: trap.severity,
+		Category: classifyEvent(trap.name + " " + message),
+		Message:  message,
+		Raw:      trap.name + ": " + message,
+	}, true
+}
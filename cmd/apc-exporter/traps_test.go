@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+// TestTrapReceiverConfigCheck checks that an enabled receiver needs a community or
+// valid allowed sources.
+func TestTrapReceiverConfigCheck(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		cfg  TrapReceiverConfig
+		ok   bool
+	}{
+		{"disabled", TrapReceiverConfig{}, true},
+		{"open", TrapReceiverConfig{ListenAddress: ":1162"}, false},
+		{"community", TrapReceiverConfig{ListenAddress: ":1162", Community: "public"}, true},
+		{"allowed sources", TrapReceiverConfig{ListenAddress: ":1162", AllowedSources: []string{"10.0.0.11", "10.0.1.0/24", "fd00::/64"}}, true},
+		{"invalid source", TrapReceiverConfig{ListenAddress: ":1162", AllowedSources: []string{"ups-rack-a.example.com"}}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.cfg.check(); (err == nil) != tc.ok {
+				t.Errorf("check() = %v, want ok %v", err, tc.ok)
+			}
+		})
+	}
+
+	cfg := TrapReceiverConfig{AllowedSources: []string{"10.0.0.11", "10.0.1.7/24"}}
+	allowed, err := cfg.allowedSources()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []netip.Prefix{netip.MustParsePrefix("10.0.0.11/32"), netip.MustParsePrefix("10.0.1.0/24")}
+	if !slices.Equal(allowed, want) {
+		t.Errorf("allowed sources %v, want %v", allowed, want)
+	}
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// upgradeEnv names the file descriptor on which a process started for a hot upgrade
+// tells the old one that it listens, so the old one can shut down.
+const upgradeEnv = "APC_EXPORTER_UPGRADE_FD"
+
+// dbLockTimeout is how long to wait for the lock of a database: of a bolt database to
+// open it, and of the SQLite history database to write. During a hot upgrade the old
+// process holds them until it has shut down.
+var dbLockTimeout = 5 * time.Second
+
+// upgrading reports whether this process was started by another for a hot upgrade.
+func upgrading() bool {
+	return os.Getenv(upgradeEnv) != ""
+}
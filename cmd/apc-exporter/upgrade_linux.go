@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// reusePort lets the old and the new process of a hot upgrade bind the same ports.
+var reusePort = net.ListenConfig{
+	Control: func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			sockErr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	},
+}
+
+// listen binds a TCP listener with SO_REUSEPORT.
+func listen(address string) (net.Listener, error) {
+	return reusePort.Listen(context.Background(), "tcp", address)
+}
+
+// listenPacket binds a UDP socket with SO_REUSEPORT.
+func listenPacket(address string) (net.PacketConn, error) {
+	return reusePort.ListenPacket(context.Background(), "udp", address)
+}
+
+// upgradeSignals receives SIGUSR2, which starts a hot upgrade.
+func upgradeSignals() <-chan os.Signal {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGUSR2)
+	return c
+}
+
+// startUpgrade starts the executable, as now found on disk, with the same arguments
+// and waits until it listens. The caller then shuts down; if the new process fails to
+// start, it is killed and the caller keeps running.
+func startUpgrade() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = []*os.File{w}
+	// The new process pets the systemd watchdog once it is the main process.
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, "WATCHDOG_PID=") {
+			cmd.Env = append(cmd.Env, kv)
+		}
+	}
+	cmd.Env = append(cmd.Env, upgradeEnv+"=3")
+	err = cmd.Start()
+	w.Close()
+	if err != nil {
+		return err
+	}
+	go cmd.Wait()
+
+	ready := make(chan error, 1)
+	go func() {
+		_, err := r.Read(make([]byte, 1))
+		ready <- err
+	}()
+	select {
+	case err = <-ready:
+	case <-time.After(time.Minute):
+		err = fmt.Errorf("not listening after a minute")
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		return fmt.Errorf("new process %d: %w", cmd.Process.Pid, err)
+	}
+	slog.Info("New process took over, shutting down", "pid", cmd.Process.Pid)
+	return nil
+}
+
+// upgradeReady tells the old process of a hot upgrade that this one listens, after
+// telling systemd that this is the main process now.
+func upgradeReady() {
+	fd, err := strconv.Atoi(os.Getenv(upgradeEnv))
+	if err != nil {
+		return
+	}
+	os.Unsetenv(upgradeEnv)
+	if err := sdNotify(fmt.Sprintf("MAINPID=%d", os.Getpid())); err != nil {
+		slog.Warn("Error notifying systemd", "err", err)
+	}
+	f := os.NewFile(uintptr(fd), "upgrade")
+	f.Write([]byte{1})
+	f.Close()
+}
@@ -0,0 +1,28 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+)
+
+func listen(address string) (net.Listener, error) {
+	return net.Listen("tcp", address)
+}
+
+func listenPacket(address string) (net.PacketConn, error) {
+	return net.ListenPacket("udp", address)
+}
+
+// upgradeSignals returns nil: hot upgrades are only supported on Linux.
+func upgradeSignals() <-chan os.Signal {
+	return nil
+}
+
+func startUpgrade() error {
+	return errors.New("hot upgrades are only supported on Linux")
+}
+
+func upgradeReady() {}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Build metadata, set when building a release:
+//
+//	go build -ldflags "-X main.version=1.2.0 -X main.commit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// Without them, the module version and the VCS information Go records are used.
+var (
+	version   = ""
+	commit    = ""
+	buildDate = ""
+)
+
+// buildInfo fills in the build metadata that was not set with -ldflags.
+func buildInfo() (v, rev, date string) {
+	v, rev, date = version, commit, buildDate
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if v == "" && info.Main.Version != "" {
+			v = info.Main.Version
+		}
+		for _, s := range info.Settings {
+			switch {
+			case s.Key == "vcs.revision" && rev == "":
+				rev = s.Value
+			case s.Key == "vcs.time" && date == "":
+				date = s.Value
+			case s.Key == "vcs.modified" && s.Value == "true" && commit == "":
+				rev += "-dirty"
+			}
+		}
+	}
+	if v == "" {
+		v = "(devel)"
+	}
+	if rev == "" {
+		rev = "unknown"
+	}
+	if date == "" {
+		date = "unknown"
+	}
+	return v, rev, date
+}
+
+// versionString describes the build in one line, for the version command and the log.
+func versionString() string {
+	v, rev, date := buildInfo()
+	return fmt.Sprintf("apc-exporter %s (commit %s, built %s, %s %s/%s)", v, rev, date, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+}
+
+// newBuildInfoGauge exports the build metadata as labels of a constant 1.
+func newBuildInfoGauge() prometheus.Gauge {
+	v, rev, date := buildInfo()
+	g := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "apc_exporter_build_info",
+		Help: "A metric with a constant '1' value labeled by the version, commit, build date and Go version the exporter was built from.",
+		ConstLabels: prometheus.Labels{
+			"version":   v,
+			"revision":  rev,
+			"builddate": date,
+			"goversion": runtime.Version(),
+		},
+	})
+	g.Set(1)
+	return g
+}
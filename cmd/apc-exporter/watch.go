@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// watchChangesShown bounds the changes listed below the status table.
+const watchChangesShown = 10
+
+// runWatchCommand implements the watch command: it scrapes one target on an interval
+// and redraws its status table in the terminal, like apcaccess in a loop, with the
+// time of the last status change and a list of the recent changes, until interrupted.
+// The log is kept off the screen; the last line logged is shown when a scrape fails.
+func runWatchCommand(cfg Config, args []string) error {
+	flags := flag.NewFlagSet("watch", flag.ContinueOnError)
+	name := flags.String("target", "", "Name or URL of the target to watch (default the only configured target)")
+	username := flags.String("username", "", "Username to log in with instead of the configured one")
+	password := flags.String("password", "", "Password to log in with instead of the configured one")
+	interval := flags.Duration("interval", 5*time.Second, "Time between scrapes")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *interval <= 0 {
+		return fmt.Errorf("-interval must be positive, got %s", *interval)
+	}
+	target, err := commandTarget(cfg, *name, *username, *password)
+	if err != nil {
+		return err
+	}
+
+	httpClient, err := newTargetHTTPClient(target)
+	if err != nil {
+		return err
+	}
+	collector, err := newUPSCollector(cfg, httpClient, target)
+	if err != nil {
+		return err
+	}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(collector)
+	transitions := cfg.Transitions.withDefaults()
+	rules := compileRules(transitions.Rules)
+
+	lastLog := &lastLineWriter{}
+	setLogOutput(lastLog)
+	defer setLogOutput(os.Stderr)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+
+	var (
+		status          string
+		alarms, changes []string
+		sinceTime       time.Time
+	)
+	for {
+		samples, err := gatherSamples(registry, "ups_")
+		now := time.Now()
+		var state map[string]float64
+		newStatus, newAlarms := "COMMLOST", []string(nil)
+		if err == nil && collector.Scraped() {
+			_, states := samplesByTarget(samples)
+			state = states[target.Name]
+			newStatus, newAlarms = upsStatus(target, state, transitions, rules)
+		}
+
+		// What holds at the first scrape is the starting point, not a change.
+		if status != "" {
+			change := func(format string, args ...any) {
+				changes = append(changes, now.Format(time.TimeOnly)+"  "+fmt.Sprintf(format, args...))
+			}
+			if newStatus != status {
+				change("%s -> %s", status, newStatus)
+			}
+			for _, a := range newAlarms {
+				if !slices.Contains(alarms, a) {
+					change("%s raised", a)
+				}
+			}
+			for _, a := range alarms {
+				if !slices.Contains(newAlarms, a) {
+					change("%s cleared", a)
+				}
+			}
+		}
+		if newStatus != status {
+			status, sinceTime = newStatus, now
+		}
+		alarms = newAlarms
+		if len(changes) > watchChangesShown {
+			changes = changes[len(changes)-watchChangesShown:]
+		}
+		since := fmt.Sprintf("%s since %s (%s)", status, sinceTime.Format(time.TimeOnly), now.Sub(sinceTime).Truncate(time.Second))
+
+		var screen bytes.Buffer
+		// Move the cursor home and clear the screen before every redraw.
+		screen.WriteString("\033[H\033[2J")
+		fmt.Fprintf(&screen, "Every %s: %s    %s\n\n", *interval, target.Name, now.Format(time.DateTime))
+		printStatus(&screen, target, state, transitions, rules)
+		if state == nil {
+			fmt.Fprintf(&screen, "%-9s: %s\n", "LASTLOG", lastLog.String())
+		}
+		fmt.Fprintf(&screen, "\n%s\n", since)
+		if len(changes) > 0 {
+			screen.WriteString("\nChanges:\n")
+			for _, c := range changes {
+				fmt.Fprintf(&screen, "  %s\n", c)
+			}
+		}
+		screen.WriteString("\nPress Ctrl-C to quit.\n")
+		os.Stdout.Write(screen.Bytes())
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// lastLineWriter keeps the last line written to it, to show the log without letting
+// it scroll the screen.
+type lastLineWriter struct {
+	mu   sync.Mutex
+	line string
+}
+
+func (w *lastLineWriter) Write(p []byte) (int, error) {
+	if line := strings.TrimSpace(string(p)); line != "" {
+		w.mu.Lock()
+		w.line = line
+		w.mu.Unlock()
+	}
+	return len(p), nil
+}
+
+func (w *lastLineWriter) String() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.line
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/exporter-toolkit/web"
+)
+
+// defaultListenAddress is where the exporter serves HTTP without -web.listen-address.
+const defaultListenAddress = ":8000"
+
+var (
+	// listenAddress is the address the exporter serves HTTP on, set by -web.listen-address.
+	listenAddress = defaultListenAddress
+	// webConfigFile is the exporter-toolkit web config file enabling TLS and basic auth,
+	// set by -web.config.file.
+	webConfigFile string
+)
+
+// listenPort returns the port of the listen address with its colon, e.g. ":8000".
+func listenPort() string {
+	_, port, err := net.SplitHostPort(listenAddress)
+	if err != nil {
+		return defaultListenAddress
+	}
+	return ":" + port
+}
+
+// newLandingPage returns the page served on /, linking to the metrics and health check.
+func newLandingPage() (http.Handler, error) {
+	v, _, _ := buildInfo()
+	return web.NewLandingPage(web.LandingConfig{
+		Name:        "APC Exporter",
+		Description: "Prometheus exporter for APC UPS network management cards",
+		Version:     v,
+		Profiling:   "false",
+		Links: []web.LandingLinks{
+			{Address: "metrics", Text: "Metrics"},
+			{Address: "healthz", Text: "Health check"},
+		},
+	})
+}
+
+// webServerShutdownTimeout is how long a server replaced on a reload may take to finish
+// its requests.
+const webServerShutdownTimeout = time.Minute
+
+// webServer serves HTTP on the listener, with TLS and basic auth as the web config file
+// asks for. The file is re-read on every new connection and request, so rotated
+// certificates and changed users apply at once. Other changes, such as TLS switched on
+// or off, apply on a reload of the config: a new server then takes over the socket and
+// the old one is lame-ducked, finishing the requests it has accepted, so no connection
+// is dropped and no scrape misses.
+type webServer struct {
+	handler  http.Handler
+	listener net.Listener
+
+	mu        sync.Mutex
+	server    *http.Server
+	webConfig []byte // the web config file the server was started with
+}
+
+// start serves HTTP on the listener in the background.
+func (w *webServer) start() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	webConfig, err := readWebConfig()
+	if err != nil {
+		return err
+	}
+	w.serve(w.listener, webConfig)
+	return nil
+}
+
+// serve starts a server on the listener. w.mu must be held.
+func (w *webServer) serve(listener net.Listener, webConfig []byte) {
+	server := &http.Server{Handler: w.handler, ErrorLog: slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn)}
+	w.server, w.webConfig = server, webConfig
+	go func() {
+		if err := serveWeb(server, listener); err != nil && err != http.ErrServerClosed {
+			fatal("Could not start server", "err", err)
+		}
+	}()
+}
+
+// reload starts a new server if the web config file changed and is valid, and shuts
+// the old one down gracefully once the new one listens on a duplicate of its socket.
+func (w *webServer) reload() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	webConfig, err := readWebConfig()
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(webConfig, w.webConfig) {
+		return nil
+	}
+	if err := web.Validate(webConfigFile); err != nil {
+		return fmt.Errorf("web config file: %w", err)
+	}
+	file, ok := w.listener.(interface{ File() (*os.File, error) })
+	if !ok {
+		return fmt.Errorf("web config file: the listener cannot be handed over, restart to apply the changes")
+	}
+	f, err := file.File()
+	if err != nil {
+		return fmt.Errorf("web config file: handing over the listener: %w", err)
+	}
+	listener, err := net.FileListener(f)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("web config file: handing over the listener: %w", err)
+	}
+
+	old := w.server
+	w.listener = listener
+	w.serve(listener, webConfig)
+	slog.Info("Restarted the HTTP server with the changed web config file", "path", webConfigFile)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), webServerShutdownTimeout)
+		defer cancel()
+		if err := old.Shutdown(ctx); err != nil {
+			slog.Warn("Error shutting down the replaced HTTP server", "err", err)
+		}
+	}()
+	return nil
+}
+
+// shutdown stops the server, letting running requests finish until ctx is done.
+func (w *webServer) shutdown(ctx context.Context) error {
+	w.mu.Lock()
+	server := w.server
+	w.mu.Unlock()
+	return server.Shutdown(ctx)
+}
+
+// readWebConfig returns the contents of the web config file, if any.
+func readWebConfig() ([]byte, error) {
+	if webConfigFile == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(webConfigFile)
+	if err != nil {
+		return nil, fmt.Errorf("web config file: %w", err)
+	}
+	return data, nil
+}
+
+// serveWeb serves HTTP on the listener, with TLS and basic auth as the web config file
+// asks for.
+func serveWeb(server *http.Server, listener net.Listener) error {
+	systemdSocket := false
+	addresses := []string{listenAddress}
+	flags := &web.FlagConfig{
+		WebListenAddresses: &addresses,
+		WebSystemdSocket:   &systemdSocket,
+		WebConfigFile:      &webConfigFile,
+	}
+	return web.Serve(listener, server, flags, slog.Default())
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// WebhookConfig holds the settings for posting the status to webhooks.
+type WebhookConfig struct {
+	Interval  time.Duration     `yaml:"interval"`
+	Timeout   time.Duration     `yaml:"timeout"`
+	Endpoints []WebhookEndpoint `yaml:"endpoints"`
+}
+
+// WebhookEndpoint is a single webhook receiver. With a secret, every request carries
+// an HMAC-SHA256 signature of its body.
+type WebhookEndpoint struct {
+	URL     string            `yaml:"url"`
+	Secret  string            `yaml:"secret"`
+	Headers map[string]string `yaml:"headers"`
+}
+
+// runWebhooks posts the full JSON status of all targets to every endpoint on each
+// interval until the context is cancelled. It returns immediately if no endpoints
+// are configured.
+func runWebhooks(ctx context.Context, cfg WebhookConfig, gatherer prometheus.Gatherer) {
+	if len(cfg.Endpoints) == 0 {
+		return
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = 30 * time.Second
+	}
+	gatherer = gatherWithin(gatherer, cfg.Interval)
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	client := &http.Client{Timeout: cfg.Timeout}
+
+	slog.Info("Posting status to webhooks", "webhooks", len(cfg.Endpoints), "interval", cfg.Interval)
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			body, err := webhookPayload(gatherer, now)
+			if err != nil {
+				slog.Error("Error gathering metrics for webhooks", "err", err)
+				continue
+			}
+			for _, endpoint := range cfg.Endpoints {
+				if err := postWebhook(ctx, client, endpoint, body); err != nil {
+					slog.Warn("Error posting to a webhook", "url", endpoint.URL, "err", err)
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// webhookPayload renders {"timestamp": ..., "targets": {"<target>": {"<metric>": value}}}.
+func webhookPayload(gatherer prometheus.Gatherer, now time.Time) ([]byte, error) {
+	samples, err := gatherSamples(gatherer, "ups_")
+	if err != nil {
+		return nil, err
+	}
+	_, states := samplesByTarget(samples)
+	return json.Marshal(map[string]any{
+		"timestamp": now.UTC().Format(time.RFC3339),
+		"targets":   states,
+	})
+}
+
+// postWebhook sends the payload to one endpoint. The signature is sent as
+// X-Signature-256: sha256=<hex>, the same scheme GitHub uses for its webhooks.
+func postWebhook(ctx context.Context, client *http.Client, endpoint WebhookEndpoint, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "apc-exporter")
+	if endpoint.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(endpoint.Secret))
+		mac.Write(body)
+		req.Header.Set("X-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	for k, v := range endpoint.Headers {
+		req.Header.Set(k, v)
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("server returned HTTP status %d", res.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v3"
+)
+
+// ZabbixConfig holds the settings for pushing values with the Zabbix sender protocol.
+type ZabbixConfig struct {
+	Server     string            `yaml:"server"`
+	Interval   time.Duration     `yaml:"interval"`
+	KeyMapFile string            `yaml:"key_map_file"`
+	Hosts      map[string]string `yaml:"hosts"`
+}
+
+// zabbixItem is a single value in a "sender data" request.
+type zabbixItem struct {
+	Host  string `json:"host"`
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	Clock int64  `json:"clock"`
+}
+
+// runZabbix pushes the UPS metrics as Zabbix trapper items on every interval until
+// the context is cancelled. It returns immediately if no server is configured.
+func runZabbix(ctx context.Context, cfg ZabbixConfig, gatherer prometheus.Gatherer) {
+	if cfg.Server == "" {
+		return
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = time.Minute
+	}
+	gatherer = gatherWithin(gatherer, cfg.Interval)
+	if _, _, err := net.SplitHostPort(cfg.Server); err != nil {
+		cfg.Server = net.JoinHostPort(cfg.Server, "10051")
+	}
+
+	var keyMap map[string]string
+	if cfg.KeyMapFile != "" {
+		var err error
+		if keyMap, err = loadZabbixKeyMap(cfg.KeyMapFile); err != nil {
+			slog.Warn("Zabbix output disabled", "err", err)
+			return
+		}
+	}
+
+	slog.Info("Sending metrics to Zabbix", "server", cfg.Server, "interval", cfg.Interval)
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			if err := sendZabbix(cfg, keyMap, gatherer, now); err != nil {
+				slog.Warn("Error sending to Zabbix", "err", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// loadZabbixKeyMap reads a YAML file mapping metric names to Zabbix item keys.
+func loadZabbixKeyMap(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var keyMap map[string]string
+	if err := yaml.Unmarshal(data, &keyMap); err != nil {
+		return nil, fmt.Errorf("parsing key map %s: %w", path, err)
+	}
+	return keyMap, nil
+}
+
+// sendZabbix gathers the UPS metrics once and sends them in a single request. With a
+// key map only the mapped metrics are sent; otherwise the metric name is the key. The
+// values of the labels other than target are the parameters of the key, so that the
+// samples of a family such as ups_status{state} go to items of their own.
+// Targets are sent as the Zabbix host of the same name unless remapped in Hosts.
+func sendZabbix(cfg ZabbixConfig, keyMap map[string]string, gatherer prometheus.Gatherer, now time.Time) error {
+	samples, err := gatherSamples(gatherer, "ups_")
+	if err != nil {
+		return err
+	}
+
+	var items []zabbixItem
+	for _, s := range samples {
+		key := s.Name
+		if keyMap != nil {
+			var ok bool
+			if key, ok = keyMap[s.Name]; !ok {
+				continue
+			}
+		}
+		key = zabbixKey(key, s.Labels)
+		host := s.Labels["target"]
+		if mapped, ok := cfg.Hosts[host]; ok {
+			host = mapped
+		}
+		items = append(items, zabbixItem{
+			Host:  host,
+			Key:   key,
+			Value: strconv.FormatFloat(s.Value, 'f', -1, 64),
+			Clock: now.Unix(),
+		})
+	}
+	if len(items) == 0 {
+		return nil
+	}
+
+	request, err := json.Marshal(map[string]any{
+		"request": "sender data",
+		"data":    items,
+		"clock":   now.Unix(),
+	})
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.DialTimeout("tcp", cfg.Server, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	if _, err := conn.Write(zabbixPacket(request)); err != nil {
+		return err
+	}
+
+	reply, err := readZabbixPacket(conn)
+	if err != nil {
+		return err
+	}
+	var response struct {
+		Response string `json:"response"`
+		Info     string `json:"info"`
+	}
+	if err := json.Unmarshal(reply, &response); err != nil {
+		return fmt.Errorf("decoding server response: %w", err)
+	}
+	if response.Response != "success" {
+		return fmt.Errorf("server responded %q: %s", response.Response, response.Info)
+	}
+
+	// The server accepts the request even if individual items are unknown to it.
+	var processed, failed, total int
+	var seconds float64
+	if _, err := fmt.Sscanf(response.Info, "processed: %d; failed: %d; total: %d; seconds spent: %f", &processed, &failed, &total, &seconds); err == nil && failed > 0 {
+		slog.Warn("Zabbix rejected items: check the item keys and host names", "failed", failed, "total", total)
+	}
+	return nil
+}
+
+// zabbixKey returns the item key of a metric: the key with the values of its labels
+// but target as parameters, in the order of the label names, as in
+// ups_status[onBattery]. Parameters that need it are quoted.
+func zabbixKey(key string, labels map[string]string) string {
+	var params []string
+	for _, name := range slices.Sorted(maps.Keys(labels)) {
+		if name == "target" {
+			continue
+		}
+		value := labels[name]
+		if value == "" || strings.ContainsAny(value, `,[]" `) {
+			value = `"` + strings.ReplaceAll(value, `"`, `\"`) + `"`
+		}
+		params = append(params, value)
+	}
+	if len(params) == 0 {
+		return key
+	}
+	return key + "[" + strings.Join(params, ",") + "]"
+}
+
+// zabbixPacket frames a payload with the ZBXD protocol header.
+func zabbixPacket(payload []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("ZBXD\x01")
+	binary.Write(&buf, binary.LittleEndian, uint64(len(payload)))
+	buf.Write(payload)
+	return buf.Bytes()
+}
+
+// readZabbixPacket reads a ZBXD framed reply and returns its payload.
+func readZabbixPacket(r io.Reader) ([]byte, error) {
+	header := make([]byte, 13)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("reading server response: %w", err)
+	}
+	if string(header[:4]) != "ZBXD" {
+		return nil, errors.New("invalid response header from server")
+	}
+	if header[4]&0x02 != 0 {
+		return nil, errors.New("compressed responses are not supported")
+	}
+	length := binary.LittleEndian.Uint64(header[5:])
+	if length > 1<<20 {
+		return nil, fmt.Errorf("response too large (%d bytes)", length)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, fmt.Errorf("reading server response: %w", err)
+	}
+	return payload, nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"cmp"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// zabbixTestTrapper accepts one sender connection, decodes the request as the Zabbix
+// protocol documentation describes it ("ZBXD", the flags 0x01, the length of the JSON
+// data as a little-endian uint64, and the data) and replies that every item was
+// processed. The decoded request is sent on the channel.
+func zabbixTestTrapper(t *testing.T) (string, <-chan zabbixTestRequest) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	requests := make(chan zabbixTestRequest, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		var header [13]byte
+		if _, err := io.ReadFull(conn, header[:]); err != nil {
+			t.Error(err)
+			return
+		}
+		if string(header[:5]) != "ZBXD\x01" {
+			t.Errorf("header % x, want ZBXD and the flags 0x01", header[:5])
+			return
+		}
+		data := make([]byte, binary.LittleEndian.Uint64(header[5:]))
+		if _, err := io.ReadFull(conn, data); err != nil {
+			t.Error(err)
+			return
+		}
+		var req zabbixTestRequest
+		if err := json.Unmarshal(data, &req); err != nil {
+			t.Errorf("decoding %s: %v", data, err)
+			return
+		}
+		requests <- req
+
+		info := fmt.Sprintf(`{"response":"success","info":"processed: %d; failed: 0; total: %[1]d; seconds spent: 0.000055"}`, len(req.Data))
+		reply := append([]byte("ZBXD\x01"), binary.LittleEndian.AppendUint64(nil, uint64(len(info)))...)
+		conn.Write(append(reply, info...))
+	}()
+	return ln.Addr().String(), requests
+}
+
+type zabbixTestRequest struct {
+	Request string       `json:"request"`
+	Data    []zabbixItem `json:"data"`
+	Clock   int64        `json:"clock"`
+}
+
+// TestSendZabbix checks the request a trapper receives, and that the samples of a
+// family with labels other than target are sent as items of their own, with the label
+// values as the parameters of the key.
+func TestSendZabbix(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	load := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "ups_load_percent", Help: "Output load in percent."}, []string{"target"})
+	status := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "ups_status", Help: "Whether the UPS is in the state."}, []string{"target", "state"})
+	groups := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "ups_outlet_group_on", Help: "Whether the outlet group is on."}, []string{"target", "group", "name"})
+	reg.MustRegister(load, status, groups)
+	load.WithLabelValues("rack-a").Set(23.5)
+	load.WithLabelValues("rack-b").Set(40)
+	status.WithLabelValues("rack-a", "online").Set(1)
+	status.WithLabelValues("rack-a", "onBattery").Set(0)
+	groups.WithLabelValues("rack-a", "1", "Servers, rack 1").Set(1)
+	groups.WithLabelValues("rack-a", "2", `"Switch"`).Set(0)
+
+	for _, tc := range []struct {
+		name   string
+		keyMap map[string]string
+		want   []zabbixItem
+	}{
+		{"metric names", nil, []zabbixItem{
+			{Host: "UPS Rack A", Key: "ups_load_percent", Value: "23.5"},
+			{Host: "UPS Rack A", Key: `ups_outlet_group_on[1,"Servers, rack 1"]`, Value: "1"},
+			{Host: "UPS Rack A", Key: `ups_outlet_group_on[2,"\"Switch\""]`, Value: "0"},
+			{Host: "UPS Rack A", Key: "ups_status[onBattery]", Value: "0"},
+			{Host: "UPS Rack A", Key: "ups_status[online]", Value: "1"},
+			{Host: "rack-b", Key: "ups_load_percent", Value: "40"},
+		}},
+		{"key map", map[string]string{"ups_load_percent": "apc.load", "ups_status": "apc.status"}, []zabbixItem{
+			{Host: "UPS Rack A", Key: "apc.load", Value: "23.5"},
+			{Host: "UPS Rack A", Key: "apc.status[onBattery]", Value: "0"},
+			{Host: "UPS Rack A", Key: "apc.status[online]", Value: "1"},
+			{Host: "rack-b", Key: "apc.load", Value: "40"},
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			addr, requests := zabbixTestTrapper(t)
+			cfg := ZabbixConfig{Server: addr, Hosts: map[string]string{"rack-a": "UPS Rack A"}}
+			if err := sendZabbix(cfg, tc.keyMap, reg, historyTestTime); err != nil {
+				t.Fatal(err)
+			}
+			req := <-requests
+			if req.Request != "sender data" || req.Clock != historyTestTime.Unix() {
+				t.Errorf("request %q at %d, want sender data at %d", req.Request, req.Clock, historyTestTime.Unix())
+			}
+			for i := range tc.want {
+				tc.want[i].Clock = historyTestTime.Unix()
+			}
+			slices.SortFunc(req.Data, func(a, b zabbixItem) int {
+				return cmp.Or(cmp.Compare(a.Host, b.Host), cmp.Compare(a.Key, b.Key))
+			})
+			if !slices.Equal(req.Data, tc.want) {
+				t.Errorf("items:\n%v\nwant:\n%v", req.Data, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+// Command nmc-sim serves the recorded web interface of an APC Network Management Card,
+// with a working login and sessions, for trying out the exporter without a UPS and for
+// reproducing parser issues from pages saved with apc-exporter dump-pages.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/veter2005/apc-exporter/pkg/nmcsim"
+)
+
+func main() {
+	listen := flag.String("listen", "127.0.0.1:8081", "Address to serve the simulated card on")
+	generation := flag.String("generation", nmcsim.DefaultGeneration, "Card generation to simulate, one of "+strings.Join(nmcsim.Generations(), ", "))
+	dump := flag.String("dump", "", "Serve the pages of this dump-pages archive over those of the generation")
+	username := flag.String("username", "apc", "User name to accept")
+	password := flag.String("password", "apc", "Password to accept")
+	sessionTimeout := flag.Duration("session_timeout", 3*time.Minute, "Log out sessions idle for this long, like the card's auto logout (0 disables)")
+	singleSession := flag.Bool("single_session", false, "Refuse a login while another session is active")
+	sessionPaths := flag.Bool("session_paths", false, "Serve each session below a path of its own, like /NMC/<token>/status")
+	list := flag.Bool("list", false, "List the card generations and exit")
+	flag.Parse()
+
+	if *list {
+		for _, g := range nmcsim.Generations() {
+			fmt.Println(g)
+		}
+		return
+	}
+
+	opts := nmcsim.Options{
+		Generation:     *generation,
+		Username:       *username,
+		Password:       *password,
+		SessionTimeout: *sessionTimeout,
+		SingleSession:  *singleSession,
+		SessionPaths:   *sessionPaths,
+	}
+	if *dump != "" {
+		f, err := os.Open(*dump)
+		if err != nil {
+			log.Fatalf("nmc-sim: %v", err)
+		}
+		opts.Pages, err = nmcsim.LoadDump(f)
+		f.Close()
+		if err != nil {
+			log.Fatalf("nmc-sim: %s: %v", *dump, err)
+		}
+	}
+	sim, err := nmcsim.New(opts)
+	if err != nil {
+		log.Fatalf("nmc-sim: %v", err)
+	}
+	sim.Log = log.Printf
+
+	server := &http.Server{Addr: *listen, Handler: sim, ReadHeaderTimeout: 10 * time.Second}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		server.Shutdown(context.Background())
+	}()
+
+	log.Printf("Simulating a %s card on http://%s with the pages %s", *generation, *listen, strings.Join(sim.Paths(), " "))
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatalf("nmc-sim: %v", err)
+	}
+}
@@ -0,0 +1,976 @@
+// Package collector exports the status of APC Network Management Cards, read with
+// package nmc, as Prometheus metrics.
+package collector
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/veter2005/apc-exporter/pkg/nmc"
+)
+
+// Leader tells a collector whether another replica polls the cards, and hands out the
+// values that replica polled.
+type Leader interface {
+	Following() bool
+	LeaderURL() string
+	LeaderValues(target string) (map[string]float64, error)
+}
+
+// Backend reads the values of a device by metric name, for devices that are not read
+// through the web interface of a card. Metrics missing from the values are 0.
+type Backend interface {
+	Values(ctx context.Context) (map[string]float64, error)
+}
+
+// UnsupportedBackend is a Backend that cannot read some of the metrics at all. They are
+// sent as 0, and strict mode does not count them, or their gauges in other units, as
+// missing.
+type UnsupportedBackend interface {
+	Backend
+	Unsupported() []string
+}
+
+// Collector implements the prometheus.Collector interface for one card. All metrics
+// carry a constant "target" label.
+type Collector struct {
+	mu      sync.Mutex // held while the card is scraped
+	client  *nmc.Client
+	scraped bool // whether the last scrape of the card succeeded
+
+	// The metrics of the last scrape, served by Collect while Poll runs, and the
+	// scrape running, which concurrent Collects wait for instead of starting their own.
+	flightMu sync.Mutex
+	last     []prometheus.Metric
+	inFlight chan struct{}
+	polling  bool
+
+	// Leader, if set, is asked on every scrape whether to serve the values of the
+	// leader instead of polling the card.
+	Leader Leader
+	// Backend, if set, is read instead of the card's status page.
+	Backend Backend
+	// Log receives the messages about scrapes with a syslog priority, the target and
+	// the stage (scrape, parse or leader). By default they go to the default slog
+	// logger, at the level of their priority.
+	Log func(priority int, target, stage, format string, args ...any)
+
+	namespace  string
+	sets       map[string]bool // enabled metric sets, nil for all but fahrenheit
+	fahrenheit bool            // whether WithFahrenheit was given
+	strict     bool            // whether WithStrict was given
+	units      string          // set by WithUnits, "" for legacy
+	ratedWatts float64         // set by WithRatedWatts
+	extra      map[string]bool // set by WithExtraMetrics
+	profile    *nmc.Profile    // set by WithSelectors, instead of the card's profile
+	timeout    time.Duration   // set by WithTimeout, 0 for none
+
+	descs             map[string]*prometheus.Desc // by metric name without the namespace
+	upDesc            *prometheus.Desc
+	parserProfileDesc *prometheus.Desc
+	parseFailuresDesc *prometheus.Desc
+	parseFailures     map[string]float64 // by Selectors field
+	unrecognizedDesc  *prometheus.Desc
+	unrecognized      map[string]float64 // by device status
+
+	// The metrics of the scrapes themselves, sent whatever the metric sets.
+	scrapeDurationDesc *prometheus.Desc
+	lastScrapeDesc     *prometheus.Desc
+	loginFailuresDesc  *prometheus.Desc
+	loginFailures      float64
+	scrapeErrorsDesc   *prometheus.Desc
+	scrapeErrors       map[string]float64 // by stage, out of ScrapeStages
+
+	// The gauges of the outlet groups, by group index and name; nil if not exported.
+	outletGroupOnDesc        *prometheus.Desc
+	outletGroupLoadDesc      *prometheus.Desc
+	outletGroupLoadRatioDesc *prometheus.Desc
+
+	// The about and battery pages, read again once they are older than infoRefresh;
+	// their descriptors are nil if not exported.
+	infoRefresh     time.Duration
+	infoRead        time.Time
+	about           *nmc.About
+	battery         *nmc.Battery
+	infoDesc        *prometheus.Desc
+	lastReplaceDesc *prometheus.Desc
+	nextReplaceDesc *prometheus.Desc
+
+	// The gauges of the device state, the last transfer and the alarms page; nil if
+	// not exported. The alarms page is not asked for again until infoRefresh after it
+	// could not be read, as on cards without one.
+	onBatteryDesc    *prometheus.Desc
+	stateDesc        *prometheus.Desc
+	lastTransferDesc *prometheus.Desc
+	alarmsDesc       *prometheus.Desc
+	noOnBattery      bool // whether WithoutOnBattery was given
+	alarmsFailed     time.Time
+}
+
+// ScrapeStages are the stages of ups_scrape_errors_total: the login to the card, the
+// loading of its status page or the reading of a backend, and the parsing of the page.
+var ScrapeStages = []string{"login", "fetch", "parse"}
+
+// DeviceStates are the states of ups_status, those of DefaultStatusStrings. A custom
+// status string with another state adds it to the states of its target.
+var DeviceStates = []string{"online", "onBattery", "bypass", "boost", "trim", "off", "discharged"}
+
+// DefaultInfoRefresh is how long the about and battery pages are cached by default.
+const DefaultInfoRefresh = time.Hour
+
+// metric is a gauge of the status page and the metric set it belongs to.
+type metric struct {
+	name, help, set string
+}
+
+var metrics = []metric{
+	{"ups_device_status_up", "Device status (1=Online, 0=Other).", "status"},
+	{"ups_outlet_status", "UPS outlet status (1=On, 0=Off).", "status"},
+	{"ups_load_percent", "Current UPS load in percent.", "load"},
+	{"ups_load_power_percent_va", "Load power in VA percent.", "load"},
+	{"ups_load_current_amps", "Load current in Amps.", "load"},
+	{"ups_runtime_remaining_minutes", "Estimated runtime remaining in minutes.", "battery"},
+	{"ups_runtime_remaining_seconds", "Estimated runtime remaining in seconds.", "battery"},
+	{"ups_battery_charge_percent", "Battery charge in percent.", "battery"},
+	{"ups_battery_voltage_vdc", "Battery voltage in VDC.", "battery"},
+	{"ups_input_voltage_vac", "Input voltage in VAC.", "input"},
+	{"ups_input_frequency_hz", "Input frequency in Hz.", "input"},
+	{"ups_output_voltage_vac", "Output voltage in VAC.", "output"},
+	{"ups_output_frequency_hz", "Output frequency in Hz.", "output"},
+	{"ups_internal_temperature_celsius", "Internal temperature in Celsius.", "temperature"},
+	{"ups_internal_temperature_fahrenheit", "Internal temperature in Fahrenheit.", "fahrenheit"},
+}
+
+// extraMetrics are gauges only some backends read, exported with WithExtraMetrics.
+var extraMetrics = []metric{
+	{"ups_efficiency_percent", "Efficiency of the UPS in percent, the output real power of the input real power.", "output"},
+	{"ups_output_energy_kwh", "Output energy the UPS counted in kilowatt hours.", "output"},
+}
+
+// ExtraMetrics are the names of the gauges for WithExtraMetrics.
+var ExtraMetrics []string
+
+// baseUnit is a gauge in Prometheus base units and the legacy gauge it replaces, whose
+// value times scale is its value.
+type baseUnit struct {
+	name, legacy, help, set string
+	scale                   float64
+}
+
+var baseUnits = []baseUnit{
+	{"ups_load_ratio", "ups_load_percent", "Current UPS load as a ratio (0-1).", "load", 0.01},
+	{"ups_load_power_va_ratio", "ups_load_power_percent_va", "Load power as a ratio of the VA capacity (0-1).", "load", 0.01},
+	{"ups_load_current_amperes", "ups_load_current_amps", "Load current in amperes.", "load", 1},
+	{"ups_battery_charge_ratio", "ups_battery_charge_percent", "Battery charge as a ratio (0-1).", "battery", 0.01},
+	{"ups_battery_voltage_volts", "ups_battery_voltage_vdc", "Battery voltage in volts DC.", "battery", 1},
+	{"ups_input_voltage_volts", "ups_input_voltage_vac", "Input voltage in volts AC.", "input", 1},
+	{"ups_input_frequency_hertz", "ups_input_frequency_hz", "Input frequency in hertz.", "input", 1},
+	{"ups_output_voltage_volts", "ups_output_voltage_vac", "Output voltage in volts AC.", "output", 1},
+	{"ups_output_frequency_hertz", "ups_output_frequency_hz", "Output frequency in hertz.", "output", 1},
+	{"ups_efficiency_ratio", "ups_efficiency_percent", "Efficiency of the UPS as a ratio (0-1).", "output", 0.01},
+	{"ups_output_energy_joules", "ups_output_energy_kwh", "Output energy the UPS counted in joules.", "output", 3.6e6},
+}
+
+// legacyUnits are the gauges that are not in base units, by the gauge replacing them.
+var legacyUnits = map[string]string{
+	"ups_runtime_remaining_minutes": "ups_runtime_remaining_seconds",
+}
+
+func init() {
+	for _, b := range baseUnits {
+		legacyUnits[b.legacy] = b.name
+	}
+	for _, m := range extraMetrics {
+		ExtraMetrics = append(ExtraMetrics, m.name)
+	}
+}
+
+// Units are the unit systems for WithUnits: "legacy" exports the gauges in the units
+// the card shows, such as ups_load_percent; "base" exports them in Prometheus base
+// units instead, such as ups_load_ratio; "both" exports both.
+var Units = []string{"legacy", "both", "base"}
+
+// MetricSets are the names of the metric sets for WithMetrics: the gauges of the
+// status page by section, "info" for ups_info, apc_exporter_parser_profile_info and
+// the apc_exporter_*_total counters, and "fahrenheit" for the internal temperature in
+// Fahrenheit, which is only exported when named or with WithFahrenheit.
+var MetricSets = []string{"status", "load", "battery", "input", "output", "temperature", "info", "fahrenheit"}
+
+// Option configures a collector made by New.
+type Option func(*Collector) error
+
+// WithClient sets the client of the card to scrape. It is required.
+func WithClient(client *nmc.Client) Option {
+	return func(c *Collector) error {
+		c.client = client
+		return nil
+	}
+}
+
+// WithNamespace prefixes the names of all metrics with namespace and an underscore,
+// e.g. "facilities" exports facilities_ups_load_percent.
+func WithNamespace(namespace string) Option {
+	return func(c *Collector) error {
+		c.namespace = namespace
+		return nil
+	}
+}
+
+// WithMetrics exports only the metrics of the named sets, out of MetricSets. By
+// default all are exported.
+func WithMetrics(sets ...string) Option {
+	return func(c *Collector) error {
+		c.sets = make(map[string]bool)
+		for _, set := range sets {
+			if !slices.Contains(MetricSets, set) {
+				return fmt.Errorf("unknown metric set %q, want one of %s", set, strings.Join(MetricSets, ", "))
+			}
+			c.sets[set] = true
+		}
+		return nil
+	}
+}
+
+// WithFahrenheit also exports the internal temperature in Fahrenheit, as
+// ups_internal_temperature_fahrenheit.
+func WithFahrenheit() Option {
+	return func(c *Collector) error {
+		c.fahrenheit = true
+		return nil
+	}
+}
+
+// WithStrict fails a scrape in which a value with a selector is missing from the
+// status page or cannot be read, or, with a Backend, is left out of its values: the
+// gauges are left out and ups_up is 0, as for any failed scrape, instead of sending 0
+// for the values.
+func WithStrict() Option {
+	return func(c *Collector) error {
+		c.strict = true
+		return nil
+	}
+}
+
+// WithUnits exports the gauges in the units of a system out of Units. By default they
+// are exported in legacy units.
+func WithUnits(units string) Option {
+	return func(c *Collector) error {
+		if !slices.Contains(Units, units) {
+			return fmt.Errorf("unknown units %q, want one of %s", units, strings.Join(Units, ", "))
+		}
+		c.units = units
+		return nil
+	}
+}
+
+// WithRatedWatts sets the real power rating of the UPS, from which the output power is
+// exported as ups_output_power_watts with units other than legacy.
+func WithRatedWatts(watts float64) Option {
+	return func(c *Collector) error {
+		if watts < 0 {
+			return fmt.Errorf("negative power rating %g", watts)
+		}
+		c.ratedWatts = watts
+		return nil
+	}
+}
+
+// WithExtraMetrics also exports gauges out of ExtraMetrics, for a Backend that reads
+// them.
+func WithExtraMetrics(names ...string) Option {
+	return func(c *Collector) error {
+		c.extra = make(map[string]bool)
+		for _, name := range names {
+			if !slices.Contains(ExtraMetrics, name) {
+				return fmt.Errorf("unknown extra metric %q, want one of %s", name, strings.Join(ExtraMetrics, ", "))
+			}
+			c.extra[name] = true
+		}
+		return nil
+	}
+}
+
+// WithSelectors reads the status page with these selectors instead of the parser
+// profile detected for the card; apc_exporter_parser_profile_info names it "custom".
+func WithSelectors(selectors nmc.Selectors) Option {
+	return func(c *Collector) error {
+		if selectors.DeviceStatus == "" {
+			return errors.New("the selectors have no device status")
+		}
+		c.profile = &nmc.Profile{Name: "custom", Status: selectors}
+		return nil
+	}
+}
+
+// WithInfoRefresh sets how long the about and battery pages, which rarely change, are
+// cached between scrapes. By default they are read again after DefaultInfoRefresh.
+func WithInfoRefresh(d time.Duration) Option {
+	return func(c *Collector) error {
+		if d < 0 {
+			return fmt.Errorf("negative info refresh %s", d)
+		}
+		c.infoRefresh = d
+		return nil
+	}
+}
+
+// WithoutOnBattery leaves out ups_on_battery, for exporters that set a gauge of that
+// name otherwise, such as from SNMP traps.
+func WithoutOnBattery() Option {
+	return func(c *Collector) error {
+		c.noOnBattery = true
+		return nil
+	}
+}
+
+// WithTimeout bounds every scrape, including the login and the other pages read with
+// the status page, so a card that stops answering fails the scrape instead of holding
+// it. By default scrapes are not bounded.
+func WithTimeout(d time.Duration) Option {
+	return func(c *Collector) error {
+		if d < 0 {
+			return fmt.Errorf("negative timeout %s", d)
+		}
+		c.timeout = d
+		return nil
+	}
+}
+
+// priorityLevel returns the slog level of a syslog priority.
+func priorityLevel(priority int) slog.Level {
+	switch {
+	case priority <= nmc.PriorityErr:
+		return slog.LevelError
+	case priority == nmc.PriorityWarning:
+		return slog.LevelWarn
+	case priority >= nmc.PriorityDebug:
+		return slog.LevelDebug
+	}
+	return slog.LevelInfo
+}
+
+// WithLogger sets the function receiving the messages about scrapes, as Log.
+func WithLogger(log func(priority int, target, stage, format string, args ...any)) Option {
+	return func(c *Collector) error {
+		c.Log = log
+		return nil
+	}
+}
+
+// New returns a collector configured by the options, to register with a registry of
+// its own or with the registry of another exporter. WithClient is required.
+func New(opts ...Option) (*Collector, error) {
+	c := &Collector{
+		Log: func(priority int, target, stage, format string, args ...any) {
+			ctx, level := context.Background(), priorityLevel(priority)
+			if slog.Default().Enabled(ctx, level) {
+				slog.Log(ctx, level, fmt.Sprintf(format, args...), "target", target, "stage", stage)
+			}
+		},
+		infoRefresh: DefaultInfoRefresh,
+	}
+	for _, opt := range opts {
+		if err := opt(c); err != nil {
+			return nil, fmt.Errorf("collector: %w", err)
+		}
+	}
+	if c.client == nil {
+		return nil, errors.New("collector: no client, use WithClient")
+	}
+
+	labels := prometheus.Labels{"target": c.client.Target().Name}
+	c.upDesc = prometheus.NewDesc(c.metricName("ups_up"), "Whether the last scrape of the UPS succeeded (1=Yes, 0=No); the other metrics of the UPS are left out if not.", nil, labels)
+	c.scrapeDurationDesc = prometheus.NewDesc(c.metricName("ups_scrape_duration_seconds"), "How long the scrape of the UPS took.", nil, labels)
+	c.lastScrapeDesc = prometheus.NewDesc(c.metricName("ups_last_scrape_timestamp_seconds"), "When the scrape of the UPS the metrics are from ended, as a Unix timestamp.", nil, labels)
+	c.loginFailuresDesc = prometheus.NewDesc(c.metricName("ups_login_failures_total"), "Scrapes that failed because the login to the card failed.", nil, labels)
+	c.scrapeErrorsDesc = prometheus.NewDesc(c.metricName("ups_scrape_errors_total"), "Scrapes that failed, by the stage they failed in (login, fetch or parse).", []string{"stage"}, labels)
+	c.scrapeErrors = make(map[string]float64)
+	for _, stage := range ScrapeStages {
+		c.scrapeErrors[stage] = 0
+	}
+	c.descs = make(map[string]*prometheus.Desc)
+	// The help of the legacy gauges is the same in all units, as targets with different
+	// units share a registry.
+	for _, m := range slices.Concat(metrics, extraMetrics) {
+		_, legacy := legacyUnits[m.name]
+		if c.exported(m) && !(legacy && c.units == "base") {
+			c.descs[m.name] = prometheus.NewDesc(c.metricName(m.name), m.help, nil, labels)
+		}
+	}
+	if c.units == "both" || c.units == "base" {
+		for _, b := range baseUnits {
+			if c.exported(metric{name: b.legacy, set: b.set}) {
+				c.descs[b.name] = prometheus.NewDesc(c.metricName(b.name), b.help, nil, labels)
+			}
+		}
+		if c.ratedWatts > 0 && c.enabled("load") {
+			c.descs["ups_output_power_watts"] = prometheus.NewDesc(c.metricName("ups_output_power_watts"), "Output power in watts, from the load and the rated real power.", nil, labels)
+		}
+	}
+	groupLabels := []string{"group", "name"}
+	if c.enabled("status") {
+		c.outletGroupOnDesc = prometheus.NewDesc(c.metricName("ups_outlet_group_on"), "Whether the outlet group is on (1=On, 0=Off).", groupLabels, labels)
+	}
+	if c.enabled("load") && c.units != "base" {
+		c.outletGroupLoadDesc = prometheus.NewDesc(c.metricName("ups_outlet_group_load_percent"), "Load of the outlet group in percent, where the card shows it.", groupLabels, labels)
+	}
+	if c.enabled("load") && (c.units == "both" || c.units == "base") {
+		c.outletGroupLoadRatioDesc = prometheus.NewDesc(c.metricName("ups_outlet_group_load_ratio"), "Load of the outlet group as a ratio (0-1), where the card shows it.", groupLabels, labels)
+	}
+	if c.enabled("status") {
+		if !c.noOnBattery {
+			c.onBatteryDesc = prometheus.NewDesc(c.metricName("ups_on_battery"), "Whether the UPS runs on battery, from the device status (1=Yes, 0=No).", nil, labels)
+		}
+		c.stateDesc = prometheus.NewDesc(c.metricName("ups_status"), "Device status as a state set, 1 for the state of the UPS and 0 for the others.", []string{"state"}, labels)
+		c.lastTransferDesc = prometheus.NewDesc(c.metricName("ups_last_transfer_reason"), "Cause of the last transfer to battery as shown by the card, always 1.", []string{"reason"}, labels)
+		c.alarmsDesc = prometheus.NewDesc(c.metricName("ups_active_alarms"), "Number of alarms active on the alarms page of the card.", nil, labels)
+	}
+	if c.enabled("battery") {
+		c.lastReplaceDesc = prometheus.NewDesc(c.metricName("ups_battery_last_replacement_timestamp_seconds"), "Date the battery was last replaced, from the battery page, in seconds since the epoch.", nil, labels)
+		c.nextReplaceDesc = prometheus.NewDesc(c.metricName("ups_battery_recommended_replacement_timestamp_seconds"), "Date by which the battery should be replaced, from the battery page, in seconds since the epoch.", nil, labels)
+	}
+	if c.enabled("info") {
+		c.infoDesc = prometheus.NewDesc(c.metricName("ups_info"), "Identification of the UPS from the about page of the card.", []string{"model", "serial", "firmware", "nmc_firmware"}, labels)
+		c.parserProfileDesc = prometheus.NewDesc(c.metricName("apc_exporter_parser_profile_info"), "Parser profile used for the card's pages, with the model and firmware from its about page.", []string{"profile", "model", "firmware"}, labels)
+		c.parseFailuresDesc = prometheus.NewDesc(c.metricName("apc_exporter_parse_failures_total"), "Scrapes in which a value of the status page could not be read, by the field of the value.", []string{"field"}, labels)
+		c.parseFailures = make(map[string]float64)
+		c.unrecognizedDesc = prometheus.NewDesc(c.metricName("ups_unrecognized_status_total"), "Scrapes in which the device status matched no status string, by the status.", []string{"status"}, labels)
+		c.unrecognized = make(map[string]float64)
+	}
+	return c, nil
+}
+
+// enabled reports whether the metrics of a set are exported.
+func (c *Collector) enabled(set string) bool {
+	if set == "fahrenheit" && c.fahrenheit {
+		return true
+	}
+	if c.sets == nil {
+		return set != "fahrenheit"
+	}
+	return c.sets[set]
+}
+
+// exported reports whether a gauge is exported in some units: its set is enabled, and
+// for extra gauges they were asked for.
+func (c *Collector) exported(m metric) bool {
+	if slices.Contains(ExtraMetrics, m.name) && !c.extra[m.name] {
+		return false
+	}
+	return c.enabled(m.set)
+}
+
+// metricName returns the exported name of a metric, with the namespace.
+func (c *Collector) metricName(name string) string {
+	if c.namespace == "" {
+		return name
+	}
+	return c.namespace + "_" + name
+}
+
+// Client returns the client of the card.
+func (c *Collector) Client() *nmc.Client {
+	return c.client
+}
+
+// Target returns the card of the collector.
+func (c *Collector) Target() nmc.Target {
+	return c.client.Target()
+}
+
+// Scraped reports whether the last scrape of the card succeeded.
+func (c *Collector) Scraped() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.scraped
+}
+
+// Following reports whether another replica polls the card.
+func (c *Collector) Following() bool {
+	return c.Leader != nil && c.Leader.Following()
+}
+
+// Describe sends the descriptors of all metrics to the provided channel.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.upDesc
+	ch <- c.scrapeDurationDesc
+	ch <- c.lastScrapeDesc
+	ch <- c.loginFailuresDesc
+	ch <- c.scrapeErrorsDesc
+	for _, desc := range c.Descs() {
+		ch <- desc
+	}
+	if c.parserProfileDesc != nil {
+		ch <- c.parserProfileDesc
+		ch <- c.parseFailuresDesc
+		ch <- c.unrecognizedDesc
+	}
+	for _, desc := range []*prometheus.Desc{c.outletGroupOnDesc, c.outletGroupLoadDesc, c.outletGroupLoadRatioDesc, c.infoDesc, c.lastReplaceDesc, c.nextReplaceDesc, c.onBatteryDesc, c.stateDesc, c.lastTransferDesc, c.alarmsDesc} {
+		if desc != nil {
+			ch <- desc
+		}
+	}
+}
+
+// Collect reads the data and sends the collected metrics to the provided channel. A
+// failed scrape sends ups_up 0 and leaves out the metrics of the UPS, rather than
+// sending 0 for them; the metrics of the scrape itself are always sent. While Poll
+// runs, the metrics of its last scrape are sent instead of scraping the card.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	// Followers leave the card to the leader, and count no errors of their own.
+	if c.Following() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		start := time.Now()
+		c.collectFromLeader(ch)
+		c.sendScrapeMetrics(ch, time.Since(start))
+		return
+	}
+
+	c.flightMu.Lock()
+	metrics := c.last
+	if !c.polling {
+		metrics = nil
+	}
+	c.flightMu.Unlock()
+	if metrics == nil {
+		metrics = c.refresh()
+	}
+	for _, m := range metrics {
+		ch <- m
+	}
+}
+
+// Poll scrapes the card every interval until ctx is done, so that Collect serves the
+// last scrape from memory and never waits for the card. The first scrape starts at
+// once; Collects before it ended wait for it. Followers do not poll.
+func (c *Collector) Poll(ctx context.Context, interval time.Duration) {
+	c.flightMu.Lock()
+	c.polling = true
+	c.flightMu.Unlock()
+	defer func() {
+		c.flightMu.Lock()
+		c.polling = false
+		c.flightMu.Unlock()
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if !c.Following() {
+			c.refresh()
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// refresh scrapes the card and returns the metrics of the scrape. If a scrape is
+// already running, it waits for that one and returns its metrics instead, so that
+// concurrent scrapes never log in to the card in parallel.
+func (c *Collector) refresh() []prometheus.Metric {
+	c.flightMu.Lock()
+	if done := c.inFlight; done != nil {
+		c.flightMu.Unlock()
+		<-done
+		c.flightMu.Lock()
+		defer c.flightMu.Unlock()
+		return c.last
+	}
+	done := make(chan struct{})
+	c.inFlight = done
+	c.flightMu.Unlock()
+
+	metrics := c.scrapeMetrics()
+	c.flightMu.Lock()
+	c.last, c.inFlight = metrics, nil
+	c.flightMu.Unlock()
+	close(done)
+	return metrics
+}
+
+// scrapeMetrics scrapes the card and returns its metrics and those of the scrape.
+func (c *Collector) scrapeMetrics() []prometheus.Metric {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var metrics []prometheus.Metric
+	ch := make(chan prometheus.Metric)
+	done := make(chan struct{})
+	go func() {
+		for m := range ch {
+			metrics = append(metrics, m)
+		}
+		close(done)
+	}()
+
+	start := time.Now()
+	stage := c.scrape(ch, start)
+	if stage != "" {
+		c.scrapeErrors[stage]++
+		if stage == "login" {
+			c.loginFailures++
+		}
+	}
+	c.sendScrapeMetrics(ch, time.Since(start))
+	ch <- prometheus.MustNewConstMetric(c.lastScrapeDesc, prometheus.GaugeValue, float64(time.Now().UnixNano())/1e9)
+	close(ch)
+	<-done
+	return metrics
+}
+
+// sendScrapeMetrics sends the metrics of a scrape that took duration.
+func (c *Collector) sendScrapeMetrics(ch chan<- prometheus.Metric, duration time.Duration) {
+	ch <- prometheus.MustNewConstMetric(c.scrapeDurationDesc, prometheus.GaugeValue, duration.Seconds())
+	ch <- prometheus.MustNewConstMetric(c.loginFailuresDesc, prometheus.CounterValue, c.loginFailures)
+	for stage, n := range c.scrapeErrors {
+		ch <- prometheus.MustNewConstMetric(c.scrapeErrorsDesc, prometheus.CounterValue, n, stage)
+	}
+}
+
+// scrape reads the card or the backend and sends its metrics. It returns the stage a
+// failed scrape failed in, out of ScrapeStages, or "" if it succeeded.
+func (c *Collector) scrape(ch chan<- prometheus.Metric, start time.Time) string {
+	target := c.client.Target().Name
+	c.scraped = false
+	ctx := context.Background()
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+	values, status, err := c.values(ctx)
+	switch {
+	case errors.Is(err, nmc.ErrParse) || errors.Is(err, nmc.ErrNoStatus):
+		c.Log(nmc.PriorityErr, target, "parse", "Error parsing status page of %s: %v", target, err)
+		c.sendFailed(ch)
+		return "parse"
+	case errors.Is(err, nmc.ErrLogin):
+		c.Log(nmc.PriorityErr, target, "scrape", "Scrape of %s failed, leaving out the values: %v", target, err)
+		c.sendFailed(ch)
+		return "login"
+	case err != nil:
+		c.Log(nmc.PriorityErr, target, "scrape", "Scrape of %s failed, leaving out the values: %v", target, err)
+		c.sendFailed(ch)
+		return "fetch"
+	}
+
+	if c.parseFailuresDesc != nil {
+		for _, field := range status.Unparsed {
+			c.parseFailures[field]++
+		}
+		for field, n := range c.parseFailures {
+			ch <- prometheus.MustNewConstMetric(c.parseFailuresDesc, prometheus.CounterValue, n, field)
+		}
+		if status.DeviceStatus != "" && status.DeviceState == "" {
+			c.unrecognized[status.DeviceStatus]++
+		}
+		for text, n := range c.unrecognized {
+			ch <- prometheus.MustNewConstMetric(c.unrecognizedDesc, prometheus.CounterValue, n, text)
+		}
+	}
+	if status.DeviceStatus != "" && status.DeviceState == "" {
+		c.Log(nmc.PriorityWarning, target, "parse", "Device status %q of %s matches no status string, sending ups_device_status_up 0", status.DeviceStatus, target)
+	}
+	switch {
+	case c.strict && len(status.Missing)+len(status.Unparsed) > 0:
+		c.Log(nmc.PriorityErr, target, "parse", "Scrape of %s failed in strict mode, values missing or unreadable: %s", target, strings.Join(slices.Concat(status.Missing, status.Unparsed), ", "))
+		c.sendFailed(ch)
+		return "parse"
+	case len(status.Unparsed) > 0:
+		c.Log(nmc.PriorityWarning, target, "parse", "Values of %s could not be read and are sent as 0: %s", target, strings.Join(status.Unparsed, ", "))
+	}
+
+	ch <- prometheus.MustNewConstMetric(c.upDesc, prometheus.GaugeValue, 1)
+	for name, desc := range c.Descs() {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, values[name])
+	}
+	c.sendOutletGroups(ch, status.OutletGroups)
+	c.scraped = true
+	if profile, about := c.client.Profile(); c.Backend == nil && profile != nil && c.parserProfileDesc != nil {
+		if c.profile != nil {
+			profile = c.profile
+		}
+		var model, firmware string
+		if about != nil {
+			model, firmware = about.Model, about.FirmwareRevision
+		}
+		ch <- prometheus.MustNewConstMetric(c.parserProfileDesc, prometheus.GaugeValue, 1, profile.Name, model, firmware)
+	}
+	if c.Backend == nil {
+		c.sendState(ctx, ch, status)
+		c.sendInfo(ctx, ch)
+	}
+	c.Log(nmc.PriorityDebug, target, "scrape", "Scrape of %s successful in %s", target, time.Since(start).Round(time.Millisecond))
+	return ""
+}
+
+// sendOutletGroups sends the gauges of the outlet groups on the status page.
+func (c *Collector) sendOutletGroups(ch chan<- prometheus.Metric, groups []nmc.OutletGroup) {
+	for _, g := range groups {
+		index := strconv.Itoa(g.Index)
+		if c.outletGroupOnDesc != nil {
+			ch <- prometheus.MustNewConstMetric(c.outletGroupOnDesc, prometheus.GaugeValue, g.On, index, g.Name)
+		}
+		if !g.LoadShown {
+			continue
+		}
+		if c.outletGroupLoadDesc != nil {
+			ch <- prometheus.MustNewConstMetric(c.outletGroupLoadDesc, prometheus.GaugeValue, g.LoadPercent, index, g.Name)
+		}
+		if c.outletGroupLoadRatioDesc != nil {
+			ch <- prometheus.MustNewConstMetric(c.outletGroupLoadRatioDesc, prometheus.GaugeValue, g.LoadPercent/100, index, g.Name)
+		}
+	}
+}
+
+// sendState sends the gauges of the device state and the last transfer of a status
+// page, and the number of active alarms on the alarms page. An alarms page that cannot
+// be read is logged and leaves out ups_active_alarms, without failing the scrape.
+func (c *Collector) sendState(ctx context.Context, ch chan<- prometheus.Metric, status *nmc.Status) {
+	if c.stateDesc == nil {
+		return
+	}
+	if status.DeviceState != "" {
+		if c.onBatteryDesc != nil {
+			ch <- prometheus.MustNewConstMetric(c.onBatteryDesc, prometheus.GaugeValue, boolValue(status.DeviceState == "onBattery"))
+		}
+		states := DeviceStates
+		if !slices.Contains(states, status.DeviceState) {
+			states = append(slices.Clone(states), status.DeviceState)
+		}
+		for _, state := range states {
+			ch <- prometheus.MustNewConstMetric(c.stateDesc, prometheus.GaugeValue, boolValue(state == status.DeviceState), state)
+		}
+	}
+	if status.LastTransfer != "" {
+		ch <- prometheus.MustNewConstMetric(c.lastTransferDesc, prometheus.GaugeValue, 1, status.LastTransfer)
+	}
+
+	if !c.alarmsFailed.IsZero() && time.Since(c.alarmsFailed) < c.infoRefresh {
+		return
+	}
+	target := c.client.Target().Name
+	alarms, err := c.client.Alarms(ctx)
+	if err != nil {
+		c.alarmsFailed = time.Now()
+		c.Log(nmc.PriorityWarning, target, "scrape", "Reading the alarms page of %s failed, trying again in %s: %v", target, c.infoRefresh, err)
+		return
+	}
+	c.alarmsFailed = time.Time{}
+	ch <- prometheus.MustNewConstMetric(c.alarmsDesc, prometheus.GaugeValue, float64(len(alarms)))
+}
+
+// boolValue returns 1 for true and 0 for false.
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// sendInfo sends ups_info and the battery replacement dates, reading the about and
+// battery pages again once the cached ones are older than the info refresh. Pages that
+// cannot be read are logged and leave out their metrics, without failing the scrape.
+func (c *Collector) sendInfo(ctx context.Context, ch chan<- prometheus.Metric) {
+	if c.infoDesc == nil && c.lastReplaceDesc == nil {
+		return
+	}
+	target := c.client.Target().Name
+	if c.infoRead.IsZero() || time.Since(c.infoRead) >= c.infoRefresh {
+		c.infoRead = time.Now()
+		if about, err := c.client.About(ctx); err != nil {
+			c.Log(nmc.PriorityWarning, target, "scrape", "Reading the about page of %s failed: %v", target, err)
+		} else {
+			c.about = about
+		}
+		if battery, err := c.client.Battery(ctx); err != nil {
+			c.Log(nmc.PriorityWarning, target, "scrape", "Reading the battery page of %s failed: %v", target, err)
+		} else {
+			c.battery = battery
+		}
+	}
+
+	if c.about != nil && c.infoDesc != nil {
+		ch <- prometheus.MustNewConstMetric(c.infoDesc, prometheus.GaugeValue, 1, c.about.Model, c.about.SerialNumber, c.about.FirmwareRevision, c.about.NMCFirmware)
+	}
+	if c.battery == nil || c.lastReplaceDesc == nil {
+		return
+	}
+	if t := c.battery.LastReplacement; !t.IsZero() {
+		ch <- prometheus.MustNewConstMetric(c.lastReplaceDesc, prometheus.GaugeValue, float64(t.Unix()))
+	}
+	if t := c.battery.RecommendedReplacement; !t.IsZero() {
+		ch <- prometheus.MustNewConstMetric(c.nextReplaceDesc, prometheus.GaugeValue, float64(t.Unix()))
+	}
+}
+
+// values reads the values of the device from the backend or the card's status page.
+// The status lists the values that are missing or could not be read; for a backend,
+// the metrics it left out are missing.
+func (c *Collector) values(ctx context.Context) (map[string]float64, *nmc.Status, error) {
+	if c.Backend != nil {
+		values, err := c.Backend.Values(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		if values == nil {
+			values = make(map[string]float64)
+		}
+		c.derive(values)
+		unsupported := make(map[string]bool)
+		if b, ok := c.Backend.(UnsupportedBackend); ok {
+			for _, name := range b.Unsupported() {
+				unsupported[name] = true
+				if base, ok := legacyUnits[name]; ok {
+					unsupported[base] = true
+				}
+			}
+		}
+		status := &nmc.Status{}
+		for name := range c.descs {
+			if _, ok := values[name]; !ok && !unsupported[name] {
+				status.Missing = append(status.Missing, name)
+			}
+		}
+		sort.Strings(status.Missing)
+		return values, status, nil
+	}
+	status, err := c.client.StatusWith(ctx, c.profile)
+	if err != nil {
+		return nil, nil, err
+	}
+	values := StatusValues(*status)
+	c.derive(values)
+	return values, status, nil
+}
+
+// derive adds the values that follow from others: those derive adds, the gauges in base
+// units and the output power.
+func (c *Collector) derive(values map[string]float64) {
+	derive(values)
+	if load, ok := values["ups_load_percent"]; ok && c.ratedWatts > 0 {
+		if _, ok := values["ups_output_power_watts"]; !ok {
+			values["ups_output_power_watts"] = load / 100 * c.ratedWatts
+		}
+	}
+}
+
+// derive adds the values a backend may leave out that follow from others, in legacy
+// and in base units.
+func derive(values map[string]float64) {
+	LegacyValues(values)
+	_, minutes := values["ups_runtime_remaining_minutes"]
+	_, seconds := values["ups_runtime_remaining_seconds"]
+	switch {
+	case minutes && !seconds:
+		values["ups_runtime_remaining_seconds"] = values["ups_runtime_remaining_minutes"] * 60
+	case seconds && !minutes:
+		values["ups_runtime_remaining_minutes"] = values["ups_runtime_remaining_seconds"] / 60
+	}
+	_, celsius := values["ups_internal_temperature_celsius"]
+	if _, ok := values["ups_internal_temperature_fahrenheit"]; celsius && !ok {
+		values["ups_internal_temperature_fahrenheit"] = fahrenheit(values["ups_internal_temperature_celsius"])
+	}
+	for _, b := range baseUnits {
+		_, ok := values[b.name]
+		if v, legacy := values[b.legacy]; legacy && !ok {
+			values[b.name] = v * b.scale
+		}
+	}
+}
+
+// LegacyValues adds to values the gauges in legacy units it lacks, from the gauges in
+// base units replacing them, for readers of the legacy names.
+func LegacyValues(values map[string]float64) {
+	for _, b := range baseUnits {
+		_, ok := values[b.legacy]
+		if v, base := values[b.name]; base && !ok {
+			values[b.legacy] = v / b.scale
+		}
+	}
+	_, ok := values["ups_runtime_remaining_minutes"]
+	if seconds, base := values["ups_runtime_remaining_seconds"]; base && !ok {
+		values["ups_runtime_remaining_minutes"] = seconds / 60
+	}
+}
+
+// collectFromLeader sends the values the leader polled instead of polling the card.
+func (c *Collector) collectFromLeader(ch chan<- prometheus.Metric) {
+	target := c.client.Target().Name
+	values, err := c.Leader.LeaderValues(target)
+	if err != nil {
+		c.Log(nmc.PriorityWarning, target, "leader", "Fetching %s from the leader failed: %v", target, err)
+		if values == nil {
+			c.sendFailed(ch)
+			return
+		}
+	}
+	// Leaders before ups_up was added only sent the values of successful scrapes.
+	up, ok := values["ups_up"]
+	if !ok {
+		up = 1
+	}
+	if up == 0 {
+		c.sendFailed(ch)
+		return
+	}
+	// Leaders may export other units.
+	c.derive(values)
+	ch <- prometheus.MustNewConstMetric(c.upDesc, prometheus.GaugeValue, 1)
+	for name, desc := range c.Descs() {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, values[name])
+	}
+}
+
+// sendFailed sends ups_up 0 on failure. The other metrics of the UPS are left out, so
+// a failed scrape cannot be mistaken for a UPS reading 0.
+func (c *Collector) sendFailed(ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(c.upDesc, prometheus.GaugeValue, 0)
+}
+
+// StatusValues returns the values of a status page by metric name.
+func StatusValues(s nmc.Status) map[string]float64 {
+	return map[string]float64{
+		"ups_device_status_up":                s.DeviceStatusUp,
+		"ups_load_percent":                    s.LoadPercent,
+		"ups_runtime_remaining_minutes":       s.RuntimeRemainingMinutes,
+		"ups_runtime_remaining_seconds":       s.RuntimeRemainingSeconds,
+		"ups_internal_temperature_celsius":    s.InternalTemperatureCelsius,
+		"ups_internal_temperature_fahrenheit": fahrenheit(s.InternalTemperatureCelsius),
+		"ups_load_power_percent_va":           s.LoadPowerPercentVA,
+		"ups_load_current_amps":               s.LoadCurrentAmps,
+		"ups_input_voltage_vac":               s.InputVoltageVAC,
+		"ups_output_voltage_vac":              s.OutputVoltageVAC,
+		"ups_input_frequency_hz":              s.InputFrequencyHz,
+		"ups_output_frequency_hz":             s.OutputFrequencyHz,
+		"ups_battery_charge_percent":          s.BatteryChargePercent,
+		"ups_battery_voltage_vdc":             s.BatteryVoltageVDC,
+		"ups_outlet_status":                   s.OutletStatus,
+	}
+}
+
+// fahrenheit converts a temperature in Celsius to Fahrenheit.
+func fahrenheit(celsius float64) float64 {
+	return celsius*9/5 + 32
+}
+
+// Descs returns the descriptors of the exported metrics by metric name, without the
+// namespace.
+func (c *Collector) Descs() map[string]*prometheus.Desc {
+	return maps.Clone(c.descs)
+}
@@ -0,0 +1,69 @@
+package nmc_test
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/veter2005/apc-exporter/pkg/nmc"
+	"github.com/veter2005/apc-exporter/pkg/nmcsim"
+)
+
+// TestClientSessionPaths reads the status of simulated cards that serve pages at their
+// paths and below a path of the session, also after the session expired.
+func TestClientSessionPaths(t *testing.T) {
+	for _, sessionPaths := range []bool{false, true} {
+		sim, err := nmcsim.New(nmcsim.Options{Generation: "nmc3", SessionPaths: sessionPaths})
+		if err != nil {
+			t.Fatal(err)
+		}
+		srv := httptest.NewServer(sim)
+		defer srv.Close()
+		client := nmc.NewClient(nil, nmc.Target{Name: "sim", URL: srv.URL, Username: "apc", Password: "apc"})
+
+		for i := range 2 {
+			status, err := client.Status(context.Background())
+			if err != nil {
+				t.Fatalf("session paths %v, scrape %d: %v", sessionPaths, i+1, err)
+			}
+			if status.DeviceStatusUp != 1 {
+				t.Errorf("session paths %v, scrape %d: device status %q", sessionPaths, i+1, status.DeviceStatus)
+			}
+			page := client.PageURL(nmc.StatusPath)
+			if got := strings.Contains(page, "/NMC/"); got != sessionPaths {
+				t.Errorf("session paths %v: status page at %s", sessionPaths, page)
+			}
+			sim.ExpireSessions()
+		}
+		if _, about := client.Profile(); about == nil || about.Model == "" {
+			t.Errorf("session paths %v: about page not read: %+v", sessionPaths, about)
+		}
+		battery, err := client.Battery(context.Background())
+		if err != nil {
+			t.Fatalf("session paths %v, battery page: %v", sessionPaths, err)
+		}
+		if battery.LastReplacement.IsZero() || battery.RecommendedReplacement.IsZero() {
+			t.Errorf("session paths %v: replacement dates not read: %+v", sessionPaths, battery)
+		}
+		if alarms, err := client.Alarms(context.Background()); err != nil || len(alarms) != 0 {
+			t.Errorf("session paths %v: alarms %+v, %v, want none", sessionPaths, alarms, err)
+		}
+	}
+}
+
+// TestClientLoginSpecialCharacters logs in with credentials holding the characters that
+// have a meaning in a form body.
+func TestClientLoginSpecialCharacters(t *testing.T) {
+	const username, password = "ops+admin", "p&ss=w0rd+100%"
+	sim, err := nmcsim.New(nmcsim.Options{Username: username, Password: password})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(sim)
+	defer srv.Close()
+	client := nmc.NewClient(nil, nmc.Target{Name: "sim", URL: srv.URL, Username: username, Password: password})
+	if err := client.Login(context.Background()); err != nil {
+		t.Fatalf("login with %q: %v", password, err)
+	}
+}
@@ -0,0 +1,221 @@
+package nmc
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// commaLocales are the languages whose cards show decimal commas, as in "230,1 VAC".
+var commaLocales = []string{
+	"bg", "cs", "da", "de", "el", "es", "et", "fi", "fr", "hr", "hu", "id", "it", "lt",
+	"lv", "nb", "nl", "no", "pl", "pt", "ro", "ru", "sk", "sl", "sr", "sv", "tr", "uk",
+	"vi",
+}
+
+// pointRegions are the regions of comma languages that show decimal points.
+var pointRegions = []string{"de-ch", "de-li", "it-ch"}
+
+// DecimalSeparator returns the decimal separator of the numbers shown by a card set
+// to a locale, such as "de" or "fr-CA", or 0 for "" and "auto", which guess it from
+// each number. Languages not known to use decimal commas use points.
+func DecimalSeparator(locale string) (rune, error) {
+	locale = strings.ToLower(strings.ReplaceAll(locale, "_", "-"))
+	if locale == "" || locale == "auto" {
+		return 0, nil
+	}
+	lang, region, _ := strings.Cut(locale, "-")
+	if len(lang) < 2 || len(lang) > 3 || strings.Trim(lang, "abcdefghijklmnopqrstuvwxyz") != "" || strings.Contains(region, "-") {
+		return 0, fmt.Errorf("invalid locale %q, want a language such as de or fr-CA, or auto", locale)
+	}
+	for _, r := range pointRegions {
+		if locale == r {
+			return '.', nil
+		}
+	}
+	for _, l := range commaLocales {
+		if lang == l {
+			return ',', nil
+		}
+	}
+	return '.', nil
+}
+
+// ParseNumber reads the number at the start of a value shown by a card, ignoring the
+// unit after it, as in "230,1 VAC", "1 234.5 W" or "27.0&nbsp;°C". Points, commas,
+// apostrophes and spaces, including non-breaking ones, may group the digits; decimal
+// is the decimal separator, or 0 to guess it: the last of a point and a comma if both
+// appear, otherwise a point or comma that appears once. It reports false if the value
+// does not start with a number.
+func ParseNumber(value string, decimal rune) (float64, bool) {
+	value = strings.TrimSpace(strings.Map(func(r rune) rune {
+		switch r {
+		case '\u00a0', '\u202f', '\u2009':
+			return ' '
+		case '\u2212':
+			return '-'
+		case '\u2019':
+			return '\''
+		}
+		return r
+	}, value))
+
+	// The number runs up to the first character that cannot be part of it, and ends
+	// with its last digit.
+	sign := ""
+	if strings.HasPrefix(value, "-") || strings.HasPrefix(value, "+") {
+		sign, value = value[:1], strings.TrimSpace(value[1:])
+	}
+	end := strings.IndexFunc(value, func(r rune) bool {
+		return (r < '0' || r > '9') && !strings.ContainsRune(".,' ", r)
+	})
+	if end >= 0 {
+		value = value[:end]
+	}
+	value = value[:strings.LastIndexAny(value, "0123456789")+1]
+	if value == "" || value[0] < '0' || value[0] > '9' {
+		return 0, false
+	}
+
+	if decimal == 0 {
+		decimal = guessDecimal(value)
+	}
+	var b strings.Builder
+	b.WriteString(sign)
+	for _, r := range value {
+		switch {
+		case r >= '0' && r <= '9':
+			b.WriteRune(r)
+		case r == decimal:
+			b.WriteByte('.')
+		}
+	}
+	val, err := strconv.ParseFloat(b.String(), 64)
+	return val, err == nil
+}
+
+// guessDecimal returns the decimal separator of a number shown in an unknown locale.
+// A single comma is taken as decimal, since the values of a status page are small:
+// "1,600" is more likely 1.6 A than 1600 A.
+func guessDecimal(number string) rune {
+	point, comma := strings.LastIndex(number, "."), strings.LastIndex(number, ",")
+	switch {
+	case point >= 0 && comma >= 0:
+		if point > comma {
+			return '.'
+		}
+		return ','
+	case point >= 0 && strings.Count(number, ".") == 1:
+		return '.'
+	case comma >= 0 && strings.Count(number, ",") == 1:
+		return ','
+	}
+	return 0
+}
+
+// ParseTemperature reads a temperature shown in Celsius, Fahrenheit or both, as in
+// "27.0 °C / 80.6 °F", "104.0 °F / 40.0 °C" or "80.6°F", and returns it in Celsius.
+// A Celsius value is preferred; a Fahrenheit one is converted, and a number without a
+// unit is taken as Celsius. It reports false if no part starts with a number.
+func ParseTemperature(value string, decimal rune) (float64, bool) {
+	var fahrenheit, other float64
+	var hasFahrenheit, hasOther bool
+	for _, part := range strings.Split(value, "/") {
+		val, ok := ParseNumber(part, decimal)
+		if !ok {
+			continue
+		}
+		switch temperatureUnit(part) {
+		case 'C':
+			return val, true
+		case 'F':
+			if !hasFahrenheit {
+				fahrenheit, hasFahrenheit = val, true
+			}
+		default:
+			if !hasOther {
+				other, hasOther = val, true
+			}
+		}
+	}
+	switch {
+	case hasOther:
+		return other, true
+	case hasFahrenheit:
+		return (fahrenheit - 32) * 5 / 9, true
+	}
+	return 0, false
+}
+
+// temperatureUnit returns 'C' or 'F' for the unit after the number of a temperature,
+// written as "°C", "º F", "deg F" or "C", or 0 if it has none.
+func temperatureUnit(temperature string) rune {
+	unit := strings.TrimLeftFunc(strings.TrimSpace(temperature), func(r rune) bool {
+		return r >= '0' && r <= '9' || strings.ContainsRune("+-.,' \u00a0\u202f\u2009\u2212\u2019", r)
+	})
+	unit = strings.TrimLeft(strings.TrimPrefix(strings.ToUpper(unit), "DEG"), "°º ")
+	switch {
+	case strings.HasPrefix(unit, "C"):
+		return 'C'
+	case strings.HasPrefix(unit, "F"):
+		return 'F'
+	}
+	return 0
+}
+
+// runtimeUnits are the units of the parts of a runtime, as cards write them.
+var runtimeUnits = map[string]time.Duration{
+	"d": 24 * time.Hour, "day": 24 * time.Hour, "days": 24 * time.Hour,
+	"h": time.Hour, "hr": time.Hour, "hrs": time.Hour, "hour": time.Hour, "hours": time.Hour,
+	"m": time.Minute, "min": time.Minute, "mins": time.Minute, "minute": time.Minute, "minutes": time.Minute,
+	"s": time.Second, "sec": time.Second, "secs": time.Second, "second": time.Second, "seconds": time.Second,
+}
+
+var (
+	runtimeClockRE = regexp.MustCompile(`^(\d+):(\d{1,2})(?::(\d{1,2}))?$`)
+	runtimePartRE  = regexp.MustCompile(`^(\d+(?:[.,]\d+)?)\s*([a-z]*)\.?`)
+)
+
+// ParseRuntime reads a runtime as cards show it: "42", "42 min", "83 minutes",
+// "1 hr 23 min", "0 hr 05 min", "1 hour 5 seconds", or "01:23:45" and "1:23" as hours,
+// minutes and seconds. A number without a unit is minutes. It reports false for
+// anything else, rather than reading a part of it.
+func ParseRuntime(value string) (time.Duration, bool) {
+	value = strings.ToLower(strings.Join(strings.Fields(strings.ReplaceAll(value, "\u00a0", " ")), " "))
+	if value == "" {
+		return 0, false
+	}
+	if m := runtimeClockRE.FindStringSubmatch(value); m != nil {
+		hours, _ := strconv.Atoi(m[1])
+		minutes, _ := strconv.Atoi(m[2])
+		seconds := 0
+		if m[3] != "" {
+			seconds, _ = strconv.Atoi(m[3])
+		}
+		if minutes > 59 || seconds > 59 {
+			return 0, false
+		}
+		return time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute + time.Duration(seconds)*time.Second, true
+	}
+
+	var runtime time.Duration
+	for value != "" {
+		m := runtimePartRE.FindStringSubmatch(value)
+		if m == nil {
+			return 0, false
+		}
+		unit, ok := time.Minute, true
+		if m[2] != "" {
+			unit, ok = runtimeUnits[m[2]]
+		}
+		n, err := strconv.ParseFloat(strings.Replace(m[1], ",", ".", 1), 64)
+		if !ok || err != nil {
+			return 0, false
+		}
+		runtime += time.Duration(n * float64(unit))
+		value = strings.TrimSpace(value[len(m[0]):])
+	}
+	return runtime, true
+}
@@ -0,0 +1,129 @@
+package nmc
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestParseNumber(t *testing.T) {
+	for _, tt := range []struct {
+		value   string
+		decimal rune
+		want    float64
+		ok      bool
+	}{
+		{"230.4", 0, 230.4, true},
+		{"230,1 VAC", 0, 230.1, true},
+		{"230,1 V CA", 0, 230.1, true},
+		{" 27.0 °C ", 0, 27, true},
+		{"1,234.5 W", 0, 1234.5, true},
+		{"1.234,5 W", 0, 1234.5, true},
+		{"1 234,5 W", 0, 1234.5, true},
+		{"1 234.5", 0, 1234.5, true},
+		{"1'234.5", 0, 1234.5, true},
+		{"1.234.567", 0, 1234567, true},
+		{"1,600 A", 0, 1.6, true},
+		{"1,600 A", '.', 1600, true},
+		{"1.600 A", ',', 1600, true},
+		{"54,60", ',', 54.6, true},
+		{"-5,5 °C", 0, -5.5, true},
+		{"−5.5", 0, -5.5, true},
+		{"42", 0, 42, true},
+		{"On Line", 0, 0, false},
+		{"NaN", 0, 0, false},
+		{"Inf", 0, 0, false},
+		{"", 0, 0, false},
+		{"-", 0, 0, false},
+		{", 5", 0, 0, false},
+	} {
+		got, ok := ParseNumber(tt.value, tt.decimal)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("ParseNumber(%q, %q) = %v, %v, want %v, %v", tt.value, tt.decimal, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestDecimalSeparator(t *testing.T) {
+	for _, tt := range []struct {
+		locale string
+		want   rune
+		err    bool
+	}{
+		{"", 0, false},
+		{"auto", 0, false},
+		{"en", '.', false},
+		{"en-US", '.', false},
+		{"de", ',', false},
+		{"de_DE", ',', false},
+		{"de-CH", '.', false},
+		{"fr-CA", ',', false},
+		{"ja", '.', false},
+		{"german", 0, true},
+		{"de-DE-x", 0, true},
+		{"1", 0, true},
+	} {
+		got, err := DecimalSeparator(tt.locale)
+		if got != tt.want || (err != nil) != tt.err {
+			t.Errorf("DecimalSeparator(%q) = %q, %v, want %q, error %v", tt.locale, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestParseTemperature(t *testing.T) {
+	for _, tt := range []struct {
+		value   string
+		decimal rune
+		want    float64
+		ok      bool
+	}{
+		{"27.0 °C / 80.6 °F", 0, 27, true},
+		{"104.0 °F / 40.0 °C", 0, 40, true},
+		{"104.0 °F/40.0 °C", 0, 40, true},
+		{"80.6°F", 0, 27, true},
+		{"212 deg F", 0, 100, true},
+		{"-4 ºF", 0, -20, true},
+		{"27,5 °C / 81,5 °F", 0, 27.5, true},
+		{"27.0", 0, 27, true},
+		{"27.0 C", 0, 27, true},
+		{"80.6 °F / 27.0", 0, 27, true},
+		{"n/a", 0, 0, false},
+		{"", 0, 0, false},
+	} {
+		got, ok := ParseTemperature(tt.value, tt.decimal)
+		if math.Abs(got-tt.want) > 1e-9 || ok != tt.ok {
+			t.Errorf("ParseTemperature(%q, %q) = %v, %v, want %v, %v", tt.value, tt.decimal, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestParseRuntime(t *testing.T) {
+	for _, tt := range []struct {
+		value string
+		want  time.Duration
+		ok    bool
+	}{
+		{"42", 42 * time.Minute, true},
+		{" 42 min ", 42 * time.Minute, true},
+		{"83 minutes", 83 * time.Minute, true},
+		{"1 hr 23 min", 83 * time.Minute, true},
+		{"0 hr 05 min", 5 * time.Minute, true},
+		{"2 Hours 0 Minutes", 2 * time.Hour, true},
+		{"1 hour 5 seconds", time.Hour + 5*time.Second, true},
+		{"1hr 2min 3sec", time.Hour + 2*time.Minute + 3*time.Second, true},
+		{"12 min.", 12 * time.Minute, true},
+		{"1,5 min", 90 * time.Second, true},
+		{"01:23:45", time.Hour + 23*time.Minute + 45*time.Second, true},
+		{"1:23", time.Hour + 23*time.Minute, true},
+		{"01:60:00", 0, false},
+		{"1 fortnight", 0, false},
+		{"Calibrating", 0, false},
+		{"--", 0, false},
+		{"", 0, false},
+	} {
+		got, ok := ParseRuntime(tt.value)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("ParseRuntime(%q) = %v, %v, want %v, %v", tt.value, got, ok, tt.want, tt.ok)
+		}
+	}
+}
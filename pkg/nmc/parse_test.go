@@ -0,0 +1,214 @@
+package nmc
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+var update = flag.Bool("update", false, "Rewrite the golden files of the testdata pages")
+
+// goldenResult is what a golden file holds for a page: the status read from it, or
+// the error reading it returned.
+type goldenResult struct {
+	Status *Status `json:",omitempty"`
+	Error  string  `json:",omitempty"`
+}
+
+func parseGolden(page []byte) goldenResult {
+	status, err := ParseStatus(page)
+	if err != nil {
+		return goldenResult{Error: err.Error()}
+	}
+	return goldenResult{Status: &status}
+}
+
+// TestParseStatusGolden parses every testdata/*.html page and compares the result with
+// the .golden file next to it. Run with -update to rewrite the golden files after a
+// deliberate change, and review their diff.
+func TestParseStatusGolden(t *testing.T) {
+	pages, err := filepath.Glob(filepath.Join("testdata", "*.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pages) == 0 {
+		t.Fatal("no pages in testdata")
+	}
+	for _, page := range pages {
+		name := strings.TrimSuffix(filepath.Base(page), ".html")
+		t.Run(name, func(t *testing.T) {
+			data, err := os.ReadFile(page)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := json.MarshalIndent(parseGolden(data), "", "  ")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, '\n')
+			golden := strings.TrimSuffix(page, ".html") + ".golden"
+			if *update {
+				if err := os.WriteFile(golden, got, 0o644); err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("%v (run go test -update to create it)", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("%s parsed to\n%s\nwant\n%s", page, got, want)
+			}
+		})
+	}
+}
+
+// TestParseStatusProfiles checks that the status page of each generation is read the
+// same by its own profile as by ParseStatus, so a page is not read by the wrong one.
+func TestParseStatusProfiles(t *testing.T) {
+	for _, name := range []string{"nmc1", "nmc2", "nmc2-legacy", "nmc3"} {
+		t.Run(name, func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join("testdata", name+"-status.html"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			profile := LookupProfile(name)
+			if profile == nil {
+				t.Fatalf("no profile %s", name)
+			}
+			got, err := profile.ParseStatus(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := ParseStatus(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("profile %s read %+v, ParseStatus %+v", name, got, want)
+			}
+			if got.DeviceStatusUp != 1 {
+				t.Errorf("profile %s did not read the device status: %+v", name, got)
+			}
+		})
+	}
+}
+
+func TestParseStatusDebug(t *testing.T) {
+	data, err := os.ReadFile(filepath.Join("testdata", "nmc2-status.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var messages []string
+	debugf := func(format string, args ...any) {
+		messages = append(messages, fmt.Sprintf(format, args...))
+	}
+	status, err := LookupProfile("nmc2").parseStatus(doc, parseOptions{debugf: debugf})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := fmt.Sprintf("Selector %q of LoadPercent read ", valueSelectors.LoadPercent)
+	found := false
+	for _, m := range messages {
+		if strings.HasPrefix(m, want) && strings.HasSuffix(m, fmt.Sprintf(" as %v", status.LoadPercent)) {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("no message %q… as %v among %q", want, status.LoadPercent, messages)
+	}
+}
+
+// FuzzParseStatus feeds ParseStatus mutations of the testdata pages. It must not panic,
+// and must fail only with ErrNoStatus: ErrParse would mean a panic was recovered.
+func FuzzParseStatus(f *testing.F) {
+	pages, err := filepath.Glob(filepath.Join("testdata", "*.html"))
+	if err != nil {
+		f.Fatal(err)
+	}
+	for _, page := range pages {
+		data, err := os.ReadFile(page)
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(data)
+	}
+	f.Add([]byte(""))
+	f.Add([]byte("<span id=\"value_DeviceStatus\">"))
+	f.Fuzz(func(t *testing.T, page []byte) {
+		if _, err := ParseStatus(page); err != nil && !errors.Is(err, ErrNoStatus) {
+			t.Errorf("ParseStatus(%q): %v", page, err)
+		}
+	})
+}
+
+func TestParseAboutLanguages(t *testing.T) {
+	for _, page := range []string{
+		`<table><tr><td>Model:</td><td>Smart-UPS 1500</td></tr><tr><td>Serial Number:</td><td>AS1234</td></tr><tr><td>Firmware Revision:</td><td>UPS 09.3</td></tr></table>`,
+		`<table><tr><td>Modell:</td><td>Smart-UPS 1500</td></tr><tr><td>Seriennummer:</td><td>AS1234</td></tr><tr><td>Firmware-Revision:</td><td>UPS 09.3</td></tr></table>`,
+		`<table><tr><td>Modèle :</td><td>Smart-UPS 1500</td></tr><tr><td>Numéro de série</td><td>AS1234</td></tr><tr><td>Révision du micrologiciel</td><td>UPS 09.3</td></tr></table>`,
+		`<table><tr><td>Modelo:</td><td>Smart-UPS 1500</td></tr><tr><td>Número de serie:</td><td>AS1234</td></tr><tr><td>Revisión de firmware:</td><td>UPS 09.3</td></tr></table>`,
+	} {
+		doc, err := goquery.NewDocumentFromReader(strings.NewReader(page))
+		if err != nil {
+			t.Fatal(err)
+		}
+		about := ParseAbout(doc)
+		if about.Model != "Smart-UPS 1500" || about.SerialNumber != "AS1234" || about.FirmwareRevision != "UPS 09.3" {
+			t.Errorf("ParseAbout(%s) = %+v", page, about)
+		}
+	}
+}
+
+func TestParseBatteryDates(t *testing.T) {
+	last := time.Date(2021, 1, 27, 0, 0, 0, 0, time.UTC)
+	next := time.Date(2025, 1, 27, 0, 0, 0, 0, time.UTC)
+	for _, page := range []string{
+		`<table><tr><td>Last Battery Replacement Date:</td><td>01/27/2021</td></tr><tr><td>Recommended Replacement Date:</td><td>01/27/2025</td></tr></table>`,
+		`<dl><dd id="value_LastReplacementDate">2021-01-27</dd><dd id="value_RecommendedReplacementDate">2025-01-27</dd></dl>`,
+		`<table><tr><td>Battery Replacement Date:</td><td>27.01.2021</td></tr><tr><td>Replace Battery By:</td><td>27.01.2025</td></tr></table>`,
+	} {
+		doc, err := goquery.NewDocumentFromReader(strings.NewReader(page))
+		if err != nil {
+			t.Fatal(err)
+		}
+		battery := ParseBattery(doc)
+		if !battery.LastReplacement.Equal(last) || !battery.RecommendedReplacement.Equal(next) {
+			t.Errorf("ParseBattery(%s) = %+v", page, battery)
+		}
+	}
+}
+
+func TestParseAlarms(t *testing.T) {
+	for _, tc := range []struct {
+		page string
+		want int
+	}{
+		{`<p>No Alarms Present</p>`, 0},
+		{`<table><tr><th>Severity</th><th>Alarm</th></tr><tr class="alarm"><td>Critical</td><td>UPS: On battery power in response to an input power problem.</td></tr><tr class="alarm"><td>Warning</td><td>UPS: A battery replacement is recommended.</td></tr></table>`, 2},
+		{`<ul><li class="list-group-item alarm">UPS: The output power is nearing its overload limit.</li></ul>`, 1},
+	} {
+		doc, err := goquery.NewDocumentFromReader(strings.NewReader(tc.page))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := ParseAlarms(doc); len(got) != tc.want {
+			t.Errorf("ParseAlarms(%s) = %+v, want %d alarms", tc.page, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,357 @@
+package nmc
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// Selectors are the CSS selectors of the values of a status page.
+type Selectors struct {
+	DeviceStatus         string // "On Line" or another status, see MatchStatus
+	LoadPercent          string
+	RuntimeRemaining     string
+	InternalTemperature  string // in Celsius, Fahrenheit or both, as "27.0 °C / 80.6 °F"
+	ApparentPowerPercent string
+	LoadCurrent          string
+	InputVoltage         string
+	OutputVoltage        string
+	InputFrequency       string
+	OutputFrequency      string
+	BatteryCharge        string
+	BatteryVoltage       string
+	OutletStatus         string // "On" or "Off", see MatchOutletState
+	LastTransfer         string // the cause of the last transfer to battery, as shown
+
+	// OutletGroupState and OutletGroupLoad select the state ("On" or "Off", see
+	// MatchOutletState) and the load in percent of each outlet group, with %d for the
+	// index of the group from 0, the main outlet group. Groups are read up to the first
+	// index without a state. The name of a group is the label of the row of its state.
+	OutletGroupState string
+	OutletGroupLoad  string
+}
+
+// HasStatus reports whether doc is a status page with these selectors.
+func (s Selectors) HasStatus(doc *goquery.Document) bool {
+	return doc.Find(s.DeviceStatus).Length() > 0
+}
+
+// Parse reads the values of a status page, guessing the decimal separator of each
+// number. Values missing from the page are 0.
+func (s Selectors) Parse(doc *goquery.Document) Status {
+	return s.parse(doc, parseOptions{})
+}
+
+// parseOptions are the settings of a target that apply to reading its status page.
+type parseOptions struct {
+	decimal       rune   // decimal separator, 0 to guess it
+	language      string // of the status strings, "" or "auto" to detect it
+	statusStrings []StatusString
+	// debugf, if set, receives what each selector read, to debug the parsing of pages.
+	debugf func(format string, args ...any)
+}
+
+// debug passes a message about the parsing to debugf, if set.
+func (opts parseOptions) debug(format string, args ...any) {
+	if opts.debugf != nil {
+		opts.debugf(format, args...)
+	}
+}
+
+// statusLanguage returns the language whose status strings a page is read with: the
+// one configured, or the one the page declares if there are strings for it, or "" to
+// try all.
+func (opts parseOptions) statusLanguage(doc *goquery.Document) string {
+	if opts.language != "" && opts.language != "auto" {
+		return opts.language
+	}
+	language := PageLanguage(doc)
+	if _, ok := LanguageStatusStrings[language]; ok || language == "en" {
+		return language
+	}
+	return ""
+}
+
+// parse reads the values of a status page.
+func (s Selectors) parse(doc *goquery.Document, opts parseOptions) Status {
+	var missing, unparsed []string
+	// read reads the value of a field with parse, and notes if it cannot.
+	read := func(field, selector string, parse func(string) (float64, bool)) float64 {
+		sel := doc.Find(selector)
+		if sel.Length() == 0 {
+			if selector != "" {
+				missing = append(missing, field)
+				opts.debug("Selector %q of %s matches nothing", selector, field)
+			}
+			return 0
+		}
+		text := sel.Text()
+		val, ok := parse(text)
+		if !ok {
+			unparsed = append(unparsed, field)
+			opts.debug("Selector %q of %s read %q, which cannot be parsed", selector, field, text)
+			return 0
+		}
+		opts.debug("Selector %q of %s read %q as %v", selector, field, text, val)
+		return val
+	}
+	number := func(value string) (float64, bool) {
+		return ParseNumber(value, opts.decimal)
+	}
+	temperature := func(value string) (float64, bool) {
+		return ParseTemperature(value, opts.decimal)
+	}
+	runtime := func(value string) (float64, bool) {
+		d, ok := ParseRuntime(value)
+		return d.Seconds(), ok
+	}
+	language := opts.statusLanguage(doc)
+	// outlet reads the state of an outlet or outlet group: 1 if on, 0 if off, missing or
+	// not an outlet state.
+	outlet := func(field string, sel *goquery.Selection) float64 {
+		if sel.Length() == 0 {
+			return 0
+		}
+		text := strings.TrimSpace(sel.Text())
+		state, ok := MatchOutletState(text, language)
+		if !ok {
+			opts.debug("%s read %q, which is no outlet state", field, text)
+		}
+		return state.Value
+	}
+
+	var groups []OutletGroup
+	for i := 0; s.OutletGroupState != "" && i < maxOutletGroups; i++ {
+		state := doc.Find(fmt.Sprintf(s.OutletGroupState, i)).First()
+		if state.Length() == 0 {
+			break
+		}
+		group := OutletGroup{Index: i, Name: rowLabel(state), On: outlet("OutletGroupState", state)}
+		if s.OutletGroupLoad != "" && doc.Find(fmt.Sprintf(s.OutletGroupLoad, i)).Length() > 0 {
+			group.LoadPercent = read("OutletGroupLoad", fmt.Sprintf(s.OutletGroupLoad, i), number)
+			group.LoadShown = true
+		}
+		groups = append(groups, group)
+	}
+
+	runtimeSeconds := read("RuntimeRemaining", s.RuntimeRemaining, runtime)
+	deviceStatus := strings.TrimSpace(doc.Find(s.DeviceStatus).First().Text())
+	state, _ := MatchStatus(deviceStatus, language, opts.statusStrings)
+	opts.debug("Selector %q of DeviceStatus read %q as state %q", s.DeviceStatus, deviceStatus, state.State)
+	return Status{
+		DeviceStatus:               deviceStatus,
+		DeviceState:                state.State,
+		DeviceStatusUp:             state.Value,
+		LoadPercent:                read("LoadPercent", s.LoadPercent, number),
+		RuntimeRemainingMinutes:    runtimeSeconds / 60,
+		RuntimeRemainingSeconds:    runtimeSeconds,
+		InternalTemperatureCelsius: read("InternalTemperature", s.InternalTemperature, temperature),
+		LoadPowerPercentVA:         read("ApparentPowerPercent", s.ApparentPowerPercent, number),
+		LoadCurrentAmps:            read("LoadCurrent", s.LoadCurrent, number),
+		InputVoltageVAC:            read("InputVoltage", s.InputVoltage, number),
+		OutputVoltageVAC:           read("OutputVoltage", s.OutputVoltage, number),
+		InputFrequencyHz:           read("InputFrequency", s.InputFrequency, number),
+		OutputFrequencyHz:          read("OutputFrequency", s.OutputFrequency, number),
+		BatteryChargePercent:       read("BatteryCharge", s.BatteryCharge, number),
+		BatteryVoltageVDC:          read("BatteryVoltage", s.BatteryVoltage, number),
+		OutletStatus:               outlet("OutletStatus", doc.Find(s.OutletStatus)),
+		LastTransfer:               strings.TrimSpace(doc.Find(s.LastTransfer).First().Text()),
+		OutletGroups:               groups,
+		Missing:                    missing,
+		Unparsed:                   unparsed,
+	}
+}
+
+// maxOutletGroups bounds the outlet groups read from a page.
+const maxOutletGroups = 64
+
+// rowLabel returns the label of the table row or NMC 2 data field of a value, without
+// a trailing colon.
+func rowLabel(value *goquery.Selection) string {
+	label := value.Closest("tr, .dataField").Children().First()
+	if label.Length() == 0 || label.IsSelection(value) || label.Contains(value.Get(0)) {
+		return ""
+	}
+	return strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(label.Text()), ":"))
+}
+
+// Profile is how the pages of one card generation or firmware line are read.
+type Profile struct {
+	Name string
+	// Match reports whether the profile fits the card that served a logon page.
+	Match  func(logon *goquery.Document) bool
+	Status Selectors
+}
+
+// ParseStatus reads the values of a status page with the profile's selectors. Values
+// missing from the page are 0, and a page without a device status returns ErrNoStatus.
+func (p *Profile) ParseStatus(page []byte) (Status, error) {
+	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(page))
+	if err != nil {
+		return Status{}, fmt.Errorf("%w: %v", ErrParse, err)
+	}
+	return p.parseStatus(doc, parseOptions{})
+}
+
+// parseStatus reads a parsed status page. Registered profiles bring their own
+// selectors, so a panic while reading the page is returned as ErrParse: a malformed
+// page fails the scrape, not the collector.
+func (p *Profile) parseStatus(doc *goquery.Document, opts parseOptions) (status Status, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			status, err = Status{}, fmt.Errorf("%w with parser profile %s: %v", ErrParse, p.Name, r)
+		}
+	}()
+	if !p.Status.HasStatus(doc) {
+		return Status{}, fmt.Errorf("%w (parser profile %s)", ErrNoStatus, p.Name)
+	}
+	return p.Status.parse(doc, opts), nil
+}
+
+// valueSelectors are the selectors of the value_<Name> ids of NMC 2 firmware.
+var valueSelectors = Selectors{
+	DeviceStatus:         "#value_DeviceStatus",
+	LoadPercent:          "#value_RealPowerPct",
+	RuntimeRemaining:     "#value_RuntimeRemaining",
+	InternalTemperature:  "#value_InternalTemp",
+	ApparentPowerPercent: "#value_ApparentPowerPct",
+	LoadCurrent:          "#value_LoadCurrent",
+	InputVoltage:         "#value_InputVoltage",
+	OutputVoltage:        "#value_OutputVoltage",
+	InputFrequency:       "#value_InputFrequency",
+	OutputFrequency:      "#value_OutputFrequency",
+	BatteryCharge:        "#value_BatteryCharge",
+	BatteryVoltage:       "#value_VoltageDC",
+	OutletStatus:         "#status0",
+	LastTransfer:         "#value_LastTransfer",
+	OutletGroupState:     "#status%d",
+}
+
+// nmc1Value selects the value of an NMC 1 status table row by its label.
+func nmc1Value(label string) string {
+	return `td:contains("` + label + `") + td`
+}
+
+// DefaultProfile is used for cards no profile matches: NMC 2 with AOS 6.x, the
+// pages the exporter was first written for.
+var DefaultProfile = &Profile{
+	Name: "nmc2",
+	Match: func(logon *goquery.Document) bool {
+		return logon.Find(`form[name="frmLogin"]`).Length() > 0
+	},
+	Status: valueSelectors,
+}
+
+var (
+	profilesMu sync.RWMutex
+	// registered are the profiles added with RegisterProfile, tried before builtin.
+	registered []*Profile
+	builtin    = []*Profile{
+		{
+			Name: "nmc3",
+			Match: func(logon *goquery.Document) bool {
+				return strings.Contains(logon.Find("title").Text(), "Network Management Card 3")
+			},
+			Status: Selectors{
+				DeviceStatus:         `[data-field="deviceStatus"]`,
+				LoadPercent:          `[data-field="realPowerPercent"]`,
+				RuntimeRemaining:     `[data-field="runtimeRemaining"]`,
+				InternalTemperature:  `[data-field="internalTemperature"]`,
+				ApparentPowerPercent: `[data-field="apparentPowerPercent"]`,
+				LoadCurrent:          `[data-field="loadCurrent"]`,
+				InputVoltage:         `[data-field="inputVoltage"]`,
+				OutputVoltage:        `[data-field="outputVoltage"]`,
+				InputFrequency:       `[data-field="inputFrequency"]`,
+				OutputFrequency:      `[data-field="outputFrequency"]`,
+				BatteryCharge:        `[data-field="batteryCharge"]`,
+				BatteryVoltage:       `[data-field="batteryVoltage"]`,
+				OutletStatus:         `[data-field="outletGroup0.state"]`,
+				LastTransfer:         `[data-field="lastTransfer"]`,
+				OutletGroupState:     `[data-field="outletGroup%d.state"]`,
+				OutletGroupLoad:      `[data-field="outletGroup%d.load"]`,
+			},
+		},
+		{
+			// AOS 5.x shows the same ids as 6.x in a table layout.
+			Name: "nmc2-legacy",
+			Match: func(logon *goquery.Document) bool {
+				return logon.Find(`form[name="HashForm1"]`).Length() > 0
+			},
+			Status: valueSelectors,
+		},
+		{
+			// NMC 1 (AP9617/AP9618/AP9619) labels its values in a table. It logs in with
+			// HTTP basic auth, so it has no logon page to match: it is used when
+			// configured, and by ParseStatus.
+			Name: "nmc1",
+			Status: Selectors{
+				DeviceStatus:         nmc1Value("Status of UPS"),
+				LoadPercent:          nmc1Value("UPS Load"),
+				RuntimeRemaining:     nmc1Value("Runtime Remaining"),
+				InternalTemperature:  nmc1Value("Internal Temperature"),
+				ApparentPowerPercent: nmc1Value("Apparent Load Power"),
+				LoadCurrent:          nmc1Value("Load Current"),
+				InputVoltage:         nmc1Value("Input Voltage"),
+				OutputVoltage:        nmc1Value("Output Voltage"),
+				InputFrequency:       nmc1Value("Input Frequency"),
+				OutputFrequency:      nmc1Value("Output Frequency"),
+				BatteryCharge:        nmc1Value("Battery Capacity"),
+				BatteryVoltage:       nmc1Value("Battery Voltage"),
+				OutletStatus:         nmc1Value("Outlet Status"),
+				LastTransfer:         nmc1Value("Last Transfer Cause"),
+			},
+		},
+		DefaultProfile,
+	}
+)
+
+// RegisterProfile adds a profile, which is tried before the built-in ones and those
+// registered before it. A profile with the name of an existing one replaces it.
+func RegisterProfile(p *Profile) {
+	profilesMu.Lock()
+	defer profilesMu.Unlock()
+	registered = removeProfile(registered, p.Name)
+	builtin = removeProfile(builtin, p.Name)
+	registered = append([]*Profile{p}, registered...)
+}
+
+func removeProfile(profiles []*Profile, name string) []*Profile {
+	var kept []*Profile
+	for _, p := range profiles {
+		if p.Name != name {
+			kept = append(kept, p)
+		}
+	}
+	return kept
+}
+
+// Profiles returns the profiles in the order they are tried.
+func Profiles() []*Profile {
+	profilesMu.RLock()
+	defer profilesMu.RUnlock()
+	return append(append([]*Profile(nil), registered...), builtin...)
+}
+
+// LookupProfile returns the profile of a name, or nil.
+func LookupProfile(name string) *Profile {
+	for _, p := range Profiles() {
+		if p.Name == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// DetectProfile returns the first profile matching a logon page, or DefaultProfile
+// and false if none does.
+func DetectProfile(logon *goquery.Document) (*Profile, bool) {
+	for _, p := range Profiles() {
+		if p.Match != nil && p.Match(logon) {
+			return p, true
+		}
+	}
+	return DefaultProfile, false
+}
@@ -0,0 +1,185 @@
+package nmc
+
+import (
+	"maps"
+	"slices"
+	"strings"
+	"unicode"
+
+	"github.com/PuerkitoBio/goquery"
+)
+
+// StatusString maps a device status shown by a card, such as "On Battery", to a state
+// and the value of Status.DeviceStatusUp.
+type StatusString struct {
+	Text  string  `yaml:"text"`
+	State string  `yaml:"state"`
+	Value float64 `yaml:"value"`
+}
+
+// DefaultStatusStrings are the device statuses of English firmware. Only the statuses
+// that keep the load on mains power are up.
+var DefaultStatusStrings = []StatusString{
+	{Text: "On Line", State: "online", Value: 1},
+	{Text: "Online", State: "online", Value: 1},
+	{Text: "Smart Boost", State: "boost", Value: 1},
+	{Text: "Smart Trim", State: "trim", Value: 1},
+	{Text: "On Battery", State: "onBattery", Value: 0},
+	{Text: "On Bypass", State: "bypass", Value: 0},
+	{Text: "Off", State: "off", Value: 0},
+	{Text: "Discharged", State: "discharged", Value: 0},
+}
+
+// LanguageStatusStrings are the device statuses of firmware in other languages than
+// English, by language. Firmware in these languages shows some statuses in English.
+var LanguageStatusStrings = map[string][]StatusString{
+	"de": {
+		{Text: "Netzbetrieb", State: "online", Value: 1},
+		{Text: "Batteriebetrieb", State: "onBattery", Value: 0},
+		{Text: "Auf Batterie", State: "onBattery", Value: 0},
+		{Text: "Bypass", State: "bypass", Value: 0},
+		{Text: "Aus", State: "off", Value: 0},
+		{Text: "Entladen", State: "discharged", Value: 0},
+	},
+	"fr": {
+		{Text: "En ligne", State: "online", Value: 1},
+		{Text: "Sur batterie", State: "onBattery", Value: 0},
+		{Text: "En dérivation", State: "bypass", Value: 0},
+		{Text: "Sur bypass", State: "bypass", Value: 0},
+		{Text: "Arrêt", State: "off", Value: 0},
+		{Text: "Déchargée", State: "discharged", Value: 0},
+	},
+	"es": {
+		{Text: "En línea", State: "online", Value: 1},
+		{Text: "En batería", State: "onBattery", Value: 0},
+		{Text: "Con batería", State: "onBattery", Value: 0},
+		{Text: "En bypass", State: "bypass", Value: 0},
+		{Text: "En derivación", State: "bypass", Value: 0},
+		{Text: "Apagado", State: "off", Value: 0},
+		{Text: "Descargada", State: "discharged", Value: 0},
+	},
+	"it": {
+		{Text: "In linea", State: "online", Value: 1},
+		{Text: "A batteria", State: "onBattery", Value: 0},
+		{Text: "Su batteria", State: "onBattery", Value: 0},
+		{Text: "In bypass", State: "bypass", Value: 0},
+		{Text: "Spento", State: "off", Value: 0},
+		{Text: "Scarica", State: "discharged", Value: 0},
+	},
+}
+
+// DefaultOutletStrings are the states of outlets and outlet groups shown by English
+// firmware, with the value of Status.OutletStatus and OutletGroup.On.
+var DefaultOutletStrings = []StatusString{
+	{Text: "On", State: "on", Value: 1},
+	{Text: "Off", State: "off", Value: 0},
+}
+
+// LanguageOutletStrings are the outlet states of firmware in other languages than
+// English, by language, as LanguageStatusStrings are for the device status.
+var LanguageOutletStrings = map[string][]StatusString{
+	"de": {
+		{Text: "Ein", State: "on", Value: 1},
+		{Text: "An", State: "on", Value: 1},
+		{Text: "Aus", State: "off", Value: 0},
+	},
+	"fr": {
+		{Text: "Allumé", State: "on", Value: 1},
+		{Text: "Activé", State: "on", Value: 1},
+		{Text: "Éteint", State: "off", Value: 0},
+		{Text: "Désactivé", State: "off", Value: 0},
+	},
+	"es": {
+		{Text: "Encendido", State: "on", Value: 1},
+		{Text: "Apagado", State: "off", Value: 0},
+	},
+	"it": {
+		{Text: "Acceso", State: "on", Value: 1},
+		{Text: "Spento", State: "off", Value: 0},
+	},
+}
+
+// Languages returns the languages of LanguageStatusStrings, sorted.
+func Languages() []string {
+	return slices.Sorted(maps.Keys(LanguageStatusStrings))
+}
+
+// MatchStatus returns the status string a device status reads as, out of custom, the
+// strings of a language, and DefaultStatusStrings. An empty language tries the strings
+// of all languages. A status string matches if its text appears in the status as whole
+// words, ignoring case and spacing, as "Smart Boost" does in "On Line, Smart Boost";
+// the longest match wins, and the first of equally long ones. It reports false for a
+// status no string matches.
+func MatchStatus(status, language string, custom []StatusString) (StatusString, bool) {
+	return matchStrings(status, languageLists(custom, language, LanguageStatusStrings, DefaultStatusStrings))
+}
+
+// MatchOutletState returns the outlet state an outlet or outlet group shows, out of
+// the strings of a language and DefaultOutletStrings, matched as by MatchStatus. It
+// reports false for a state no string matches.
+func MatchOutletState(state, language string) (StatusString, bool) {
+	return matchStrings(state, languageLists(nil, language, LanguageOutletStrings, DefaultOutletStrings))
+}
+
+// languageLists returns the lists of strings to match in order: custom, those of the
+// language, or of all languages if it is "", and the English defaults.
+func languageLists(custom []StatusString, language string, byLanguage map[string][]StatusString, defaults []StatusString) [][]StatusString {
+	lists := [][]StatusString{custom}
+	if language != "" {
+		lists = append(lists, byLanguage[language])
+	} else {
+		for _, l := range slices.Sorted(maps.Keys(byLanguage)) {
+			lists = append(lists, byLanguage[l])
+		}
+	}
+	return append(lists, defaults)
+}
+
+// matchStrings returns the longest string of the lists whose text appears in status as
+// whole words, and the first of equally long ones.
+func matchStrings(status string, lists [][]StatusString) (StatusString, bool) {
+	words := statusWords(status)
+	var best StatusString
+	bestLen := 0
+	for _, list := range lists {
+		for _, s := range list {
+			text := statusWords(s.Text)
+			if n := len(strings.Join(text, " ")); n > bestLen && containsWords(words, text) {
+				best, bestLen = s, n
+			}
+		}
+	}
+	return best, bestLen > 0
+}
+
+// statusWords splits a status into lower-case words.
+func statusWords(status string) []string {
+	return strings.FieldsFunc(strings.ToLower(status), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// containsWords reports whether words contains the sequence sub.
+func containsWords(words, sub []string) bool {
+	for i := 0; i+len(sub) <= len(words); i++ {
+		match := true
+		for j := range sub {
+			if words[i+j] != sub[j] {
+				match = false
+				break
+			}
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
+
+// PageLanguage returns the language a page declares in its html element, such as "de"
+// for lang="de-DE", or "" if it declares none.
+func PageLanguage(doc *goquery.Document) string {
+	lang, _ := doc.Find("html").First().Attr("lang")
+	lang, _, _ = strings.Cut(strings.ToLower(strings.TrimSpace(lang)), "-")
+	return lang
+}
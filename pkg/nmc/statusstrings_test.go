@@ -0,0 +1,77 @@
+package nmc
+
+import "testing"
+
+func TestMatchStatus(t *testing.T) {
+	custom := []StatusString{
+		{Text: "En ligne", State: "online", Value: 1},
+		{Text: "Off", State: "shutdown", Value: 0},
+	}
+	for _, tt := range []struct {
+		status   string
+		language string
+		state    string
+		value    float64
+		ok       bool
+	}{
+		{"On Line", "", "online", 1, true},
+		{" on  line ", "", "online", 1, true},
+		{"Online", "", "online", 1, true},
+		{"On Battery", "", "onBattery", 0, true},
+		{"On Bypass", "", "bypass", 0, true},
+		{"Off", "", "shutdown", 0, true},
+		{"Discharged", "", "discharged", 0, true},
+		{"On Line, Smart Boost", "", "boost", 1, true},
+		{"On Line, Smart Trim", "", "trim", 1, true},
+		{"On Battery, Discharged", "", "onBattery", 0, true},
+		{"En ligne", "", "online", 1, true},
+		{"Onboard", "", "", 0, false},
+		{"On", "", "", 0, false},
+		{"Offline", "", "", 0, false},
+		{"", "", "", 0, false},
+		{"Netzbetrieb", "", "online", 1, true},
+		{"Netzbetrieb", "de", "online", 1, true},
+		{"Batteriebetrieb", "de", "onBattery", 0, true},
+		{"On Battery", "de", "onBattery", 0, true},
+		{"Sur batterie", "fr", "onBattery", 0, true},
+		{"Sur batterie", "de", "", 0, false},
+		{"En línea", "", "online", 1, true},
+		{"In linea", "it", "online", 1, true},
+		{"Netzbetrieb", "en", "", 0, false},
+	} {
+		got, ok := MatchStatus(tt.status, tt.language, custom)
+		if got.State != tt.state || got.Value != tt.value || ok != tt.ok {
+			t.Errorf("MatchStatus(%q, %q) = %+v, %v, want state %q, value %v, %v", tt.status, tt.language, got, ok, tt.state, tt.value, tt.ok)
+		}
+	}
+}
+
+func TestMatchOutletState(t *testing.T) {
+	for _, tt := range []struct {
+		state    string
+		language string
+		value    float64
+		ok       bool
+	}{
+		{"On", "", 1, true},
+		{"Off", "", 0, true},
+		{" on ", "en", 1, true},
+		{"Ein", "de", 1, true},
+		{"Aus", "de", 0, true},
+		{"Ein", "", 1, true},
+		{"Allumé", "fr", 1, true},
+		{"Éteint", "fr", 0, true},
+		{"Encendido", "es", 1, true},
+		{"Spento", "it", 0, true},
+		{"On", "de", 1, true},
+		{"Ein", "fr", 0, false},
+		{"Online", "", 0, false},
+		{"Rebooting", "", 0, false},
+		{"", "", 0, false},
+	} {
+		got, ok := MatchOutletState(tt.state, tt.language)
+		if got.Value != tt.value || ok != tt.ok {
+			t.Errorf("MatchOutletState(%q, %q) = %+v, %v, want value %v, %v", tt.state, tt.language, got, ok, tt.value, tt.ok)
+		}
+	}
+}
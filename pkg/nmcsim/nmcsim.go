@@ -0,0 +1,364 @@
+// Package nmcsim simulates the web interface of an APC Network Management Card with
+// recorded pages: the logon page with its form tokens, the login and its session, and
+// the status, about and battery pages. It serves integration tests, demos and the
+// reproduction of parser issues from pages saved with the dump-pages command.
+package nmcsim
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"crypto/rand"
+	"embed"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/veter2005/apc-exporter/pkg/nmc"
+)
+
+//go:embed pages
+var pagesFS embed.FS
+
+// DefaultGeneration is the card generation served when none is given.
+const DefaultGeneration = "nmc2"
+
+// maxFormTokens bounds the form tokens handed out and not yet used.
+const maxFormTokens = 1024
+
+// SessionCookie is the name of the cookie holding the session, as on the cards.
+const SessionCookie = "C0"
+
+// Paths of the simulator that are not pages of the card.
+const (
+	HomePath   = "/home"
+	LogoutPath = "/logout"
+)
+
+var (
+	tokenInputRE = regexp.MustCompile(`(?is)<input\b[^>]*\bname\s*=\s*["']?(formtoken|formtokenid)["'\s>][^>]*>`)
+	valueAttrRE  = regexp.MustCompile(`(?is)(\bvalue\s*=\s*)("[^"]*"|'[^']*'|[^\s>]+)`)
+	manifestRE   = regexp.MustCompile(`^(\S+): GET (\S+) -> 200 `)
+)
+
+// Generations returns the names of the recorded card generations.
+func Generations() []string {
+	entries, _ := fs.ReadDir(pagesFS, "pages")
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+// GenerationPages returns the recorded pages of a card generation by path.
+func GenerationPages(generation string) (map[string][]byte, error) {
+	dir := path.Join("pages", generation)
+	entries, err := fs.ReadDir(pagesFS, dir)
+	if err != nil {
+		return nil, fmt.Errorf("unknown card generation %q, known are %s", generation, strings.Join(Generations(), ", "))
+	}
+	pages := make(map[string][]byte)
+	for _, e := range entries {
+		data, err := fs.ReadFile(pagesFS, path.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		pages["/"+strings.TrimSuffix(e.Name(), ".html")] = data
+	}
+	return pages, nil
+}
+
+// LoadDump reads the pages of a gzipped tarball written by the dump-pages command,
+// by the path they were loaded from. Pages the card did not serve with 200 OK are left
+// out.
+func LoadDump(r io.Reader) (map[string][]byte, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string][]byte)
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		files[hdr.Name] = data
+	}
+	manifest, ok := files["MANIFEST.txt"]
+	if !ok {
+		return nil, errors.New("no MANIFEST.txt in the archive, is it from dump-pages?")
+	}
+
+	pages := make(map[string][]byte)
+	sc := bufio.NewScanner(strings.NewReader(string(manifest)))
+	for sc.Scan() {
+		m := manifestRE.FindStringSubmatch(sc.Text())
+		if m == nil {
+			continue
+		}
+		if data, ok := files[m[1]]; ok {
+			pages[m[2]] = data
+		}
+	}
+	return pages, nil
+}
+
+// Options configure a Server.
+type Options struct {
+	// Generation is the card generation whose pages are served, DefaultGeneration
+	// if empty.
+	Generation string
+	// Pages are served in addition to, or instead of, the pages of the generation,
+	// by path, e.g. from LoadDump.
+	Pages map[string][]byte
+	// Username and Password are the credentials accepted by the login, apc and apc
+	// if empty, the defaults of the cards.
+	Username string
+	Password string
+	// SessionTimeout ends a session that has not been used for that long, like the
+	// auto logout of the cards. Zero keeps sessions until they are expired.
+	SessionTimeout time.Duration
+	// SingleSession refuses a login while another session is active, as older
+	// firmware does.
+	SingleSession bool
+	// SessionPaths serves each session below a path of its own, such as
+	// /NMC/Xk3jPq2Lw9/status, which the login redirects into, as some firmware does.
+	// Pages requested at their paths are not found.
+	SessionPaths bool
+}
+
+// Server is an http.Handler serving the pages of a simulated card.
+type Server struct {
+	opts  Options
+	pages map[string][]byte
+
+	mu       sync.Mutex
+	tokens   map[string]string    // form token IDs to the form tokens handed out
+	sessions map[string]time.Time // session IDs to the time they were last used
+	paths    map[string]string    // session IDs to their paths, with SessionPaths
+
+	// Log, if set, receives the messages about logins and sessions.
+	Log func(format string, args ...any)
+}
+
+// New returns a server for the options.
+func New(opts Options) (*Server, error) {
+	if opts.Generation == "" {
+		opts.Generation = DefaultGeneration
+	}
+	if opts.Username == "" {
+		opts.Username = "apc"
+	}
+	if opts.Password == "" {
+		opts.Password = "apc"
+	}
+	pages, err := GenerationPages(opts.Generation)
+	if err != nil {
+		return nil, err
+	}
+	for p, data := range opts.Pages {
+		pages[p] = data
+	}
+	return &Server{
+		opts:     opts,
+		pages:    pages,
+		tokens:   make(map[string]string),
+		sessions: make(map[string]time.Time),
+		paths:    make(map[string]string),
+	}, nil
+}
+
+// Paths returns the paths of the pages served, sorted.
+func (s *Server) Paths() []string {
+	var paths []string
+	for p := range s.pages {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// ExpireSessions ends all sessions, as if the card had been restarted.
+func (s *Server) ExpireSessions() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions = make(map[string]time.Time)
+	s.paths = make(map[string]string)
+	s.logf("All sessions expired")
+}
+
+func (s *Server) logf(format string, args ...any) {
+	if s.Log != nil {
+		s.Log(format, args...)
+	}
+}
+
+// ServeHTTP serves the logon page and the login to anyone, and the other pages in
+// a session only, redirecting to the logon page without one like the cards do.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == nmc.LogonPagePath:
+		s.serveLogonPage(w)
+		return
+	case r.URL.Path == nmc.LoginPath && r.Method == http.MethodPost:
+		s.login(w, r)
+		return
+	}
+
+	session, ok := s.session(r)
+	if !ok {
+		http.Redirect(w, r, nmc.LogonPagePath, http.StatusSeeOther)
+		return
+	}
+	p := r.URL.Path
+	if s.opts.SessionPaths {
+		var found bool
+		if p, found = strings.CutPrefix(p, session); !found || session == "" {
+			http.NotFound(w, r)
+			return
+		}
+	}
+	if p == LogoutPath {
+		s.logout(w, r)
+		return
+	}
+	page, ok := s.pages[p]
+	if !ok && r.URL.RawQuery != "" {
+		page, ok = s.pages[p+"?"+r.URL.RawQuery]
+	}
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(page)
+}
+
+// serveLogonPage serves the logon page with a fresh pair of form tokens.
+func (s *Server) serveLogonPage(w http.ResponseWriter) {
+	token, id := randomID(), randomID()
+	s.mu.Lock()
+	// Tokens of logon pages that were never submitted are dropped eventually.
+	if len(s.tokens) >= maxFormTokens {
+		s.tokens = make(map[string]string)
+	}
+	s.tokens[id] = token
+	s.mu.Unlock()
+
+	values := map[string]string{"formtoken": token, "formtokenid": id}
+	page := tokenInputRE.ReplaceAllFunc(s.pages[nmc.LogonPagePath], func(tag []byte) []byte {
+		name := strings.ToLower(string(tokenInputRE.FindSubmatch(tag)[1]))
+		return valueAttrRE.ReplaceAll(tag, []byte(`${1}"`+values[name]+`"`))
+	})
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(page)
+}
+
+// login checks the form tokens and the credentials and starts a session. A failed
+// login is sent back to the logon page.
+func (s *Server) login(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Form tokens are used once.
+	id := r.PostForm.Get("formtokenid")
+	token, ok := s.tokens[id]
+	delete(s.tokens, id)
+	switch {
+	case !ok || token != r.PostForm.Get("formtoken"):
+		s.logf("Login from %s refused: unknown form token", r.RemoteAddr)
+		http.Redirect(w, r, nmc.LogonPagePath+"?error=1", http.StatusSeeOther)
+		return
+	case r.PostForm.Get("j_username") != s.opts.Username || r.PostForm.Get("j_password") != s.opts.Password:
+		s.logf("Login from %s refused: wrong credentials for %q", r.RemoteAddr, r.PostForm.Get("j_username"))
+		http.Redirect(w, r, nmc.LogonPagePath+"?error=1", http.StatusSeeOther)
+		return
+	}
+
+	s.expireIdle()
+	if s.opts.SingleSession && len(s.sessions) > 0 {
+		s.logf("Login from %s refused: someone is already logged in", r.RemoteAddr)
+		http.Redirect(w, r, nmc.LogonPagePath+"?error=2", http.StatusSeeOther)
+		return
+	}
+	session := randomID()
+	s.sessions[session] = time.Now()
+	s.logf("Login from %s as %q", r.RemoteAddr, s.opts.Username)
+	http.SetCookie(w, &http.Cookie{Name: SessionCookie, Value: session, Path: "/", HttpOnly: true})
+	home := HomePath
+	if s.opts.SessionPaths {
+		s.paths[session] = "/NMC/" + randomID()[:10]
+		home = s.paths[session] + HomePath
+	}
+	http.Redirect(w, r, home, http.StatusSeeOther)
+}
+
+func (s *Server) logout(w http.ResponseWriter, r *http.Request) {
+	if c, err := r.Cookie(SessionCookie); err == nil {
+		s.mu.Lock()
+		delete(s.sessions, c.Value)
+		delete(s.paths, c.Value)
+		s.mu.Unlock()
+	}
+	http.Redirect(w, r, nmc.LogonPagePath, http.StatusSeeOther)
+}
+
+// session reports whether the request belongs to a live session, and keeps it alive.
+// It returns the path of the session with SessionPaths.
+func (s *Server) session(r *http.Request) (string, bool) {
+	c, err := r.Cookie(SessionCookie)
+	if err != nil {
+		return "", false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expireIdle()
+	if _, ok := s.sessions[c.Value]; !ok {
+		return "", false
+	}
+	s.sessions[c.Value] = time.Now()
+	return s.paths[c.Value], true
+}
+
+// expireIdle ends the sessions that have been idle for longer than the timeout. The
+// caller must hold s.mu.
+func (s *Server) expireIdle() {
+	if s.opts.SessionTimeout <= 0 {
+		return
+	}
+	for id, last := range s.sessions {
+		if time.Since(last) > s.opts.SessionTimeout {
+			delete(s.sessions, id)
+			delete(s.paths, id)
+			s.logf("Session idle for %s, logged out", s.opts.SessionTimeout)
+		}
+	}
+}
+
+func randomID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}